@@ -0,0 +1,38 @@
+// Package aribcaption decodes the captions and superimposed text of ISDB
+// broadcasts, coded as in ARIB STD-B24, to the text of ASS dialogue lines.
+// The size, position and colors of the characters become override tags, and
+// the rest the decoder can't express, like ruby and flashing, becomes
+// comments such as {ruby} and {flash}.
+//
+// The additional symbols and kanji of ARIB are decoded with a built-in
+// mapping, or with a GaijiMap given to the Decoder. DRCS glyphs are
+// parsed by ParseDRCS and written as the strings a Decoder is given for them.
+package aribcaption
+
+// Kinds of the codes the decoder can't handle, given to Decoder.Unhandled
+const (
+	UnhandledC0        = "Unhandled C0 code"
+	UnhandledC1        = "Unhandled C1 code"
+	UnhandledCSI       = "Unhandled CSI control function"
+	UnhandledCharacter = "Unhandled character"
+	UnknownGaiji       = "Unknown gaiji"
+)
+
+// CRC16 computes CRC-16-CCITT (x^16 + x^12 + x^5 + 1, initial value 0) used
+// by caption data groups. Running it over a data group including its CRC_16
+// field yields 0.
+// ARIB STD-B24 第三編 9.2
+func CRC16(data []byte) uint16 {
+	crc := uint16(0)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
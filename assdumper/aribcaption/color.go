@@ -0,0 +1,162 @@
+package aribcaption
+
+import (
+	"fmt"
+	"image/color"
+	"strings"
+)
+
+// Kinds of colors set by the color control codes. The half tone is drawn
+// between the foreground and the background, so it becomes the outline, and
+// the background becomes the back color, which is the box of BorderStyle 4
+// in libass and the shadow otherwise.
+// ARIB STD-B24 第一編 第2部 表 7-16 COL
+const (
+	colorForeground = iota
+	colorHalfForeground
+	colorBackground
+	numColorKinds
+)
+
+var (
+	colorTagNames = [numColorKinds]string{"c", "3c", "4c"}
+	alphaTagNames = [numColorKinds]string{"1a", "3a", "4a"}
+	// The colors of the Default style, which the output has no [V4+ Styles]
+	// section to change
+	defaultColors = [numColorKinds]clutColor{{0xff, 0xff, 0xff, 0xff}, {0, 0, 0, 0xff}, {0, 0, 0, 0xff}}
+	resetTags     = [numColorKinds]string{"\\c&HFFFFFF&", "\\3c&H000000&", "\\4c&H000000&"}
+)
+
+type clutColor struct {
+	r, g, b, a uint8
+}
+
+// clut is the default CLUT of 8 palettes of 16 colors, which captions
+// refer to unless the broadcaster sends a color map data unit.
+var clut = defaultCLUT()
+
+// CLUT returns the default CLUT as a palette, which the PNG of station logos
+// refer to instead of a PLTE chunk of their own.
+func CLUT() color.Palette {
+	p := make(color.Palette, len(clut))
+	for i, c := range clut {
+		p[i] = color.NRGBA{c.r, c.g, c.b, c.a}
+	}
+	return p
+}
+
+func defaultCLUT() [128]clutColor {
+	var c [128]clutColor
+	// Palette 0 has the primaries in full and half intensity, and
+	// transparent at 8.
+	for i := 0; i < 8; i++ {
+		level := func(bit int, v uint8) uint8 {
+			if i&bit == 0 {
+				return 0
+			}
+			return v
+		}
+		c[i] = clutColor{level(1, 0xff), level(2, 0xff), level(4, 0xff), 0xff}
+		if i != 0 {
+			c[8+i] = clutColor{level(1, 0xaa), level(2, 0xaa), level(4, 0xaa), 0xff}
+		}
+	}
+	// Palettes 1 to 3 have the rest of the colors whose components are
+	// multiples of 0x55, in order.
+	n := 16
+	levels := []uint8{0, 0x55, 0xaa, 0xff}
+	for _, r := range levels {
+		for _, g := range levels {
+			for _, b := range levels {
+				color := clutColor{r, g, b, 0xff}
+				known := false
+				for _, k := range c[:16] {
+					known = known || k == color
+				}
+				if !known && n < 64 {
+					c[n] = color
+					n++
+				}
+			}
+		}
+	}
+	// Palettes 4 to 7 are palettes 0 to 3 at half transparency.
+	for i := 0; i < 64; i++ {
+		c[64+i] = c[i]
+		if c[i].a != 0 {
+			c[64+i].a = 0x80
+		}
+	}
+	return c
+}
+
+func colorTag(kind int, color clutColor) string {
+	if color == defaultColors[kind] {
+		return resetTags[kind]
+	}
+	tag := fmt.Sprintf("\\%s&H%02x%02x%02x&", colorTagNames[kind], color.b, color.g, color.r)
+	if color.a != 0xff {
+		tag += fmt.Sprintf("\\%s&H%02x&", alphaTagNames[kind], 0xff-color.a)
+	}
+	return tag
+}
+
+// Colors is the color state of a caption stream, which lasts across
+// statements on the same screen.
+type Colors struct {
+	palette int
+	// override tags of the colors other than the default, by kind
+	tags [numColorKinds]string
+}
+
+// set changes the color of kind to the index in the current palette and
+// returns the override block to write, if the color changed.
+func (c *Colors) set(kind, index int) string {
+	color := clut[c.palette<<4|index]
+	tag := colorTag(kind, color)
+	old := c.tags[kind]
+	if color == defaultColors[kind] {
+		c.tags[kind] = ""
+	} else {
+		c.tags[kind] = tag
+	}
+	if c.tags[kind] == old {
+		return ""
+	}
+	if alpha := "\\" + alphaTagNames[kind]; strings.Contains(old, alpha) && color.a == 0xff {
+		tag += alpha + "&H00&"
+	}
+	return "{" + tag + "}"
+}
+
+// overrides returns the override block that brings the colors into effect.
+func (c *Colors) overrides() string {
+	s := strings.Join(c.tags[:], "")
+	if s == "" {
+		return ""
+	}
+	return "{" + s + "}"
+}
+
+// resets returns the override block that brings back the default colors.
+func (c *Colors) resets() string {
+	s := ""
+	for kind, tag := range c.tags {
+		if tag == "" {
+			continue
+		}
+		s += resetTags[kind]
+		if alpha := "\\" + alphaTagNames[kind]; strings.Contains(tag, alpha) {
+			s += alpha + "&H00&"
+		}
+	}
+	if s == "" {
+		return ""
+	}
+	return "{" + s + "}"
+}
+
+// clear brings back the default colors, keeping the palette.
+func (c *Colors) clear() {
+	c.tags = [numColorKinds]string{}
+}
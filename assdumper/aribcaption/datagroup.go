@@ -0,0 +1,240 @@
+package aribcaption
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+var (
+	// ErrEmptyDataGroup is returned by Session.DataGroup for a data group
+	// without any data, or a caption statement without any data unit, which
+	// some broadcasters send in between.
+	ErrEmptyDataGroup = errors.New("empty data group")
+	// ErrRetransmission is returned by Session.DataGroup for a caption
+	// statement that must not be displayed again.
+	ErrRetransmission = errors.New("retransmitted caption statement")
+)
+
+// PES is what a caption PES carries.
+type PES struct {
+	// DataGroup is the data group, or nil when the PES carries none.
+	DataGroup []byte
+	// PTS is in 90kHz units when HasPTS is set.
+	PTS    int64
+	HasPTS bool
+	// Truncated tells that PES_packet_length is longer than the PES, which
+	// lost its end.
+	Truncated bool
+	// MalformedPTS tells that PTS_DTS_flags or the marker bits are broken,
+	// and the caption should be timed by PCR.
+	MalformedPTS bool
+}
+
+// ParsePES returns the data group of a caption or superimpose PES.
+// ARIB STD-B24 第三編 5
+func ParsePES(pes []byte) PES {
+	var r PES
+	if len(pes) < 9 {
+		return r
+	}
+	PES_packet_length := int(pes[4])<<8 | int(pes[5])
+	if PES_packet_length != 0 {
+		if len(pes) < 6+PES_packet_length {
+			r.Truncated = true
+		} else {
+			// Drop the stuffing bytes following the PES.
+			pes = pes[:6+PES_packet_length]
+		}
+	}
+	if len(pes) < 9 {
+		return r
+	}
+	var data []byte
+	if stream_id := pes[3]; stream_id == 0xbf {
+		// Superimpose may be sent as asynchronous PES in private_stream_2,
+		// which has neither the optional PES header nor PTS.
+		// ARIB STD-B24 第三編 5.2
+		data = pes[6:]
+	} else {
+		pts, _, hasPTS, _, ok := tspacket.PESTimestamps(pes)
+		if ok {
+			r.PTS, r.HasPTS = pts, hasPTS
+		} else {
+			r.MalformedPTS = true
+		}
+		PES_header_data_length := int(pes[8])
+		if 9+PES_header_data_length > len(pes) {
+			return r
+		}
+		data = pes[9+PES_header_data_length:]
+	}
+	// data_identifier, private_stream_id, PES_data_packet_header_length
+	if len(data) < 3 || len(data) < 3+int(data[2]&0x0f)+5 {
+		return r
+	}
+	PES_data_packet_header_length := int(data[2] & 0x0f)
+	if group := data[3+PES_data_packet_header_length:]; !isStuffing(group) {
+		r.DataGroup = group
+	}
+	return r
+}
+
+func isStuffing(b []byte) bool {
+	for _, c := range b {
+		if c != 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+// DataGroup is a data group of caption management data or caption statement.
+type DataGroup struct {
+	// ID is data_group_id.
+	ID int
+	// Management is set for caption management data.
+	Management bool
+	// Language is the language number (1-8) of caption statement.
+	Language int
+	// NewSession tells that management data of another group (A or B)
+	// started a new caption session, which reset the Decoder.
+	NewSession bool
+	// CRCError tells that CRC_16 didn't match, or that the data group lost
+	// its end.
+	CRCError bool
+	// Truncated tells that data_unit_size of a data unit ran past the end
+	// of the data group, and the units from it on were dropped.
+	Truncated bool
+	Units     []DataUnit
+}
+
+// DataUnit is a data unit of a data group. Data is only valid until the
+// data of the PES is reused.
+type DataUnit struct {
+	Parameter byte
+	Data      []byte
+}
+
+// Session is the state of a caption ES carried across its data groups: the
+// Decoder with the DRCS defined so far, the languages of the management
+// data in effect and the last statement of each language. Its zero value is
+// ready to use, with the DRCS map of Decoder made by the caller.
+type Session struct {
+	Decoder Decoder
+	// Languages are ISO_639_language_code by language_tag, from the
+	// management data.
+	Languages [8]string
+
+	// managementGroupId is data_group_id of the management data plus one,
+	// or 0 before the first one.
+	managementGroupId int
+	// lastStatements are the last statement of each language, from
+	// data_group_id to data_group_data, so that data_group_version is
+	// compared along with the data.
+	lastStatements [8][]byte
+}
+
+// DataGroup parses a data group of the ES, following the caption session.
+// It returns ErrEmptyDataGroup or ErrRetransmission for a data group to be
+// skipped. Data units of a data group with CRCError are still returned,
+// since a damaged caption is better than none.
+// ARIB STD-B24 第三編 9
+func (s *Session) DataGroup(p []byte) (*DataGroup, error) {
+	if len(p) < 5 {
+		return nil, ErrEmptyDataGroup
+	}
+	// ARIB STD-B24 第三編 表9-1
+	data_group_id := int(p[0]&0xfc) >> 2
+	data_group_size := int(p[3])<<8 | int(p[4])
+	if data_group_size == 0 {
+		return nil, ErrEmptyDataGroup
+	}
+	g := &DataGroup{
+		ID:       data_group_id,
+		CRCError: 5+data_group_size+2 > len(p) || CRC16(p[:5+data_group_size+2]) != 0,
+	}
+	if data_group_id == 0x00 || data_group_id == 0x20 {
+		g.Management = true
+		// Management data is retransmitted periodically with the same
+		// data_group_id. A switch between group A and B starts a new
+		// caption session, which invalidates the DRCS defined so far.
+		if data_group_id+1 != s.managementGroupId {
+			s.managementGroupId = data_group_id + 1
+			s.Decoder.Reset()
+			s.lastStatements = [8][]byte{}
+			g.NewSession = true
+		}
+		// ARIB STD-B24 第三編 表9-3
+		// caption_management_data
+		if len(p) < 7 {
+			return g, nil
+		}
+		num_languages := int(p[6])
+		p = p[7:]
+		for i := 0; i < num_languages; i++ {
+			if len(p) < 6 {
+				return g, nil
+			}
+			language_tag := p[0] >> 5
+			if DMF := p[0] & 0x0f; DMF == 0x0c || DMF == 0x0d || DMF == 0x0e {
+				// DC
+				p = p[1:]
+			}
+			s.Languages[language_tag] = string(p[1:4])
+			p = p[5:]
+		}
+	} else {
+		g.Language = data_group_id & 0x0f
+		// ARIB TR-B14 Caption statements belong to the group (A or B) of
+		// the management data in effect, and the ones of the other group
+		// are left over from before the switch. A statement is
+		// retransmitted as it was, with the same data_group_version and
+		// data, which must not be displayed again. The version alone
+		// can't tell, as many streams keep it 0 for every statement,
+		// while a new statement with the same text gets another version.
+		if s.managementGroupId != 0 && data_group_id&0x20 != s.managementGroupId-1 {
+			return nil, ErrRetransmission
+		}
+		if language := g.Language; !g.CRCError && 1 <= language && language <= len(s.lastStatements) {
+			group := p[:5+data_group_size]
+			if bytes.Equal(group, s.lastStatements[language-1]) {
+				return nil, ErrRetransmission
+			}
+			s.lastStatements[language-1] = append(s.lastStatements[language-1][:0], group...)
+		}
+		// caption_data
+		if len(p) < 6 {
+			return nil, ErrEmptyDataGroup
+		}
+		p = p[6:]
+	}
+	if len(p) < 3 {
+		if g.Management {
+			return g, nil
+		}
+		return nil, ErrEmptyDataGroup
+	}
+	// ARIB STD-B24 第三編 表9-3
+	data_unit_loop_length := int(p[0])<<16 | int(p[1])<<8 | int(p[2])
+	if data_unit_loop_length == 0 && !g.Management {
+		return nil, ErrEmptyDataGroup
+	}
+	for index := 0; index < data_unit_loop_length; {
+		if index+8 > len(p) {
+			// The PES was cut short.
+			g.Truncated = true
+			break
+		}
+		q := p[index:]
+		data_unit_size := int(q[5])<<16 | int(q[6])<<8 | int(q[7])
+		if 8+data_unit_size > len(q) {
+			g.Truncated = true
+			break
+		}
+		g.Units = append(g.Units, DataUnit{Parameter: q[4], Data: q[8 : 8+data_unit_size]})
+		index += 5 + data_unit_size
+	}
+	return g, nil
+}
@@ -0,0 +1,92 @@
+package aribcaption
+
+import "testing"
+
+// testDataGroup returns a data group with CRC_16 of data_group_id and
+// data_group_version.
+func testDataGroup(id, version byte, data []byte) []byte {
+	group := append([]byte{id<<2 | version, 0x00, 0x00, byte(len(data) >> 8), byte(len(data))}, data...)
+	crc := CRC16(group)
+	return append(group, byte(crc>>8), byte(crc))
+}
+
+// TestDataGroupRetransmission checks that a caption sent twice on purpose is
+// returned twice, while a data group sent again with the same
+// data_group_version is skipped.
+func TestDataGroupRetransmission(t *testing.T) {
+	// caption_management_data of Japanese without any data unit
+	management := []byte{0x00, 0x01, 0x00, 'j', 'p', 'n', 0x00, 0x00, 0x00, 0x00}
+	text, err := Encode("（拍手）")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// caption_data of a statement body
+	unit := append([]byte{0x1f, 0x20, 0x00, 0x00, byte(len(text))}, text...)
+	statement := append([]byte{0x00, 0x00, 0x00, byte(len(unit))}, unit...)
+	steps := []struct {
+		name  string
+		group []byte
+		err   error
+	}{
+		{"management of group A", testDataGroup(0x00, 0, management), nil},
+		{"statement", testDataGroup(0x01, 0, statement), nil},
+		{"retransmitted statement", testDataGroup(0x01, 0, statement), ErrRetransmission},
+		{"same statement again", testDataGroup(0x01, 1, statement), nil},
+		{"statement of group B left over", testDataGroup(0x21, 2, statement), ErrRetransmission},
+		{"management of group B", testDataGroup(0x20, 0, management), nil},
+		{"same statement in group B", testDataGroup(0x21, 1, statement), nil},
+		{"retransmitted statement in group B", testDataGroup(0x21, 1, statement), ErrRetransmission},
+		{"management of group A again", testDataGroup(0x00, 0, management), nil},
+		{"same statement back in group A", testDataGroup(0x01, 1, statement), nil},
+	}
+	var s Session
+	s.Decoder.DRCS = make(map[uint16]string)
+	for _, step := range steps {
+		g, err := s.DataGroup(step.group)
+		if err != step.err {
+			t.Errorf("%s: got error %v, want %v", step.name, err, step.err)
+			continue
+		}
+		if err != nil || g.Management {
+			continue
+		}
+		if len(g.Units) != 1 {
+			t.Errorf("%s: %d data units", step.name, len(g.Units))
+			continue
+		}
+		if text, _ := s.Decoder.Decode(g.Units[0].Data); text != "（拍手）" {
+			t.Errorf("%s: decoded %q", step.name, text)
+		}
+	}
+}
+
+// TestDataGroupConstantVersion checks that different statements are all
+// returned in a stream that keeps data_group_version 0, as many do.
+func TestDataGroupConstantVersion(t *testing.T) {
+	management := []byte{0x00, 0x01, 0x00, 'j', 'p', 'n', 0x00, 0x00, 0x00, 0x00}
+	var s Session
+	s.Decoder.DRCS = make(map[uint16]string)
+	if _, err := s.DataGroup(testDataGroup(0x00, 0, management)); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"（拍手）", "おはよう", "こんばんは"} {
+		text, err := Encode(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unit := append([]byte{0x1f, 0x20, 0x00, 0x00, byte(len(text))}, text...)
+		statement := append([]byte{0x00, 0x00, 0x00, byte(len(unit))}, unit...)
+		g, err := s.DataGroup(testDataGroup(0x01, 0, statement))
+		if err != nil {
+			t.Errorf("%s: %v", want, err)
+			continue
+		}
+		if len(g.Units) != 1 {
+			t.Errorf("%s: %d data units", want, len(g.Units))
+			continue
+		}
+		if got, _ := s.Decoder.Decode(g.Units[0].Data); got != want {
+			t.Errorf("decoded %q, want %q", got, want)
+		}
+	}
+}
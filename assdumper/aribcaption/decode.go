@@ -0,0 +1,562 @@
+package aribcaption
+
+import "fmt"
+
+// Decoder decodes the statements of a caption ES. It carries what lasts
+// across the statements of a caption session.
+type Decoder struct {
+	Profile Profile
+	// DRCS maps CharacterCode of the DRCS glyphs defined so far to the
+	// string to write for them. A reference to a code missing from DRCS is
+	// written as nothing and counted as a placeholder.
+	DRCS map[uint16]string
+	// Colors last across statements on the same screen until CS.
+	Colors Colors
+	// Unhandled is called, unless nil, for every code the decoder can't
+	// handle, with its kind and the code in hex.
+	Unhandled func(kind, code string)
+	// Gaiji is the mapping of the additional symbols and kanji, or nil for
+	// the built-in one. It's only read, so Decoders may share it.
+	Gaiji GaijiMap
+}
+
+// Reset forgets the DRCS glyphs and the colors, which management data of
+// another data group invalidates.
+func (d *Decoder) Reset() {
+	d.DRCS = make(map[uint16]string)
+	d.Colors = Colors{}
+}
+
+// Decode decodes a caption statement, the data of a statement body data
+// unit. It also returns the number of characters it could not decode and
+// replaced with a placeholder.
+func (d *Decoder) Decode(data []byte) (string, int) {
+	return d.decodeString(data, len(data), d.Profile.graphicSets(), d.Profile.layout(), true, &d.Colors)
+}
+
+func (d *Decoder) gaiji() GaijiMap {
+	if d.Gaiji != nil {
+		return d.Gaiji
+	}
+	return defaultGaiji
+}
+
+func (d *Decoder) unhandled(kind, code string) {
+	if d.Unhandled != nil {
+		d.Unhandled(kind, code)
+	}
+}
+
+// decodeString decodes an 8-bit character string. Character sizes,
+// flashing and highlighting are written as ASS overrides when styled is set,
+// and dropped otherwise.
+// colors are carried over from the previous string and updated for the
+// next one. They are written before the first character, and the decoded
+// string always ends in the default colors, so that they don't leak into a
+// caption merged after it in the same Dialogue line.
+func (d *Decoder) decodeString(bytes []byte, length int, sets *graphicSets, layout *captionLayout, styled bool, colors *Colors) (string, int) {
+	decoded := ""
+	fallbacks := 0
+	// colored is set once the colors are in effect in decoded.
+	colored := false
+	useColors := func() {
+		if !colored {
+			decoded += colors.overrides()
+			colored = true
+		}
+	}
+	setColor := func(kind, index int) {
+		useColors()
+		decoded += colors.set(kind, index)
+	}
+	size := sizeNormal
+	scale := [2]int{100, 100}
+	inRuby := false
+	// endRuby closes the ruby run being written.
+	endRuby := func() {
+		if inRuby {
+			decoded += "{/ruby}"
+			inRuby = false
+		}
+	}
+	// put writes a character, preceded by a size override when its scale
+	// differs from the previous character. Small characters are enclosed in
+	// ruby comments with the position of the first one instead, and left
+	// unscaled for the renderer, which decides how to show them.
+	put := func(s string, narrow bool) {
+		if s == "" {
+			return
+		}
+		if s != " " {
+			useColors()
+		}
+		if styled && size == sizeSmall && !inRuby {
+			decoded += layout.rubyStart()
+			inRuby = true
+		}
+		layout.advance(size)
+		if want := size.scale(narrow); styled && size != sizeSmall && want != scale {
+			decoded += fmt.Sprintf("{\\fscx%d\\fscy%d}", want[0], want[1])
+			scale = want
+		}
+		decoded += s
+	}
+	flashing := false
+	// flash starts or stops flashing as FLC says. The renderer turns the
+	// comments into alpha animations, since it knows how long the line is
+	// displayed.
+	flash := func(p byte) {
+		if flashing {
+			decoded += "{/flash}"
+			flashing = false
+		}
+		if !styled {
+			return
+		}
+		switch p {
+		case 0x40:
+			decoded += "{flash}"
+			flashing = true
+		case 0x47:
+			// Flashing in the opposite phase
+			decoded += "{flash inverted}"
+			flashing = true
+		}
+	}
+	highlighted := false
+	// highlight starts or stops the enclosure of HLC. ASS can't draw sides
+	// of a box on their own, so the outline gets thicker instead.
+	highlight := func(on bool) {
+		if on && !highlighted && styled {
+			decoded += "{\\bord4}"
+			highlighted = true
+		} else if !on && highlighted {
+			decoded += "{\\bord}"
+			highlighted = false
+		}
+	}
+	resize := func(to charSize) {
+		if to != sizeSmall {
+			endRuby()
+		}
+		size = to
+	}
+
+	for i := 0; i < length; i++ {
+		b := bytes[i]
+		if 0 <= b && b <= 0x20 {
+			// ARIB STD-B24 第一編 第2部 表 7-14
+			// ARIB STD-B24 第一編 第2部 表 7-15
+			// C0 制御集合
+			switch b {
+			case 0x0c:
+				// CS, which also brings back the default colors
+				resize(sizeNormal)
+				flash(0x4f)
+				highlight(false)
+				if colored {
+					decoded += colors.resets()
+				}
+				colors.clear()
+				decoded += "\f"
+				layout.clear()
+			case 0x0d:
+				// APR
+				decoded += "\\n"
+				layout.nextRow()
+			case 0x0e:
+				// LS1
+				sets.gl = 1
+			case 0x0f:
+				// LS0
+				sets.gl = 0
+			case 0x19, 0x1d:
+				// SS2, SS3 invoke G2 or G3 for the next character only.
+				g := 2
+				if b == 0x1d {
+					g = 3
+				}
+				s, n, fallback := sets.decodeChar(g, bytes[i+1:length], d.DRCS, d.gaiji(), d.unhandled)
+				put(s, sets.narrow(g))
+				if fallback {
+					fallbacks++
+				}
+				i += n
+			case 0x1b:
+				// ESC
+				i += sets.escape(bytes[i+1 : length])
+			case 0x16:
+				// PAPF
+				d.unhandled(UnhandledC0, fmt.Sprintf("0x%02x", b))
+				i++
+			case 0x1c:
+				// APS, with the row and the column offset by 0x40
+				if i+2 < length {
+					row, col := int(bytes[i+1]&0x3f), int(bytes[i+2]&0x3f)
+					if size == sizeSmall {
+						// Ruby is placed on its own, and doesn't move
+						// the base text to another row.
+						endRuby()
+						layout.locate(row, col, size)
+					} else {
+						decoded += layout.moveTo(row, col, size)
+					}
+				}
+				i += 2
+			case 0x20:
+				// SP
+				put(" ", true)
+			default:
+				d.unhandled(UnhandledC0, fmt.Sprintf("0x%02x", b))
+			}
+		} else if 0x20 < b && b < 0x7f {
+			s, n, fallback := sets.decodeChar(sets.gl, bytes[i:length], d.DRCS, d.gaiji(), d.unhandled)
+			put(s, sets.narrow(sets.gl))
+			if fallback {
+				fallbacks++
+			}
+			i += n - 1
+		} else if 0x80 <= b && b < 0xA0 {
+			// ARIB STD-B24 第一編 第2部 表 7-14
+			// ARIB STD-B24 第一編 第2部 表 7-16
+			// C1 制御集合
+			switch b {
+			case 0x80, 0x81, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87:
+				// BKF, RDF, GRF, YLF, BLF, MGF, CNF, WHF select the
+				// foreground color from the first 8 of the palette.
+				setColor(colorForeground, int(b-0x80))
+			case 0x90:
+				// COL, which selects a color of the palette, or the
+				// palette itself with the intermediate byte 0x20
+				if i+1 < length && bytes[i+1] == 0x20 {
+					if i+2 < length {
+						colors.palette = int(bytes[i+2] & 0x07)
+					}
+					i += 2
+				} else if i+1 < length {
+					p := bytes[i+1]
+					switch p & 0x70 {
+					case 0x40:
+						setColor(colorForeground, int(p&0x0f))
+					case 0x50:
+						setColor(colorBackground, int(p&0x0f))
+					case 0x60:
+						setColor(colorHalfForeground, int(p&0x0f))
+					case 0x70:
+						// The half tone of the background has no
+						// counterpart in ASS.
+					}
+					i++
+				}
+			case 0x88:
+				// SSZ. Small characters are mostly ruby over the row below.
+				resize(sizeSmall)
+			case 0x89:
+				// MSZ
+				resize(sizeMiddle)
+			case 0x8a:
+				// NSZ
+				resize(sizeNormal)
+			case 0x8b:
+				// SZX, other sizes, which are left at the current one
+				i++
+			case 0x91:
+				// FLC
+				if i+1 < length {
+					flash(bytes[i+1])
+				}
+				i++
+			case 0x92:
+				// CDC, concealment, which has the intermediate byte 0x20
+				// before the parameter of the replacing kinds
+				if i+1 < length && bytes[i+1] == 0x20 {
+					i++
+				}
+				i++
+			case 0x93, 0x94:
+				// POL (pattern polarity) and WMM (writing mode)
+				i++
+			case 0x95:
+				// MACRO. A definition, started with the parameter 0x40,
+				// 0x41 or 0x42, runs until MACRO 0x4f, and isn't
+				// written itself.
+				if i+1 < length && 0x40 <= bytes[i+1] && bytes[i+1] <= 0x42 {
+					i += 2
+					for i+1 < length && !(bytes[i] == 0x95 && bytes[i+1] == 0x4f) {
+						i++
+					}
+				}
+				i++
+			case 0x97:
+				// HLC, with the sides of the enclosure in the lower 4 bits
+				if i+1 < length {
+					highlight(bytes[i+1]&0x0f != 0)
+				}
+				i++
+			case 0x98:
+				// RPC, repeating the next character, which is written
+				// once
+				i++
+			case 0x9b:
+				// CSI
+				params, final, n := parseCSI(bytes[i+1 : length])
+				if !layout.control(params, final) {
+					d.unhandled(UnhandledCSI, fmt.Sprintf("0x%02x", final))
+				}
+				i += n
+			case 0x9d:
+				// TIME
+				i += 2
+			default:
+				d.unhandled(UnhandledC1, fmt.Sprintf("0x%02x", b))
+			}
+		} else if 0xa0 < b && b < 0xff {
+			// GR carries the same code points as GL with the MSB set.
+			p := []byte{b & 0x7f}
+			if i+1 < length {
+				p = append(p, bytes[i+1]&0x7f)
+			}
+			s, n, fallback := sets.decodeChar(sets.gr, p, d.DRCS, d.gaiji(), d.unhandled)
+			put(s, sets.narrow(sets.gr))
+			if fallback {
+				fallbacks++
+			}
+			i += n - 1
+		}
+	}
+	resize(sizeNormal)
+	flash(0x4f)
+	highlight(false)
+	if colored {
+		decoded += colors.resets()
+	}
+	return decoded, fallbacks
+}
+
+// graphicSets tracks the code set designations (ESC) to G0-G3 and their
+// invocations to GL (LS0, LS1, LS2, LS3) and GR (LS1R, LS2R, LS3R).
+// ARIB STD-B24 第一編 第2部 7.2
+type graphicSets struct {
+	g  [4]graphicSet
+	gl int
+	gr int
+}
+
+type graphicSet struct {
+	// final byte F of the designation sequence
+	final byte
+	// dynamic is set for DRCS and the macro set, which are designated with
+	// the intermediate byte 0x20 and share final bytes with the other sets.
+	dynamic bool
+	bytes   int
+}
+
+// Final bytes of the graphic sets
+// ARIB STD-B24 第一編 第2部 表 7-3
+const (
+	setKanji                = 0x42
+	setJISX0213Plane1       = 0x39
+	setJISX0213Plane2       = 0x3a
+	setAdditionalSymbols    = 0x3b
+	setAlphanumeric         = 0x4a
+	setHiragana             = 0x30
+	setKatakana             = 0x31
+	setProportionalAlnum    = 0x36
+	setProportionalHiragana = 0x37
+	setProportionalKatakana = 0x38
+	setJISX0201Katakana     = 0x49
+	setDRCS0                = 0x40
+	setDRCS15               = 0x4f
+	setMacro                = 0x70
+)
+
+// narrow reports whether the characters of the set invoked as g are written
+// as half-width ones.
+func (sets *graphicSets) narrow(g int) bool {
+	switch set := sets.g[g]; {
+	case set.dynamic:
+		return false
+	case set.final == setAlphanumeric, set.final == setProportionalAlnum, set.final == setJISX0201Katakana:
+		return true
+	}
+	return false
+}
+
+// newGraphicSets returns the initial state for captions: kanji, alphanumeric,
+// hiragana and macro, with G0 in GL and G2 in GR.
+// ARIB STD-B24 第一編 第3部 8.2.1
+func newGraphicSets() *graphicSets {
+	return &graphicSets{
+		g: [4]graphicSet{
+			{final: setKanji, bytes: 2},
+			{final: setAlphanumeric, bytes: 1},
+			{final: setHiragana, bytes: 1},
+			{final: setMacro, dynamic: true, bytes: 1},
+		},
+		gr: 2,
+	}
+}
+
+// newSIGraphicSets returns the initial state for SI strings, which has
+// katakana in G3 instead of macro.
+// ARIB STD-B10 第2部 付録 A
+func newSIGraphicSets() *graphicSets {
+	sets := newGraphicSets()
+	sets.g[3] = graphicSet{final: setKatakana, bytes: 1}
+	return sets
+}
+
+// escape interprets the escape sequence following ESC in p and returns its
+// length.
+// ARIB STD-B24 第一編 第2部 表 7-2, 表 7-3
+func (sets *graphicSets) escape(p []byte) int {
+	if len(p) == 0 {
+		return 0
+	}
+	switch p[0] {
+	case 0x6e:
+		// LS2
+		sets.gl = 2
+		return 1
+	case 0x6f:
+		// LS3
+		sets.gl = 3
+		return 1
+	case 0x7e:
+		// LS1R
+		sets.gr = 1
+		return 1
+	case 0x7d:
+		// LS2R
+		sets.gr = 2
+		return 1
+	case 0x7c:
+		// LS3R
+		sets.gr = 3
+		return 1
+	case 0x24, 0x28, 0x29, 0x2a, 0x2b:
+	default:
+		if 0x30 <= p[0] && p[0] <= 0x4f {
+			// ESC F designates a 1-byte set to G0.
+			sets.g[0] = graphicSet{final: p[0], bytes: 1}
+		}
+		return 1
+	}
+
+	i := 0
+	bytes := 1
+	if p[i] == 0x24 {
+		bytes = 2
+		i++
+	}
+	g := 0
+	if i < len(p) && 0x28 <= p[i] && p[i] <= 0x2b {
+		g = int(p[i] - 0x28)
+		i++
+	}
+	dynamic := false
+	if i < len(p) && p[i] == 0x20 {
+		dynamic = true
+		i++
+	}
+	if i >= len(p) {
+		return i
+	}
+	sets.g[g] = graphicSet{final: p[i], dynamic: dynamic, bytes: bytes}
+	return i + 1
+}
+
+// decodeChar decodes the character at the head of p, given in GL, as a
+// character of G set g. It returns the decoded string, the number of bytes
+// the character occupies, 0 when p doesn't start with one, and whether the
+// character had to be replaced with a placeholder.
+func (sets *graphicSets) decodeChar(g int, p []byte, drcs map[uint16]string, gaiji GaijiMap, unhandled func(kind, code string)) (s string, n int, fallback bool) {
+	set := sets.g[g]
+	n = set.bytes
+	if n > len(p) {
+		return "", len(p), false
+	}
+	c := p[0]
+	if c < 0x21 || 0x7e < c {
+		// A control code or GR following SS2 or SS3
+		unhandled(UnhandledCharacter, fmt.Sprintf("0x%02x in set 0x%02x", c, set.final))
+		return "", 0, false
+	}
+	switch {
+	case set.dynamic && setDRCS0 <= set.final && set.final <= setDRCS15:
+		// CharacterCode of 1-byte DRCS carries the final byte in its upper
+		// byte.
+		// ARIB STD-B24 第一編 第2部 付録規定D
+		code := uint16(set.final)<<8 | uint16(c)
+		if set.bytes == 2 {
+			code = uint16(c)<<8 | uint16(p[1])
+		}
+		s, ok := drcs[code]
+		// Reference to an undefined DRCS glyph, or to one without a
+		// replacement
+		return s, n, !ok
+	case set.dynamic:
+		// Macro
+	case set.bytes == 2:
+		c1, c2 := c, p[1]
+		if r, ok := decodeKanji(c1, c2); ok && set.final != setJISX0213Plane2 {
+			return string(r), n, false
+		} else if g := gaiji[int(c1)<<8|int(c2)]; g != "" {
+			return g, n, false
+		}
+		unhandled(UnknownGaiji, fmt.Sprintf("0x%x", int(c1)<<8|int(c2)))
+		return fmt.Sprintf("{gaiji 0x%x}", int(c1)<<8|int(c2)), n, true
+	case set.final == setAlphanumeric || set.final == setProportionalAlnum:
+		return decodeAlphanumeric(c), n, false
+	case set.final == setHiragana || set.final == setProportionalHiragana:
+		return decodeKana(c, 0x3041), n, false
+	case set.final == setKatakana || set.final == setProportionalKatakana:
+		return decodeKana(c, 0x30a1), n, false
+	case set.final == setJISX0201Katakana && c <= 0x5f:
+		// Halfwidth forms from U+FF61 (｡) to U+FF9F (ﾟ)
+		return string(rune(0xff61 + int(c) - 0x21)), n, false
+	}
+	unhandled(UnhandledCharacter, fmt.Sprintf("0x%02x in set 0x%02x", c, set.final))
+	return "", n, false
+}
+
+// decodeAlphanumeric decodes the alphanumeric set, which is ASCII except for
+// the yen sign and the overline.
+// ARIB STD-B24 第一編 第2部 表 7-5
+func decodeAlphanumeric(c byte) string {
+	switch c {
+	case 0x5c:
+		return "¥"
+	case 0x7e:
+		return "‾"
+	}
+	return string(rune(c))
+}
+
+// decodeKana decodes the hiragana or katakana set. The kana follow the order
+// of JIS X 0208 from base, and the last columns are symbols common to both.
+// ARIB STD-B24 第一編 第2部 表 7-6, 表 7-7
+func decodeKana(c byte, base rune) string {
+	symbols := []rune{'ー', '。', '「', '」', '、', '・'}
+	switch {
+	case c == 0x77:
+		// ゝ or ヽ
+		return string(base + 0x5c)
+	case c == 0x78:
+		// ゞ or ヾ
+		return string(base + 0x5d)
+	case c >= 0x79:
+		return string(symbols[c-0x79])
+	case base == 0x3041 && c > 0x73:
+		// Unassigned in hiragana
+		return ""
+	}
+	return string(base + rune(c-0x21))
+}
+
+// DecodeSIString decodes an ARIB 8-bit string in SI descriptors, such as a
+// service name.
+func DecodeSIString(b []byte) string {
+	s, _ := (&Decoder{}).decodeString(b, len(b), newSIGraphicSets(), newCaptionLayout(), false, &Colors{})
+	return s
+}
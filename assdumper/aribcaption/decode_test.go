@@ -0,0 +1,141 @@
+package aribcaption
+
+import "testing"
+
+// decodeCase is a caption statement and the text it decodes to.
+type decodeCase struct {
+	name string
+	data []byte
+	want string
+}
+
+// testDecode decodes each case with a fresh Decoder of profile A, which must
+// give the text without any code left unhandled.
+func testDecode(t *testing.T, cases []decodeCase) {
+	t.Helper()
+	for _, c := range cases {
+		var unhandled []string
+		d := Decoder{Unhandled: func(kind, code string) {
+			unhandled = append(unhandled, kind+": "+code)
+		}}
+		d.Reset()
+		got, fallbacks := d.Decode(c.data)
+		if got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+		if fallbacks != 0 {
+			t.Errorf("%s: %d fallbacks", c.name, fallbacks)
+		}
+		if len(unhandled) != 0 {
+			t.Errorf("%s: unhandled %v", c.name, unhandled)
+		}
+	}
+}
+
+// TestDecodeFlashingAndHighlight checks that FLC and HLC become their markup
+// and that their parameters, like those of the other C1 codes taking one,
+// aren't written as characters.
+func TestDecodeFlashingAndHighlight(t *testing.T) {
+	testDecode(t, []decodeCase{
+		{"FLC", []byte{0x91, 0x40, 0xa2, 0x91, 0x4f, 0xa4}, "{flash}あ{/flash}い"},
+		{"FLC inverted", []byte{0x91, 0x47, 0xa2}, "{flash inverted}あ{/flash}"},
+		{"FLC left open", []byte{0x91, 0x40, 0xa2}, "{flash}あ{/flash}"},
+		{"HLC", []byte{0x97, 0x4f, 0xa2, 0x97, 0x40, 0xa4}, "{\\bord4}あ{\\bord}い"},
+		{"HLC left open", []byte{0x97, 0x41, 0xa2}, "{\\bord4}あ{\\bord}"},
+		{"POL, WMM and RPC", []byte{0x93, 0x40, 0x94, 0x48, 0x98, 0x43, 0xa2}, "あ"},
+		{"CDC", []byte{0x92, 0x20, 0x41, 0xa2, 0x92, 0x4f}, "あ"},
+		{"MACRO definition", []byte{0x95, 0x40, 0xa2, 0xa4, 0x95, 0x4f, 0xa6}, "う"},
+	})
+}
+
+// TestDecodeGraphicSets checks the designations of ESC and the invocations
+// of the shifts against the initial sets of captions: kanji in G0 and GL,
+// alphanumeric in G1, hiragana in G2 and GR, and macro in G3.
+func TestDecodeGraphicSets(t *testing.T) {
+	testDecode(t, []decodeCase{
+		{"kanji in GL", []byte{0x30, 0x21, 0x3b, 0x7a}, "亜字"},
+		{"hiragana in GR", []byte{0xa2, 0xa4, 0xf9}, "あいー"},
+		{"LS1 and LS0", []byte{0x0e, 0x41, 0x5c, 0x7e, 0x0f, 0x30, 0x21}, "A¥‾亜"},
+		{"SS2", []byte{0x30, 0x21, 0x19, 0x22, 0x30, 0x21}, "亜あ亜"},
+		{"katakana to G1", []byte{0x1b, 0x29, 0x31, 0x0e, 0x22, 0x77, 0x78}, "アヽヾ"},
+		{"katakana to G3 and SS3", []byte{0x1b, 0x2b, 0x31, 0x1d, 0x22, 0x30, 0x21}, "ア亜"},
+		{"LS2", []byte{0x1b, 0x6e, 0x22, 0x24}, "あい"},
+		{"LS1R", []byte{0x1b, 0x7e, 0xc1, 0xc2}, "AB"},
+		{"kanji to G2", []byte{0x1b, 0x24, 0x2a, 0x42, 0xb0, 0xa1}, "亜"},
+		{"ESC F to G0", []byte{0x1b, 0x4a, 0x48, 0x69}, "Hi"},
+		{"JIS X0201 katakana", []byte{0x1b, 0x28, 0x49, 0x31, 0x5f}, "ｱﾟ"},
+		{"proportional alphanumeric", []byte{0x1b, 0x29, 0x36, 0x0e, 0x61}, "a"},
+	})
+}
+
+// TestDecodePosition checks that APS places the statement by the writing
+// format of CSI, on the default script resolution of 384x288.
+func TestDecodePosition(t *testing.T) {
+	testDecode(t, []decodeCase{
+		{"no APS", []byte{0xa2}, "あ"},
+		// (170+2*40, 30+1*60) on the plane of 960x540
+		{"APS", []byte{0x1c, 0x41, 0x42, 0xa2}, "{\\an7\\pos(100,48)}あ"},
+		{"APS to the next row", []byte{0x1c, 0x41, 0x42, 0xa2, 0x1c, 0x42, 0x42, 0xa4}, "{\\an7\\pos(100,48)}あ\\Nい"},
+		{"APS on the same row", []byte{0x1c, 0x41, 0x42, 0xa2, 0x1c, 0x41, 0x45, 0xa4}, "{\\an7\\pos(100,48)}あい"},
+		{"APR", []byte{0xa2, 0x0d, 0xa4}, "あ\\nい"},
+		{"SDP", []byte{0x9b, '1', '0', '0', ';', '5', '0', 0x20, 0x5f, 0x1c, 0x40, 0x40, 0xa2}, "{\\an7\\pos(40,26)}あ"},
+		{"SWF 1920x1080", []byte{0x9b, '5', 0x20, 0x53, 0x1c, 0x40, 0x40, 0xa2}, "{\\an7\\pos(34,8)}あ"},
+		{"SSM and SVS", []byte{0x9b, '1', '8', ';', '1', '8', 0x20, 0x57, 0x9b, '1', '2', 0x20, 0x59, 0x1c, 0x42, 0x40, 0xa2}, "{\\an7\\pos(68,48)}あ"},
+		{"SDF", []byte{0x9b, '6', '2', '0', ';', '4', '8', '0', 0x20, 0x56, 0xa2}, "あ"},
+		{"CS forgets the position", []byte{0x1c, 0x41, 0x42, 0xa2, 0x0c, 0x1c, 0x40, 0x40, 0xa4}, "{\\an7\\pos(100,48)}あ\f{\\an7\\pos(68,16)}い"},
+	})
+}
+
+// TestDecodeCharacterSize checks the overrides of MSZ and NSZ, which leave
+// the half-width characters unscaled, and the ruby runs of SSZ.
+func TestDecodeCharacterSize(t *testing.T) {
+	testDecode(t, []decodeCase{
+		{"MSZ and NSZ", []byte{0x89, 0xa2, 0xa4, 0x8a, 0xa6}, "{\\fscx50\\fscy100}あい{\\fscx100\\fscy100}う"},
+		{"MSZ to the end", []byte{0x89, 0xa2}, "{\\fscx50\\fscy100}あ"},
+		{"MSZ of alphanumerics", []byte{0x89, 0x0e, 0x41, 0x0f, 0x30, 0x21}, "A{\\fscx50\\fscy100}亜"},
+		{"NSZ without MSZ", []byte{0x8a, 0xa2}, "あ"},
+		{"SZX", []byte{0x8b, 0x41, 0xa2}, "あ"},
+	})
+}
+
+// TestDecodeRuby checks that SSZ runs are enclosed in ruby comments, with
+// the position of their first character when APS has placed them.
+func TestDecodeRuby(t *testing.T) {
+	testDecode(t, []decodeCase{
+		{"SSZ", []byte{0x88, 0xa2, 0xa4, 0x8a, 0x30, 0x21}, "{ruby}あい{/ruby}亜"},
+		{"SSZ to the end", []byte{0x30, 0x21, 0x88, 0xa2}, "亜{ruby}あ{/ruby}"},
+		// The ruby at row 1 of the small size is half as far below the
+		// area as the base text at row 1 of the normal size, which it
+		// doesn't move.
+		{"SSZ placed by APS", []byte{0x88, 0x1c, 0x41, 0x40, 0xa2, 0x8a, 0x1c, 0x41, 0x40, 0x30, 0x21}, "{ruby 68,32}あ{/ruby}{\\an7\\pos(68,48)}亜"},
+		{"APS ends the run", []byte{0x88, 0xa2, 0x1c, 0x40, 0x42, 0xa4}, "{ruby}あ{/ruby}{ruby 84,16}い{/ruby}"},
+	})
+}
+
+// TestDecodeColors checks the color overrides of the foreground codes and
+// COL with the default CLUT, which are brought back to the defaults at the
+// end of the statement.
+func TestDecodeColors(t *testing.T) {
+	testDecode(t, []decodeCase{
+		{"RDF", []byte{0x81, 0xa2}, "{\\c&H0000ff&}あ{\\c&HFFFFFF&}"},
+		{"WHF", []byte{0x81, 0xa2, 0x87, 0xa4}, "{\\c&H0000ff&}あ{\\c&HFFFFFF&}い"},
+		{"COL foreground", []byte{0x90, 0x4a, 0xa2}, "{\\c&H00aa00&}あ{\\c&HFFFFFF&}"},
+		{"COL background", []byte{0x90, 0x52, 0xa2}, "{\\4c&H00ff00&}あ{\\4c&H000000&}"},
+		{"COL half tone", []byte{0x90, 0x64, 0xa2}, "{\\3c&Hff0000&}あ{\\3c&H000000&}"},
+		{"COL half tone of the background", []byte{0x90, 0x71, 0xa2}, "あ"},
+		{"COL palette", []byte{0x90, 0x20, 0x44, 0x90, 0x41, 0xa2}, "{\\c&H0000ff&\\1a&H7f&}あ{\\c&HFFFFFF&\\1a&H00&}"},
+	})
+}
+
+// TestDecodeClearScreen checks that CS is written as a form feed, which ends
+// the displayed caption, and brings back the default colors and size. The
+// size is written again for the characters after it, which go on in the same
+// line.
+func TestDecodeClearScreen(t *testing.T) {
+	testDecode(t, []decodeCase{
+		{"CS", []byte{0x0c}, "\f"},
+		{"CS between statements", []byte{0xa2, 0x0c, 0xa4}, "あ\fい"},
+		{"CS after colors", []byte{0x81, 0xa2, 0x0c, 0xa4}, "{\\c&H0000ff&}あ{\\c&HFFFFFF&}\fい"},
+		{"CS after MSZ and FLC", []byte{0x89, 0x91, 0x40, 0xa2, 0x0c, 0xa4}, "{flash}{\\fscx50\\fscy100}あ{/flash}\f{\\fscx100\\fscy100}い"},
+	})
+}
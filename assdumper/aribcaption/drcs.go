@@ -0,0 +1,134 @@
+package aribcaption
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// DRCSCode is a character defined by a DRCS data unit, with a glyph for each
+// font.
+type DRCSCode struct {
+	Code  uint16
+	Fonts []DRCSFont
+}
+
+// DRCSFont is the glyph of a DRCS character in a font.
+type DRCSFont struct {
+	FontID byte
+	Mode   byte
+	// Width and Height are the size of the pattern, or of the region of
+	// the geometric data in the compressed modes.
+	Width  int
+	Height int
+	// Bits is the number of bits per pixel of the pattern. The geometric
+	// data of the compressed modes is drawn into a pattern of 1 bit.
+	Bits    int
+	Pattern []byte
+}
+
+// ParseDRCS parses a DRCS data unit. When the data unit is truncated, it
+// returns the characters parsed so far.
+// ARIB STD-B24 第一編 第2部 付録規定D
+func ParseDRCS(data []byte) []DRCSCode {
+	if len(data) < 1 {
+		return nil
+	}
+	numberOfCode := int(data[0])
+	data = data[1:]
+	var codes []DRCSCode
+	for i := 0; i < numberOfCode; i++ {
+		if len(data) < 3 {
+			return codes
+		}
+		code := DRCSCode{Code: uint16(data[0])<<8 | uint16(data[1])}
+		numberOfFont := int(data[2])
+		data = data[3:]
+		for j := 0; j < numberOfFont; j++ {
+			if len(data) < 4 {
+				return codes
+			}
+			font := DRCSFont{FontID: data[0] >> 4, Mode: data[0] & 0x0f}
+			if font.Mode != 0x00 && font.Mode != 0x01 {
+				// The compressed modes carry geometric data in a region
+				// instead of a pattern, which is drawn into one.
+				// ARIB STD-B24 第一編 第2部 表 D-1
+				if len(data) < 5 {
+					return codes
+				}
+				font.Width, font.Height = int(data[1]), int(data[2])
+				length := int(data[3])<<8 | int(data[4])
+				if 5+length > len(data) {
+					return codes
+				}
+				font.Bits = 1
+				font.Pattern = rasterizeGeometric(data[5:5+length], font.Width, font.Height)
+				code.Fonts = append(code.Fonts, font)
+				data = data[5+length:]
+				continue
+			}
+			depth := int(data[1])
+			font.Width, font.Height = int(data[2]), int(data[3])
+			font.Bits = drcsBitsPerPixel(font.Mode, depth)
+			size := (font.Width*font.Height*font.Bits + 7) / 8
+			if 4+size > len(data) {
+				return codes
+			}
+			font.Pattern = data[4 : 4+size]
+			code.Fonts = append(code.Fonts, font)
+			data = data[4+size:]
+		}
+		codes = append(codes, code)
+	}
+	return codes
+}
+
+func drcsBitsPerPixel(mode byte, depth int) int {
+	bits := 1
+	if mode == 0x01 {
+		// depth is the number of gradations minus 2
+		for 1<<bits < depth+2 {
+			bits++
+		}
+	}
+	return bits
+}
+
+// Rows returns the first bits of every row of the pattern as a line of 0
+// and 1.
+func (f DRCSFont) Rows() string {
+	var b strings.Builder
+	for h := 0; h < f.Height; h++ {
+		for w := 0; w < f.Width/8; w++ {
+			fmt.Fprintf(&b, "%08b", f.Pattern[h*(f.Width/8)+w])
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// MD5 returns the MD5 of Rows in hex, which identifies the glyph across
+// broadcasts.
+func (f DRCSFont) MD5() string {
+	h := md5.New()
+	io.WriteString(h, f.Rows())
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// drcsReplacements maps the MD5 of the glyphs that broadcasters commonly
+// define to the characters they stand for.
+var drcsReplacements = map[string]string{
+	"4447af4c020758d6b615713ad6640fc5": "《",
+	"6d6cf86c3f892dc45b68703bb84068a9": "》",
+	"6bcc3c66dc1f853e605613fceda9e648": "♬",
+	"ec5a85c9f822a0e27847a2d8d31ab73e": "📺",
+	"f64c27d6df14074b2e1f92b3a4985c01": "➡",
+}
+
+// Replacement returns the character the glyph stands for, or an empty string
+// for a glyph it doesn't know.
+func (f DRCSFont) Replacement() string {
+	return drcsReplacements[f.MD5()]
+}
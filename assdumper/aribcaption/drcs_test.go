@@ -0,0 +1,92 @@
+package aribcaption
+
+import (
+	"strings"
+	"testing"
+)
+
+// pdiPoint encodes a point of the geometric data in the default domain, where
+// a coordinate is 9 bits in 3 bytes, as a fraction of 256.
+func pdiPoint(x, y int) []byte {
+	var b []byte
+	for shift := 6; shift >= 0; shift -= 3 {
+		b = append(b, 0x40|byte(x>>shift&7)<<3|byte(y>>shift&7))
+	}
+	return b
+}
+
+// TestParseDRCSGeometric draws glyphs of the compressed mode from their
+// geometric data.
+func TestParseDRCSGeometric(t *testing.T) {
+	cases := []struct {
+		name      string
+		geometric []byte
+		want      []string
+	}{
+		{
+			name: "filled rectangle",
+			// SET & RECTANGLE (FILLED) at (1/4, 1/4) of 1/2 x 1/2
+			geometric: append(append([]byte{pdiRectSetFilled}, pdiPoint(64, 64)...), pdiPoint(128, 128)...),
+			want: []string{
+				"00000000",
+				"00000000",
+				"00111100",
+				"00111100",
+				"00111100",
+				"00111100",
+				"00000000",
+				"00000000",
+			},
+		},
+		{
+			name: "lines",
+			// SET & LINE (ABSOLUTE) from the bottom left to the top
+			// right, and LINE (RELATIVE) down to the bottom right
+			geometric: append(append(append([]byte{pdiLineSetAbs}, pdiPoint(0, 0)...), pdiPoint(224, 224)...),
+				append([]byte{pdiLineRel}, pdiPoint(0, -224&0x1ff)...)...),
+			want: []string{
+				"00000001",
+				"00000011",
+				"00000101",
+				"00001001",
+				"00010001",
+				"00100001",
+				"01000001",
+				"10000001",
+			},
+		},
+		{
+			name: "outlined polygon",
+			// SET & POLYGON (OUTLINED) of a triangle, closed back to
+			// where it starts
+			geometric: append(append(append([]byte{pdiPolygonSetOutlined}, pdiPoint(0, 0)...), pdiPoint(224, 0)...), pdiPoint(-224&0x1ff, 224)...),
+			want: []string{
+				"10000000",
+				"11000000",
+				"10100000",
+				"10010000",
+				"10001000",
+				"10000100",
+				"10000010",
+				"11111111",
+			},
+		},
+	}
+	for _, c := range cases {
+		// A code of a font in mode 2 (compressed, 2 gradations) with a
+		// region of 8 x 8
+		data := []byte{0x01, 0x41, 0x21, 0x01, 0x02, 8, 8, byte(len(c.geometric) >> 8), byte(len(c.geometric))}
+		data = append(data, c.geometric...)
+		codes := ParseDRCS(data)
+		if len(codes) != 1 || len(codes[0].Fonts) != 1 {
+			t.Fatalf("%s: parsed %+v", c.name, codes)
+		}
+		font := codes[0].Fonts[0]
+		if font.Width != 8 || font.Height != 8 || font.Bits != 1 {
+			t.Errorf("%s: %dx%d in %d bits", c.name, font.Width, font.Height, font.Bits)
+		}
+		if got, want := font.Rows(), strings.Join(c.want, "\n")+"\n"; got != want {
+			t.Errorf("%s: got\n%swant\n%s", c.name, got, want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package aribcaption
+
+import (
+	"fmt"
+	"sync"
+)
+
+var (
+	kanjiCodesOnce sync.Once
+	kanjiCodes     map[rune]uint16
+)
+
+// Encode encodes text into a caption statement of profile A, with the code
+// sets in their initial state: kanji in G0 and alphanumeric in G1. ASCII
+// characters are written in alphanumeric invoked by LS1, the other
+// characters in JIS X 0208 kanji, and line breaks become APR. It's the
+// inverse of Decoder.Decode for plain text, meant for making test streams.
+func Encode(text string) ([]byte, error) {
+	kanjiCodesOnce.Do(func() {
+		kanjiCodes = make(map[rune]uint16)
+		for c1 := byte(0x21); c1 <= 0x7e; c1++ {
+			for c2 := byte(0x21); c2 <= 0x7e; c2++ {
+				if r, ok := decodeKanji(c1, c2); ok {
+					if _, dup := kanjiCodes[r]; !dup {
+						kanjiCodes[r] = uint16(c1)<<8 | uint16(c2)
+					}
+				}
+			}
+		}
+	})
+
+	var b []byte
+	alphanumeric := false
+	for _, r := range text {
+		switch {
+		case r == '\n':
+			// APR
+			b = append(b, 0x0d)
+		case r == ' ':
+			// SP
+			b = append(b, 0x20)
+		case 0x21 <= r && r <= 0x7e && r != '\\' && r != '~', r == '¥', r == '‾':
+			if !alphanumeric {
+				// LS1
+				b = append(b, 0x0e)
+				alphanumeric = true
+			}
+			// The alphanumeric set has ¥ and ‾ in place of \ and ~.
+			switch r {
+			case '¥':
+				r = 0x5c
+			case '‾':
+				r = 0x7e
+			}
+			b = append(b, byte(r))
+		default:
+			code, ok := kanjiCodes[r]
+			if !ok {
+				return nil, fmt.Errorf("%q can't be encoded", r)
+			}
+			if alphanumeric {
+				// LS0
+				b = append(b, 0x0f)
+				alphanumeric = false
+			}
+			b = append(b, byte(code>>8), byte(code))
+		}
+	}
+	return b, nil
+}
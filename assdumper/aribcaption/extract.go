@@ -0,0 +1,303 @@
+package aribcaption
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+// Caption is a caption displayed from Start until End, when the next one
+// replaces it or the screen is erased.
+type Caption struct {
+	Start time.Time
+	End   time.Time
+	// Text is the plain text, with a newline between rows and without
+	// ruby.
+	Text string
+	// Styled is the text of an ASS dialogue line, as Decoder writes it.
+	Styled string
+	// Lang is ISO_639_language_code of the caption language.
+	Lang string
+}
+
+// Extract sends the captions of the first caption language of the first
+// program that has one to ch, until the end of r or until ctx is done. The
+// caption on the screen then is still sent, ending at the last PCR, so ch
+// must be read until Extract closes it when it returns.
+func Extract(ctx context.Context, r io.Reader, ch chan<- Caption) error {
+	defer close(ch)
+	return ExtractFunc(ctx, r, func(c Caption) {
+		ch <- c
+	})
+}
+
+// ExtractFunc calls fn with the captions Extract would send. The times are
+// in JST from TOT. Captions are held until the first TOT anchors the clock,
+// and a stream without TOT gets times from the zero Time at its first PCR.
+func ExtractFunc(ctx context.Context, r io.Reader, fn func(Caption)) error {
+	x := &extractor{
+		demux:      tspacket.NewDemuxer(r),
+		captionPid: -1,
+		pcrPid:     -1,
+		fn:         fn,
+	}
+	x.session.Decoder.DRCS = make(map[uint16]string)
+	x.demux.HandleSections(0x0000, x.handlePAT)
+	x.demux.HandleSections(0x0014, x.handleTOT)
+	err := x.demux.Run(ctx)
+	x.demux.Flush()
+	// The last caption lasts until the end of the stream.
+	x.show(x.pcr, "", "")
+	if !x.anchored {
+		x.anchor(x.firstPCR, time.Time{})
+	}
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return err
+}
+
+type extractor struct {
+	demux      *tspacket.Demuxer
+	pmtPids    map[int]bool
+	captionPid int
+	pcrPid     int
+
+	// rawPCR is the last PCR as sent, and offset is added to it to stitch
+	// the time bases across discontinuities into pcr.
+	rawPCR   int64
+	pcr      int64
+	firstPCR int64
+	offset   int64
+	// The wall clock at anchorPCR, once a TOT has been seen
+	anchored   bool
+	anchorPCR  int64
+	anchorTime time.Time
+
+	session Session
+
+	// The caption on the screen since its PCR, which ends when the next
+	// one starts
+	current      string
+	currentLang  string
+	currentStart int64
+	// pending holds the captions until the clock is anchored.
+	pending []pendingCaption
+	fn      func(Caption)
+}
+
+type pendingCaption struct {
+	styled, lang string
+	start, end   int64
+}
+
+func (x *extractor) handlePAT(section []byte) {
+	if x.pmtPids != nil || tspacket.CRC32(section) != 0 {
+		return
+	}
+	x.pmtPids = make(map[int]bool)
+	for pid := range tspacket.ParsePAT(section) {
+		x.pmtPids[pid] = true
+		x.demux.HandleSections(pid, x.handlePMT)
+	}
+}
+
+func (x *extractor) handlePMT(section []byte) {
+	if x.captionPid != -1 || section[0] != 0x02 || tspacket.CRC32(section) != 0 {
+		return
+	}
+	for _, es := range tspacket.ParsePMT(section) {
+		if es.StreamType != 0x06 || (es.ComponentTag != 0x87 && es.DataComponentID != DataComponentMobileCaption) {
+			continue
+		}
+		x.captionPid = es.PID
+		if es.DataComponentID == DataComponentMobileCaption {
+			x.session.Decoder.Profile = ProfileC
+		}
+		x.pcrPid = tspacket.PCRPID(section)
+		x.demux.HandlePCR(x.pcrPid, x.handlePCR)
+		x.demux.HandlePES(x.captionPid, x.handlePES)
+		for pid := range x.pmtPids {
+			x.demux.HandleSections(pid, nil)
+		}
+		return
+	}
+}
+
+func (x *extractor) handlePCR(pcr int64, discontinuity bool) {
+	if x.rawPCR == 0 {
+		x.firstPCR = pcr
+	} else if discontinuity || tspacket.IsPCRDiscontinuity(x.rawPCR, pcr) {
+		// The new time base continues from the last PCR.
+		x.offset = x.pcr - pcr
+	}
+	x.rawPCR = pcr
+	x.pcr = pcr + x.offset
+}
+
+func (x *extractor) handleTOT(section []byte) {
+	if x.anchored || x.pcr == 0 || tspacket.CRC32(section) != 0 {
+		return
+	}
+	if t := tspacket.ParseTOT(section); t != 0 {
+		x.anchor(x.pcr, time.Unix(t, 0))
+	}
+}
+
+// anchor sets the clock and passes the captions held until then.
+func (x *extractor) anchor(pcr int64, t time.Time) {
+	x.anchored = true
+	x.anchorPCR = pcr
+	x.anchorTime = t
+	for _, c := range x.pending {
+		x.send(c)
+	}
+	x.pending = nil
+}
+
+func (x *extractor) handlePES(pes []byte) {
+	if x.pcr == 0 {
+		return
+	}
+	r := ParsePES(pes)
+	if r.DataGroup == nil {
+		return
+	}
+	timestamp := tspacket.PresentationTime(x.rawPCR, r.PTS, r.HasPTS) + x.offset
+	g, err := x.session.DataGroup(r.DataGroup)
+	if err != nil {
+		return
+	}
+	if g.NewSession {
+		// A new session erases the screen.
+		x.show(timestamp, "", "")
+	}
+	styled := ""
+	found := false
+	for _, unit := range g.Units {
+		switch unit.Parameter {
+		case 0x20:
+			text, _ := x.session.Decoder.Decode(unit.Data)
+			styled += text
+			found = true
+		case 0x30, 0x31:
+			for _, c := range ParseDRCS(unit.Data) {
+				if len(c.Fonts) == 0 {
+					continue
+				}
+				if s := c.Fonts[0].Replacement(); s != "" {
+					x.session.Decoder.DRCS[c.Code] = s
+				} else {
+					delete(x.session.Decoder.DRCS, c.Code)
+				}
+			}
+		}
+	}
+	// Only the first language is extracted.
+	if found && g.Language == 1 {
+		x.show(timestamp, styled, x.session.Languages[0])
+	}
+}
+
+// show ends the caption on the screen at timestamp and puts styled on it.
+// Statements with the same timestamp make up one caption.
+func (x *extractor) show(timestamp int64, styled, lang string) {
+	if x.current != "" && timestamp == x.currentStart {
+		x.current += styled
+		return
+	}
+	if x.current != "" {
+		if end := timestamp; end > x.currentStart {
+			c := pendingCaption{styled: x.current, lang: x.currentLang, start: x.currentStart, end: end}
+			if x.anchored {
+				x.send(c)
+			} else {
+				x.pending = append(x.pending, c)
+			}
+		}
+	}
+	x.current = styled
+	x.currentLang = lang
+	x.currentStart = timestamp
+}
+
+func (x *extractor) send(c pendingCaption) {
+	styled := strings.Replace(c.styled, "\f", "", -1)
+	text := plainText(styled)
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+	x.fn(Caption{
+		Start:  x.wallClock(c.start),
+		End:    x.wallClock(c.end),
+		Text:   text,
+		Styled: styled,
+		Lang:   c.lang,
+	})
+}
+
+func (x *extractor) wallClock(pcr int64) time.Time {
+	return x.anchorTime.Add(time.Duration((pcr - x.anchorPCR) * 1000 / 27))
+}
+
+// plainText drops the override blocks, comments, drawings and ruby of the
+// text Decoder writes, and turns its line breaks and hard spaces into
+// ordinary ones.
+func plainText(styled string) string {
+	var b strings.Builder
+	ruby := false
+	drawing := false
+	for len(styled) > 0 {
+		if styled[0] == '{' {
+			end := strings.IndexByte(styled, '}')
+			if end == -1 {
+				break
+			}
+			block := styled[1:end]
+			switch {
+			case strings.HasPrefix(block, "ruby"):
+				ruby = true
+			case block == "/ruby":
+				ruby = false
+			default:
+				if level, ok := drawingLevel(block); ok {
+					drawing = level != 0
+				}
+			}
+			styled = styled[end+1:]
+			continue
+		}
+		if styled[0] == '\\' && len(styled) >= 2 {
+			switch styled[1] {
+			case 'n', 'N':
+				b.WriteString("\n")
+				styled = styled[2:]
+				continue
+			case 'h':
+				b.WriteString(" ")
+				styled = styled[2:]
+				continue
+			}
+		}
+		if !ruby && !drawing {
+			b.WriteByte(styled[0])
+		}
+		styled = styled[1:]
+	}
+	return b.String()
+}
+
+// drawingLevel returns the level of the last \p tag of an override block,
+// which starts a drawing unless it is 0.
+func drawingLevel(block string) (int, bool) {
+	level, ok := 0, false
+	for i := 0; i+2 < len(block); i++ {
+		if block[i] == '\\' && block[i+1] == 'p' && '0' <= block[i+2] && block[i+2] <= '9' {
+			level, ok = int(block[i+2]-'0'), true
+		}
+	}
+	return level, ok
+}
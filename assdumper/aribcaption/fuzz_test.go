@@ -0,0 +1,78 @@
+package aribcaption
+
+import "testing"
+
+// FuzzDecode decodes arbitrary caption statements with both profiles.
+func FuzzDecode(f *testing.F) {
+	// CS, kanji, LS1 and alphanumeric, APR
+	f.Add([]byte{0x0c, 0x30, 0x21, 0x0e, 0x41, 0x0d, 0x0f, 0x24, 0x22})
+	// ESC designating DRCS-1 to G0 and a character of it
+	f.Add([]byte{0x1b, 0x28, 0x20, 0x41, 0x21})
+	// CSI SWF, SDF, SDP and ACPS
+	f.Add([]byte{0x9b, 0x37, 0x20, 0x53, 0x9b, 0x39, 0x36, 0x30, 0x3b, 0x35, 0x34, 0x30, 0x20, 0x56, 0x9b, 0x31, 0x30, 0x30, 0x3b, 0x32, 0x30, 0x20, 0x61})
+	// COL, FLC, HLC, SZX, RPC, small size
+	f.Add([]byte{0x90, 0x51, 0x91, 0x40, 0x97, 0x4f, 0x8b, 0x60, 0x98, 0x43, 0x88, 0x30, 0x21})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, profile := range []Profile{ProfileA, ProfileC} {
+			d := Decoder{Profile: profile}
+			d.Reset()
+			d.DRCS[0x4121] = "〓"
+			d.Decode(data)
+		}
+		DecodeSIString(data)
+	})
+}
+
+// captionPES returns a caption PES with a statement of data units.
+func captionPES(units ...[]byte) []byte {
+	var loop []byte
+	for _, unit := range units {
+		loop = append(loop, unit...)
+	}
+	data := append([]byte{0x3f, byte(len(loop) >> 16), byte(len(loop) >> 8), byte(len(loop))}, loop...)
+	group := append([]byte{0x04, 0x00, 0x00, byte(len(data) >> 8), byte(len(data))}, data...)
+	crc := CRC16(group)
+	group = append(group, byte(crc>>8), byte(crc))
+	pes := []byte{0x00, 0x00, 0x01, 0xbd, 0x00, 0x00, 0x80, 0x80, 0x05, 0x21, 0x00, 0x01, 0x00, 0x01, 0x80, 0xff, 0xf0}
+	pes = append(pes, group...)
+	pes[4], pes[5] = byte((len(pes)-6)>>8), byte(len(pes)-6)
+	return pes
+}
+
+// FuzzDataGroup parses arbitrary PES of a caption ES, its data group and
+// DRCS data units as Extract does.
+func FuzzDataGroup(f *testing.F) {
+	// Statement body
+	f.Add(captionPES([]byte{0x1f, 0x20, 0x00, 0x00, 0x02, 0x0c, 0x41}))
+	// 1-byte DRCS of 2x2 pixels in 2 gradations, and its use
+	f.Add(captionPES(
+		[]byte{0x1f, 0x30, 0x00, 0x00, 0x09, 0x01, 0x41, 0x21, 0x01, 0x00, 0x00, 0x02, 0x02, 0x90},
+		[]byte{0x1f, 0x20, 0x00, 0x00, 0x05, 0x1b, 0x28, 0x20, 0x41, 0x21},
+	))
+	// 1-byte DRCS of the compressed mode, a filled rectangle in a region of
+	// 8x8
+	f.Add(captionPES([]byte{0x1f, 0x30, 0x00, 0x00, 0x10, 0x01, 0x41, 0x21, 0x01, 0x02, 0x08, 0x08, 0x00, 0x07, 0x33, 0x48, 0x40, 0x40, 0x50, 0x40, 0x40}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var s Session
+		s.Decoder.DRCS = make(map[uint16]string)
+		r := ParsePES(data)
+		g, err := s.DataGroup(r.DataGroup)
+		if err != nil {
+			return
+		}
+		for _, unit := range g.Units {
+			switch unit.Parameter {
+			case 0x20:
+				s.Decoder.Decode(unit.Data)
+			case 0x30, 0x31:
+				for _, code := range ParseDRCS(unit.Data) {
+					for _, font := range code.Fonts {
+						font.Rows()
+						font.MD5()
+						font.Replacement()
+					}
+				}
+			}
+		}
+	})
+}
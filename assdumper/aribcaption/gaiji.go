@@ -0,0 +1,110 @@
+package aribcaption
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// gaiji.json maps the additional symbols and kanji of ARIB (rows 0x75 to
+// 0x7E of the kanji set), which JIS X 0208 lacks, to Unicode. The keys are
+// the character codes in hex, as the {gaiji 0x7e21} placeholders show them.
+//
+//go:embed gaiji.json
+var defaultGaijiJSON []byte
+
+// gaiji_unicode.json maps the additional symbols that Unicode 5.2 and later
+// encoded for ARIB, like 🈟 and ㊙, to those code points. gaiji.json spells
+// them as 【新】 and （秘）, which fonts without the new code points can show.
+//
+//go:embed gaiji_unicode.json
+var unicodeGaijiJSON []byte
+
+// GaijiMap maps the character codes of the additional symbols and kanji to
+// the strings they decode to.
+type GaijiMap map[int]string
+
+// defaultGaiji is the mapping of gaiji.json, for Decoders without their
+// own. It's never modified.
+var defaultGaiji = mustParseGaijiMap(defaultGaijiJSON)
+
+// DefaultGaijiMap returns a copy of the built-in mapping, to be adjusted by
+// UseUnicode and Load and given to Decoder.Gaiji.
+func DefaultGaijiMap() GaijiMap {
+	m := make(GaijiMap, len(defaultGaiji))
+	for c, s := range defaultGaiji {
+		m[c] = s
+	}
+	return m
+}
+
+func parseGaijiMap(data []byte) (GaijiMap, error) {
+	var entries map[string]string
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	table := make(GaijiMap, len(entries))
+	for key, s := range entries {
+		c, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(key), "0x"), 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid character code %q", key)
+		}
+		table[int(c)] = s
+	}
+	return table, nil
+}
+
+func mustParseGaijiMap(data []byte) GaijiMap {
+	table, err := parseGaijiMap(data)
+	if err != nil {
+		panic(err)
+	}
+	return table
+}
+
+// Load adds the mapping of the JSON file at path, in the format of
+// gaiji.json. It replaces the mapping of the same codes, and an empty
+// string leaves the character undecoded.
+func (m GaijiMap) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	table, err := parseGaijiMap(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	for c, s := range table {
+		m[c] = s
+	}
+	return nil
+}
+
+// UseUnicode makes the additional symbols decode to the code points Unicode
+// has for them rather than the spellings with ordinary characters.
+func (m GaijiMap) UseUnicode() {
+	for c, s := range mustParseGaijiMap(unicodeGaijiJSON) {
+		m[c] = s
+	}
+}
+
+// AdditionalSymbols returns the characters that the additional symbols of
+// ARIB decode to, which fonts often lack. Symbols decoded to several
+// characters, like 【HV】, are made of ordinary ones. A nil m is the
+// built-in mapping.
+func (m GaijiMap) AdditionalSymbols() map[rune]bool {
+	if m == nil {
+		m = defaultGaiji
+	}
+	symbols := make(map[rune]bool)
+	for _, s := range m {
+		if r, n := utf8.DecodeRuneInString(s); n != 0 && n == len(s) {
+			symbols[r] = true
+		}
+	}
+	return symbols
+}
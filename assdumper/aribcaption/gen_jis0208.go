@@ -0,0 +1,66 @@
+//go:build ignore
+
+// gen_jis0208 writes jis0208_table.go from the EUC-JP decoder of
+// golang.org/x/text, so that the regular build doesn't depend on x/text.
+// Rows from 85 on are left out: broadcasters use them for the ARIB
+// additional kanji and symbols, which GaijiMap handles.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"os"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/japanese"
+)
+
+func main() {
+	var buf bytes.Buffer
+	buf.WriteString("// Code generated by gen_jis0208.go; DO NOT EDIT.\n\n")
+	buf.WriteString("//go:build !xtext\n\n")
+	buf.WriteString("package aribcaption\n\n")
+	buf.WriteString("// jis0208Table maps JIS X 0208 rows 1 to 84 to Unicode. The index is\n")
+	buf.WriteString("// (row-1)*94 + (cell-1) and 0 means unassigned.\n")
+	buf.WriteString("var jis0208Table = [84 * 94]uint16{\n")
+
+	decoder := japanese.EUCJP.NewDecoder()
+	dst := make([]byte, 8)
+	n := 0
+	for row := 1; row <= 84; row++ {
+		for cell := 1; cell <= 94; cell++ {
+			src := []byte{byte(row + 0xa0), byte(cell + 0xa0)}
+			r := rune(0)
+			if ndst, _, err := decoder.Transform(dst, src, true); err == nil {
+				r, _ = utf8.DecodeRune(dst[:ndst])
+				if r == utf8.RuneError {
+					r = 0
+				}
+			}
+			if r > 0xffff {
+				fmt.Fprintf(os.Stderr, "row %d cell %d is outside the BMP\n", row, cell)
+				os.Exit(1)
+			}
+			if n%8 == 0 {
+				buf.WriteString("\t")
+			}
+			fmt.Fprintf(&buf, "0x%04x,", r)
+			n++
+			if n%8 == 0 {
+				buf.WriteString("\n")
+			} else {
+				buf.WriteString(" ")
+			}
+		}
+	}
+	buf.WriteString("\n}\n")
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile("jis0208_table.go", src, 0644); err != nil {
+		panic(err)
+	}
+}
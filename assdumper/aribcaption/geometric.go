@@ -0,0 +1,271 @@
+package aribcaption
+
+import (
+	"math"
+	"sort"
+)
+
+// The geometric data of the compressed DRCS modes draws the glyph with the
+// picture description instructions (PDI) that ARIB shares with NAPLPS. An
+// opcode from 0x20 to 0x3f is followed by its operands, in bytes from 0x40
+// to 0x7f. Coordinates are fractions of the unit square, which is mapped onto
+// the region of the glyph with Y going up.
+// ARIB STD-B24 第一編 第2部 付録規定D
+const (
+	pdiReset              = 0x20
+	pdiDomain             = 0x21
+	pdiPointSetAbs        = 0x24
+	pdiPointSetRel        = 0x25
+	pdiPointAbs           = 0x26
+	pdiPointRel           = 0x27
+	pdiLineAbs            = 0x28
+	pdiLineRel            = 0x29
+	pdiLineSetAbs         = 0x2a
+	pdiLineSetRel         = 0x2b
+	pdiArcOutlined        = 0x2c
+	pdiArcFilled          = 0x2d
+	pdiArcSetOutlined     = 0x2e
+	pdiArcSetFilled       = 0x2f
+	pdiRectOutlined       = 0x30
+	pdiRectFilled         = 0x31
+	pdiRectSetOutlined    = 0x32
+	pdiRectSetFilled      = 0x33
+	pdiPolygonOutlined    = 0x34
+	pdiPolygonFilled      = 0x35
+	pdiPolygonSetOutlined = 0x36
+	pdiPolygonSetFilled   = 0x37
+)
+
+// geometricCanvas rasterizes geometric data into a pattern of 1 bit per
+// pixel, laid out as the pattern of mode 0.
+type geometricCanvas struct {
+	width, height int
+	pattern       []byte
+	// multiBytes is the length of a coordinate operand, and threeD tells
+	// that it has Z as well, as DOMAIN sets them.
+	multiBytes int
+	threeD     bool
+	// x and y are the drawing point.
+	x, y float64
+}
+
+// rasterizeGeometric draws the geometric data of a DRCS glyph into a pattern
+// of width x height pixels in 2 gradations. Arcs are drawn as straight
+// segments through their points, and the instructions that don't draw, such
+// as colors and textures, are skipped.
+func rasterizeGeometric(data []byte, width, height int) []byte {
+	c := &geometricCanvas{width: width, height: height, pattern: make([]byte, (width*height+7)/8)}
+	c.reset()
+	for i := 0; i < len(data); {
+		op := data[i]
+		i++
+		start := i
+		for i < len(data) && 0x40 <= data[i] && data[i] <= 0x7f {
+			i++
+		}
+		if 0x20 <= op && op <= 0x3f {
+			c.execute(op, data[start:i])
+		}
+	}
+	return c.pattern
+}
+
+func (c *geometricCanvas) reset() {
+	c.multiBytes = 3
+	c.threeD = false
+	c.x, c.y = 0, 0
+}
+
+// points splits operands into coordinates. The bits of X, Y (and Z) are
+// interleaved in every byte, the most significant first, and make a two's
+// complement fraction.
+func (c *geometricCanvas) points(operands []byte) [][2]float64 {
+	bitsPerByte, axes := 3, 2
+	if c.threeD {
+		bitsPerByte, axes = 2, 3
+	}
+	var points [][2]float64
+	for ; len(operands) >= c.multiBytes; operands = operands[c.multiBytes:] {
+		var v [3]int
+		for _, b := range operands[:c.multiBytes] {
+			for axis := 0; axis < axes; axis++ {
+				shift := uint((axes - 1 - axis) * bitsPerByte)
+				v[axis] = v[axis]<<bitsPerByte | int(b>>shift)&(1<<bitsPerByte-1)
+			}
+		}
+		bits := c.multiBytes * bitsPerByte
+		var p [2]float64
+		for axis := 0; axis < 2; axis++ {
+			if v[axis]&(1<<(bits-1)) != 0 {
+				v[axis] -= 1 << bits
+			}
+			p[axis] = float64(v[axis]) / float64(int(1)<<(bits-1))
+		}
+		points = append(points, p)
+	}
+	return points
+}
+
+func (c *geometricCanvas) execute(op byte, operands []byte) {
+	switch op {
+	case pdiReset:
+		c.reset()
+		return
+	case pdiDomain:
+		// The single-value length in the lowest bits, the dimension,
+		// and the multi-value length. The logical pel size following
+		// is of no use for a bitmap.
+		if len(operands) != 0 {
+			c.threeD = operands[0]&0x04 != 0
+			c.multiBytes = int(operands[0]>>3&0x07) + 1
+		}
+		return
+	}
+	points := c.points(operands)
+	if len(points) == 0 {
+		return
+	}
+	set := false
+	relative := false
+	switch op {
+	case pdiPointSetAbs, pdiPointAbs, pdiLineAbs:
+	case pdiPointSetRel, pdiPointRel, pdiLineRel:
+		relative = true
+	case pdiLineSetAbs, pdiArcSetOutlined, pdiArcSetFilled:
+		set = true
+	case pdiLineSetRel, pdiRectSetOutlined, pdiRectSetFilled, pdiPolygonSetOutlined, pdiPolygonSetFilled:
+		set, relative = true, true
+	case pdiArcOutlined, pdiArcFilled:
+	case pdiRectOutlined, pdiRectFilled, pdiPolygonOutlined, pdiPolygonFilled:
+		relative = true
+	default:
+		return
+	}
+	if set {
+		// The first operand sets the drawing point absolutely.
+		c.x, c.y = points[0][0], points[0][1]
+		points = points[1:]
+	}
+	// path is the drawing point followed by the points of the operands.
+	path := [][2]float64{{c.x, c.y}}
+	for _, p := range points {
+		if relative {
+			last := path[len(path)-1]
+			p = [2]float64{last[0] + p[0], last[1] + p[1]}
+		}
+		path = append(path, p)
+	}
+	switch op {
+	case pdiPointSetAbs, pdiPointSetRel:
+	case pdiPointAbs, pdiPointRel:
+		for _, p := range path[1:] {
+			c.plot(c.pixel(p))
+		}
+	case pdiLineAbs, pdiLineRel, pdiLineSetAbs, pdiLineSetRel, pdiArcOutlined, pdiArcSetOutlined:
+		c.polyline(path)
+	case pdiArcFilled, pdiArcSetFilled, pdiPolygonFilled, pdiPolygonSetFilled:
+		c.fill(path)
+		c.polyline(append(path, path[0]))
+	case pdiPolygonOutlined, pdiPolygonSetOutlined:
+		c.polyline(append(path, path[0]))
+	case pdiRectOutlined, pdiRectFilled, pdiRectSetOutlined, pdiRectSetFilled:
+		if len(path) < 2 {
+			break
+		}
+		// The operand is the size, and the drawing point moves along
+		// the width.
+		x0, y0, x1, y1 := c.x, c.y, path[1][0], path[1][1]
+		corners := [][2]float64{{x0, y0}, {x1, y0}, {x1, y1}, {x0, y1}}
+		if op == pdiRectFilled || op == pdiRectSetFilled {
+			c.fillRect(x0, y0, x1, y1)
+		} else {
+			c.polyline(append(corners, corners[0]))
+		}
+		c.x = x1
+		return
+	}
+	last := path[len(path)-1]
+	c.x, c.y = last[0], last[1]
+}
+
+// pixel returns the pixel of the region that a point falls in.
+func (c *geometricCanvas) pixel(p [2]float64) (int, int) {
+	return int(math.Floor(p[0] * float64(c.width))), c.height - 1 - int(math.Floor(p[1]*float64(c.height)))
+}
+
+func (c *geometricCanvas) plot(x, y int) {
+	if x < 0 || y < 0 || x >= c.width || y >= c.height {
+		return
+	}
+	bit := y*c.width + x
+	c.pattern[bit/8] |= 0x80 >> (bit % 8)
+}
+
+// polyline draws the segments between the points with Bresenham's algorithm.
+func (c *geometricCanvas) polyline(path [][2]float64) {
+	for i := 1; i < len(path); i++ {
+		x0, y0 := c.pixel(path[i-1])
+		x1, y1 := c.pixel(path[i])
+		dx, dy := abs(x1-x0), -abs(y1-y0)
+		sx, sy := 1, 1
+		if x0 > x1 {
+			sx = -1
+		}
+		if y0 > y1 {
+			sy = -1
+		}
+		e := dx + dy
+		for {
+			c.plot(x0, y0)
+			if x0 == x1 && y0 == y1 {
+				break
+			}
+			e2 := 2 * e
+			if e2 >= dy {
+				e += dy
+				x0 += sx
+			}
+			if e2 <= dx {
+				e += dx
+				y0 += sy
+			}
+		}
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// fillRect fills the pixels whose centers are between the corners.
+func (c *geometricCanvas) fillRect(x0, y0, x1, y1 float64) {
+	c.fill([][2]float64{{x0, y0}, {x1, y0}, {x1, y1}, {x0, y1}})
+}
+
+// fill fills the pixels whose centers are inside the polygon by the even-odd
+// rule, a row at a time.
+func (c *geometricCanvas) fill(polygon [][2]float64) {
+	var crossings []float64
+	for y := 0; y < c.height; y++ {
+		py := (float64(c.height-1-y) + 0.5) / float64(c.height)
+		crossings = crossings[:0]
+		for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+			a, b := polygon[i], polygon[j]
+			if (a[1] > py) != (b[1] > py) {
+				crossings = append(crossings, a[0]+(py-a[1])*(b[0]-a[0])/(b[1]-a[1]))
+			}
+		}
+		sort.Float64s(crossings)
+		for k := 0; k+1 < len(crossings); k += 2 {
+			// The pixels whose centers are between the crossings
+			x0 := max(0, int(math.Ceil(crossings[k]*float64(c.width)-0.5)))
+			x1 := min(c.width, int(math.Ceil(crossings[k+1]*float64(c.width)-0.5)))
+			for x := x0; x < x1; x++ {
+				c.plot(x, y)
+			}
+		}
+	}
+}
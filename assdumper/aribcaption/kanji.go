@@ -0,0 +1,20 @@
+//go:build !xtext
+
+package aribcaption
+
+//go:generate go run gen_jis0208.go
+
+// decodeKanji returns the JIS X 0208 character of the 2-byte code c1 c2 given
+// in GL (0x21-0x7e). ok is false for unassigned codes, including the ARIB
+// additional kanji and symbols.
+func decodeKanji(c1, c2 byte) (rune, bool) {
+	if c1 < 0x21 || 0x7e < c1 || c2 < 0x21 || 0x7e < c2 {
+		return 0, false
+	}
+	i := int(c1-0x21)*94 + int(c2-0x21)
+	if i >= len(jis0208Table) {
+		return 0, false
+	}
+	r := jis0208Table[i]
+	return rune(r), r != 0
+}
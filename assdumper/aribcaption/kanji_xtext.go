@@ -0,0 +1,21 @@
+//go:build xtext
+
+package aribcaption
+
+import (
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/japanese"
+)
+
+// decodeKanji decodes c1 c2 with the EUC-JP decoder of golang.org/x/text. Build
+// with -tags xtext to compare its output with the embedded table.
+func decodeKanji(c1, c2 byte) (rune, bool) {
+	buf := make([]byte, 8)
+	ndst, _, err := japanese.EUCJP.NewDecoder().Transform(buf, []byte{c1 | 0x80, c2 | 0x80}, true)
+	if err != nil {
+		return 0, false
+	}
+	r, _ := utf8.DecodeRune(buf[:ndst])
+	return r, r != utf8.RuneError
+}
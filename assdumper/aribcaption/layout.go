@@ -0,0 +1,218 @@
+package aribcaption
+
+import "fmt"
+
+// The ASS output sets no PlayResX/PlayResY, so renderers lay it out on the
+// default script resolution of 384x288.
+const (
+	PlayResX = 384
+	PlayResY = 288
+)
+
+// The format HD captions commonly announce, on which the decoder lays out
+// statements until CSI says otherwise.
+const (
+	PlaneWidth        = 960
+	PlaneHeight       = 540
+	CharWidth         = 36
+	CharHeight        = 36
+	HorizontalSpacing = 4
+	VerticalSpacing   = 24
+)
+
+// captionLayout tracks the writing format set by CSI and the active position
+// set by APS, so that a statement is placed where the broadcaster put it on
+// the screen.
+// ARIB STD-B24 第一編 第2部 7.2.5
+type captionLayout struct {
+	// SWF
+	planeWidth  int
+	planeHeight int
+	// SDP
+	areaX int
+	areaY int
+	// SSM
+	charWidth  int
+	charHeight int
+	// SHS, SVS
+	horizontalSpacing int
+	verticalSpacing   int
+
+	row        int
+	positioned bool
+	// The active position on the plane, known once APS has set it
+	x, y    int
+	located bool
+}
+
+// newCaptionLayout returns the default format of HD captions.
+func newCaptionLayout() *captionLayout {
+	return &captionLayout{
+		planeWidth:        PlaneWidth,
+		planeHeight:       PlaneHeight,
+		areaX:             170,
+		areaY:             30,
+		charWidth:         CharWidth,
+		charHeight:        CharHeight,
+		horizontalSpacing: HorizontalSpacing,
+		verticalSpacing:   VerticalSpacing,
+	}
+}
+
+// clear forgets the position after CS, which starts a new screen.
+func (l *captionLayout) clear() {
+	l.positioned = false
+	l.located = false
+}
+
+// nextRow follows APR, which moves to the beginning of the next row.
+func (l *captionLayout) nextRow() {
+	l.row++
+	l.x = l.areaX
+	l.y += l.charHeight + l.verticalSpacing
+}
+
+// locate sets the active position to the character cell at row and col,
+// which are counted in cells of the current character size.
+func (l *captionLayout) locate(row, col int, size charSize) {
+	scale := size.scale(false)
+	l.x = l.areaX + col*(l.charWidth+l.horizontalSpacing)*scale[0]/100
+	l.y = l.areaY + row*(l.charHeight+l.verticalSpacing)*scale[1]/100
+	l.located = true
+}
+
+// advance moves the active position past a character of the size.
+func (l *captionLayout) advance(size charSize) {
+	l.x += (l.charWidth + l.horizontalSpacing) * size.scale(false)[0] / 100
+}
+
+// rubyStart returns the comment that starts a ruby run, which has the
+// active position in the ASS coordinates when APS has set it.
+func (l *captionLayout) rubyStart() string {
+	if !l.located {
+		return "{ruby}"
+	}
+	return fmt.Sprintf("{ruby %d,%d}", l.x*PlayResX/l.planeWidth, l.y*PlayResY/l.planeHeight)
+}
+
+// control applies a CSI control function and returns whether it was a
+// writing format one.
+func (l *captionLayout) control(params []int, final byte) bool {
+	switch final {
+	case 0x53:
+		// SWF
+		if len(params) == 0 {
+			return true
+		}
+		switch params[0] {
+		case 5:
+			l.planeWidth, l.planeHeight = 1920, 1080
+		case 7:
+			l.planeWidth, l.planeHeight = 960, 540
+		case 9:
+			l.planeWidth, l.planeHeight = 720, 480
+		}
+	case 0x5f:
+		// SDP
+		if len(params) >= 2 {
+			l.areaX, l.areaY = params[0], params[1]
+		}
+	case 0x57:
+		// SSM
+		if len(params) >= 2 {
+			l.charWidth, l.charHeight = params[0], params[1]
+		}
+	case 0x58:
+		// SHS
+		if len(params) >= 1 {
+			l.horizontalSpacing = params[0]
+		}
+	case 0x59:
+		// SVS
+		if len(params) >= 1 {
+			l.verticalSpacing = params[0]
+		}
+	case 0x56:
+		// SDF, the size of the display area, doesn't move the characters.
+	default:
+		return false
+	}
+	return true
+}
+
+// moveTo handles APS and returns the ASS to write for it. The first position
+// of a screen becomes a \pos override for the top left of the character
+// cell, and moving to another row later is a hard line break, since an ASS
+// line can only have one position.
+func (l *captionLayout) moveTo(row, col int, size charSize) string {
+	l.locate(row, col, size)
+	if !l.positioned {
+		l.positioned = true
+		l.row = row
+		return fmt.Sprintf("{\\an7\\pos(%d,%d)}", l.x*PlayResX/l.planeWidth, l.y*PlayResY/l.planeHeight)
+	}
+	if row != l.row {
+		l.row = row
+		return "\\N"
+	}
+	return ""
+}
+
+// parseCSI parses the control sequence following CSI in p and returns its
+// numeric parameters, its final byte and its length.
+// ARIB STD-B24 第一編 第2部 7.2.5.1
+func parseCSI(p []byte) (params []int, final byte, n int) {
+	param := 0
+	digits := false
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; {
+		case 0x30 <= c && c <= 0x39:
+			param = param*10 + int(c-0x30)
+			digits = true
+		case c == 0x3b:
+			params = append(params, param)
+			param, digits = 0, false
+		case c == 0x20:
+			// The intermediate byte precedes the final byte.
+			if digits {
+				params = append(params, param)
+			}
+			if i+1 < len(p) {
+				return params, p[i+1], i + 2
+			}
+			return params, 0, len(p)
+		default:
+			// Control functions without the intermediate byte
+			return params, c, i + 1
+		}
+	}
+	return params, 0, len(p)
+}
+
+// charSize is the character size set by SSZ, MSZ and NSZ.
+// ARIB STD-B24 第一編 第2部 表 7-16
+type charSize int
+
+const (
+	sizeNormal charSize = iota
+	sizeMiddle
+	sizeSmall
+)
+
+// scale returns the \fscx and \fscy to write a character in the size. MSZ
+// halves the width and SSZ both the width and the height. Alphanumerics and
+// JIS X0201 katakana are written as half-width characters already, so only
+// their height is scaled.
+func (size charSize) scale(narrow bool) [2]int {
+	x, y := 100, 100
+	switch size {
+	case sizeMiddle:
+		x = 50
+	case sizeSmall:
+		x, y = 50, 50
+	}
+	if narrow {
+		x = 100
+	}
+	return [2]int{x, y}
+}
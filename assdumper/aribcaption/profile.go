@@ -0,0 +1,63 @@
+package aribcaption
+
+// Profile is the profile of the caption coding. The services of
+// ISDB-T and BS use profile A, and the partial reception (1seg) service uses
+// profile C, which restricts the coding for mobile receivers.
+// ARIB STD-B24 第三編, ARIB TR-B14 第三分冊
+type Profile int
+
+const (
+	ProfileA Profile = iota
+	ProfileC
+)
+
+// data_component_id of the data component descriptor of a caption ES
+// ARIB STD-B10 第2部 付録 J
+const (
+	DataComponentCaption       = 0x0008
+	DataComponentMobileCaption = 0x0012
+)
+
+func (p Profile) String() string {
+	if p == ProfileC {
+		return "C"
+	}
+	return "A"
+}
+
+// graphicSets returns the initial state of the code sets. Profile C starts
+// with DRCS-1, alphanumeric, kanji and macro, with G1 in GL and G2 in GR.
+// ARIB STD-B24 第三編 第2部 付録
+func (p Profile) graphicSets() *graphicSets {
+	if p != ProfileC {
+		return newGraphicSets()
+	}
+	return &graphicSets{
+		g: [4]graphicSet{
+			{final: setDRCS0 + 1, dynamic: true, bytes: 1},
+			{final: setAlphanumeric, bytes: 1},
+			{final: setKanji, bytes: 2},
+			{final: setMacro, dynamic: true, bytes: 1},
+		},
+		gl: 1,
+		gr: 2,
+	}
+}
+
+// layout returns the writing format of the profile. Profile C has a fixed
+// format on a 320x180 plane, which statements don't announce.
+func (p Profile) layout() *captionLayout {
+	if p != ProfileC {
+		return newCaptionLayout()
+	}
+	return &captionLayout{
+		planeWidth:        320,
+		planeHeight:       180,
+		areaX:             0,
+		areaY:             0,
+		charWidth:         18,
+		charHeight:        18,
+		horizontalSpacing: 2,
+		verticalSpacing:   6,
+	}
+}
@@ -2,15 +2,20 @@ package main
 
 import (
 	"bufio"
-	"crypto/md5"
-	"encoding/hex"
+	"context"
+	"flag"
 	"fmt"
-	"golang.org/x/text/encoding/japanese"
 	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strings"
+	"syscall"
 	"time"
-	"unicode/utf8"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/aribcaption"
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
 )
 
 /*
@@ -18,56 +23,1011 @@ import (
 [ISO]: ISO/IEC 13818-1
 */
 
-const TS_PACKET_SIZE = 188
+// pidKind tells what the analyzer does with the packets of a PID.
+type pidKind uint8
+
+const (
+	pidIgnored pidKind = iota
+	pidPAT
+	pidPMT
+	pidSDT
+	pidTOT
+	pidEIT
+	pidCaption
+	pidSuperimpose
+	pidOtherCaption
+)
+
+func isPsiKind(kind pidKind) bool {
+	return pidPAT <= kind && kind <= pidEIT
+}
+
+// captionStream is the state of a caption or superimpose ES being decoded.
+// Both are made of the same data groups, but they are independent of each
+// other including their DRCS.
+type captionStream struct {
+	track        string
+	componentTag int
+	pid          int
+	payload      []byte
+	pcr          SystemClock
+	// offset is the byte offset of the packet that started payload, or -1
+	// for a packet pushed by Push.
+	offset int64
+	// session keeps the DRCS and the colors until management data of
+	// another data group. The profile of its Decoder is C for the caption
+	// ES of a 1seg service.
+	session aribcaption.Session
+}
 
+func newCaptionStream(track string, componentTag int, state *AnalyzerState) *captionStream {
+	return &captionStream{
+		track:        track,
+		componentTag: componentTag,
+		pid:          -1,
+		offset:       -1,
+		session: aribcaption.Session{
+			Decoder: aribcaption.Decoder{
+				DRCS:      make(map[uint16]string),
+				Unhandled: state.logUnhandled,
+				Gaiji:     state.gaiji,
+			},
+		},
+	}
+}
+
+// AnalyzerState is owned by the goroutine running its demux over the input,
+// and nothing else may touch it. Other goroutines get what they need through
+// emitted events, which are values that don't share memory with the state,
+// or through snapshot taken by the owner. With decoder, the sessions of the
+// caption streams, the counters of decoding, the DRCS tables and emit belong
+// to the decoding stage instead, which the owner reaches through decode.
 type AnalyzerState struct {
-	pmtPids           map[int]bool
-	pcrPid            int
-	captionPid        int
-	currentTimestamp  SystemClock
-	clockOffset       int64
-	previousSubtitle  string
-	previousIsBlank   bool
-	previousTimestamp SystemClock
-	preludePrinted    bool
-	captionPayload    []byte
+	demux            *tspacket.Demuxer
+	pmtPids          map[int]int
+	pcrPid           int
+	pmtPid           int
+	pmtVersion       int
+	dualMono         []string
+	programNumber    int
+	serviceId        int
+	serviceName      string
+	currentTimestamp SystemClock
+	// clock smooths PCR into currentTimestamp, counting packets by
+	// demux.
+	clock clockFilter
+	// resumed is set from an interruption of the input until the next PCR.
+	resumed bool
+	caption *captionStream
+	// runningStatus is the last running_status of each event_id in EIT[p/f].
+	runningStatus map[int]int
+	// superimpose is nil unless superimpose is extracted as well.
+	superimpose *captionStream
+	// otherCaption is the caption ES of the other language, nil unless
+	// both languages are extracted.
+	otherCaption *captionStream
+	// gaiji is the mapping of the additional symbols given to the decoders
+	// of every caption stream, which only read it.
+	gaiji  aribcaption.GaijiMap
+	drcsDB *drcsDB
+	// drcsCache records every DRCS glyph with the replacement chosen for
+	// it, and the replacements recorded there win over the others so that
+	// runs over many recordings agree.
+	drcsCache *drcsDB
+	// drcsPUA replaces the DRCS glyphs without a replacement with code
+	// points of the Private Use Area derived from their MD5.
+	drcsPUA bool
+	// drcsDrawings replaces the DRCS glyphs without a replacement with
+	// drawings of their bitmaps.
+	drcsDrawings bool
+	// drcsPNGDir is where -drcs-png writes the glyphs, named by their MD5.
+	drcsPNGDir string
+	// pesDump writes every caption PES for -dump-pes, unless nil.
+	pesDump *pesDumper
+	// drcsPatterns emits the DRCS glyphs as DRCSPattern events for the
+	// compositor, which draws them in place of the {drcs MD5} comments.
+	drcsPatterns bool
+	// crcErrors counts PSI/SI sections skipped for CRC_32 errors.
+	crcErrors int
+	// scrambledPids are the PIDs already warned of as scrambled.
+	scrambledPids map[int]bool
+	// captionCRCErrors counts caption data groups with CRC_16 errors, and
+	// unhandledCodes the codes the decoders couldn't handle.
+	captionCRCErrors int
+	unhandledCodes   int
+	// emptyPes counts caption PES carrying no data unit, which some
+	// encoders send as filler.
+	emptyPes int
+	// retransmissions counts caption statements skipped as retransmitted,
+	// or as left over from the other of group A and B.
+	retransmissions int
+	// skippedUnits counts the data units not decoded by data_unit_parameter.
+	skippedUnits map[byte]int
+	// unhandled counts the codes the decoders couldn't handle and the
+	// unmapped DRCS for -report, and is nil without it.
+	unhandled *unhandledReport
+	// tableVersions is the last version_number of each section, tracked
+	// only when TableUpdate events are wanted.
+	tableVersions map[sectionKey]int
+	// emit is called on the decoding stage, and the events found while
+	// demuxing are given to send.
+	emit func(Event)
+	// clockTick is called, unless nil, on the decoding stage with a
+	// snapshot at every new currentTimestamp.
+	clockTick func(analyzerSnapshot)
+	// decoder decodes the captions on a goroutine of its own, or is nil
+	// to decode them on the goroutine feeding packets.
+	decoder *decodeStage
+}
+
+// inputInterrupted tells that the input reconnected and packets of every
+// PID may have been lost.
+func (state *AnalyzerState) inputInterrupted() {
+	state.demux.Interrupted()
+	state.clock.reset()
+	state.resumed = true
+}
+
+// sectionKey identifies a section of a PSI/SI table in the stream.
+type sectionKey struct {
+	pid              int
+	tableId          int
+	tableIdExtension int
+	sectionNumber    int
+}
+
+// analyzerSnapshot is an immutable copy of what AnalyzerState has found so
+// far, which the owner may hand to other goroutines. The PIDs are -1 until
+// found. The counters of decoding are of the captions decoded by the time
+// the snapshot was taken, which may lag behind demuxing.
+type analyzerSnapshot struct {
+	ProgramNumber   int
+	ServiceName     string
+	PcrPid          int
+	CaptionPid      int
+	SuperimposePid  int
+	OtherCaptionPid int
+	// Language is ISO_639_language_code of the first caption language in
+	// the management data, or empty before it.
+	Language string
+	// Clock is currentTimestamp, and Offset the byte offset of the last
+	// packet, or -1 for a pushed one. Processed is the bytes of the input
+	// demuxed so far, or 0 for pushed packets.
+	Clock     SystemClock
+	Offset    int64
+	Processed int64
+
+	Packets          int64
+	ContinuityErrors int
+	ScrambledPackets int64
+	SectionCRCErrors int
+	CaptionCRCErrors int
+	UnhandledCodes   int
+	Retransmissions  int
+}
+
+// snapshot takes a snapshot while the decoding stage is idle, such as
+// before and after analyzing an input.
+func (state *AnalyzerState) snapshot() analyzerSnapshot {
+	s := state.demuxSnapshot()
+	state.decodeSnapshot(&s)
+	return s
+}
+
+// demuxSnapshot is the part of the snapshot that demuxing owns.
+func (state *AnalyzerState) demuxSnapshot() analyzerSnapshot {
+	s := analyzerSnapshot{
+		ProgramNumber:    state.programNumber,
+		ServiceName:      state.serviceName,
+		PcrPid:           state.pcrPid,
+		CaptionPid:       state.caption.pid,
+		SuperimposePid:   -1,
+		OtherCaptionPid:  -1,
+		Clock:            state.currentTimestamp,
+		Offset:           state.demux.Position().Offset,
+		Packets:          state.demux.Packets(),
+		ContinuityErrors: state.demux.ContinuityErrors(),
+		ScrambledPackets: state.demux.ScrambledPackets(),
+		SectionCRCErrors: state.crcErrors,
+	}
+	if s.Offset >= 0 {
+		s.Processed = s.Offset + int64(state.demux.PacketSize())
+	}
+	if state.superimpose != nil {
+		s.SuperimposePid = state.superimpose.pid
+	}
+	if state.otherCaption != nil {
+		s.OtherCaptionPid = state.otherCaption.pid
+	}
+	return s
+}
+
+// decodeSnapshot fills in the part of the snapshot that the decoding stage
+// owns, on the decoding stage.
+func (state *AnalyzerState) decodeSnapshot(s *analyzerSnapshot) {
+	s.Language = state.caption.session.Languages[0]
+	s.CaptionCRCErrors = state.captionCRCErrors
+	s.UnhandledCodes = state.unhandledCodes
+	s.Retransmissions = state.retransmissions
+}
+
+func newAnalyzerState() *AnalyzerState {
+	state := new(AnalyzerState)
+	state.pcrPid = -1
+	state.pmtPid = -1
+	state.pmtVersion = -1
+	state.serviceId = -1
+	state.runningStatus = make(map[int]int)
+	state.skippedUnits = make(map[byte]int)
+	state.scrambledPids = make(map[int]bool)
+	state.clock = rawClock{}
+	state.caption = newCaptionStream("", 0x87, state)
+	state.demux = tspacket.NewDemuxer(nil)
+	state.demux.ContinuityError = func(pid, previous, current int) {
+		if debugMode() {
+			fmt.Fprintf(os.Stderr, "continuity_counter gap at %v: %d -> %d\n", state.demux.Position(), previous, current)
+		}
+	}
+	state.demux.Scrambled = state.warnScrambled
+	state.setPIDKind(0x0000, pidPAT)
+	state.setPIDKind(0x0011, pidSDT)
+	state.setPIDKind(0x0012, pidEIT)
+	state.setPIDKind(0x0014, pidTOT)
+	return state
+}
+
+// warnScrambled tells as soon as a PID the analyzer reads turns out to be
+// scrambled, since the captions of a recording not descrambled would
+// silently come out empty.
+func (state *AnalyzerState) warnScrambled(pid int) {
+	if state.scrambledPids[pid] {
+		return
+	}
+	state.scrambledPids[pid] = true
+	name := "PID"
+	for _, stream := range []*captionStream{state.caption, state.superimpose, state.otherCaption} {
+		if stream != nil && stream.pid == pid {
+			name = "Caption PID"
+			if stream == state.superimpose {
+				name = "Superimpose PID"
+			}
+		}
+	}
+	at := ""
+	if offset := state.demux.Position().Offset; offset != -1 {
+		at = fmt.Sprintf(" at offset %d", offset)
+	}
+	fmt.Fprintf(os.Stderr, "%s 0x%04x is scrambled%s: decode the recording with b25 first\n", name, pid, at)
+}
+
+// setPIDKind hands the packets of pid to the analyzer by kind, or stops
+// handling them with pidIgnored.
+func (state *AnalyzerState) setPIDKind(pid int, kind pidKind) {
+	var stream *captionStream
+	switch kind {
+	case pidCaption:
+		stream = state.caption
+	case pidSuperimpose:
+		stream = state.superimpose
+	case pidOtherCaption:
+		stream = state.otherCaption
+	}
+	if isPsiKind(kind) {
+		state.demux.HandleSections(pid, func(section []byte) {
+			handleSection(pid, kind, section, state)
+		})
+	} else {
+		state.demux.HandleSections(pid, nil)
+	}
+	if stream != nil {
+		state.demux.HandlePayload(pid, func(payload []byte, start, gap bool) {
+			assembleCaption(payload, start, gap, stream, state)
+		})
+	} else {
+		state.demux.HandlePayload(pid, nil)
+	}
 }
 
 type SystemClock int64
 
 func main() {
-	if len(os.Args) == 1 {
-		fmt.Fprintf(os.Stderr, "usage: %s MPEG2-TS-FILE\n", os.Args[0])
-		os.Exit(1)
+	// Registered first to run last, once the other deferred calls have
+	// cleaned up.
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+	// SIGINT and SIGTERM stop reading the input, and what was read so far
+	// is still written out. Another signal kills assdumper as usual.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	context.AfterFunc(ctx, stop)
+
+	if c := findSubcommand(os.Args[1:]); c != nil {
+		c.run(ctx, os.Args[2:])
+		return
 	}
-	fin, err := os.Open(os.Args[1])
-	if err != nil {
+
+	outputPath := flag.String("o", "", "write subtitles to `FILE` instead of stdout, or into it named after the program in EIT when it's a directory")
+	eventsPath := flag.String("events", "", "write the intermediate event log to `FILE` as JSON Lines")
+	twoPass := flag.Bool("two-pass", false, "collect the whole event log before rendering, for exact timing of the first captions")
+	live := flag.Bool("live", false, "write every Dialogue line to stdout as soon as its end is known, for live inputs")
+	liveHold := flag.Duration("live-hold", 10*time.Second, "with -live, write a caption on the screen for `DURATION` without waiting for the next one, continuing it in another line")
+	gaijiUnicode := flag.Bool("gaiji-unicode", false, "decode the ARIB additional symbols to their Unicode code points (🈟, ㊙, ...) instead of spellings like 【新】 and （秘）")
+	gaijiMapPath := flag.String("gaiji-map", "", "decode the additional symbols and kanji with the JSON mapping in `FILE` on top of the built-in one")
+	drcsPUA := flag.Bool("drcs-pua", false, "replace the DRCS glyphs that can't be replaced with a code point of the Private Use Area derived from their MD5, recorded in -drcs-cache")
+	drcsDraw := flag.Bool("drcs-draw", false, "draw the DRCS glyphs that can't be replaced from their bitmaps with inline ASS drawings, instead of dropping them")
+	drcsPNGDir := flag.String("drcs-png", "", "write every DRCS glyph to `DIR` as a PNG named by the MD5 that -drcs-db and drcs-label use")
+	dumpPES := flag.String("dump-pes", "", "write every reassembled caption and superimpose PES to numbered files in `DIR`, listed in DIR/index.tsv with their PIDs, byte offsets, PCR and PTS")
+	drcsDBPath := flag.String("drcs-db", "", "replace DRCS glyphs labeled in `FILE` and record the unknown ones there")
+	drcsCachePath := flag.String("drcs-cache", "", "record every DRCS glyph with its replacement in `FILE`, and replace the glyphs recorded there the same way in later runs")
+	serviceId := flag.Int("service", -1, "extract captions of the program whose program_number (service_id) is `N`")
+	listServices := flag.Bool("list-services", false, "list the services of the input and exit")
+	remuxService := flag.Int("remux-service", -1, "write a TS of the program whose program_number (service_id) is `N` alone to -o instead of subtitles, as the remux subcommand does")
+	lang := flag.Int("lang", 1, "extract the `N`th caption language (1 or 2)")
+	componentTag := flag.Int("component-tag", 0, "extract the caption ES with component_tag `TAG` (e.g. 0x88), overriding -lang")
+	chaptersPath := flag.String("chapters", "", "write caption sessions as chapters to `FILE`, in JSON if it ends with .json and in FFMETADATA otherwise")
+	report := flag.Bool("report", false, "summarize the unhandled control codes, unknown gaiji and unmapped DRCS with their counts at the end, instead of logging them one by one")
+	glyphReportPath := flag.String("glyph-report", "", "write every character of the captions with its count to `FILE`, to subset fonts")
+	metadataFrom := flag.String("metadata-from", "", "title the outputs and the manifest with the program of the recording fetched from `URL`, epgstation://HOST:PORT/recorded/ID or mirakurun://HOST:PORT/programs/ID")
+	manifestPath := flag.String("manifest", "", "write the service and the actual start and end of programs from EIT running_status to `FILE` as JSON")
+	burnIn := flag.String("burn-in", "", "composite the captions onto transparent frames for burning into video, as PNG files listed in `DEST`/captions.ffconcat, or as raw video to DEST (- for stdout) with -burn-in-format rgba")
+	burnInFormat := flag.String("burn-in-format", "png", "write the -burn-in frames as `FORMAT`: png or rgba")
+	burnInSize := flag.String("burn-in-size", "1920x1080", "composite the -burn-in frames at `WIDTHxHEIGHT`")
+	burnInRate := flag.String("burn-in-rate", "30000/1001", "write the rgba -burn-in frames at `RATE` frames per second")
+	burnInFont := flag.String("burn-in-font", "", "draw the -burn-in text with the TrueType or OpenType font `FILE`")
+	superimposePath := flag.String("superimpose", "", "write superimpose (字幕スーパー) of the same language to `FILE` as another ASS")
+	format := flag.String("format", "ass", "write the captions as `FORMAT`: "+strings.Join(formatNames(), ", ")+" (SSA v4 for old players, dropping the override tags SSA lacks)")
+	ssa := flag.Bool("ssa", false, "same as -format ssa")
+	rubyMode := flag.String("ruby", "layer", "show ruby (furigana) as `MODE`: layer, over the base text on a Dialogue line of its own, or paren, in parentheses")
+	multiLang := flag.String("multilang", "", "extract both caption languages, written by `MODE`: single-file, into one ASS with a style (JPN, ENG, ...) and layers per language, or separate-files, into a file per language named after -o (e.g. news.jpn.ass)")
+	tableUpdates := flag.Bool("table-updates", false, "add an event to the -events log for every new version of PAT, PMT, SDT, EIT[p/f] and for every TOT")
+	clockFilterName := flag.String("clock-filter", "raw", "smooth jittery PCR from noisy tuners with `FILTER`: raw, median or pll")
+	metricsAddr := flag.String("metrics", "", "serve the counters of packets, errors and captions and the stream latency on http://`ADDR`/metrics for Prometheus, and the profiles of net/http/pprof on /debug/pprof/")
+	summaryPath := flag.String("summary", "", "write the number of captions and errors tolerated and the exit code to `FILE` as JSON at the end")
+	cpuProfile := flag.String("cpuprofile", "", "write a CPU profile to `FILE`")
+	memProfile := flag.String("memprofile", "", "write a heap profile to `FILE` at the end")
+	progress := flag.Bool("progress", false, "report the bytes processed, the percentage, the speed and the stream time to stderr every 5 seconds")
+	sample := flag.String("sample", "", "only decode windows spread across the input and report them, e.g. `every=10m,window=30s`")
+	inputOpts := registerInputFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [-o FILE] [-superimpose FILE] [-service N] [-lang N] [MPEG2-TS-FILE|URL]...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [-o FILE] -listen udp://ADDR:PORT\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s -remux-service N [-o FILE.ts] [MPEG2-TS-FILE|URL]...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s SUBCOMMAND [FLAGS] [ARGS]\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Reads from stdin when MPEG2-TS-FILE is omitted or is -.")
+		fmt.Fprintln(os.Stderr, "Several inputs are processed as one stream, e.g. a recording split into files.")
+		flag.PrintDefaults()
+		printSubcommands(os.Stderr, os.Args[0])
+	}
+	flag.Parse()
+	inputs := flag.Args()
+	if len(inputs) == 0 {
+		inputs = []string{""}
+	}
+	captionTag := *componentTag
+	if captionTag == 0 {
+		if *lang != 1 && *lang != 2 {
+			fmt.Fprintln(os.Stderr, "-lang must be 1 or 2")
+			os.Exit(2)
+		}
+		captionTag = 0x86 + *lang
+	}
+	if *ssa {
+		*format = "ssa"
+	}
+	if err := checkFormat(*format); err != nil {
+		fmt.Fprintf(os.Stderr, "-format: %v\n", err)
+		os.Exit(2)
+	}
+	if *rubyMode != "layer" && *rubyMode != "paren" {
+		fmt.Fprintln(os.Stderr, "-ruby must be layer or paren")
+		os.Exit(2)
+	}
+	if *multiLang != "" && *multiLang != "single-file" && *multiLang != "separate-files" {
+		fmt.Fprintln(os.Stderr, "-multilang must be single-file or separate-files")
+		os.Exit(2)
+	}
+	if *live && (*outputPath != "" || *twoPass || *multiLang != "") {
+		fmt.Fprintln(os.Stderr, "-live writes a single language to stdout as it goes, and can't be used with -o, -two-pass or -multilang")
+		os.Exit(2)
+	}
+	if *live && *liveHold < 10*time.Millisecond {
+		fmt.Fprintln(os.Stderr, "-live-hold must be at least 10ms")
+		os.Exit(2)
+	}
+	if *multiLang == "separate-files" {
+		if info, err := os.Stat(*outputPath); *outputPath == "" || err == nil && info.IsDir() {
+			fmt.Fprintln(os.Stderr, "-multilang separate-files needs -o FILE to name the files after")
+			os.Exit(2)
+		}
+	}
+	var burnInWidth, burnInHeight int
+	var burnInNum, burnInDen int64
+	var burnInFace captionFont
+	if *burnIn != "" {
+		var err error
+		if *burnInFormat != "png" && *burnInFormat != "rgba" {
+			fmt.Fprintln(os.Stderr, "-burn-in-format must be png or rgba")
+			os.Exit(2)
+		}
+		if *burnInFormat == "rgba" && *burnIn == "-" && *outputPath == "" {
+			fmt.Fprintln(os.Stderr, "-burn-in - needs -o FILE, since the subtitles are written to stdout")
+			os.Exit(2)
+		}
+		if burnInWidth, burnInHeight, err = parseFrameSize(*burnInSize); err != nil {
+			fmt.Fprintf(os.Stderr, "-burn-in-size: %v\n", err)
+			os.Exit(2)
+		}
+		if burnInNum, burnInDen, err = parseFrameRate(*burnInRate); err != nil {
+			fmt.Fprintf(os.Stderr, "-burn-in-rate: %v\n", err)
+			os.Exit(2)
+		}
+		if *burnInFont == "" {
+			fmt.Fprintln(os.Stderr, "-burn-in needs -burn-in-font FILE to draw text with")
+			os.Exit(2)
+		}
+		if burnInFace, err = loadCaptionFont(*burnInFont); err != nil {
+			fmt.Fprintf(os.Stderr, "-burn-in-font: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	if _, err := newClockFilter(*clockFilterName); err != nil {
+		fmt.Fprintf(os.Stderr, "-clock-filter: %v\n", err)
+		os.Exit(2)
+	}
+	gaiji := aribcaption.DefaultGaijiMap()
+	if *gaijiUnicode {
+		gaiji.UseUnicode()
+	}
+	if *gaijiMapPath != "" {
+		if err := gaiji.Load(*gaijiMapPath); err != nil {
+			panic(err)
+		}
+	}
+	newState := func() *AnalyzerState {
+		state := newAnalyzerState()
+		state.gaiji = gaiji
+		state.caption.session.Decoder.Gaiji = gaiji
+		state.clock, _ = newClockFilter(*clockFilterName)
+		state.serviceId = *serviceId
+		state.caption.componentTag = captionTag
+		return state
+	}
+
+	stopProfiles := startProfiles(*cpuProfile, *memProfile)
+	defer stopProfiles()
+
+	if *listServices {
+		printServices(scanServices(ctx, inputs[0], inputOpts), false)
+		return
+	}
+	if *remuxService != -1 {
+		remux(ctx, inputs, inputOpts, *remuxService, *outputPath)
+		return
+	}
+	if *sample != "" {
+		spec, err := parseSampleSpec(*sample)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		for _, path := range inputs {
+			if len(inputs) > 1 {
+				fmt.Println(path)
+			}
+			runSample(ctx, os.Stdout, path, spec, newState)
+		}
+		return
+	}
+
+	var err error
+	state := newState()
+	if *tableUpdates {
+		state.tableVersions = make(map[sectionKey]int)
+	}
+	state.drcsPUA = *drcsPUA
+	if *report {
+		state.unhandled = newUnhandledReport()
+	}
+	state.drcsDrawings = *drcsDraw
+	if *drcsPNGDir != "" {
+		if err := os.MkdirAll(*drcsPNGDir, 0755); err != nil {
+			panic(err)
+		}
+		state.drcsPNGDir = *drcsPNGDir
+	}
+	if *dumpPES != "" {
+		state.pesDump, err = newPESDumper(*dumpPES)
+		if err != nil {
+			panic(err)
+		}
+		defer state.pesDump.index.Abort()
+	}
+	if *drcsDBPath != "" {
+		state.drcsDB, err = loadDRCSDB(*drcsDBPath)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if *drcsCachePath != "" {
+		state.drcsCache, err = loadDRCSDB(*drcsCachePath)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	var metadata *recordingMetadata
+	if *metadataFrom != "" {
+		metadata, err = fetchMetadata(*metadataFrom, inputOpts.httpTimeout)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	newRenderer := func(w io.Writer) *assRenderer {
+		r := newFormatRenderer(w, *format)
+		if *format == "ssa" {
+			r = newSSARenderer(w)
+		}
+		if *rubyMode == "paren" {
+			r.rubyParen = true
+		}
+		if *live {
+			r.liveHold = int64(*liveHold / (10 * time.Millisecond))
+		}
+		if metadata != nil {
+			// The name of the program wins over the service name of SDT.
+			r.title = metadata.Name
+			r.info = metadata.scriptInfo()
+		}
+		return r
+	}
+	newMainRenderer := func(w io.Writer) captionRenderer {
+		if *multiLang == "single-file" {
+			return newMultiLanguageRenderer(w, newRenderer)
+		}
+		return newRenderer(w)
+	}
+	var fout *atomicFile
+	var renderer captionRenderer
+	var namer *outputNamer
+	if *outputPath == "" {
+		renderer = newMainRenderer(os.Stdout)
+	} else if *multiLang == "separate-files" {
+		files := newLanguageFileRenderer(*outputPath, newRenderer)
+		defer files.Abort()
+		renderer = files
+	} else {
+		path := *outputPath
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			// The file is renamed on commit, once EIT has been read.
+			namer = &outputNamer{extension: "." + *format}
+			path = filepath.Join(path, "assdumper"+namer.extension)
+		}
+		fout, err = createAtomicFile(path)
+		if err != nil {
+			panic(err)
+		}
+		defer fout.Abort()
+		renderer = newMainRenderer(fout)
+	}
+	if *multiLang != "" {
+		// [TR-B14] The other language is carried in the ES of the other
+		// component_tag, if not in the same ES.
+		switch captionTag {
+		case 0x87:
+			state.otherCaption = newCaptionStream("other", 0x88, state)
+		case 0x88:
+			state.otherCaption = newCaptionStream("other", 0x87, state)
+		}
+	}
+	var superimposeOut *atomicFile
+	var superimposeRenderer *assRenderer
+	if *superimposePath != "" {
+		// [TR-B14] component_tag 0x89 and 0x8a are the superimpose of the
+		// first and the second language.
+		superimposeTag := 0x89
+		if captionTag == 0x88 {
+			superimposeTag = 0x8a
+		}
+		state.superimpose = newCaptionStream("superimpose", superimposeTag, state)
+		superimposeOut, err = createAtomicFile(*superimposePath)
+		if err != nil {
+			panic(err)
+		}
+		defer superimposeOut.Abort()
+		superimposeRenderer = newRenderer(superimposeOut)
+	}
+	// Clock and table events go to every renderer, captions and sessions
+	// only to the renderer of their track.
+	render := func(ev Event) {
+		track, tracked := "", false
+		switch ev := ev.(type) {
+		case CaptionUnit:
+			track, tracked = ev.Track, true
+		case CaptionSession:
+			track, tracked = ev.Track, true
+		}
+		if !tracked || track == "" || track == "other" {
+			renderer.handle(ev)
+		}
+		if superimposeRenderer != nil && (!tracked || track == "superimpose") {
+			superimposeRenderer.handle(ev)
+		}
+	}
+
+	var eventLog *eventLogWriter
+	if *eventsPath != "" {
+		f, err := os.Create(*eventsPath)
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		w := bufio.NewWriter(f)
+		defer w.Flush()
+		eventLog = newEventLogWriter(w)
+	}
+
+	var chapters *chapterWriter
+	if *chaptersPath != "" {
+		chapters = new(chapterWriter)
+	}
+	var glyphs *glyphCounter
+	if *glyphReportPath != "" {
+		glyphs = newGlyphCounter(state.gaiji)
+	}
+	var compositor *captionCompositor
+	if *burnIn != "" {
+		var sink frameSink
+		if *burnInFormat == "png" {
+			pngSink, err := newPNGFrameSink(*burnIn)
+			if err != nil {
+				panic(err)
+			}
+			defer pngSink.Abort()
+			sink = pngSink
+		} else {
+			w := io.Writer(os.Stdout)
+			if *burnIn != "-" {
+				f, err := os.Create(*burnIn)
+				if err != nil {
+					panic(err)
+				}
+				defer f.Close()
+				w = f
+			}
+			sink = newRawFrameSink(w, burnInNum, burnInDen, burnInWidth, burnInHeight)
+		}
+		compositor = newCaptionCompositor(sink, burnInFace, burnInWidth, burnInHeight)
+		state.drcsPatterns = true
+	}
+	var manifest *manifestWriter
+	if *manifestPath != "" {
+		manifest = newManifestWriter()
+		manifest.manifest.Recording = metadata
+	}
+	var metrics *metricsExporter
+	if *metricsAddr != "" {
+		metrics, err = serveMetrics(*metricsAddr)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	summary := &runSummary{Inputs: inputs}
+	var events []Event
+	state.emit = func(ev Event) {
+		summary.handle(ev)
+		if eventLog != nil {
+			if err := eventLog.write(ev); err != nil {
+				panic(err)
+			}
+		}
+		if chapters != nil {
+			chapters.handle(ev)
+		}
+		if glyphs != nil {
+			glyphs.handle(ev)
+		}
+		if compositor != nil {
+			compositor.handle(ev)
+		}
+		if manifest != nil {
+			manifest.handle(ev)
+		}
+		if namer != nil {
+			namer.handle(ev)
+		}
+		if metrics != nil {
+			metrics.handle(ev)
+		}
+		if *twoPass {
+			events = append(events, ev)
+		} else {
+			render(ev)
+		}
+	}
+
+	var progressReport *progressReporter
+	if *progress {
+		progressReport = newProgressReporter(inputs, state)
+	}
+	if *live || progressReport != nil || metrics != nil {
+		state.clockTick = func(snapshot analyzerSnapshot) {
+			clock := snapshot.Clock
+			if *live {
+				renderer.(*assRenderer).advance(clock)
+				if superimposeRenderer != nil {
+					superimposeRenderer.advance(clock)
+				}
+			}
+			if progressReport != nil {
+				progressReport.tick(snapshot)
+			}
+			if metrics != nil {
+				metrics.tick(snapshot)
+			}
+		}
+	}
+
+	// Captions are decoded and rendered on a stage of their own, which is
+	// caught up with before the state is read between the inputs.
+	state.decoder = startDecodeStage()
+	for _, path := range inputs {
+		err := analyzeInput(ctx, path, inputOpts, state)
+		state.decoder.wait()
+		if err != nil && ctx.Err() == nil {
+			// The outputs are left uncommitted as the input is.
+			fmt.Fprintln(os.Stderr, err)
+			state.decoder.stop()
+			exitCode = summary.finish(state, err)
+			if *summaryPath != "" {
+				if err := writeSummary(*summaryPath, summary); err != nil {
+					panic(err)
+				}
+			}
+			return
+		}
+		if progressReport != nil {
+			progressReport.nextInput()
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	state.decoder.stop()
+	state.decoder = nil
+	if progressReport != nil {
+		progressReport.report()
+	}
+
+	if *twoPass {
+		renderer.prepare(events)
+		if superimposeRenderer != nil {
+			superimposeRenderer.prepare(events)
+		}
+		for _, ev := range events {
+			render(ev)
+		}
+	}
+
+	if err := renderer.Flush(); err != nil {
 		panic(err)
 	}
-	defer func() {
-		if err := fin.Close(); err != nil {
+	if state.drcsDB != nil {
+		if err := state.drcsDB.save(); err != nil {
 			panic(err)
 		}
-	}()
+	}
+	if state.drcsCache != nil {
+		if err := state.drcsCache.save(); err != nil {
+			panic(err)
+		}
+	}
+	if state.pesDump != nil {
+		if err := state.pesDump.close(); err != nil {
+			panic(err)
+		}
+	}
+	if state.crcErrors != 0 {
+		fmt.Fprintf(os.Stderr, "Skipped %d sections with CRC_32 errors\n", state.crcErrors)
+	}
+	if state.demux.ScrambledPackets() != 0 {
+		fmt.Fprintf(os.Stderr, "Dropped %d scrambled packets\n", state.demux.ScrambledPackets())
+	}
+	if state.demux.ContinuityErrors() != 0 || state.demux.Duplicates() != 0 {
+		fmt.Fprintf(os.Stderr, "Found %d continuity_counter gaps and %d duplicate packets\n", state.demux.ContinuityErrors(), state.demux.Duplicates())
+	}
+	reportSkippedUnits(state.skippedUnits)
+	if state.unhandled != nil {
+		state.unhandled.write(os.Stderr)
+	}
+	if state.emptyPes != 0 && debugMode() {
+		fmt.Fprintf(os.Stderr, "Skipped %d empty caption PES\n", state.emptyPes)
+	}
+	if state.retransmissions != 0 && debugMode() {
+		fmt.Fprintf(os.Stderr, "Skipped %d retransmitted caption statements\n", state.retransmissions)
+	}
+	if fout != nil {
+		if namer != nil {
+			fout.path = filepath.Join(*outputPath, namer.name(inputs[0]))
+		}
+		if err := fout.Commit(); err != nil {
+			panic(err)
+		}
+		if namer != nil {
+			fmt.Fprintf(os.Stderr, "Wrote %s\n", fout.path)
+		}
+	}
+	if superimposeRenderer != nil {
+		if err := superimposeRenderer.Flush(); err != nil {
+			panic(err)
+		}
+		if err := superimposeOut.Commit(); err != nil {
+			panic(err)
+		}
+	}
+	if chapters != nil {
+		chapters.finish(state.currentTimestamp)
+		if err := writeChapters(*chaptersPath, chapters); err != nil {
+			panic(err)
+		}
+	}
+	if compositor != nil {
+		if err := compositor.finish(state.currentTimestamp); err != nil {
+			panic(err)
+		}
+	}
+	if glyphs != nil {
+		if err := writeGlyphReport(*glyphReportPath, glyphs); err != nil {
+			panic(err)
+		}
+	}
+	if manifest != nil {
+		if err := writeManifest(*manifestPath, manifest); err != nil {
+			panic(err)
+		}
+	}
+	if exitCode = summary.finish(state, nil); exitCode == exitNoCaptions {
+		if state.demux.ScrambledPackets() != 0 {
+			fmt.Fprintln(os.Stderr, "No captions found, as the stream is scrambled: decode the recording with b25 first")
+		} else {
+			fmt.Fprintln(os.Stderr, "No captions found")
+		}
+	}
+	if *summaryPath != "" {
+		if err := writeSummary(*summaryPath, summary); err != nil {
+			panic(err)
+		}
+	}
+}
 
-	reader := bufio.NewReader(fin)
+func writeChapters(path string, chapters *chapterWriter) error {
+	f, err := createAtomicFile(path)
+	if err != nil {
+		return err
+	}
+	defer f.Abort()
+	if filepath.Ext(path) == ".json" {
+		err = chapters.writeJSON(f)
+	} else {
+		err = chapters.writeFFMetadata(f)
+	}
+	if err != nil {
+		return err
+	}
+	return f.Commit()
+}
 
-	buf := make([]byte, TS_PACKET_SIZE)
-	state := new(AnalyzerState)
-	state.pcrPid = -1
-	state.captionPid = -1
+// analyzeInput feeds the packets of one input to the analyzer until its end
+// or until ctx is done. A caption PES cut off at the end of the input is
+// decoded as is rather than glued to whatever the next input starts with.
+func analyzeInput(ctx context.Context, path string, opts *inputOptions, state *AnalyzerState) error {
+	fin, err := openInput(ctx, path, opts)
+	if err != nil {
+		return err
+	}
+	return analyzeStream(ctx, fin, state)
+}
+
+// analyzeStream is analyzeInput of an input already opened, which it closes.
+func analyzeStream(ctx context.Context, fin io.ReadCloser, state *AnalyzerState) error {
+	if in, ok := fin.(*httpInput); ok {
+		in.onResume = state.inputInterrupted
+	}
+	err := demuxInput(ctx, state.demux, fin)
+	if cerr := fin.Close(); err == nil {
+		err = cerr
+	}
+	for _, stream := range []*captionStream{state.caption, state.superimpose, state.otherCaption} {
+		if stream != nil && len(stream.payload) != 0 {
+			dumpCaption(stream.payload, stream, state)
+			stream.payload = stream.payload[:0]
+		}
+	}
+	return err
+}
 
+// demuxInput runs demux over r until its end, until ctx is done or until a
+// handler stops it. A resumable input is resumed when a read fails, dropping
+// the packet cut short along with what is being assembled, and a packet cut
+// short at the end of the input is ignored.
+func demuxInput(ctx context.Context, demux *tspacket.Demuxer, r io.Reader) error {
+	demux.Reset(r)
+	if size := demux.PacketSize(); size != tspacket.Size {
+		fmt.Fprintf(os.Stderr, "Detected %d-byte packets\n", size)
+	}
+	var err error
 	for {
-		err := readFull(reader, buf)
-		if err == io.EOF {
+		err = demux.Run(ctx)
+		resumable, ok := r.(resumableInput)
+		if !ok || err == nil || err == tspacket.ErrSync || ctx.Err() != nil {
 			break
 		}
-		if err != nil {
-			panic(err)
+		if err = resumable.resume(err); err != nil {
+			break
 		}
+		// The new connection starts on a packet boundary.
+		demux.Interrupted()
+		demux.Reset(r)
+	}
+	if err == tspacket.ErrSync {
+		return fmt.Errorf("%w at offset %d", err, demux.Position().Offset)
+	}
+	if err == io.ErrUnexpectedEOF {
+		// Piped input (e.g. an interrupted recpt1) may stop in the
+		// middle of a packet.
+		fmt.Fprintln(os.Stderr, "Ignoring truncated packet at end of input")
+		return nil
+	}
+	return err
+}
+
+// atomicFile is written under a temporary name in the destination directory
+// and renamed to its final path on Commit, so that an interrupted run never
+// leaves a truncated subtitle file behind.
+type atomicFile struct {
+	*os.File
+	path      string
+	committed bool
+}
 
-		analyzePacket(buf, state)
+func createAtomicFile(path string) (*atomicFile, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
 	}
+	return &atomicFile{File: f, path: path}, nil
+}
+
+func (f *atomicFile) Commit() error {
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), f.path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	f.committed = true
+	return nil
+}
+
+// Abort discards the temporary file unless Commit has already succeeded.
+func (f *atomicFile) Abort() {
+	if f.committed {
+		return
+	}
+	f.File.Close()
+	os.Remove(f.Name())
 }
 
 func debugMode() bool {
@@ -78,1371 +1038,637 @@ func isDRCSEnabled() bool {
 	return os.Getenv("ASSDUMPER_DRCS") == "1"
 }
 
-func assertSyncByte(packet []byte) {
-	if packet[0] != 0x47 {
-		panic("sync_byte failed")
+// handlePCR updates currentTimestamp with the PCR of the program.
+func (state *AnalyzerState) handlePCR(value int64, discontinuity_indicator bool) {
+	pcr := SystemClock(value)
+	if state.currentTimestamp == 0 {
+		state.send(ClockStart{PCR: pcr})
+	} else if state.resumed && pcr >= state.currentTimestamp {
+		// The broadcast went on while the input was interrupted, on
+		// the same time base.
+	} else if discontinuity_indicator || isPcrDiscontinuity(state.currentTimestamp, pcr) {
+		state.clock.reset()
+		state.send(ClockDiscontinuity{Previous: state.currentTimestamp, Current: pcr})
+	}
+	state.currentTimestamp = state.clock.filter(pcr, state.demux.Packets())
+	state.resumed = false
+	if state.clockTick != nil {
+		snapshot := state.demuxSnapshot()
+		state.decode(func() {
+			state.decodeSnapshot(&snapshot)
+			state.clockTick(snapshot)
+		})
 	}
 }
 
-func readFull(reader *bufio.Reader, buf []byte) error {
-	for i := 0; i < len(buf); {
-		n, err := reader.Read(buf[i:])
-		if err != nil {
-			return err
+// handlePMT picks the first program whose PMT has the caption (or
+// superimpose) ES, and follows later versions of that PMT since the PIDs may
+// move e.g. when the next event starts.
+func handlePMT(pid int, section []byte, state *AnalyzerState) {
+	// [ISO] 2.4.4.8 Program Map Table
+	if section[0] != 0x02 || len(section) < 12 {
+		return
+	}
+	version_number := int(section[5]>>1) & 0x1f
+	current_next_indicator := section[5]&0x01 != 0
+	if !current_next_indicator {
+		return
+	}
+	program_number := state.pmtPids[pid]
+	if state.pmtPid == -1 {
+		if state.serviceId != -1 && program_number != state.serviceId {
+			return
 		}
-		i += n
+	} else if pid != state.pmtPid || version_number == state.pmtVersion {
+		return
 	}
-	return nil
+
+	pcrPid := tspacket.PCRPID(section)
+	captionPid, profile := extractCaptionPid(section, state.caption.componentTag)
+	superimposePid := -1
+	if state.superimpose != nil {
+		superimposePid, _ = extractCaptionPid(section, state.superimpose.componentTag)
+	}
+	otherCaptionPid, otherProfile := -1, aribcaption.ProfileA
+	if state.otherCaption != nil {
+		otherCaptionPid, otherProfile = extractCaptionPid(section, state.otherCaption.componentTag)
+	}
+	if state.pmtPid == -1 && captionPid == -1 && superimposePid == -1 {
+		return
+	}
+	if state.pmtPid == -1 {
+		if debugMode() {
+			// assdumper info tells the whole PMT.
+			fmt.Fprintf(os.Stderr, "caption pid = %d, superimpose pid = %d, PCR_PID = %d, caption components = %v\n", captionPid, superimposePid, pcrPid, captionComponents(section))
+		}
+		if profile == aribcaption.ProfileC {
+			fmt.Fprintln(os.Stderr, "The caption ES is of a 1seg service (profile C)")
+		}
+	} else {
+		fmt.Fprintf(os.Stderr, "PMT version %d: caption pid = %d, superimpose pid = %d, PCR_PID = %d\n", version_number, captionPid, superimposePid, pcrPid)
+	}
+	state.pmtPid = pid
+	state.pmtVersion = version_number
+	state.dualMono = extractDualMono(section)
+	state.programNumber = program_number
+	if state.pcrPid != -1 {
+		state.demux.HandlePCR(state.pcrPid, nil)
+	}
+	state.pcrPid = pcrPid
+	state.demux.HandlePCR(pcrPid, state.handlePCR)
+	change := TableChange{
+		PCR:           state.currentTimestamp,
+		Table:         "PMT",
+		PID:           pid,
+		ProgramNumber: program_number,
+		PcrPid:        pcrPid,
+	}
+	if moveCaptionStream(state.caption, captionPid, pidCaption, state) {
+		// The PES of the old PID is decoded with the old profile.
+		state.decode(func() {
+			state.caption.session.Decoder.Profile = profile
+		})
+		change.CaptionPid = captionPid
+	}
+	if state.superimpose != nil && moveCaptionStream(state.superimpose, superimposePid, pidSuperimpose, state) {
+		change.SuperimposePid = superimposePid
+	}
+	if state.otherCaption != nil && state.otherCaption.pid != otherCaptionPid {
+		if moveCaptionStream(state.otherCaption, otherCaptionPid, pidOtherCaption, state) {
+			state.decode(func() {
+				state.otherCaption.session.Decoder.Profile = otherProfile
+			})
+			fmt.Fprintf(os.Stderr, "caption pid of the other language = %d\n", otherCaptionPid)
+		}
+	}
+	state.send(change)
 }
 
-func analyzePacket(packet []byte, state *AnalyzerState) {
-	assertSyncByte(packet)
-
-	payload_unit_start_indicator := (packet[1] & 0x40) != 0
-	pid := int(packet[1]&0x1f)<<8 | int(packet[2])
-	hasAdaptation := (packet[3] & 0x20) != 0
-	hasPayload := (packet[3] & 0x10) != 0
-	p := packet[4:]
-
-	if hasAdaptation {
-		// [ISO] 2.4.3.4
-		// Table 2-6
-		adaptation_field_length := int(p[0])
-		p = p[1:]
-		pcr_flag := (p[0] & 0x10) != 0
-		if pcr_flag && pid == state.pcrPid {
-			state.currentTimestamp = extractPcr(p)
-		}
-		if adaptation_field_length >= len(p) {
-			// TODO: adaptation_field_length could be bigger than
-			// one packet size. We should handle
-			// payload_unit_start_indicator and pointer_field more
-			// correctly.
-			return
+// moveCaptionStream points stream to pid, which is -1 when the ES is gone.
+// The PES pending on the old PID is dumped first. It returns whether stream
+// has a PID.
+func moveCaptionStream(stream *captionStream, pid int, kind pidKind, state *AnalyzerState) bool {
+	if stream.pid != pid {
+		if stream.pid != -1 {
+			state.setPIDKind(stream.pid, pidIgnored)
+		}
+		if len(stream.payload) != 0 {
+			dumpCaption(stream.payload, stream, state)
 		}
-		p = p[adaptation_field_length:]
+		stream.pid = pid
+		stream.payload = stream.payload[:0]
+		if pid != -1 {
+			state.setPIDKind(pid, kind)
+		}
+	}
+	return pid != -1
+}
+
+// noteTableUpdate emits a TableUpdate when section is a new version.
+func noteTableUpdate(pid int, kind pidKind, section []byte, state *AnalyzerState) {
+	table_id := int(section[0])
+	update := TableUpdate{PCR: state.currentTimestamp, PID: pid, TableId: table_id, Version: -1}
+	switch {
+	case kind == pidPAT && table_id == 0x00:
+		update.Table = "PAT"
+	case kind == pidPMT && table_id == 0x02:
+		update.Table = "PMT"
+	case kind == pidSDT && (table_id == 0x42 || table_id == 0x46):
+		update.Table = "SDT"
+	case kind == pidEIT && (table_id == 0x4E || table_id == 0x4F):
+		update.Table = "EIT"
+	case kind == pidTOT && table_id == 0x73:
+		state.send(TableUpdate{PCR: state.currentTimestamp, Table: "TOT", PID: pid, TableId: table_id, Version: -1})
+		return
+	default:
+		return
+	}
+	// [ISO] 2.4.4.10 Syntax of the Private section
+	if len(section) < 8 || section[5]&0x01 == 0 {
+		// Too short, or current_next_indicator says it's not valid yet
+		return
 	}
+	update.TableIdExtension = int(section[3])<<8 | int(section[4])
+	update.Version = int(section[5]>>1) & 0x1f
+	update.SectionNumber = int(section[6])
+	key := sectionKey{pid, table_id, update.TableIdExtension, update.SectionNumber}
+	if v, ok := state.tableVersions[key]; ok && v == update.Version {
+		return
+	}
+	state.tableVersions[key] = update.Version
+	state.send(update)
+}
 
-	if hasPayload {
-		if pid == 0 {
-			if len(state.pmtPids) == 0 {
-				state.pmtPids = extractPmtPids(p[1:])
+// handleSection processes a complete PSI/SI section received on pid.
+func handleSection(pid int, kind pidKind, section []byte, state *AnalyzerState) {
+	if tspacket.CRC32(section) != 0 {
+		state.crcErrors++
+		if debugMode() {
+			fmt.Fprintf(os.Stderr, "CRC_32 error in section at %v\n", state.demux.Position())
+		}
+		return
+	}
+	if state.tableVersions != nil {
+		noteTableUpdate(pid, kind, section, state)
+	}
+	switch kind {
+	case pidPAT:
+		if len(state.pmtPids) == 0 {
+			state.pmtPids = tspacket.ParsePAT(section)
+			if debugMode() {
+				// assdumper info tells the whole PAT.
 				fmt.Fprintf(os.Stderr, "Found %d pids: %v\n", len(state.pmtPids), state.pmtPids)
 			}
-		} else if state.pmtPids != nil && state.pmtPids[pid] {
-			if state.captionPid == -1 && payload_unit_start_indicator {
-				// PMT section
-				pcrPid := extractPcrPid(p[1:])
-				captionPid := extractCaptionPid(p[1:])
-				if captionPid != -1 {
-					fmt.Fprintf(os.Stderr, "caption pid = %d, PCR_PID = %d\n", captionPid, pcrPid)
-					state.pcrPid = pcrPid
-					state.captionPid = captionPid
-				}
+			if state.serviceId != -1 && !hasProgram(state.pmtPids, state.serviceId) {
+				fmt.Fprintf(os.Stderr, "Service %d isn't in PAT\n", state.serviceId)
 			}
-		} else if pid == 0x0014 {
-			// Time Offset Table
-			// [B10] 5.2.9
-			t := extractJstTime(p[1:])
-			if t != 0 {
-				state.clockOffset = t*100 - state.currentTimestamp.centitime()
+			for pmtPid := range state.pmtPids {
+				state.setPIDKind(pmtPid, pidPMT)
 			}
-		} else if pid == state.captionPid {
-			if payload_unit_start_indicator {
-				if len(state.captionPayload) != 0 {
-					dumpCaption(state.captionPayload, state)
-				}
-				state.captionPayload = make([]byte, len(p))
-				copy(state.captionPayload, p)
-			} else {
-				for _, b := range p {
-					state.captionPayload = append(state.captionPayload, b)
-				}
+			state.send(TableChange{PCR: state.currentTimestamp, Table: "PAT", PID: pid})
+		}
+	case pidPMT:
+		handlePMT(pid, section, state)
+	case pidSDT:
+		// Service Description Table
+		if state.pcrPid != -1 && section[0] == 0x42 {
+			name, ok := extractServiceNames(section)[state.programNumber]
+			if ok && name != state.serviceName {
+				state.serviceName = name
+				state.send(TableChange{
+					PCR:           state.currentTimestamp,
+					Table:         "SDT",
+					PID:           pid,
+					ProgramNumber: state.programNumber,
+					ServiceName:   name,
+				})
 			}
 		}
+	case pidEIT:
+		if state.pcrPid != -1 {
+			handleEIT(section, state)
+		}
+	case pidTOT:
+		// Time Offset Table
+		// [B10] 5.2.9
+		t := tspacket.ParseTOT(section)
+		// A TOT preceding the first PCR can't anchor anything.
+		if t != 0 && state.currentTimestamp != 0 {
+			state.send(ClockAnchor{PCR: state.currentTimestamp, Time: t})
+		}
 	}
 }
 
-func extractPmtPids(payload []byte) map[int]bool {
-	// [ISO] 2.4.4.3
-	// Table 2-25
-	table_id := payload[0]
-	pids := make(map[int]bool)
-	if table_id != 0x00 {
-		return pids
-	}
-	section_length := int(payload[1]&0x0F)<<8 | int(payload[2])
-	index := 8
-	for index < 3+section_length-4 {
-		program_number := int(payload[index+0])<<8 | int(payload[index+1])
-		if program_number != 0 {
-			program_map_PID := int(payload[index+2]&0x1F)<<8 | int(payload[index+3])
-			pids[program_map_PID] = true
-		}
-		index += 4
-	}
-	return pids
+// assembleCaption appends the payload p of a packet to the PES of stream and
+// decodes it once it's complete, or the previous PES when a new one starts.
+// gap tells that packets were lost right before this one.
+func assembleCaption(p []byte, start, gap bool, stream *captionStream, state *AnalyzerState) {
+	if start {
+		// A gap before a new PES may have cut the previous one short,
+		// which dumpCaption detects with PES_packet_length.
+		if len(stream.payload) != 0 {
+			dumpCaption(stream.payload, stream, state)
+		}
+		stream.pcr = state.currentTimestamp
+		stream.offset = state.demux.Position().Offset
+		// The buffer is reused for every PES, since dumpCaption keeps
+		// nothing of it.
+		stream.payload = append(stream.payload[:0], p...)
+	} else if gap {
+		// Some packets in the middle of the PES were lost. Discard the
+		// rest of it rather than decoding the pieces glued together.
+		stream.payload = stream.payload[:0]
+	} else if len(stream.payload) != 0 {
+		stream.payload = append(stream.payload, p...)
+	}
+	// A PES telling its length is decoded as soon as it's complete rather
+	// than when the next one starts, which may be seconds later in a live
+	// stream. The stuffing after it is dropped with the packets following
+	// an empty payload.
+	if pes := stream.payload; len(pes) >= 6 {
+		if PES_packet_length := int(pes[4])<<8 | int(pes[5]); PES_packet_length != 0 && len(pes) >= 6+PES_packet_length {
+			dumpCaption(pes, stream, state)
+			stream.payload = stream.payload[:0]
+		}
+	}
 }
 
-func extractPcrPid(payload []byte) int {
-	return (int(payload[8]&0x1f) << 8) | int(payload[9])
+// hasProgram reports whether program_number is in the PAT.
+func hasProgram(pmtPids map[int]int, program_number int) bool {
+	for _, n := range pmtPids {
+		if n == program_number {
+			return true
+		}
+	}
+	return false
 }
 
-func extractCaptionPid(payload []byte) int {
-	// [ISO] 2.4.4.8 Program Map Table
-	// Table 2-28
-	table_id := payload[0]
-	if table_id != 0x02 {
-		return -1
-	}
-	section_length := int(payload[1]&0x0F)<<8 | int(payload[2])
-	if section_length >= len(payload) {
-		return -1
-	}
-
-	program_info_length := int(payload[10]&0x0F)<<8 | int(payload[11])
-	index := 12 + program_info_length
-
-	for index < 3+section_length-4 {
-		stream_type := payload[index+0]
-		ES_info_length := int(payload[index+3]&0xF)<<8 | int(payload[index+4])
-		if stream_type == 0x06 {
-			elementary_PID := int(payload[index+1]&0x1F)<<8 | int(payload[index+2])
-			subIndex := index + 5
-			for subIndex < index+ES_info_length {
-				// [ISO] 2.6 Program and program element descriptors
-				descriptor_tag := payload[subIndex+0]
-				descriptor_length := int(payload[subIndex+1])
-				if descriptor_tag == 0x52 {
-					// [B10] 6.2.16 Stream identifier descriptor
-					// 表 6-28
-					component_tag := payload[subIndex+2]
-					if component_tag == 0x87 {
-						return elementary_PID
-					}
-				}
-				subIndex += 2 + descriptor_length
+// extractCaptionPid returns the PID of the caption ES with componentTag,
+// and the profile of its coding.
+// [TR-B14] component_tag 0x87 is the first caption language and 0x88 the
+// second one. The PMT of a 1seg service may lay its only caption ES out
+// differently, which is found by data_component_id instead when the first
+// language is wanted.
+func extractCaptionPid(payload []byte, componentTag int) (int, aribcaption.Profile) {
+	streams := tspacket.ParsePMT(payload)
+	profile := func(es tspacket.ElementaryStream) aribcaption.Profile {
+		if es.DataComponentID == aribcaption.DataComponentMobileCaption {
+			return aribcaption.ProfileC
+		}
+		return aribcaption.ProfileA
+	}
+	for _, es := range streams {
+		if es.StreamType == 0x06 && es.ComponentTag == componentTag {
+			return es.PID, profile(es)
+		}
+	}
+	if componentTag == 0x87 {
+		for _, es := range streams {
+			if es.StreamType == 0x06 && es.DataComponentID == aribcaption.DataComponentMobileCaption {
+				return es.PID, aribcaption.ProfileC
 			}
 		}
-		index += 5 + ES_info_length
 	}
-	return -1
+	return -1, aribcaption.ProfileA
 }
 
-func extractPcr(payload []byte) SystemClock {
-	pcr_base := (int64(payload[1]) << 25) |
-		(int64(payload[2]) << 17) |
-		(int64(payload[3]) << 9) |
-		(int64(payload[4]) << 1) |
-		(int64(payload[5]&0x80) >> 7)
-	pcr_ext := (int64(payload[5] & 0x01)) | int64(payload[6])
-	// [ISO] 2.4.2.2
-	return SystemClock(pcr_base*300 + pcr_ext)
+// extractDualMono returns the languages of the main and sub channel of the
+// first dual mono audio ES, or nil when there is none.
+func extractDualMono(payload []byte) []string {
+	for _, es := range tspacket.ParsePMT(payload) {
+		if es.DualMono != nil {
+			return es.DualMono
+		}
+	}
+	return nil
 }
 
-func extractJstTime(payload []byte) int64 {
-	if payload[0] != 0x73 {
-		return 0
+// captionComponents returns the component_tag of every caption and
+// superimpose ES.
+func captionComponents(payload []byte) []string {
+	var tags []string
+	for _, es := range tspacket.ParsePMT(payload) {
+		if es.StreamType == 0x06 && 0x87 <= es.ComponentTag && es.ComponentTag <= 0x8a {
+			tags = append(tags, fmt.Sprintf("0x%02x", es.ComponentTag))
+		}
 	}
+	return tags
+}
 
-	// [B10] Appendix C
-	MJD := (int(payload[3]) << 8) | int(payload[4])
-	y := int((float64(MJD) - 15078.2) / 365.25)
-	m := int((float64(MJD) - 14956.1 - float64(int(float64(y)*365.25))) / 30.6001)
-	k := 0
-	if m == 14 || m == 15 {
-		k = 1
+// decodeCaption decodes a caption PES of stream on the decoding stage.
+func decodeCaption(assembled assembledPES, stream *captionStream, state *AnalyzerState) {
+	pes := aribcaption.ParsePES(assembled.payload)
+	if state.pesDump != nil {
+		if err := state.pesDump.dump(assembled, stream.track, pes.PTS, pes.HasPTS); err != nil {
+			panic(err)
+		}
 	}
-	year := y + k + 1900
-	month := m - 1 - k*12
-	day := MJD - 14956 - int(float64(y)*365.25) - int(float64(m)*30.6001)
-	hour := decodeBcd(payload[5])
-	minute := decodeBcd(payload[6])
-	second := decodeBcd(payload[7])
-
-	str := fmt.Sprintf("%d-%02d-%02dT%02d:%02d:%02d+09:00", year, month, day, hour, minute, second)
-	t, err := time.Parse(time.RFC3339, str)
-	if err != nil {
-		panic(err)
+	if pes.MalformedPTS {
+		fmt.Fprintf(os.Stderr, "Malformed PTS/DTS in PES header at %v, timing the caption by PCR\n", assembled.position)
 	}
-	return t.Unix()
-}
-
-func decodeBcd(n byte) int {
-	return (int(n)>>4)*10 + int(n&0x0f)
-}
-
-func dumpCaption(payload []byte, state *AnalyzerState) {
-	PES_header_data_length := payload[8]
-	PES_data_packet_header_length := payload[11+PES_header_data_length] & 0x0F
-	p := payload[12+PES_header_data_length+PES_data_packet_header_length:]
-
-	// [B24] Table 9-1 (p184)
-	data_group_id := (p[0] & 0xFC) >> 2
-	if data_group_id == 0x00 || data_group_id == 0x20 {
-		// [B24] Table 9-3 (p186)
-		// caption_management_data
-		num_languages := p[6]
-		p = p[7+num_languages*5:]
-	} else {
-		// caption_data
-		p = p[6:]
-	}
-	// [B24] Table 9-3 (p186)
-	data_unit_loop_length := (int(p[0]) << 16) | (int(p[1]) << 8) | int(p[2])
-	index := 0
-	for index < data_unit_loop_length {
-		q := p[index:]
-		data_unit_parameter := q[4]
-		data_unit_size := (int(q[5]) << 16) | (int(q[6]) << 8) | int(q[7])
-		data := q[8:]
-		subtitle := ""
-		subtitleFound := false
-		switch data_unit_parameter {
+	if pes.DataGroup == nil {
+		state.emptyPes++
+		return
+	}
+	drops := 0
+	if pes.Truncated {
+		drops++
+	}
+	group, err := stream.session.DataGroup(pes.DataGroup)
+	switch err {
+	case aribcaption.ErrEmptyDataGroup:
+		state.emptyPes++
+		return
+	case aribcaption.ErrRetransmission:
+		state.retransmissions++
+		return
+	}
+	if group.CRCError {
+		state.captionCRCErrors++
+	}
+	if group.Truncated && !group.CRCError && debugMode() {
+		fmt.Fprintf(os.Stderr, "data_unit_size overruns the data group at %v\n", assembled.position)
+	}
+	if group.NewSession {
+		state.emit(CaptionSession{
+			Track:       stream.track,
+			PCR:         assembled.pcr,
+			PTS:         pes.PTS,
+			HasPTS:      pes.HasPTS,
+			DataGroupId: group.ID,
+		})
+	}
+	for _, unit := range group.Units {
+		switch unit.Parameter {
 		case 0x20:
-			subtitleFound = true
-			subtitle = decodeString(data, data_unit_size)
-		case 0x30:
-			subtitleFound = true
-			// DRCS
-			// ARIB STD-B24 第一編 第2部 付録規定D
-			numberOfCode := int(data[0])
-			data = data[1:]
-			for i := 0; i < numberOfCode; i++ {
-				// characterCode := uint16(data[0])<<8 | uint16(data[1])
-				numberOfFont := int(data[2])
-				data = data[3:]
-				for j := 0; j < numberOfFont; j++ {
-					// fontId := data[0] >> 4
-					mode := data[0] & 0x0f
-					if mode == 0x00 || mode == 0x01 {
-						// depth := data[1]
-						width := int(data[2])
-						height := int(data[3])
-						pat := ""
-						for h := 0; h < height; h++ {
-							for w := 0; w < width/8; w++ {
-								pat += fmt.Sprintf("%08b", data[4+h*(width/8)+w])
-							}
-							pat += "\n"
-						}
-						s, md5sum := replaceDRCS(pat)
-						if s != "" {
-							if isDRCSEnabled() {
-								subtitle = s
-							}
-						} else if debugMode() {
-							fmt.Fprintf(os.Stderr, "Unable to replace DRCS bitmap %s\n", md5sum)
-							fmt.Fprint(os.Stderr, pat)
-						}
-					} else {
-						if debugMode() {
-							fmt.Fprintf(os.Stderr, "Compressed mode isn't supported (mode=%d)\n", mode)
-						}
-					}
-				}
+			subtitle, fallbacks := stream.session.Decoder.Decode(unit.Data)
+			caption := CaptionUnit{
+				Track:      stream.track,
+				PCR:        assembled.pcr,
+				PTS:        pes.PTS,
+				HasPTS:     pes.HasPTS,
+				Text:       subtitle,
+				Confidence: captionConfidence(drops, group.CRCError, fallbacks),
+			}
+			if language := group.Language; 1 <= language && language <= len(stream.session.Languages) {
+				caption.Language = stream.session.Languages[language-1]
+				caption.AudioChannel = audioChannel(assembled.dualMono, caption.Language, language)
 			}
+			state.emit(caption)
+		case 0x30, 0x31:
+			defineDRCS(unit.Data, stream, assembled.pcr, state)
 		default:
-			fmt.Fprintf(os.Stderr, "Unknown data_unit_parameter: 0x%02x\n", data_unit_parameter)
-		}
-		index += 5 + data_unit_size
-
-		if subtitleFound {
-			if len(state.previousSubtitle) != 0 && !(isBlank(state.previousSubtitle) && state.previousIsBlank) {
-				if state.previousTimestamp == state.currentTimestamp {
-					state.previousSubtitle += subtitle
-					continue
-				} else {
-					prevTimeCenti := state.previousTimestamp.centitime() + state.clockOffset
-					curTimeCenti := state.currentTimestamp.centitime() + state.clockOffset
-					prevTime := prevTimeCenti / 100
-					curTime := curTimeCenti / 100
-					prevCenti := prevTimeCenti % 100
-					curCenti := curTimeCenti % 100
-					prev := time.Unix(prevTime, 0)
-					cur := time.Unix(curTime, 0)
-					if !state.preludePrinted {
-						printPrelude()
-						state.preludePrinted = true
-					}
-					subtitle := strings.Replace(state.previousSubtitle, "\f", "", -1)
-					fmt.Printf("Dialogue: 0,%02d:%02d:%02d.%02d,%02d:%02d:%02d.%02d,Default,,,,,,%s\n",
-						prev.Hour(), prev.Minute(), prev.Second(), prevCenti,
-						cur.Hour(), cur.Minute(), cur.Second(), curCenti,
-						subtitle)
-				}
+			// Data services can send these in every PES, so they are
+			// counted and reported once at the end.
+			if state.skippedUnits[unit.Parameter] == 0 && debugMode() {
+				fmt.Fprintf(os.Stderr, "Skipping data units with data_unit_parameter 0x%02x\n", unit.Parameter)
 			}
-			state.previousIsBlank = isBlank(state.previousSubtitle)
-			state.previousSubtitle = subtitle
-			state.previousTimestamp = state.currentTimestamp
+			state.skippedUnits[unit.Parameter]++
 		}
 	}
 }
 
-func isBlank(str string) bool {
-	for _, c := range str {
-		if c != ' ' {
-			return false
+// audioChannel returns the channel of the dual mono audio, "main" or "sub",
+// that goes with the caption of language number (1-origin) whose
+// ISO_639_language_code is code. The caption languages are paired with the
+// channels in order unless the codes tell otherwise.
+func audioChannel(dualMono []string, code string, language int) string {
+	if dualMono == nil {
+		return ""
+	}
+	if code != "" && dualMono[0] != dualMono[1] {
+		switch code {
+		case dualMono[0]:
+			return "main"
+		case dualMono[1]:
+			return "sub"
 		}
 	}
-	return true
+	switch language {
+	case 1:
+		return "main"
+	case 2:
+		return "sub"
+	}
+	return ""
 }
 
-func printPrelude() {
-	fmt.Println("[Script Info]")
-	fmt.Println("ScriptType: v4.00+")
-	fmt.Println("Collisions: Normal")
-	fmt.Println("ScaledBorderAndShadow: yes")
-	fmt.Println("Timer: 100.0000")
-	fmt.Println("\n[Events]")
+// dataUnitNames are the data units defined besides the statement body and
+// DRCS, none of which can be expressed in ASS.
+// [B24] 第一編 第3部 表 9-12
+var dataUnitNames = map[byte]string{
+	0x28: "geometric",
+	0x2c: "synthesized sound",
+	0x34: "color map",
+	0x35: "bitmap",
 }
 
-func decodeString(bytes []byte, length int) string {
-	eucjpDecoder := japanese.EUCJP.NewDecoder()
-	decoded := ""
-	nonDefaultColor := false
-
-	for i := 0; i < length; i++ {
-		b := bytes[i]
-		if 0 <= b && b <= 0x20 {
-			// ARIB STD-B24 第一編 第2部 表 7-14
-			// ARIB STD-B24 第一編 第2部 表 7-15
-			// C0 制御集合
-			switch b {
-			case 0x0c:
-				// CS
-				decoded += "\f"
-			case 0x0d:
-				// APR
-				decoded += "\\n"
-			case 0x20:
-				// SP
-				decoded += " "
-			default:
-				fmt.Fprintf(os.Stderr, "Unhandled C0 code: 0x%02x\n", b)
-			}
-		} else if 0x20 < b && b < 0x80 {
-			if debugMode() {
-				fmt.Fprintf(os.Stderr, "Unhandled GL code: 0x%02x\n", b)
+func reportSkippedUnits(skipped map[byte]int) {
+	if len(skipped) == 0 {
+		return
+	}
+	params := make([]int, 0, len(skipped))
+	for p := range skipped {
+		params = append(params, int(p))
+	}
+	sort.Ints(params)
+	var counts []string
+	for _, p := range params {
+		name, ok := dataUnitNames[byte(p)]
+		if !ok {
+			name = "unknown"
+		}
+		counts = append(counts, fmt.Sprintf("0x%02x (%s) x%d", p, name, skipped[byte(p)]))
+	}
+	fmt.Fprintf(os.Stderr, "Skipped data units: %s\n", strings.Join(counts, ", "))
+}
+
+// captionConfidence estimates how much a caption statement can be trusted
+// from the damage seen while assembling it. Lost packets and a broken
+// data group halve the score, and every character that had to be replaced
+// with a placeholder costs a little.
+func captionConfidence(drops int, crcError bool, fallbacks int) float64 {
+	confidence := 1.0
+	for i := 0; i < drops; i++ {
+		confidence *= 0.5
+	}
+	if crcError {
+		confidence *= 0.5
+	}
+	for i := 0; i < fallbacks; i++ {
+		confidence *= 0.9
+	}
+	return confidence
+}
+
+// defineDRCS registers the glyphs of a DRCS data unit. The definitions stay
+// valid for the following statements until management data of another data
+// group arrives.
+func defineDRCS(data []byte, stream *captionStream, pcr SystemClock, state *AnalyzerState) {
+	for _, c := range aribcaption.ParseDRCS(data) {
+		for j, font := range c.Fonts {
+			s, md5sum := font.Replacement(), font.MD5()
+			if state.drcsPNGDir != "" {
+				writeDRCSPNG(state.drcsPNGDir, md5sum, font.Width, font.Height, font.Bits, font.Pattern)
 			}
-		} else if 0x80 <= b && b < 0xA0 {
-			// ARIB STD-B24 第一編 第2部 表 7-14
-			// ARIB STD-B24 第一編 第2部 表 7-16
-			// C1 制御集合
-			switch b {
-			case 0x80:
-				// BKF, black
-				decoded += "{\\c&H000000&}"
-				nonDefaultColor = true
-			case 0x81:
-				// RDF, red
-				decoded += "{\\c&H0000ff&}"
-				nonDefaultColor = true
-			case 0x82:
-				// GRF, green
-				decoded += "{\\c&H00ff00&}"
-				nonDefaultColor = true
-			case 0x83:
-				// YLF, yellow
-				decoded += "{\\c&H00ffff&}"
-				nonDefaultColor = true
-			case 0x84:
-				// BLF, blue
-				decoded += "{\\c&Hff0000&}"
-				nonDefaultColor = true
-			case 0x85:
-				// MGF, magenta
-				decoded += "{\\c&Hff00ff&}"
-				nonDefaultColor = true
-			case 0x86:
-				// CNF, cyan
-				decoded += "{\\c&Hffff00&}"
-				nonDefaultColor = true
-			case 0x87:
-				// WHF, white
-				if nonDefaultColor {
-					decoded += "{\\c&HFFFFFF&}"
-					nonDefaultColor = false
+			if state.drcsPatterns {
+				if j == 0 {
+					state.emit(DRCSPattern{
+						Track:  stream.track,
+						PCR:    pcr,
+						MD5:    md5sum,
+						Width:  font.Width,
+						Height: font.Height,
+						Bits:   font.Bits,
+						Data:   append([]byte(nil), font.Pattern...),
+					})
+					stream.setDRCS(c.Code, "{drcs "+md5sum+"}")
 				}
-			case 0x89:
-				// MSZ
-			case 0x8a:
-				// NSZ
-			case 0x9d:
-				// TIME
-				i += 2
-			default:
-				fmt.Fprintf(os.Stderr, "Unhandled C1 code: 0x%02x\n", b)
+				continue
 			}
-		} else if 0xa0 < b && b <= 0xff {
-			eucjp := make([]byte, 3)
-			eucjp[0] = bytes[i]
-			eucjp[1] = bytes[i+1]
-			eucjp[2] = 0
-			i++
-
-			if eucjp[0] == 0xfc && eucjp[1] == 0xa1 {
-				// FIXME
-				decoded += "➡"
-			} else {
-				buf := make([]byte, 10)
-				ndst, nsrc, err := eucjpDecoder.Transform(buf, eucjp, true)
-				if err == nil {
-					if nsrc == 3 {
-						c, _ := utf8.DecodeRune(buf)
-						if c == 0xfffd {
-							gaiji := (int(eucjp[0]&0x7f) << 8) | int(eucjp[1]&0x7f)
-							if gaiji != 0x7c21 {
-								decoded += tryGaiji(gaiji)
-							}
-						} else {
-							decoded += string(buf[:ndst-1])
-						}
-					} else {
-						fmt.Fprintf(os.Stderr, "eucjp decode failed: ndst=%d, nsrc=%d\n", ndst, nsrc)
-					}
-				} else {
-					fmt.Fprintf(os.Stderr, "eucjp decode error: %v\n", err)
-				}
+			s = state.lookupDRCS(s, md5sum, font.Width, font.Height, font.Bits, font.Pattern)
+			if s == "" && !state.unhandled.note("Unmapped DRCS", md5sum) && debugMode() {
+				fmt.Fprintf(os.Stderr, "Unable to replace DRCS bitmap %s\n", md5sum)
+				fmt.Fprint(os.Stderr, font.Rows())
+			}
+			if s == "" && state.drcsDrawings {
+				s = drcsDrawing(font.Width, font.Height, font.Bits, font.Pattern)
+			}
+			if j == 0 {
+				stream.setDRCS(c.Code, s)
 			}
 		}
 	}
-	return decoded
 }
 
-func replaceDRCS(pattern string) (string, string) {
-	h := md5.New()
-	io.WriteString(h, pattern)
-	md5sum := hex.EncodeToString(h.Sum(nil))
-	switch md5sum {
-	case "4447af4c020758d6b615713ad6640fc5":
-		return "《", md5sum
-	case "6d6cf86c3f892dc45b68703bb84068a9":
-		return "》", md5sum
-	case "6bcc3c66dc1f853e605613fceda9e648":
-		return "♬", md5sum
-	case "ec5a85c9f822a0e27847a2d8d31ab73e":
-		return "📺", md5sum
-	case "f64c27d6df14074b2e1f92b3a4985c01":
-		return "➡", md5sum
-	default:
-		return "", md5sum
+// setDRCS sets what the decoder writes for a DRCS code. A code without a
+// replacement is left undefined, so that the decoder counts it as a
+// placeholder. Replacements with ordinary characters are only written with
+// ASSDUMPER_DRCS=1, while the comments of glyphs to be composited, the
+// drawings of -drcs-draw and the code points of -drcs-pua are only made
+// when asked for, and always kept.
+func (stream *captionStream) setDRCS(code uint16, s string) {
+	if s == "" {
+		delete(stream.session.Decoder.DRCS, code)
+		return
+	}
+	if !isDRCSEnabled() && !strings.HasPrefix(s, "{") && !isDRCSPUA(s) {
+		s = ""
 	}
+	stream.session.Decoder.DRCS[code] = s
 }
 
-func tryGaiji(c int) string {
-	switch c {
-	case 0x7A50:
-		return "【HV】"
-	case 0x7A51:
-		return "【SD】"
-	case 0x7A52:
-		return "【Ｐ】"
-	case 0x7A53:
-		return "【Ｗ】"
-	case 0x7A54:
-		return "【MV】"
-	case 0x7A55:
-		return "【手】"
-	case 0x7A56:
-		return "【字】"
-	case 0x7A57:
-		return "【双】"
-	case 0x7A58:
-		return "【デ】"
-	case 0x7A59:
-		return "【Ｓ】"
-	case 0x7A5A:
-		return "【二】"
-	case 0x7A5B:
-		return "【多】"
-	case 0x7A5C:
-		return "【解】"
-	case 0x7A5D:
-		return "【SS】"
-	case 0x7A5E:
-		return "【Ｂ】"
-	case 0x7A5F:
-		return "【Ｎ】"
-	case 0x7A62:
-		return "【天】"
-	case 0x7A63:
-		return "【交】"
-	case 0x7A64:
-		return "【映】"
-	case 0x7A65:
-		return "【無】"
-	case 0x7A66:
-		return "【料】"
-	case 0x7A67:
-		return "【年齢制限】"
-	case 0x7A68:
-		return "【前】"
-	case 0x7A69:
-		return "【後】"
-	case 0x7A6A:
-		return "【再】"
-	case 0x7A6B:
-		return "【新】"
-	case 0x7A6C:
-		return "【初】"
-	case 0x7A6D:
-		return "【終】"
-	case 0x7A6E:
-		return "【生】"
-	case 0x7A6F:
-		return "【販】"
-	case 0x7A70:
-		return "【声】"
-	case 0x7A71:
-		return "【吹】"
-	case 0x7A72:
-		return "【PPV】"
-
-	case 0x7A60:
-		return "■"
-	case 0x7A61:
-		return "●"
-	case 0x7A73:
-		return "（秘）"
-	case 0x7A74:
-		return "ほか"
-
-	case 0x7C21:
-		return "→"
-	case 0x7C22:
-		return "←"
-	case 0x7C23:
-		return "↑"
-	case 0x7C24:
-		return "↓"
-	case 0x7C25:
-		return "●"
-	case 0x7C26:
-		return "○"
-	case 0x7C27:
-		return "年"
-	case 0x7C28:
-		return "月"
-	case 0x7C29:
-		return "日"
-	case 0x7C2A:
-		return "円"
-	case 0x7C2B:
-		return "㎡"
-	case 0x7C2C:
-		return "㎥"
-	case 0x7C2D:
-		return "㎝"
-	case 0x7C2E:
-		return "㎠"
-	case 0x7C2F:
-		return "㎤"
-	case 0x7C30:
-		return "０."
-	case 0x7C31:
-		return "１."
-	case 0x7C32:
-		return "２."
-	case 0x7C33:
-		return "３."
-	case 0x7C34:
-		return "４."
-	case 0x7C35:
-		return "５."
-	case 0x7C36:
-		return "６."
-	case 0x7C37:
-		return "７."
-	case 0x7C38:
-		return "８."
-	case 0x7C39:
-		return "９."
-	case 0x7C3A:
-		return "氏"
-	case 0x7C3B:
-		return "副"
-	case 0x7C3C:
-		return "元"
-	case 0x7C3D:
-		return "故"
-	case 0x7C3E:
-		return "前"
-	case 0x7C3F:
-		return "[新]"
-	case 0x7C40:
-		return "０,"
-	case 0x7C41:
-		return "１,"
-	case 0x7C42:
-		return "２,"
-	case 0x7C43:
-		return "３,"
-	case 0x7C44:
-		return "４,"
-	case 0x7C45:
-		return "５,"
-	case 0x7C46:
-		return "６,"
-	case 0x7C47:
-		return "７,"
-	case 0x7C48:
-		return "８,"
-	case 0x7C49:
-		return "９,"
-	case 0x7C4A:
-		return "(社)"
-	case 0x7C4B:
-		return "(財)"
-	case 0x7C4C:
-		return "(有)"
-	case 0x7C4D:
-		return "(株)"
-	case 0x7C4E:
-		return "(代)"
-	case 0x7C4F:
-		return "(問)"
-	case 0x7C50:
-		return "▶"
-	case 0x7C51:
-		return "◀"
-	case 0x7C52:
-		return "〖"
-	case 0x7C53:
-		return "〗"
-	case 0x7C54:
-		return "⟐"
-	case 0x7C55:
-		return "^2"
-	case 0x7C56:
-		return "^3"
-	case 0x7C57:
-		return "(CD)"
-	case 0x7C58:
-		return "(vn)"
-	case 0x7C59:
-		return "(ob)"
-	case 0x7C5A:
-		return "(cb)"
-	case 0x7C5B:
-		return "(ce"
-	case 0x7C5C:
-		return "mb)"
-	case 0x7C5D:
-		return "(hp)"
-	case 0x7C5E:
-		return "(br)"
-	case 0x7C5F:
-		return "(p)"
-	case 0x7C60:
-		return "(s)"
-	case 0x7C61:
-		return "(ms)"
-	case 0x7C62:
-		return "(t)"
-	case 0x7C63:
-		return "(bs)"
-	case 0x7C64:
-		return "(b)"
-	case 0x7C65:
-		return "(tb)"
-	case 0x7C66:
-		return "(tp)"
-	case 0x7C67:
-		return "(ds)"
-	case 0x7C68:
-		return "(ag)"
-	case 0x7C69:
-		return "(eg)"
-	case 0x7C6A:
-		return "(vo)"
-	case 0x7C6B:
-		return "(fl)"
-	case 0x7C6C:
-		return "(ke"
-	case 0x7C6D:
-		return "y)"
-	case 0x7C6E:
-		return "(sa"
-	case 0x7C6F:
-		return "x)"
-	case 0x7C70:
-		return "(sy"
-	case 0x7C71:
-		return "n)"
-	case 0x7C72:
-		return "(or"
-	case 0x7C73:
-		return "g)"
-	case 0x7C74:
-		return "(pe"
-	case 0x7C75:
-		return "r)"
-	case 0x7C76:
-		return "(R)"
-	case 0x7C77:
-		return "(C)"
-	case 0x7C78:
-		return "(箏)"
-	case 0x7C79:
-		return "DJ"
-	case 0x7C7A:
-		return "[演]"
-	case 0x7C7B:
-		return "Fax"
-
-	case 0x7D21:
-		return "㈪"
-	case 0x7D22:
-		return "㈫"
-	case 0x7D23:
-		return "㈬"
-	case 0x7D24:
-		return "㈭"
-	case 0x7D25:
-		return "㈮"
-	case 0x7D26:
-		return "㈯"
-	case 0x7D27:
-		return "㈰"
-	case 0x7D28:
-		return "㈷"
-	case 0x7D29:
-		return "㍾"
-	case 0x7D2A:
-		return "㍽"
-	case 0x7D2B:
-		return "㍼"
-	case 0x7D2C:
-		return "㍻"
-	case 0x7D2D:
-		return "№"
-	case 0x7D2E:
-		return "℡"
-	case 0x7D2F:
-		return "〶"
-	case 0x7D30:
-		return "○"
-	case 0x7D31:
-		return "〔本〕"
-	case 0x7D32:
-		return "〔三〕"
-	case 0x7D33:
-		return "〔二〕"
-	case 0x7D34:
-		return "〔安〕"
-	case 0x7D35:
-		return "〔点〕"
-	case 0x7D36:
-		return "〔打〕"
-	case 0x7D37:
-		return "〔盗〕"
-	case 0x7D38:
-		return "〔勝〕"
-	case 0x7D39:
-		return "〔敗〕"
-	case 0x7D3A:
-		return "〔Ｓ〕"
-	case 0x7D3B:
-		return "［投］"
-	case 0x7D3C:
-		return "［捕］"
-	case 0x7D3D:
-		return "［一］"
-	case 0x7D3E:
-		return "［二］"
-	case 0x7D3F:
-		return "［三］"
-	case 0x7D40:
-		return "［遊］"
-	case 0x7D41:
-		return "［左］"
-	case 0x7D42:
-		return "［中］"
-	case 0x7D43:
-		return "［右］"
-	case 0x7D44:
-		return "［指］"
-	case 0x7D45:
-		return "［走］"
-	case 0x7D46:
-		return "［打］"
-	case 0x7D47:
-		return "㍑"
-	case 0x7D48:
-		return "㎏"
-	case 0x7D49:
-		return "㎐"
-	case 0x7D4A:
-		return "ha"
-	case 0x7D4B:
-		return "㎞"
-	case 0x7D4C:
-		return "㎢"
-	case 0x7D4D:
-		return "㍱"
-	case 0x7D4E:
-		return "・"
-	case 0x7D4F:
-		return "・"
-	case 0x7D50:
-		return "1/2"
-	case 0x7D51:
-		return "0/3"
-	case 0x7D52:
-		return "1/3"
-	case 0x7D53:
-		return "2/3"
-	case 0x7D54:
-		return "1/4"
-	case 0x7D55:
-		return "3/4"
-	case 0x7D56:
-		return "1/5"
-	case 0x7D57:
-		return "2/5"
-	case 0x7D58:
-		return "3/5"
-	case 0x7D59:
-		return "4/5"
-	case 0x7D5A:
-		return "1/6"
-	case 0x7D5B:
-		return "5/6"
-	case 0x7D5C:
-		return "1/7"
-	case 0x7D5D:
-		return "1/8"
-	case 0x7D5E:
-		return "1/9"
-	case 0x7D5F:
-		return "1/10"
-	case 0x7D60:
-		return "☀"
-	case 0x7D61:
-		return "☁"
-	case 0x7D62:
-		return "☂"
-	case 0x7D63:
-		return "☃"
-	case 0x7D64:
-		return "☖"
-	case 0x7D65:
-		return "☗"
-	case 0x7D66:
-		return "▽"
-	case 0x7D67:
-		return "▼"
-	case 0x7D68:
-		return "♦"
-	case 0x7D69:
-		return "♥"
-	case 0x7D6A:
-		return "♣"
-	case 0x7D6B:
-		return "♠"
-	case 0x7D6C:
-		return "⌺"
-	case 0x7D6D:
-		return "⦿"
-	case 0x7D6E:
-		return "‼"
-	case 0x7D6F:
-		return "⁉"
-	case 0x7D70:
-		return "(曇/晴)"
-	case 0x7D71:
-		return "☔"
-	case 0x7D72:
-		return "(雨)"
-	case 0x7D73:
-		return "(雪)"
-	case 0x7D74:
-		return "(大雪)"
-	case 0x7D75:
-		return "⚡"
-	case 0x7D76:
-		return "(雷雨)"
-	case 0x7D77:
-		return "　"
-	case 0x7D78:
-		return "・"
-	case 0x7D79:
-		return "・"
-	case 0x7D7A:
-		return "♬"
-	case 0x7D7B:
-		return "☎"
-
-	case 0x7E21:
-		return "Ⅰ"
-	case 0x7E22:
-		return "Ⅱ"
-	case 0x7E23:
-		return "Ⅲ"
-	case 0x7E24:
-		return "Ⅳ"
-	case 0x7E25:
-		return "Ⅴ"
-	case 0x7E26:
-		return "Ⅵ"
-	case 0x7E27:
-		return "Ⅶ"
-	case 0x7E28:
-		return "Ⅷ"
-	case 0x7E29:
-		return "Ⅸ"
-	case 0x7E2A:
-		return "Ⅹ"
-	case 0x7E2B:
-		return "Ⅺ"
-	case 0x7E2C:
-		return "Ⅻ"
-	case 0x7E2D:
-		return "⑰"
-	case 0x7E2E:
-		return "⑱"
-	case 0x7E2F:
-		return "⑲"
-	case 0x7E30:
-		return "⑳"
-	case 0x7E31:
-		return "⑴"
-	case 0x7E32:
-		return "⑵"
-	case 0x7E33:
-		return "⑶"
-	case 0x7E34:
-		return "⑷"
-	case 0x7E35:
-		return "⑸"
-	case 0x7E36:
-		return "⑹"
-	case 0x7E37:
-		return "⑺"
-	case 0x7E38:
-		return "⑻"
-	case 0x7E39:
-		return "⑼"
-	case 0x7E3A:
-		return "⑽"
-	case 0x7E3B:
-		return "⑾"
-	case 0x7E3C:
-		return "⑿"
-	case 0x7E3D:
-		return "㉑"
-	case 0x7E3E:
-		return "㉒"
-	case 0x7E3F:
-		return "㉓"
-	case 0x7E40:
-		return "㉔"
-	case 0x7E41:
-		return "(A)"
-	case 0x7E42:
-		return "(B)"
-	case 0x7E43:
-		return "(C)"
-	case 0x7E44:
-		return "(D)"
-	case 0x7E45:
-		return "(E)"
-	case 0x7E46:
-		return "(F)"
-	case 0x7E47:
-		return "(G)"
-	case 0x7E48:
-		return "(H)"
-	case 0x7E49:
-		return "(I)"
-	case 0x7E4A:
-		return "(J)"
-	case 0x7E4B:
-		return "(K)"
-	case 0x7E4C:
-		return "(L)"
-	case 0x7E4D:
-		return "(M)"
-	case 0x7E4E:
-		return "(N)"
-	case 0x7E4F:
-		return "(O)"
-	case 0x7E50:
-		return "(P)"
-	case 0x7E51:
-		return "(Q)"
-	case 0x7E52:
-		return "(R)"
-	case 0x7E53:
-		return "(S)"
-	case 0x7E54:
-		return "(T)"
-	case 0x7E55:
-		return "(U)"
-	case 0x7E56:
-		return "(V)"
-	case 0x7E57:
-		return "(W)"
-	case 0x7E58:
-		return "(X)"
-	case 0x7E59:
-		return "(Y)"
-	case 0x7E5A:
-		return "(Z)"
-	case 0x7E5B:
-		return "㉕"
-	case 0x7E5C:
-		return "㉖"
-	case 0x7E5D:
-		return "㉗"
-	case 0x7E5E:
-		return "㉘"
-	case 0x7E5F:
-		return "㉙"
-	case 0x7E60:
-		return "㉚"
-	case 0x7E61:
-		return "①"
-	case 0x7E62:
-		return "②"
-	case 0x7E63:
-		return "③"
-	case 0x7E64:
-		return "④"
-	case 0x7E65:
-		return "⑤"
-	case 0x7E66:
-		return "⑥"
-	case 0x7E67:
-		return "⑦"
-	case 0x7E68:
-		return "⑧"
-	case 0x7E69:
-		return "⑨"
-	case 0x7E6A:
-		return "⑩"
-	case 0x7E6B:
-		return "⑪"
-	case 0x7E6C:
-		return "⑫"
-	case 0x7E6D:
-		return "⑬"
-	case 0x7E6E:
-		return "⑭"
-	case 0x7E6F:
-		return "⑮"
-	case 0x7E70:
-		return "⑯"
-	case 0x7E71:
-		return "❶"
-	case 0x7E72:
-		return "❷"
-	case 0x7E73:
-		return "❸"
-	case 0x7E74:
-		return "❹"
-	case 0x7E75:
-		return "❺"
-	case 0x7E76:
-		return "❻"
-	case 0x7E77:
-		return "❼"
-	case 0x7E78:
-		return "❽"
-	case 0x7E79:
-		return "❾"
-	case 0x7E7A:
-		return "❿"
-	case 0x7E7B:
-		return "⓫"
-	case 0x7E7C:
-		return "⓬"
-	case 0x7E7D:
-		return "㉛"
-
-	case 0x7521:
-		return "㐂"
-	case 0x7522:
-		return "亭"
-	case 0x7523:
-		return "份"
-	case 0x7524:
-		return "仿"
-	case 0x7525:
-		return "侚"
-	case 0x7526:
-		return "俉"
-	case 0x7527:
-		return "傜"
-	case 0x7528:
-		return "儞"
-	case 0x7529:
-		return "冼"
-	case 0x752A:
-		return "㔟"
-	case 0x752B:
-		return "匇"
-	case 0x752C:
-		return "卡"
-	case 0x752D:
-		return "卬"
-	case 0x752E:
-		return "詹"
-	case 0x752F:
-		return "吉"
-	case 0x7530:
-		return "呍"
-	case 0x7531:
-		return "咖"
-	case 0x7532:
-		return "咜"
-	case 0x7533:
-		return "咩"
-	case 0x7534:
-		return "唎"
-	case 0x7535:
-		return "啊"
-	case 0x7536:
-		return "噲"
-	case 0x7537:
-		return "囤"
-	case 0x7538:
-		return "圳"
-	case 0x7539:
-		return "圴"
-	case 0x753A:
-		return "塚"
-	case 0x753B:
-		return "墀"
-	case 0x753C:
-		return "姤"
-	case 0x753D:
-		return "娣"
-	case 0x753E:
-		return "婕"
-	case 0x753F:
-		return "寬"
-	case 0x7540:
-		return "﨑"
-	case 0x7541:
-		return "㟢"
-	case 0x7542:
-		return "庬"
-	case 0x7543:
-		return "弴"
-	case 0x7544:
-		return "彅"
-	case 0x7545:
-		return "德"
-	case 0x7546:
-		return "怗"
-	case 0x7547:
-		return "恵"
-	case 0x7548:
-		return "愰"
-	case 0x7549:
-		return "昤"
-	case 0x754A:
-		return "曈"
-	case 0x754B:
-		return "曙"
-	case 0x754C:
-		return "曺"
-	case 0x754D:
-		return "曻"
-	case 0x754E:
-		return "桒"
-	case 0x754F:
-		return "・"
-	case 0x7550:
-		return "椑"
-	case 0x7551:
-		return "椻"
-	case 0x7552:
-		return "橅"
-	case 0x7553:
-		return "檑"
-	case 0x7554:
-		return "櫛"
-	case 0x7555:
-		return "・"
-	case 0x7556:
-		return "・"
-	case 0x7557:
-		return "・"
-	case 0x7558:
-		return "毱"
-	case 0x7559:
-		return "泠"
-	case 0x755A:
-		return "洮"
-	case 0x755B:
-		return "海"
-	case 0x755C:
-		return "涿"
-	case 0x755D:
-		return "淊"
-	case 0x755E:
-		return "淸"
-	case 0x755F:
-		return "渚"
-	case 0x7560:
-		return "潞"
-	case 0x7561:
-		return "濹"
-	case 0x7562:
-		return "灤"
-	case 0x7563:
-		return "・"
-	case 0x7564:
-		return "・"
-	case 0x7565:
-		return "煇"
-	case 0x7566:
-		return "燁"
-	case 0x7567:
-		return "爀"
-	case 0x7568:
-		return "玟"
-	case 0x7569:
-		return "・"
-	case 0x756A:
-		return "珉"
-	case 0x756B:
-		return "珖"
-	case 0x756C:
-		return "琛"
-	case 0x756D:
-		return "琡"
-	case 0x756E:
-		return "琢"
-	case 0x756F:
-		return "琦"
-	case 0x7570:
-		return "琪"
-	case 0x7571:
-		return "琬"
-	case 0x7572:
-		return "琹"
-	case 0x7573:
-		return "瑋"
-	case 0x7574:
-		return "㻚"
-	case 0x7575:
-		return "畵"
-	case 0x7576:
-		return "疁"
-	case 0x7577:
-		return "睲"
-	case 0x7578:
-		return "䂓"
-	case 0x7579:
-		return "磈"
-	case 0x757A:
-		return "磠"
-	case 0x757B:
-		return "祇"
-	case 0x757C:
-		return "禮"
-	case 0x757D:
-		return "・"
-	case 0x757E:
-		return "・"
-
-	case 0x7621:
-		return "・"
-	case 0x7622:
-		return "秚"
-	case 0x7623:
-		return "稞"
-	case 0x7624:
-		return "筿"
-	case 0x7625:
-		return "簱"
-	case 0x7626:
-		return "䉤"
-	case 0x7627:
-		return "綋"
-	case 0x7628:
-		return "羡"
-	case 0x7629:
-		return "脘"
-	case 0x762A:
-		return "脺"
-	case 0x762B:
-		return "・"
-	case 0x762C:
-		return "芮"
-	case 0x762D:
-		return "葛"
-	case 0x762E:
-		return "蓜"
-	case 0x762F:
-		return "蓬"
-	case 0x7630:
-		return "蕙"
-	case 0x7631:
-		return "藎"
-	case 0x7632:
-		return "蝕"
-	case 0x7633:
-		return "蟬"
-	case 0x7634:
-		return "蠋"
-	case 0x7635:
-		return "裵"
-	case 0x7636:
-		return "角"
-	case 0x7637:
-		return "諶"
-	case 0x7638:
-		return "跎"
-	case 0x7639:
-		return "辻"
-	case 0x763A:
-		return "迶"
-	case 0x763B:
-		return "郝"
-	case 0x763C:
-		return "鄧"
-	case 0x763D:
-		return "鄭"
-	case 0x763E:
-		return "醲"
-	case 0x763F:
-		return "鈳"
-	case 0x7640:
-		return "銈"
-	case 0x7641:
-		return "錡"
-	case 0x7642:
-		return "鍈"
-	case 0x7643:
-		return "閒"
-	case 0x7644:
-		return "雞"
-	case 0x7645:
-		return "餃"
-	case 0x7646:
-		return "饀"
-	case 0x7647:
-		return "髙"
-	case 0x7648:
-		return "鯖"
-	case 0x7649:
-		return "鷗"
-	case 0x764A:
-		return "麴"
-	case 0x764B:
-		return "麵"
+// logUnhandled logs a code the decoders of the caption streams couldn't
+// handle, unless -report counts it. Unhandled control codes are always
+// logged, while CSI and characters of unknown sets are common enough to be
+// logged only in debug mode. Unknown gaiji are written as placeholders,
+// which show them.
+func (state *AnalyzerState) logUnhandled(kind, code string) {
+	state.unhandledCodes++
+	if state.unhandled.note(kind, code) {
+		return
+	}
+	switch kind {
+	case aribcaption.UnhandledC0, aribcaption.UnhandledC1:
+	case aribcaption.UnhandledCSI, aribcaption.UnhandledCharacter:
+		if !debugMode() {
+			return
+		}
 	default:
-		return fmt.Sprintf("{gaiji 0x%x}", c)
+		return
 	}
+	fmt.Fprintf(os.Stderr, "%s: %s\n", kind, code)
+}
+
+// lookupDRCS returns the replacement of a glyph for which the built-in table
+// gave s. A replacement in -drcs-cache comes first, then s, -drcs-db, which
+// records the glyph unless it has a replacement, and -drcs-pua. -drcs-cache
+// records the glyph with the replacement chosen.
+func (state *AnalyzerState) lookupDRCS(s, md5sum string, width, height, bits int, pattern []byte) string {
+	if state.drcsCache != nil {
+		if cached := state.drcsCache.lookup(md5sum); cached != "" {
+			return cached
+		}
+	}
+	if s == "" && state.drcsDB != nil {
+		s = state.drcsDB.lookup(md5sum)
+		if s == "" {
+			state.drcsDB.record(md5sum, width, height, bits, pattern)
+		}
+	}
+	if s == "" && state.drcsPUA {
+		s = drcsPUA(md5sum, state.drcsCache)
+		if s != "" && debugMode() {
+			fmt.Fprintf(os.Stderr, "Replaced DRCS %s with U+%04X\n", md5sum, []rune(s)[0])
+		}
+	}
+	if state.drcsCache != nil {
+		state.drcsCache.remember(md5sum, s, width, height, bits, pattern)
+	}
+	return s
+}
+
+// writeDRCSPNG writes the glyph to dir unless a file of the same MD5 is
+// there already.
+func writeDRCSPNG(dir, md5sum string, width, height, bits int, pattern []byte) {
+	path := filepath.Join(dir, md5sum+".png")
+	if _, err := os.Stat(path); err == nil {
+		return
+	}
+	e := &drcsEntry{Width: width, Height: height, Bits: bits}
+	if err := writePNG(path, e.image(pattern, drcsGlyphScale)); err != nil {
+		panic(err)
+	}
+	if debugMode() {
+		fmt.Fprintf(os.Stderr, "Wrote DRCS bitmap %s\n", path)
+	}
+}
+
+// drcsDrawing returns the glyph as an inline ASS drawing. A pixel of the
+// pattern is a pixel of the HD caption plane, and each row is drawn as
+// rectangles over its runs of pixels of half the gradation or more, since a
+// drawing has a single color. It returns an empty string for a blank glyph.
+func drcsDrawing(width, height, bits int, pattern []byte) string {
+	e := &drcsEntry{Width: width, Height: height, Bits: bits}
+	// \p4 draws in eighths of a pixel of the script.
+	unitX := func(v int) int {
+		return (v*8*aribcaption.PlayResX + aribcaption.PlaneWidth/2) / aribcaption.PlaneWidth
+	}
+	unitY := func(v int) int {
+		return (v*8*aribcaption.PlayResY + aribcaption.PlaneHeight/2) / aribcaption.PlaneHeight
+	}
+	var commands []string
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; {
+			if e.pixel(pattern, x, y) < 0.5 {
+				x++
+				continue
+			}
+			start := x
+			for x < width && e.pixel(pattern, x, y) >= 0.5 {
+				x++
+			}
+			x0, x1, y0, y1 := unitX(start), unitX(x), unitY(y), unitY(y+1)
+			commands = append(commands, fmt.Sprintf("m %d %d l %d %d %d %d %d %d", x0, y0, x1, y0, x1, y1, x0, y1))
+		}
+	}
+	if len(commands) == 0 {
+		return ""
+	}
+	return "{\\p4}" + strings.Join(commands, " ") + "{\\p0}"
 }
 
 const K int64 = 27000000
 
+func isPcrDiscontinuity(previous, current SystemClock) bool {
+	return tspacket.IsPCRDiscontinuity(int64(previous), int64(current))
+}
+
+// since returns the time from start to clock, across the wrap around of PCR.
+func (clock SystemClock) since(start SystemClock) SystemClock {
+	return SystemClock(tspacket.PCRSince(int64(start), int64(clock)))
+}
+
 func (clock SystemClock) centitime() int64 {
 	return int64(clock) / (K / 100)
 }
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tsgen"
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+// sectionPacket puts a section, with CRC_32 appended, in a TS packet of pid.
+func sectionPacket(pid, continuity int, section []byte) tspacket.Packet {
+	// section_length counts the bytes after it, including CRC_32.
+	length := len(section) - 3 + 4
+	section[1] = section[1]&0xf0 | byte(length>>8)
+	section[2] = byte(length)
+	crc := tspacket.CRC32(section)
+	section = append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+
+	packet := make([]byte, 188)
+	for i := range packet {
+		packet[i] = 0xff
+	}
+	packet[0] = tspacket.SyncByte
+	packet[1] = 0x40 | byte(pid>>8)
+	packet[2] = byte(pid)
+	packet[3] = 0x10 | byte(continuity&0x0f)
+	// pointer_field
+	packet[4] = 0
+	copy(packet[5:], section)
+	return packet
+}
+
+// TestSnapshotWhileAnalyzing analyzes a stream on the demuxing and decoding
+// stages while another goroutine reads what the analyzer publishes, the
+// snapshots it hands out and the counters of -metrics served over HTTP, which
+// go test -race checks for shared memory.
+func TestSnapshotWhileAnalyzing(t *testing.T) {
+	var ts bytes.Buffer
+	if err := tsgen.Write(&ts, &tsgen.Script{
+		Start: time.Date(2024, time.April, 1, 21, 0, 0, 0, time.UTC),
+		Cues: []tsgen.Cue{
+			{Time: time.Second, Text: "字幕"},
+			{Time: 2 * time.Second, Text: "もう一つ"},
+			{Time: 3 * time.Second},
+		},
+		Duration: 4 * time.Second,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	state := newAnalyzerState()
+	state.decoder = startDecodeStage()
+	metrics := &metricsExporter{}
+	state.emit = metrics.handle
+	snapshots := make(chan analyzerSnapshot, 16)
+	state.clockTick = func(snapshot analyzerSnapshot) {
+		metrics.tick(snapshot)
+		select {
+		case snapshots <- snapshot:
+		default:
+		}
+	}
+	stop := make(chan struct{})
+	done := make(chan analyzerSnapshot)
+	go func() {
+		var last analyzerSnapshot
+		for {
+			select {
+			case s := <-snapshots:
+				last = s
+			case <-stop:
+				done <- last
+				return
+			default:
+				metrics.serve(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+			}
+		}
+	}()
+	err := analyzeStream(context.Background(), io.NopCloser(&ts), state)
+	state.decoder.stop()
+	snapshots <- state.snapshot()
+	for len(snapshots) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	last := <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.CaptionPid != tsgen.CaptionPID || last.PcrPid != tsgen.PCRPID || last.ProgramNumber != tsgen.ProgramNumber {
+		t.Errorf("snapshot has caption PID 0x%x, PCR_PID 0x%x and program %d", last.CaptionPid, last.PcrPid, last.ProgramNumber)
+	}
+	if last.Language != "jpn" || last.Clock == 0 || last.Packets == 0 {
+		t.Errorf("snapshot has language %q, clock %d and %d packets", last.Language, last.Clock, last.Packets)
+	}
+
+	w := httptest.NewRecorder()
+	metrics.serve(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		fmt.Sprintf("\nassdumper_caption_pid %d\n", tsgen.CaptionPID),
+		"\nassdumper_captions_total 3\n",
+		"\nassdumper_continuity_errors_total 0\n",
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("metrics lack %q:\n%s", strings.TrimSpace(want), w.Body.String())
+		}
+	}
+}
+
+// TestScrambledCaption drops the payload of the caption ES while it's
+// scrambled, and warns of it.
+func TestScrambledCaption(t *testing.T) {
+	pat := []byte{0x00, 0xb0, 0x00, 0x00, 0x01, 0xc1, 0x00, 0x00, 0x00, 0x01, 0xe1, 0xf0}
+	pmt := []byte{
+		0x02, 0xb0, 0x00, 0x00, 0x01, 0xc1, 0x00, 0x00, 0xe1, 0x00, 0xf0, 0x00,
+		0x06, 0xe1, 0x30, 0xf0, 0x03, 0x52, 0x01, 0x87,
+	}
+	state := newAnalyzerState()
+	state.emit = func(Event) {}
+	state.demux.Push(sectionPacket(0x0000, 0, pat))
+	state.demux.Push(sectionPacket(0x01f0, 0, pmt))
+
+	packet := make(tspacket.Packet, tspacket.Size)
+	copy(packet, []byte{tspacket.SyncByte, 0x41, 0x30, 0x10, 0x00, 0x00, 0x01, 0xbd, 0x00, 0x00, 0x80, 0x80, 0x05})
+	// transport_scrambling_control of the odd key
+	packet[3] |= 0xc0
+	state.demux.Push(packet)
+	if state.demux.ScrambledPackets() != 1 || !state.scrambledPids[0x130] {
+		t.Errorf("scrambled packets = %d, PIDs = %v", state.demux.ScrambledPackets(), state.scrambledPids)
+	}
+	if len(state.caption.payload) != 0 {
+		t.Errorf("payload = % x", state.caption.payload)
+	}
+}
+
+// FuzzHandleSection gives a section, with a correct CRC_32 so that it's
+// parsed, to the handler of every kind of PID once the program is known.
+func FuzzHandleSection(f *testing.F) {
+	// SDT with a service descriptor of 0x400
+	f.Add([]byte{0x42, 0xf0, 0x00, 0x00, 0x01, 0xc1, 0x00, 0x00, 0x00, 0x04, 0xff,
+		0x04, 0x00, 0xfc, 0x80, 0x08, 0x48, 0x06, 0x01, 0x00, 0x03, 0x24, 0x46, 0x24})
+	// EIT[p/f] of 0x400 with a short event descriptor
+	f.Add([]byte{0x4e, 0xf0, 0x00, 0x04, 0x00, 0xc1, 0x00, 0x01, 0x00, 0x01, 0x00, 0x04, 0x01, 0x4e,
+		0x00, 0x01, 0xe8, 0x9d, 0x21, 0x00, 0x00, 0x00, 0x30, 0x00, 0x80, 0x09,
+		0x4d, 0x07, 'j', 'p', 'n', 0x02, 0x24, 0x22, 0x00})
+	f.Add([]byte{0x02, 0xb0, 0x00, 0x04, 0x00, 0xc1, 0x00, 0x00, 0xe1, 0x00, 0xf0, 0x00,
+		0x06, 0xe1, 0x30, 0xf0, 0x08, 0x52, 0x01, 0x87, 0xfd, 0x03, 0x00, 0x08, 0x3d,
+		0x0f, 0xe1, 0x11, 0xf0, 0x0b, 0xc4, 0x09, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 'j', 'p', 'n'})
+	f.Fuzz(func(t *testing.T, section []byte) {
+		if len(section) < 3 || len(section) > 1024 {
+			return
+		}
+		for _, kind := range []pidKind{pidPAT, pidPMT, pidSDT, pidEIT, pidTOT} {
+			state := newAnalyzerState()
+			state.emit = func(Event) {}
+			state.tableVersions = make(map[sectionKey]int)
+			state.pmtPids = map[int]int{tsgen.PMTPID: tsgen.ProgramNumber}
+			state.pcrPid = tsgen.PCRPID
+			state.programNumber = tsgen.ProgramNumber
+			state.currentTimestamp = 27000000
+			s := append([]byte(nil), section...)
+			// section_length counts the bytes after it, including CRC_32.
+			length := len(s) - 3 + 4
+			s[1] = s[1]&0xf0 | byte(length>>8)
+			s[2] = byte(length)
+			crc := tspacket.CRC32(s)
+			handleSection(tsgen.PMTPID, kind, append(s, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc)), state)
+		}
+	})
+}
+
+// FuzzAnalyzePackets analyzes arbitrary packets, starting from a stream of
+// tsgen that has the analyzer follow the caption ES.
+func FuzzAnalyzePackets(f *testing.F) {
+	var ts bytes.Buffer
+	if err := tsgen.Write(&ts, &tsgen.Script{
+		Start: time.Date(2024, time.April, 1, 21, 0, 0, 0, time.UTC),
+		Cues: []tsgen.Cue{
+			{Time: 100 * time.Millisecond, Text: "字幕ABC"},
+			{Time: 200 * time.Millisecond},
+		},
+	}); err != nil {
+		f.Fatal(err)
+	}
+	f.Add(ts.Bytes())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		state := newAnalyzerState()
+		state.emit = func(Event) {}
+		for len(data) >= tspacket.Size {
+			// Reader only gives packets starting with sync_byte.
+			packet := append(tspacket.Packet(nil), data[:tspacket.Size]...)
+			packet[0] = tspacket.SyncByte
+			state.demux.Push(packet)
+			data = data[tspacket.Size:]
+		}
+		state.demux.Flush()
+	})
+}
+
+// TestJoinedInputs analyzes a recording split into two files as the inputs
+// are analyzed one after another. The PCR of the second file starts over,
+// which is stitched so that the captions go on at the times of TOT, and the
+// caption on the screen sent again at its head isn't shown twice.
+func TestJoinedInputs(t *testing.T) {
+	first := generateTS(t, `@start 2024-04-01T21:00:00+09:00
+1s	前半
+3s	続き
+@duration 4s
+`)
+	second := generateTS(t, `@start 2024-04-01T21:00:04+09:00
+0s	続き
+2s	後半
+3s
+`)
+	var out bytes.Buffer
+	r := newFormatRenderer(&out, "test-tsv")
+	state := newAnalyzerState()
+	var discontinuities int
+	state.emit = func(ev Event) {
+		if _, ok := ev.(ClockDiscontinuity); ok {
+			discontinuities++
+		}
+		r.handle(ev)
+	}
+	for _, ts := range [][]byte{first, second} {
+		if err := analyzeStream(context.Background(), io.NopCloser(bytes.NewReader(ts)), state); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if discontinuities != 1 || state.retransmissions != 1 {
+		t.Errorf("%d discontinuities and %d retransmissions", discontinuities, state.retransmissions)
+	}
+	// The times are in centiseconds, here of the minute.
+	want := "start\tend\ttext\n100\t300\t前半\n300\t600\t続き\n600\t700\t後半\nend\n"
+	if out.String() != want {
+		t.Errorf("got\n%swant\n%s", out.String(), want)
+	}
+}
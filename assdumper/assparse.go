@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// assScript is a script in the ASS or SSA dialect assdumper writes, read
+// back for tools that convert, compare or retime earlier output. The lines
+// before the first Dialogue line are kept as they are.
+type assScript struct {
+	header    []string
+	title     string
+	legacy    bool
+	dialogues []assDialogue
+}
+
+// assDialogue is a Dialogue line. start and end are in centiseconds from
+// the midnight before the first line, since the times have no date.
+type assDialogue struct {
+	layer int
+	start int64
+	end   int64
+	text  string
+}
+
+const centisecondsPerDay = 24 * 60 * 60 * 100
+
+// parseASS reads a script written by assRenderer.
+func parseASS(r io.Reader) (*assScript, error) {
+	s := &assScript{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	day := int64(0)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if !strings.HasPrefix(line, "Dialogue: ") {
+			if len(s.dialogues) != 0 {
+				if line == "" {
+					continue
+				}
+				return nil, fmt.Errorf("line %d: unexpected line after Dialogue lines", lineno)
+			}
+			s.header = append(s.header, line)
+			if strings.HasPrefix(line, "Title: ") {
+				s.title = strings.TrimPrefix(line, "Title: ")
+			}
+			if line == "ScriptType: v4.00" {
+				s.legacy = true
+			}
+			continue
+		}
+		// Layer (Marked in SSA), Start, End, Style, Name, MarginL, MarginR,
+		// MarginV, Effect, Text
+		fields := strings.SplitN(strings.TrimPrefix(line, "Dialogue: "), ",", 10)
+		if len(fields) != 10 {
+			return nil, fmt.Errorf("line %d: Dialogue has %d fields", lineno, len(fields))
+		}
+		d := assDialogue{text: fields[9]}
+		if !strings.HasPrefix(fields[0], "Marked=") {
+			layer, err := strconv.Atoi(fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid layer: %v", lineno, err)
+			}
+			d.layer = layer
+		}
+		start, err := parseASSTime(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineno, err)
+		}
+		end, err := parseASSTime(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineno, err)
+		}
+		// The lines are in order, so a time going back by more than half a
+		// day has passed midnight.
+		if n := len(s.dialogues); n != 0 && start+day < s.dialogues[n-1].start-centisecondsPerDay/2 {
+			day += centisecondsPerDay
+		}
+		d.start = start + day
+		d.end = end + day
+		if d.end < d.start {
+			d.end += centisecondsPerDay
+		}
+		s.dialogues = append(s.dialogues, d)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// parseASSTime parses H:MM:SS.cc into centiseconds.
+func parseASSTime(s string) (int64, error) {
+	var h, m, sec, centi int64
+	if _, err := fmt.Sscanf(s, "%d:%d:%d.%d", &h, &m, &sec, &centi); err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return ((h*60+m)*60+sec)*100 + centi, nil
+}
+
+// events turns the script back into the events assRenderer renders it from.
+// Each Dialogue line is a caption unit at its start, gaps between lines are
+// filled with empty units, and ruby lines on layer 1 go back into the line
+// over which they were placed. Rendering the events again gives the same ASS
+// script, but SSA lost the override tags it lacks on the way.
+func (s *assScript) events() []Event {
+	var events []Event
+	if s.title != "" {
+		events = append(events, TableChange{Table: "SDT", ServiceName: s.title})
+	}
+	midnight := time.Date(1970, time.January, 1, 0, 0, 0, 0, time.Local).Unix()
+	events = append(events, ClockAnchor{PCR: 0, Time: midnight})
+	clock := func(centi int64) SystemClock {
+		return SystemClock(centi * (K / 100))
+	}
+
+	var units []CaptionUnit
+	var ends []int64
+	var rubies []string
+	for _, d := range s.dialogues {
+		text := d.text
+		if d.layer == 1 && len(units) != 0 {
+			if ruby, ok := parseRubyLine(removeFlashing(text)); ok {
+				rubies[len(rubies)-1] += ruby
+				continue
+			}
+		}
+		confidence := 1.0
+		if strings.HasPrefix(text, "{low-confidence ") {
+			if n := strings.IndexByte(text, '}'); n != -1 {
+				if c, err := strconv.ParseFloat(text[len("{low-confidence "):n], 64); err == nil {
+					confidence = c
+					text = text[n+1:]
+				}
+			}
+		}
+		units = append(units, CaptionUnit{PCR: clock(d.start), Text: removeFlashing(text), Confidence: confidence})
+		ends = append(ends, d.end)
+		rubies = append(rubies, "")
+	}
+	for i, unit := range units {
+		unit.Text = "\f" + rubies[i] + unit.Text
+		if i != 0 && ends[i-1] != unit.PCR.centitime() {
+			events = append(events, CaptionUnit{PCR: clock(ends[i-1]), Confidence: 1})
+		}
+		events = append(events, unit)
+	}
+	if len(ends) != 0 {
+		events = append(events, CaptionUnit{PCR: clock(ends[len(ends)-1]), Confidence: 1})
+	}
+	return events
+}
+
+// parseRubyLine turns a ruby line written by extractRuby back into the
+// comments the decoder encloses ruby in.
+func parseRubyLine(text string) (string, bool) {
+	var x, y int
+	n := strings.Index(text, "\\fscx50\\fscy50}")
+	if n == -1 {
+		return "", false
+	}
+	if _, err := fmt.Sscanf(text[:n], "{\\an7\\pos(%d,%d)", &x, &y); err != nil {
+		return "", false
+	}
+	return fmt.Sprintf("{ruby %d,%d}%s{/ruby}", x, y, text[n+len("\\fscx50\\fscy50}"):]), true
+}
+
+// removeFlashing takes out the animations animateFlashing wrote after the
+// flashing comments.
+func removeFlashing(text string) string {
+	for _, comment := range []string{"{flash}", "{flash inverted}", "{/flash}"} {
+		var b strings.Builder
+		for {
+			start := strings.Index(text, comment+"{")
+			if start == -1 {
+				break
+			}
+			start += len(comment)
+			end := strings.IndexByte(text[start:], '}')
+			if end == -1 {
+				break
+			}
+			b.WriteString(text[:start])
+			text = text[start+end+1:]
+		}
+		b.WriteString(text)
+		text = b.String()
+	}
+	return text
+}
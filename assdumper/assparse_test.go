@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func renderASSEvents(t *testing.T, r *assRenderer, out *bytes.Buffer, events []Event) string {
+	t.Helper()
+	for _, ev := range events {
+		r.handle(ev)
+	}
+	if err := r.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+// TestParseASSRoundTrip renders caption units, reads the script back and
+// renders the events it gives again, which must give the same script.
+func TestParseASSRoundTrip(t *testing.T) {
+	anchor := time.Date(2020, time.April, 1, 23, 59, 0, 0, time.Local).Unix()
+	unit := func(seconds float64, text string) CaptionUnit {
+		return CaptionUnit{PCR: SystemClock(seconds * float64(K)), Text: text, Confidence: 1}
+	}
+	cases := []struct {
+		name   string
+		events []Event
+	}{
+		{
+			name: "plain",
+			events: []Event{
+				TableChange{Table: "SDT", ServiceName: "テスト"},
+				ClockAnchor{PCR: 0, Time: anchor},
+				unit(1, "\fこんにちは"),
+				unit(3, "\fさようなら"),
+				unit(5, "\f"),
+				unit(10, "\f{\\c&H00FFFF&}黄色{\\c&HFFFFFF&}"),
+				unit(12, "\f"),
+			},
+		},
+		{
+			name: "across midnight",
+			events: []Event{
+				ClockAnchor{PCR: 0, Time: anchor},
+				unit(50, "\f前"),
+				unit(70, "\f後"),
+				unit(75, "\f"),
+			},
+		},
+		{
+			name: "ruby",
+			events: []Event{
+				ClockAnchor{PCR: 0, Time: anchor},
+				unit(1, "\f{ruby 100,200}かんじ{/ruby}漢字"),
+				unit(4, "\f"),
+			},
+		},
+		{
+			name: "low confidence",
+			events: []Event{
+				ClockAnchor{PCR: 0, Time: anchor},
+				CaptionUnit{PCR: SystemClock(K), Text: "\f受信不良", Confidence: 0.5},
+				unit(2, "\f"),
+			},
+		},
+	}
+
+	for _, c := range cases {
+		for _, legacy := range []bool{false, true} {
+			newRenderer := newASSRenderer
+			if legacy {
+				newRenderer = newSSARenderer
+			}
+			var first, second bytes.Buffer
+			want := renderASSEvents(t, newRenderer(&first), &first, c.events)
+			script, err := parseASS(bytes.NewReader(first.Bytes()))
+			if err != nil {
+				t.Fatalf("%s (legacy=%v): %v", c.name, legacy, err)
+			}
+			if len(script.dialogues) == 0 {
+				t.Fatalf("%s (legacy=%v): no Dialogue lines in\n%s", c.name, legacy, want)
+			}
+			if script.legacy != legacy {
+				t.Errorf("%s: legacy = %v, want %v", c.name, script.legacy, legacy)
+			}
+			got := renderASSEvents(t, newRenderer(&second), &second, script.events())
+			if got != want {
+				t.Errorf("%s (legacy=%v): rendered again\n%s\nwant\n%s", c.name, legacy, got, want)
+			}
+		}
+	}
+}
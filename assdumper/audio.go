@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/aribcaption"
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+// audioStream is an audio ES of a PMT, with the audio component descriptor
+// of PMT or, as broadcasters mostly send it, of the present event of EIT.
+type audioStream struct {
+	ProgramNumber int    `json:"program_number"`
+	PID           int    `json:"pid"`
+	StreamType    int    `json:"stream_type"`
+	Codec         string `json:"codec"`
+	ComponentTag  int    `json:"component_tag"`
+	// Languages are ISO_639_language_code of the audio component
+	// descriptor, or of the ISO 639 language descriptor without it. A
+	// dual mono ES has those of the main and sub channel.
+	Languages     []string `json:"languages"`
+	ComponentType string   `json:"component_type,omitempty"`
+	DualMono      bool     `json:"dual_mono"`
+	Main          bool     `json:"main"`
+	SamplingRate  string   `json:"sampling_rate,omitempty"`
+	Text          string   `json:"text,omitempty"`
+}
+
+// audioComponent is an audio component descriptor.
+// [B10] 6.2.26 Audio component descriptor
+type audioComponent struct {
+	componentType int
+	componentTag  int
+	main          bool
+	samplingRate  int
+	languages     []string
+	text          string
+}
+
+// audioScanner reads PAT and PMT with infoScanner, and the audio component
+// descriptors of the present event of every program from EIT[p/f].
+type audioScanner struct {
+	demux *tspacket.Demuxer
+	info  *infoScanner
+	// components maps service_id to the audio component descriptors of
+	// its present event.
+	components map[int][]audioComponent
+}
+
+func runAudio(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("audio", flag.ExitOnError)
+	jsonOutput := fs.Bool("json", false, "print the audio streams as JSON")
+	inputOpts := registerInputFlags(fs)
+	fs.Parse(args)
+
+	fin, err := openInput(ctx, fs.Arg(0), inputOpts)
+	if err != nil {
+		panic(err)
+	}
+	defer fin.Close()
+	s := newAudioScanner()
+	if err := demuxInput(ctx, s.demux, fin); err != nil && ctx.Err() == nil {
+		panic(err)
+	}
+	if s.info.info == nil {
+		fmt.Fprintln(os.Stderr, "No PAT found")
+		os.Exit(1)
+	}
+	streams := s.audioStreams()
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(streams); err != nil {
+			panic(err)
+		}
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PROGRAM\tPID\tTAG\tCODEC\tLANGUAGE\tCOMPONENT\tDUAL-MONO\tMAIN\tSAMPLING\tTEXT")
+	for _, a := range streams {
+		tag := "-"
+		if a.ComponentTag != -1 {
+			tag = fmt.Sprintf("0x%02x", a.ComponentTag)
+		}
+		dualMono, main := "-", "-"
+		if a.DualMono {
+			dualMono = "yes"
+		}
+		if a.Main {
+			main = "yes"
+		}
+		fmt.Fprintf(w, "%d\t0x%04x\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", a.ProgramNumber, a.PID, tag, a.Codec, orDash(strings.Join(a.Languages, "+")), orDash(a.ComponentType), dualMono, main, orDash(a.SamplingRate), orDash(a.Text))
+	}
+	w.Flush()
+}
+
+func newAudioScanner() *audioScanner {
+	demux := tspacket.NewDemuxer(nil)
+	s := &audioScanner{
+		demux:      demux,
+		info:       newInfoScanner(demux, false),
+		components: make(map[int][]audioComponent),
+	}
+	demux.HandleSections(0x0012, func(section []byte) {
+		if tspacket.CRC32(section) == 0 {
+			s.handleEIT(section)
+		}
+	})
+	demux.HandlePackets(func(tspacket.Packet) {
+		if s.done() {
+			demux.Stop()
+		}
+	})
+	return s
+}
+
+// done tells whether every PMT and the present event of every program are
+// found, or servicesScanLimit packets have been read without them.
+func (s *audioScanner) done() bool {
+	if !s.info.done() {
+		return false
+	}
+	if s.demux.Packets() >= servicesScanLimit {
+		return true
+	}
+	for program_number := range s.info.programs {
+		if _, ok := s.components[program_number]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// handleEIT keeps the audio component descriptors of the present event of
+// EIT[p/f] actual.
+func (s *audioScanner) handleEIT(section []byte) {
+	// [B10] 5.2.7 Event Information Table
+	if section[0] != 0x4E || len(section) < 14 || section[6] != 0 {
+		return
+	}
+	section_length := int(section[1]&0x0F)<<8 | int(section[2])
+	end := 3 + section_length - 4
+	if 3+section_length > len(section) || end < 26 {
+		return
+	}
+	service_id := int(section[3])<<8 | int(section[4])
+	descriptors_loop_length := int(section[24]&0x0F)<<8 | int(section[25])
+	if 26+descriptors_loop_length > end {
+		return
+	}
+	components := []audioComponent{}
+	forEachDescriptor(section[26:26+descriptors_loop_length], func(tag byte, d []byte) {
+		if c, ok := parseAudioComponent(tag, d); ok {
+			components = append(components, c)
+		}
+	})
+	s.components[service_id] = components
+}
+
+// parseAudioComponent decodes an audio component descriptor.
+func parseAudioComponent(tag byte, d []byte) (audioComponent, bool) {
+	// [B10] 6.2.26 Audio component descriptor
+	if tag != 0xC4 || len(d) < 9 {
+		return audioComponent{}, false
+	}
+	c := audioComponent{
+		componentType: int(d[1]),
+		componentTag:  int(d[2]),
+		main:          d[5]&0x40 != 0,
+		samplingRate:  int(d[5] >> 1 & 0x07),
+		languages:     []string{string(d[6:9])},
+	}
+	index := 9
+	ES_multi_lingual_flag := d[5]&0x80 != 0
+	if ES_multi_lingual_flag && len(d) >= 12 {
+		c.languages = append(c.languages, string(d[9:12]))
+		index = 12
+	}
+	c.text = aribcaption.DecodeSIString(d[index:])
+	return c, true
+}
+
+// audioComponentTypes are the names of component_type of audio.
+// [B10] component_type of stream_content 0x02
+var audioComponentTypes = map[int]string{
+	0x01: "1/0 (mono)",
+	0x02: "1/0+1/0 (dual mono)",
+	0x03: "2/0 (stereo)",
+	0x04: "2/1",
+	0x05: "3/0",
+	0x06: "2/2",
+	0x07: "3/1",
+	0x08: "3/2",
+	0x09: "3/2+LFE (5.1ch)",
+}
+
+// samplingRates are the names of sampling_rate.
+// [B10] 6.2.26 Audio component descriptor
+var samplingRates = map[int]string{
+	1: "16kHz", 2: "22.05kHz", 3: "24kHz", 5: "32kHz", 6: "44.1kHz", 7: "48kHz",
+}
+
+// audioStreams returns the audio ES of every program in the order of
+// program_number and PMT.
+func (s *audioScanner) audioStreams() []audioStream {
+	var numbers []int
+	for program_number := range s.info.programs {
+		numbers = append(numbers, program_number)
+	}
+	sort.Ints(numbers)
+	streams := []audioStream{}
+	for _, program_number := range numbers {
+		for _, es := range s.info.programs[program_number].Streams {
+			if !isAudioStreamType(byte(es.StreamType)) {
+				continue
+			}
+			a := audioStream{
+				ProgramNumber: program_number,
+				PID:           es.PID,
+				StreamType:    es.StreamType,
+				Codec:         es.Type,
+				ComponentTag:  -1,
+				Languages:     []string{},
+			}
+			var component *audioComponent
+			for _, d := range es.Descriptors {
+				switch d.Tag {
+				case 0x52:
+					if len(d.Data) >= 1 {
+						a.ComponentTag = int(d.Data[0])
+					}
+				case 0x0A:
+					// [ISO] 2.6.18 ISO 639 language descriptor
+					for i := 0; i+4 <= len(d.Data); i += 4 {
+						a.Languages = append(a.Languages, string(d.Data[i:i+3]))
+					}
+				case 0xC4:
+					if c, ok := parseAudioComponent(byte(d.Tag), d.Data); ok {
+						component = &c
+					}
+				}
+			}
+			// The descriptor of PMT is preferred to that of EIT, which
+			// refers to the ES by component_tag.
+			if component == nil && a.ComponentTag != -1 {
+				for i, c := range s.components[program_number] {
+					if c.componentTag == a.ComponentTag {
+						component = &s.components[program_number][i]
+						break
+					}
+				}
+			}
+			if component != nil {
+				a.Languages = component.languages
+				a.ComponentType = audioComponentTypes[component.componentType]
+				if a.ComponentType == "" {
+					a.ComponentType = fmt.Sprintf("0x%02x", component.componentType)
+				}
+				a.DualMono = component.componentType == 0x02
+				a.Main = component.main
+				a.SamplingRate = samplingRates[component.samplingRate]
+				a.Text = component.text
+			}
+			streams = append(streams, a)
+		}
+	}
+	return streams
+}
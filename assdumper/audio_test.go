@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestAudio finds the ES that the audio component descriptor of the present
+// event says is dual mono.
+func TestAudio(t *testing.T) {
+	pat := []byte{0x00, 0xb0, 0x00, 0x7f, 0xe0, 0xc1, 0x00, 0x00, 0x04, 0x00, 0xe1, 0xf0}
+	pmt := []byte{
+		0x02, 0xb0, 0x00, 0x04, 0x00, 0xc1, 0x00, 0x00, 0xe1, 0x00, 0xf0, 0x00,
+		// AAC on PID 0x110 of component_tag 0x10, and on PID 0x111 of
+		// 0x11 in English
+		0x0f, 0xe1, 0x10, 0xf0, 0x03, 0x52, 0x01, 0x10,
+		0x0f, 0xe1, 0x11, 0xf0, 0x09, 0x52, 0x01, 0x11, 0x0a, 0x04, 'e', 'n', 'g', 0x00,
+		// Not audio
+		0x06, 0xe1, 0x30, 0xf0, 0x00,
+	}
+	eit := []byte{
+		0x4e, 0xf0, 0x00, 0x04, 0x00, 0xc1, 0x00, 0x01,
+		0x00, 0x01, 0x00, 0x04, 0x01, 0x4e,
+		0x00, 0x01, 0xe8, 0x9d, 0x20, 0x00, 0x00, 0x01, 0x00, 0x00, 0x80, 0x0e,
+		// Audio component descriptor of dual mono for component_tag 0x10,
+		// multi lingual and main at 48kHz, in Japanese and English
+		0xc4, 0x0c, 0xf2, 0x02, 0x10, 0x0f, 0xff, 0xce, 'j', 'p', 'n', 'e', 'n', 'g',
+	}
+
+	s := newAudioScanner()
+	for i, packet := range [][]byte{
+		sectionPacket(0x0000, 0, pat),
+		sectionPacket(0x01f0, 0, pmt),
+		sectionPacket(0x0012, 0, eit),
+	} {
+		s.demux.Push(packet)
+		if s.done() != (i == 2) {
+			t.Fatalf("done = %v at packet %d", s.done(), i)
+		}
+	}
+	streams := s.audioStreams()
+	if len(streams) != 2 {
+		t.Fatalf("streams = %+v", streams)
+	}
+	a := streams[0]
+	if a.PID != 0x110 || a.Codec != "AAC" || !a.DualMono || !a.Main || a.SamplingRate != "48kHz" || strings.Join(a.Languages, "+") != "jpn+eng" {
+		t.Errorf("PID 0x110 = %+v", a)
+	}
+	if a := streams[1]; a.PID != 0x111 || a.DualMono || strings.Join(a.Languages, "+") != "eng" || a.ComponentType != "" {
+		t.Errorf("PID 0x111 = %+v", a)
+	}
+}
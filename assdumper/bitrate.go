@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+// bitrateMeter measures the bitrate of every PID and program with the PCR
+// of a program as the time base, which unlike the size of the file over the
+// length of the program isn't thrown off by a recording that starts late or
+// has gaps. The peak is the highest bitrate over a window of PCR time.
+type bitrateMeter struct {
+	demux     *tspacket.Demuxer
+	pidMap    *pidMap
+	serviceId int
+	// pcrPid is the PID whose PCR is the time base, once PMT is known.
+	pcrPid int
+	window int64
+
+	pcr         int64
+	windowStart int64
+	// elapsed is the PCR time measured so far in 27MHz units, without
+	// the gaps at discontinuities.
+	elapsed int64
+	// pending are the bytes since the last PCR, which count once the next
+	// one tells how long they took.
+	pending     map[int]int64
+	bytes       map[int]int64
+	windowBytes map[int]int64
+	peaks       map[int]float64
+	// programPeaks are the peaks of the programs, which may be above the
+	// sum of the peaks of their PIDs in different windows.
+	programPeaks map[int]float64
+}
+
+type bitrateEntry struct {
+	PID           int     `json:"pid,omitempty"`
+	ProgramNumber int     `json:"program_number,omitempty"`
+	Label         string  `json:"label"`
+	Bytes         int64   `json:"bytes"`
+	Average       float64 `json:"average"`
+	Peak          float64 `json:"peak"`
+	// Share is the percentage of the bytes of the TS.
+	Share float64 `json:"share"`
+}
+
+type bitrateReport struct {
+	// Duration is the PCR time measured, in seconds.
+	Duration float64        `json:"duration"`
+	PIDs     []bitrateEntry `json:"pids"`
+	Programs []bitrateEntry `json:"programs"`
+}
+
+func runBitrate(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("bitrate", flag.ExitOnError)
+	serviceId := fs.Int("service", -1, "measure with the PCR of the program whose program_number (service_id) is `N` instead of the first one")
+	window := fs.Duration("window", time.Second, "measure the peak bitrates over `DURATION` of PCR time")
+	jsonOutput := fs.Bool("json", false, "print the bitrates in bit/s as JSON")
+	inputOpts := registerInputFlags(fs)
+	fs.Parse(args)
+	if *window < 10*time.Millisecond {
+		fmt.Fprintln(os.Stderr, "-window must be at least 10ms")
+		os.Exit(2)
+	}
+
+	fin, err := openInput(ctx, fs.Arg(0), inputOpts)
+	if err != nil {
+		panic(err)
+	}
+	defer fin.Close()
+	m := newBitrateMeter(*serviceId, *window)
+	if err := demuxInput(ctx, m.demux, fin); err != nil && ctx.Err() == nil {
+		panic(err)
+	}
+	if m.elapsed == 0 {
+		fmt.Fprintln(os.Stderr, "No PCR to measure the bitrates with")
+		os.Exit(1)
+	}
+	report := m.report()
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			panic(err)
+		}
+		return
+	}
+	fmt.Printf("%s of PCR time\n", formatOffset(time.Duration(report.Duration*float64(time.Second))))
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "PID\tTYPE\tAVERAGE\tPEAK\tSHARE\t")
+	for _, e := range report.PIDs {
+		fmt.Fprintf(w, "0x%04x\t%s\t%s\t%s\t%.1f%%\t\n", e.PID, e.Label, formatBitrate(e.Average), formatBitrate(e.Peak), e.Share)
+	}
+	w.Flush()
+	for _, e := range report.PIDs {
+		if e.PID == tspacket.NullPID {
+			fmt.Printf("null packets waste %s (%.1f%%)\n", formatBitrate(e.Average), e.Share)
+		}
+	}
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "PROGRAM\t\tAVERAGE\tPEAK\tSHARE\t")
+	for _, e := range report.Programs {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%.1f%%\t\n", e.ProgramNumber, e.Label, formatBitrate(e.Average), formatBitrate(e.Peak), e.Share)
+	}
+	w.Flush()
+}
+
+func newBitrateMeter(serviceId int, window time.Duration) *bitrateMeter {
+	demux := tspacket.NewDemuxer(nil)
+	m := &bitrateMeter{
+		demux:        demux,
+		pidMap:       newPIDMap(demux),
+		serviceId:    serviceId,
+		pcrPid:       -1,
+		window:       int64(window / time.Microsecond * 27),
+		pcr:          -1,
+		pending:      make(map[int]int64),
+		bytes:        make(map[int]int64),
+		windowBytes:  make(map[int]int64),
+		peaks:        make(map[int]float64),
+		programPeaks: make(map[int]float64),
+	}
+	m.pidMap.onPMT = func(int) {
+		if m.pcrPid == -1 {
+			m.choosePCRPID()
+		}
+	}
+	demux.HandlePackets(m.count)
+	return m
+}
+
+func formatBitrate(bps float64) string {
+	switch {
+	case bps >= 1e6:
+		return fmt.Sprintf("%.2f Mbps", bps/1e6)
+	case bps >= 1e3:
+		return fmt.Sprintf("%.1f kbps", bps/1e3)
+	default:
+		return fmt.Sprintf("%.0f bps", bps)
+	}
+}
+
+// count counts the bytes of every packet from the first PCR, including the
+// PCR packet itself.
+func (m *bitrateMeter) count(packet tspacket.Packet) {
+	if m.pcr >= 0 {
+		m.pending[packet.PID()] += tspacket.Size
+	}
+}
+
+// choosePCRPID takes the PCR_PID of the program of -service, or of the one
+// with the smallest program_number.
+func (m *bitrateMeter) choosePCRPID() {
+	best := -1
+	for program_number := range m.pidMap.pcrPids {
+		if m.serviceId != -1 && program_number != m.serviceId {
+			continue
+		}
+		if best == -1 || program_number < best {
+			best = program_number
+		}
+	}
+	if best != -1 {
+		m.pcrPid = m.pidMap.pcrPids[best]
+		m.demux.HandlePCR(m.pcrPid, m.handlePCR)
+	}
+}
+
+func (m *bitrateMeter) handlePCR(pcr int64, discontinuity bool) {
+	if m.pcr < 0 {
+		m.pcr, m.windowStart = pcr, pcr
+		return
+	}
+	if discontinuity || tspacket.IsPCRDiscontinuity(m.pcr, pcr) {
+		// The bytes across the gap are dropped, and the window is cut
+		// short with the bytes in it counting only for the averages.
+		m.pcr, m.windowStart = pcr, pcr
+		for pid := range m.pending {
+			delete(m.pending, pid)
+		}
+		for pid := range m.windowBytes {
+			delete(m.windowBytes, pid)
+		}
+		return
+	}
+	for pid, n := range m.pending {
+		m.bytes[pid] += n
+		m.windowBytes[pid] += n
+		delete(m.pending, pid)
+	}
+	m.elapsed += pcr - m.pcr
+	m.pcr = pcr
+	if d := pcr - m.windowStart; d >= m.window {
+		programBytes := make(map[int]int64)
+		for pid, n := range m.windowBytes {
+			if rate := float64(n*8) * 27000000 / float64(d); rate > m.peaks[pid] {
+				m.peaks[pid] = rate
+			}
+			for _, program_number := range m.pidMap.programs[pid] {
+				programBytes[program_number] += n
+			}
+			delete(m.windowBytes, pid)
+		}
+		for program_number, n := range programBytes {
+			if rate := float64(n*8) * 27000000 / float64(d); rate > m.programPeaks[program_number] {
+				m.programPeaks[program_number] = rate
+			}
+		}
+		m.windowStart = pcr
+	}
+}
+
+func (m *bitrateMeter) report() *bitrateReport {
+	seconds := float64(m.elapsed) / 27000000
+	report := &bitrateReport{Duration: seconds, PIDs: []bitrateEntry{}, Programs: []bitrateEntry{}}
+	var total int64
+	for _, n := range m.bytes {
+		total += n
+	}
+	programBytes := make(map[int]int64)
+	for pid, n := range m.bytes {
+		report.PIDs = append(report.PIDs, bitrateEntry{
+			PID:     pid,
+			Label:   m.pidMap.label(pid),
+			Bytes:   n,
+			Average: float64(n*8) / seconds,
+			Peak:    m.peaks[pid],
+			Share:   float64(n) * 100 / float64(total),
+		})
+		for _, program_number := range m.pidMap.programs[pid] {
+			programBytes[program_number] += n
+		}
+	}
+	for program_number, n := range programBytes {
+		label := ""
+		if program_number == m.serviceId || m.pidMap.pcrPids[program_number] == m.pcrPid {
+			label = "time base"
+		}
+		report.Programs = append(report.Programs, bitrateEntry{
+			ProgramNumber: program_number,
+			Label:         label,
+			Bytes:         n,
+			Average:       float64(n*8) / seconds,
+			Peak:          m.programPeaks[program_number],
+			Share:         float64(n) * 100 / float64(total),
+		})
+	}
+	sort.Slice(report.PIDs, func(i, j int) bool {
+		return report.PIDs[i].PID < report.PIDs[j].PID
+	})
+	sort.Slice(report.Programs, func(i, j int) bool {
+		return report.Programs[i].ProgramNumber < report.Programs[j].ProgramNumber
+	})
+	return report
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tsgen"
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+// TestBitrate measures a generated stream with 10 null packets after every
+// PCR, sent every 100ms, whose bitrates are known.
+func TestBitrate(t *testing.T) {
+	generated := generateTS(t, `@start 2024-04-01T21:00:00+09:00
+1s	字幕
+@duration 4s
+`)
+	null := make(tspacket.Packet, tspacket.Size)
+	copy(null, []byte{tspacket.SyncByte, 0x1f, 0xff, 0x10})
+	var ts bytes.Buffer
+	for i := 0; i+tspacket.Size <= len(generated); i += tspacket.Size {
+		packet := tspacket.Packet(generated[i : i+tspacket.Size])
+		ts.Write(packet)
+		if field, _, _ := packet.AdaptationField(); packet.PID() == tsgen.PCRPID && tspacket.HasPCR(field) {
+			for j := 0; j < 10; j++ {
+				ts.Write(null)
+			}
+		}
+	}
+
+	m := newBitrateMeter(-1, time.Second)
+	if err := demuxInput(context.Background(), m.demux, &ts); err != nil {
+		t.Fatal(err)
+	}
+	report := m.report()
+	// From the first PCR to the last one, whose packets after it aren't
+	// counted
+	if report.Duration != 4 {
+		t.Errorf("duration = %v", report.Duration)
+	}
+	want := map[int]float64{
+		tspacket.NullPID: 10 * tspacket.Size * 8 * 10,
+		tsgen.PCRPID:     tspacket.Size * 8 * 10,
+	}
+	for _, e := range report.PIDs {
+		rate, ok := want[e.PID]
+		if !ok {
+			continue
+		}
+		delete(want, e.PID)
+		if e.Average != rate || e.Peak != rate {
+			t.Errorf("PID 0x%x %s: average %v and peak %v, want %v", e.PID, e.Label, e.Average, e.Peak, rate)
+		}
+	}
+	if len(want) != 0 {
+		t.Errorf("no bitrates of %v in %+v", want, report.PIDs)
+	}
+	if len(report.Programs) != 1 || report.Programs[0].ProgramNumber != tsgen.ProgramNumber || report.Programs[0].Label != "time base" {
+		t.Errorf("programs = %+v", report.Programs)
+	}
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/aribcaption"
+)
+
+// captionFont rasterizes characters for the compositor. It's implemented in
+// burnin_font.go, which needs golang.org/x/image.
+type captionFont interface {
+	// mask returns the coverage of r drawn to fill a cell of w x h pixels.
+	mask(r rune, w, h int) *image.Alpha
+}
+
+// captionCompositor draws the captions of the main track onto transparent
+// frames, for burning them into video without trusting how a player renders
+// the ASS output. Characters are drawn in the cells of the caption plane
+// with their colors, and DRCS glyphs with their bitmaps. Like the Dialogue
+// lines, a frame is shown from its caption until the next one, in seconds
+// from the start of the recording.
+type captionCompositor struct {
+	sink   frameSink
+	font   captionFont
+	width  int
+	height int
+	start  SystemClock
+	offset SystemClock
+	drcs   map[string]DRCSPattern
+	masks  map[glyphKey]*image.Alpha
+	// text is the screen being built from the units at timestamp.
+	text      string
+	timestamp SystemClock
+	pending   bool
+}
+
+type glyphKey struct {
+	r    rune
+	drcs string
+	w, h int
+}
+
+func newCaptionCompositor(sink frameSink, font captionFont, width, height int) *captionCompositor {
+	return &captionCompositor{
+		sink:   sink,
+		font:   font,
+		width:  width,
+		height: height,
+		drcs:   make(map[string]DRCSPattern),
+		masks:  make(map[glyphKey]*image.Alpha),
+	}
+}
+
+func (c *captionCompositor) handle(ev Event) {
+	switch ev := ev.(type) {
+	case ClockStart:
+		if c.start == 0 {
+			c.start = ev.PCR
+		}
+	case ClockDiscontinuity:
+		c.offset += ev.Previous - ev.Current
+	case DRCSPattern:
+		if ev.Track == "" {
+			c.drcs[ev.MD5] = ev
+		}
+	case CaptionSession:
+		if ev.Track == "" {
+			c.show(ev.presentationTime(), "\f")
+		}
+	case CaptionUnit:
+		if ev.Track == "" {
+			c.show(ev.presentationTime(), ev.Text)
+		}
+	}
+}
+
+// show puts text on the screen at timestamp. Units of the same timestamp
+// make one screen, as they do one Dialogue line.
+func (c *captionCompositor) show(timestamp SystemClock, text string) {
+	if c.pending && timestamp == c.timestamp {
+		c.text += text
+		return
+	}
+	c.flushScreen()
+	c.text, c.timestamp, c.pending = text, timestamp, true
+}
+
+func (c *captionCompositor) flushScreen() {
+	if !c.pending {
+		return
+	}
+	c.pending = false
+	text := c.text
+	if i := strings.LastIndexByte(text, '\f'); i != -1 {
+		text = text[i+1:]
+	}
+	if err := c.sink.frame(c.elapsed(c.timestamp), c.compose(text)); err != nil {
+		panic(err)
+	}
+}
+
+func (c *captionCompositor) elapsed(pcr SystemClock) float64 {
+	if pcr == 0 || c.start == 0 {
+		return 0
+	}
+	return float64(pcr+c.offset-c.start) / float64(K)
+}
+
+// finish shows the last screen until end, the last PCR of the input.
+func (c *captionCompositor) finish(end SystemClock) error {
+	c.flushScreen()
+	return c.sink.finish(c.elapsed(end))
+}
+
+// compose draws a screen of the decoder's text. Ruby is drawn at its own
+// position in half size, as extractRuby lays it out for ASS.
+func (c *captionCompositor) compose(text string) *image.NRGBA {
+	frame := image.NewNRGBA(image.Rect(0, 0, c.width, c.height))
+	if isBlank(text) {
+		return frame
+	}
+	text, rubies := extractRuby(text, false)
+	for _, s := range append([]string{text}, rubies...) {
+		for _, g := range c.layout(s) {
+			c.drawGlyph(frame, g)
+		}
+	}
+	return frame
+}
+
+// placedGlyph is a character, or a DRCS glyph, placed in its cell.
+type placedGlyph struct {
+	r                       rune
+	drcs                    string
+	x, y, w, h              int
+	fg, outline, background color.NRGBA
+	boxed                   bool
+}
+
+// textStyle is the state of the override tags while laying out a line.
+type textStyle struct {
+	scaleX, scaleY          int
+	fg, outline, background color.NRGBA
+	boxed                   bool
+}
+
+func defaultTextStyle() textStyle {
+	return textStyle{
+		scaleX:     100,
+		scaleY:     100,
+		fg:         color.NRGBA{0xff, 0xff, 0xff, 0xff},
+		outline:    color.NRGBA{0, 0, 0, 0xff},
+		background: color.NRGBA{0, 0, 0, 0xff},
+	}
+}
+
+// layout places the characters of text in the cells of the HD caption
+// plane that the decoder assumes, starting at the \pos of the decoder.
+// Text without a position is centered at the bottom, where the Default
+// style puts it.
+func (c *captionCompositor) layout(text string) []placedGlyph {
+	cellW := (aribcaption.CharWidth + aribcaption.HorizontalSpacing) * c.width / aribcaption.PlaneWidth
+	cellH := (aribcaption.CharHeight + aribcaption.VerticalSpacing) * c.height / aribcaption.PlaneHeight
+	charW := aribcaption.CharWidth * c.width / aribcaption.PlaneWidth
+	charH := aribcaption.CharHeight * c.height / aribcaption.PlaneHeight
+
+	var glyphs []placedGlyph
+	style := defaultTextStyle()
+	originX, x, y := 0, 0, 0
+	positioned := false
+	// lines are the ranges of glyphs by line of the unpositioned text.
+	var lines [][2]int
+	lineStart := 0
+	newline := func() {
+		lines = append(lines, [2]int{lineStart, len(glyphs)})
+		lineStart = len(glyphs)
+		x = originX
+		y += cellH * style.scaleY / 100
+	}
+	put := func(r rune, drcs string) {
+		w := cellW * style.scaleX / 100
+		gw := charW * style.scaleX / 100
+		if drcs == "" && isNarrowRune(r) {
+			w /= 2
+			gw /= 2
+		}
+		h := cellH * style.scaleY / 100
+		gh := charH * style.scaleY / 100
+		// The spacing is shared by both sides of the character.
+		glyphs = append(glyphs, placedGlyph{
+			r: r, drcs: drcs,
+			x: x + (w-gw)/2, y: y + (h-gh)/2, w: gw, h: gh,
+			fg: style.fg, outline: style.outline, background: style.background, boxed: style.boxed,
+		})
+		x += w
+	}
+	for len(text) != 0 {
+		switch {
+		case text[0] == '{':
+			end := strings.IndexByte(text, '}')
+			if end == -1 {
+				text = ""
+				continue
+			}
+			block := text[1:end]
+			text = text[end+1:]
+			if strings.HasPrefix(block, "drcs ") {
+				put(0, strings.TrimPrefix(block, "drcs "))
+				continue
+			}
+			for _, tag := range strings.Split(block, "\\")[1:] {
+				if px, py, ok := parsePosTag(tag); ok {
+					if len(glyphs) != lineStart {
+						newline()
+					}
+					positioned = true
+					originX = px * c.width / aribcaption.PlayResX
+					x, y = originX, py*c.height/aribcaption.PlayResY
+					continue
+				}
+				style.apply(tag)
+			}
+		case strings.HasPrefix(text, "\\N"), strings.HasPrefix(text, "\\n"):
+			text = text[2:]
+			newline()
+		case strings.HasPrefix(text, "\\h"):
+			text = text[2:]
+			put(' ', "")
+		default:
+			r, n := utf8.DecodeRuneInString(text)
+			text = text[n:]
+			put(r, "")
+		}
+	}
+	if positioned {
+		return glyphs
+	}
+	// Center each line, and put the last one above the bottom margin.
+	lines = append(lines, [2]int{lineStart, len(glyphs)})
+	shiftY := c.height - c.height/15 - y - cellH
+	for _, line := range lines {
+		if line[0] == line[1] {
+			continue
+		}
+		first, last := glyphs[line[0]], glyphs[line[1]-1]
+		shiftX := (c.width - (last.x + last.w - first.x)) / 2
+		for i := line[0]; i < line[1]; i++ {
+			glyphs[i].x += shiftX - first.x
+			glyphs[i].y += shiftY
+		}
+	}
+	return glyphs
+}
+
+// apply follows an override tag that the decoder writes. Unknown tags are
+// ignored, and flashing text is drawn steadily.
+func (s *textStyle) apply(tag string) {
+	switch {
+	case strings.HasPrefix(tag, "fscx"):
+		if n, err := strconv.Atoi(tag[4:]); err == nil {
+			s.scaleX = n
+		}
+	case strings.HasPrefix(tag, "fscy"):
+		if n, err := strconv.Atoi(tag[4:]); err == nil {
+			s.scaleY = n
+		}
+	case strings.HasPrefix(tag, "c&"), strings.HasPrefix(tag, "1c&"):
+		s.fg = parseASSColor(tag[strings.IndexByte(tag, '&'):], s.fg)
+	case strings.HasPrefix(tag, "3c&"):
+		s.outline = parseASSColor(tag[2:], s.outline)
+	case strings.HasPrefix(tag, "4c&"):
+		s.background = parseASSColor(tag[2:], s.background)
+		s.boxed = s.background != defaultTextStyle().background
+	case strings.HasPrefix(tag, "1a&"):
+		s.fg.A = parseASSAlpha(tag[2:])
+	case strings.HasPrefix(tag, "3a&"):
+		s.outline.A = parseASSAlpha(tag[2:])
+	case strings.HasPrefix(tag, "4a&"):
+		s.background.A = parseASSAlpha(tag[2:])
+	}
+}
+
+// parsePosTag parses \pos(X,Y).
+func parsePosTag(tag string) (int, int, bool) {
+	var x, y int
+	if !strings.HasPrefix(tag, "pos(") {
+		return 0, 0, false
+	}
+	if _, err := fmt.Sscanf(tag, "pos(%d,%d)", &x, &y); err != nil {
+		return 0, 0, false
+	}
+	return x, y, true
+}
+
+// parseASSColor parses &HBBGGRR&, keeping the alpha of old.
+func parseASSColor(s string, old color.NRGBA) color.NRGBA {
+	v, err := strconv.ParseUint(strings.Trim(s, "&H"), 16, 32)
+	if err != nil {
+		return old
+	}
+	return color.NRGBA{uint8(v), uint8(v >> 8), uint8(v >> 16), old.A}
+}
+
+// parseASSAlpha parses &HAA&, where 0 is opaque.
+func parseASSAlpha(s string) uint8 {
+	v, err := strconv.ParseUint(strings.Trim(s, "&H"), 16, 8)
+	if err != nil {
+		return 0xff
+	}
+	return 0xff - uint8(v)
+}
+
+// isNarrowRune reports whether r is written as a half-width character, as
+// the alphanumeric and JIS X0201 katakana sets are.
+func isNarrowRune(r rune) bool {
+	return r < 0x370 || 0xff61 <= r && r <= 0xffdc
+}
+
+func (c *captionCompositor) drawGlyph(frame *image.NRGBA, g placedGlyph) {
+	if g.w <= 0 || g.h <= 0 {
+		return
+	}
+	rect := image.Rect(g.x, g.y, g.x+g.w, g.y+g.h)
+	if g.boxed {
+		draw.Draw(frame, rect, image.NewUniform(g.background), image.Point{}, draw.Over)
+	}
+	mask := c.glyphMask(g)
+	if mask == nil {
+		return
+	}
+	if g.drcs == "" {
+		// The half tone becomes an outline, as it does in the ASS output.
+		radius := c.height / 540
+		if radius < 1 {
+			radius = 1
+		}
+		outline := image.NewUniform(g.outline)
+		for dy := -radius; dy <= radius; dy++ {
+			for dx := -radius; dx <= radius; dx++ {
+				if dx == 0 && dy == 0 || dx*dx+dy*dy > radius*radius {
+					continue
+				}
+				draw.DrawMask(frame, rect.Add(image.Pt(dx, dy)), outline, image.Point{}, mask, image.Point{}, draw.Over)
+			}
+		}
+	}
+	draw.DrawMask(frame, rect, image.NewUniform(g.fg), image.Point{}, mask, image.Point{}, draw.Over)
+}
+
+func (c *captionCompositor) glyphMask(g placedGlyph) *image.Alpha {
+	key := glyphKey{r: g.r, drcs: g.drcs, w: g.w, h: g.h}
+	if mask, ok := c.masks[key]; ok {
+		return mask
+	}
+	var mask *image.Alpha
+	if g.drcs != "" {
+		if pattern, ok := c.drcs[g.drcs]; ok {
+			mask = drcsMask(pattern, g.w, g.h)
+		}
+	} else if g.r != ' ' && g.r != '　' {
+		mask = c.font.mask(g.r, g.w, g.h)
+	}
+	c.masks[key] = mask
+	return mask
+}
+
+// drcsMask scales the bitmap of a DRCS glyph to w x h pixels. The highest
+// gradation is the foreground, and the others are blended towards the
+// background.
+func drcsMask(pattern DRCSPattern, w, h int) *image.Alpha {
+	if pattern.Width == 0 || pattern.Height == 0 || pattern.Bits == 0 {
+		return nil
+	}
+	mask := image.NewAlpha(image.Rect(0, 0, w, h))
+	max := 1<<pattern.Bits - 1
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := (y*pattern.Height/h*pattern.Width + x*pattern.Width/w) * pattern.Bits
+			if i/8 >= len(pattern.Data) {
+				continue
+			}
+			v := int(pattern.Data[i/8]) >> (8 - pattern.Bits - i%8) & max
+			mask.Pix[y*mask.Stride+x] = uint8(v * 0xff / max)
+		}
+	}
+	return mask
+}
+
+// frameSink receives the composited frames, each shown from t seconds until
+// the next one.
+type frameSink interface {
+	frame(t float64, img *image.NRGBA) error
+	finish(end float64) error
+}
+
+// pngFrameSink writes the frames as PNG files in a directory, with
+// captions.ffconcat listing them with their durations for the concat demuxer
+// of ffmpeg, e.g.
+//
+//	ffmpeg -i in.ts -f concat -i DIR/captions.ffconcat -filter_complex overlay out.mp4
+type pngFrameSink struct {
+	dir     string
+	list    *atomicFile
+	out     *bufio.Writer
+	count   int
+	last    float64
+	written bool
+}
+
+func newPNGFrameSink(dir string) (*pngFrameSink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	list, err := createAtomicFile(filepath.Join(dir, "captions.ffconcat"))
+	if err != nil {
+		return nil, err
+	}
+	out := bufio.NewWriter(list)
+	fmt.Fprintln(out, "ffconcat version 1.0")
+	return &pngFrameSink{dir: dir, list: list, out: out}, nil
+}
+
+func (s *pngFrameSink) frame(t float64, img *image.NRGBA) error {
+	if !s.written && t > 0 {
+		// The video starts without captions.
+		if err := s.frame(0, image.NewNRGBA(img.Rect)); err != nil {
+			return err
+		}
+	}
+	if s.written {
+		if t < s.last {
+			t = s.last
+		}
+		fmt.Fprintf(s.out, "duration %.3f\n", t-s.last)
+	}
+	s.count++
+	name := fmt.Sprintf("%06d.png", s.count)
+	if err := writePNG(filepath.Join(s.dir, name), img); err != nil {
+		return err
+	}
+	fmt.Fprintf(s.out, "file %s\n", name)
+	s.last, s.written = t, true
+	return nil
+}
+
+func (s *pngFrameSink) finish(end float64) error {
+	if s.written && end > s.last {
+		fmt.Fprintf(s.out, "duration %.3f\n", end-s.last)
+	}
+	if err := s.out.Flush(); err != nil {
+		return err
+	}
+	return s.list.Commit()
+}
+
+// Abort removes the list unless it was committed. The PNG files are left,
+// since they are written as they come.
+func (s *pngFrameSink) Abort() {
+	s.list.Abort()
+}
+
+// rawFrameSink writes the frames as raw RGBA video at a constant frame rate
+// of num/den, to be read by ffmpeg through a pipe, e.g.
+//
+//	ffmpeg -i in.ts -f rawvideo -pix_fmt rgba -s 1920x1080 -r 30000/1001 -i pipe:3 ...
+//
+// Frames are written up to a caption as soon as it arrives.
+type rawFrameSink struct {
+	out      *bufio.Writer
+	num, den int64
+	frames   int64
+	current  *image.NRGBA
+}
+
+func newRawFrameSink(w io.Writer, num, den int64, width, height int) *rawFrameSink {
+	return &rawFrameSink{
+		out:     bufio.NewWriter(w),
+		num:     num,
+		den:     den,
+		current: image.NewNRGBA(image.Rect(0, 0, width, height)),
+	}
+}
+
+// writeUntil repeats the current frame until the frame at t seconds.
+func (s *rawFrameSink) writeUntil(t float64) error {
+	for float64(s.frames*s.den) < t*float64(s.num) {
+		if _, err := s.out.Write(s.current.Pix); err != nil {
+			return err
+		}
+		s.frames++
+	}
+	return nil
+}
+
+func (s *rawFrameSink) frame(t float64, img *image.NRGBA) error {
+	if err := s.writeUntil(t); err != nil {
+		return err
+	}
+	s.current = img
+	return s.out.Flush()
+}
+
+func (s *rawFrameSink) finish(end float64) error {
+	if err := s.writeUntil(end); err != nil {
+		return err
+	}
+	return s.out.Flush()
+}
+
+func writePNG(path string, img image.Image) error {
+	f, err := createAtomicFile(path)
+	if err != nil {
+		return err
+	}
+	defer f.Abort()
+	if err := png.Encode(f, img); err != nil {
+		return err
+	}
+	return f.Commit()
+}
+
+// parseFrameSize parses WIDTHxHEIGHT.
+func parseFrameSize(s string) (int, int, error) {
+	var w, h int
+	if _, err := fmt.Sscanf(s, "%dx%d", &w, &h); err != nil || w <= 0 || h <= 0 {
+		return 0, 0, fmt.Errorf("invalid frame size %q, e.g. 1920x1080", s)
+	}
+	return w, h, nil
+}
+
+// parseFrameRate parses NUM/DEN or NUM.
+func parseFrameRate(s string) (int64, int64, error) {
+	num, den := s, "1"
+	if i := strings.IndexByte(s, '/'); i != -1 {
+		num, den = s[:i], s[i+1:]
+	}
+	n, err1 := strconv.ParseInt(num, 10, 64)
+	d, err2 := strconv.ParseInt(den, 10, 64)
+	if err1 != nil || err2 != nil || n <= 0 || d <= 0 {
+		return 0, 0, fmt.Errorf("invalid frame rate %q, e.g. 30000/1001", s)
+	}
+	return n, d, nil
+}
@@ -0,0 +1,83 @@
+//go:build burnin
+
+package main
+
+import (
+	"image"
+	"os"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+)
+
+// openTypeFont rasterizes characters with an OpenType or TrueType font, or
+// the first font of a collection.
+type openTypeFont struct {
+	font  *sfnt.Font
+	faces map[int]font.Face
+}
+
+func loadCaptionFont(path string) (captionFont, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := opentype.Parse(data)
+	if err != nil {
+		collection, cerr := opentype.ParseCollection(data)
+		if cerr != nil {
+			return nil, err
+		}
+		if f, err = collection.Font(0); err != nil {
+			return nil, err
+		}
+	}
+	return &openTypeFont{font: f, faces: make(map[int]font.Face)}, nil
+}
+
+func (f *openTypeFont) face(size int) (font.Face, error) {
+	if face, ok := f.faces[size]; ok {
+		return face, nil
+	}
+	face, err := opentype.NewFace(f.font, &opentype.FaceOptions{Size: float64(size), DPI: 72, Hinting: font.HintingNone})
+	if err != nil {
+		return nil, err
+	}
+	f.faces[size] = face
+	return face, nil
+}
+
+// mask draws r at the height of the cell, centered on the line. A glyph
+// wider than the cell, like a kanji of MSZ, is drawn at its own advance and
+// then squeezed into the cell.
+func (f *openTypeFont) mask(r rune, w, h int) *image.Alpha {
+	face, err := f.face(h)
+	if err != nil {
+		return nil
+	}
+	advance, ok := face.GlyphAdvance(r)
+	if !ok {
+		return nil
+	}
+	natural := advance.Ceil()
+	if natural < w {
+		natural = w
+	}
+	glyph := image.NewAlpha(image.Rect(0, 0, natural, h))
+	metrics := face.Metrics()
+	d := font.Drawer{Dst: glyph, Src: image.Opaque, Face: face}
+	d.Dot = fixed.Point26_6{
+		X: (fixed.I(natural) - advance) / 2,
+		Y: (fixed.I(h)-metrics.Ascent-metrics.Descent)/2 + metrics.Ascent,
+	}
+	d.DrawString(string(r))
+	if natural == w {
+		return glyph
+	}
+	mask := image.NewAlpha(image.Rect(0, 0, w, h))
+	draw.BiLinear.Scale(mask, mask.Rect, glyph, glyph.Rect, draw.Src, nil)
+	return mask
+}
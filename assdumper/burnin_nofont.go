@@ -0,0 +1,11 @@
+//go:build !burnin
+
+package main
+
+import "errors"
+
+// loadCaptionFont is implemented in burnin_font.go, which needs
+// golang.org/x/image.
+func loadCaptionFont(path string) (captionFont, error) {
+	return nil, errors.New("-burn-in needs golang.org/x/image to draw text: build with -tags burnin")
+}
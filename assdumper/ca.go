@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+// caPID is the ECM or EMM PID of a conditional access descriptor.
+type caPID struct {
+	PID        int    `json:"pid"`
+	CASystemID int    `json:"ca_system_id"`
+	System     string `json:"system"`
+	// ES is the PID of the ES an ECM is for, or 0 for the whole program.
+	ES int `json:"es,omitempty"`
+}
+
+type caProgram struct {
+	ProgramNumber int     `json:"program_number"`
+	ECM           []caPID `json:"ecm"`
+	// Packets and Scrambled count the packets of the ES of the program
+	// and those with transport_scrambling_control among them.
+	Packets   int64 `json:"packets"`
+	Scrambled int64 `json:"scrambled"`
+}
+
+// caReport is the EMM of CAT and the ECM of every PMT, for the ca
+// subcommand.
+type caReport struct {
+	CATFound bool        `json:"cat_found"`
+	EMM      []caPID     `json:"emm"`
+	Programs []caProgram `json:"programs"`
+}
+
+// caScanner reads PAT and PMT with infoScanner and CAT, and counts the
+// scrambled packets of every PID.
+type caScanner struct {
+	demux     *tspacket.Demuxer
+	info      *infoScanner
+	report    caReport
+	packets   map[int]int64
+	scrambled map[int]int64
+}
+
+func runCA(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("ca", flag.ExitOnError)
+	jsonOutput := fs.Bool("json", false, "print CAT and the ECM of every program as JSON")
+	inputOpts := registerInputFlags(fs)
+	fs.Parse(args)
+
+	fin, err := openInput(ctx, fs.Arg(0), inputOpts)
+	if err != nil {
+		panic(err)
+	}
+	defer fin.Close()
+	s := newCAScanner()
+	if err := demuxInput(ctx, s.demux, fin); err != nil && ctx.Err() == nil {
+		panic(err)
+	}
+	if s.info.info == nil {
+		fmt.Fprintln(os.Stderr, "No PAT found")
+		os.Exit(1)
+	}
+	report := s.result()
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if !report.CATFound {
+		fmt.Println("CAT: not found")
+	} else {
+		fmt.Println("CAT:")
+		for _, emm := range report.EMM {
+			fmt.Printf("  EMM PID 0x%04x: CA_system_ID 0x%04x (%s)\n", emm.PID, emm.CASystemID, emm.System)
+		}
+	}
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PROGRAM\tECM\tSCRAMBLED\tSTATUS")
+	for _, p := range report.Programs {
+		var ecm []string
+		for _, e := range p.ECM {
+			text := fmt.Sprintf("0x%04x (%s)", e.PID, e.System)
+			if e.ES != 0 {
+				text += fmt.Sprintf(" for 0x%04x", e.ES)
+			}
+			ecm = append(ecm, text)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d/%d\t%s\n", p.ProgramNumber, orDash(strings.Join(ecm, ", ")), p.Scrambled, p.Packets, caStatus(p))
+	}
+	w.Flush()
+}
+
+// caStatus tells whether the program still needs descrambling.
+func caStatus(p caProgram) string {
+	switch {
+	case p.Scrambled != 0:
+		return "scrambled, needs descrambling"
+	case p.Packets == 0:
+		return "-"
+	case len(p.ECM) != 0:
+		return "descrambled"
+	default:
+		return "free"
+	}
+}
+
+func newCAScanner() *caScanner {
+	demux := tspacket.NewDemuxer(nil)
+	s := &caScanner{
+		demux:     demux,
+		info:      newInfoScanner(demux, false),
+		report:    caReport{EMM: []caPID{}, Programs: []caProgram{}},
+		packets:   make(map[int]int64),
+		scrambled: make(map[int]int64),
+	}
+	demux.HandleSections(0x0001, func(section []byte) {
+		if tspacket.CRC32(section) == 0 {
+			s.handleCAT(section)
+		}
+	})
+	demux.HandlePackets(s.count)
+	return s
+}
+
+// count counts the packets with payload of every PID and the scrambled ones
+// among them, up to servicesScanLimit packets, so that the scrambled ones
+// are counted after PSI is found as well.
+func (s *caScanner) count(packet tspacket.Packet) {
+	pid := packet.PID()
+	if packet.HasPayload() && !packet.TransportError() {
+		s.packets[pid]++
+		if packet.Scrambled() {
+			s.scrambled[pid]++
+		}
+	}
+	if s.demux.Packets() >= servicesScanLimit {
+		s.demux.Stop()
+	}
+}
+
+// handleCAT keeps the EMM PIDs of the first CAT.
+func (s *caScanner) handleCAT(section []byte) {
+	// [ISO] 2.4.4.6 Conditional access section
+	if s.report.CATFound || section[0] != 0x01 || len(section) < 12 {
+		return
+	}
+	section_length := int(section[1]&0x0F)<<8 | int(section[2])
+	if 3+section_length > len(section) || section_length < 9 {
+		return
+	}
+	s.report.CATFound = true
+	forEachDescriptor(section[8:3+section_length-4], func(tag byte, d []byte) {
+		if e, ok := parseCADescriptor(tag, d); ok {
+			s.report.EMM = append(s.report.EMM, e)
+		}
+	})
+}
+
+// parseCADescriptor decodes a conditional access descriptor.
+func parseCADescriptor(tag byte, d []byte) (caPID, bool) {
+	// [ISO] 2.6.16 Conditional access descriptor
+	if tag != 0x09 || len(d) < 4 {
+		return caPID{}, false
+	}
+	CA_system_ID := int(d[0])<<8 | int(d[1])
+	return caPID{
+		PID:        int(d[2]&0x1F)<<8 | int(d[3]),
+		CASystemID: CA_system_ID,
+		System:     caSystemName(CA_system_ID),
+	}, true
+}
+
+func caSystemName(CA_system_ID int) string {
+	switch CA_system_ID {
+	case 0x0005:
+		// The conditional access of ARIB with MULTI2
+		return "B-CAS"
+	default:
+		return "unknown"
+	}
+}
+
+// result gathers the ECM of every PMT and counts the packets of their ES.
+func (s *caScanner) result() caReport {
+	report := s.report
+	var numbers []int
+	for program_number := range s.info.programs {
+		numbers = append(numbers, program_number)
+	}
+	sort.Ints(numbers)
+	for _, program_number := range numbers {
+		program := s.info.programs[program_number]
+		p := caProgram{ProgramNumber: program_number, ECM: []caPID{}}
+		for _, d := range program.Descriptors {
+			if e, ok := parseCADescriptor(byte(d.Tag), d.Data); ok {
+				p.ECM = append(p.ECM, e)
+			}
+		}
+		for _, es := range program.Streams {
+			for _, d := range es.Descriptors {
+				if e, ok := parseCADescriptor(byte(d.Tag), d.Data); ok {
+					e.ES = es.PID
+					p.ECM = append(p.ECM, e)
+				}
+			}
+			p.Packets += s.packets[es.PID]
+			p.Scrambled += s.scrambled[es.PID]
+		}
+		report.Programs = append(report.Programs, p)
+	}
+	return report
+}
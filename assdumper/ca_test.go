@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+// TestCA finds the EMM of CAT and the ECM of PMT, and tells that the program
+// is still scrambled.
+func TestCA(t *testing.T) {
+	pat := []byte{0x00, 0xb0, 0x00, 0x7f, 0xe0, 0xc1, 0x00, 0x00, 0x04, 0x00, 0xe1, 0xf0}
+	cat := []byte{
+		0x01, 0xb0, 0x00, 0xff, 0xff, 0xc1, 0x00, 0x00,
+		// EMM on PID 0x901 of CA_system_ID 5
+		0x09, 0x04, 0x00, 0x05, 0xe9, 0x01,
+	}
+	pmt := []byte{
+		0x02, 0xb0, 0x00, 0x04, 0x00, 0xc1, 0x00, 0x00, 0xe1, 0x00, 0xf0, 0x06,
+		// ECM on PID 0x1f1
+		0x09, 0x04, 0x00, 0x05, 0xe1, 0xf1,
+		0x1b, 0xe1, 0x11, 0xf0, 0x00,
+	}
+	video := make(tspacket.Packet, tspacket.Size)
+	copy(video, []byte{tspacket.SyncByte, 0x41, 0x11, 0xd0})
+
+	s := newCAScanner()
+	for _, packet := range [][]byte{
+		sectionPacket(0x0000, 0, pat),
+		sectionPacket(0x0001, 0, cat),
+		sectionPacket(0x01f0, 0, pmt),
+		video,
+	} {
+		s.demux.Push(packet)
+	}
+	report := s.result()
+	if !report.CATFound || len(report.EMM) != 1 || report.EMM[0].PID != 0x901 || report.EMM[0].System != "B-CAS" {
+		t.Errorf("EMM = %+v", report.EMM)
+	}
+	if len(report.Programs) != 1 {
+		t.Fatalf("programs = %+v", report.Programs)
+	}
+	p := report.Programs[0]
+	if len(p.ECM) != 1 || p.ECM[0].PID != 0x1f1 || p.Scrambled != 1 || caStatus(p) != "scrambled, needs descrambling" {
+		t.Errorf("program = %+v", p)
+	}
+}
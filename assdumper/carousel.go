@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+// carouselModule is a module announced by DII, whose blocks are gathered from
+// DDB until it's complete.
+type carouselModule struct {
+	componentTag int
+	moduleId     int
+	version      int
+	size         int
+	// name and mimeType are of the Name and Type descriptors, and
+	// compressed tells the Compression Type descriptor of zlib.
+	name       string
+	mimeType   string
+	compressed bool
+	blockSize  int
+	blocks     [][]byte
+	received   int
+	done       bool
+}
+
+type carouselKey struct {
+	pid        int
+	downloadId uint32
+	moduleId   int
+}
+
+// carouselExtractor writes the modules of the DSM-CC data carousels of data
+// broadcasting, BML documents and their images, under the directory of
+// their component_tag and moduleId, where BML refers to them as
+// /component_tag/moduleId/resource.
+type carouselExtractor struct {
+	demux     *tspacket.Demuxer
+	pidMap    *pidMap
+	serviceId int
+	dir       string
+	// carousels are the PIDs of the data carousels read.
+	carousels map[int]bool
+	modules   map[carouselKey]*carouselModule
+	written   int
+}
+
+func runCarousel(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("carousel", flag.ExitOnError)
+	outputDir := fs.String("o", ".", "write the modules to `DIR`")
+	serviceId := fs.Int("service", -1, "extract the data broadcasting of the program whose program_number (service_id) is `N` instead of every one")
+	inputOpts := registerInputFlags(fs)
+	fs.Parse(args)
+	if info, err := os.Stat(*outputDir); err != nil || !info.IsDir() {
+		fmt.Fprintf(os.Stderr, "-o %s is not a directory\n", *outputDir)
+		os.Exit(2)
+	}
+
+	fin, err := openInput(ctx, fs.Arg(0), inputOpts)
+	if err != nil {
+		panic(err)
+	}
+	defer fin.Close()
+	e := newCarouselExtractor(*outputDir, *serviceId)
+	if err := demuxInput(ctx, e.demux, fin); err != nil && ctx.Err() == nil {
+		panic(err)
+	}
+	incomplete := 0
+	for _, m := range e.modules {
+		if !m.done {
+			incomplete++
+		}
+	}
+	if incomplete != 0 {
+		fmt.Fprintf(os.Stderr, "%d modules were incomplete at the end of the input\n", incomplete)
+	}
+	if e.written == 0 {
+		fmt.Fprintln(os.Stderr, "No data carousel modules found")
+		os.Exit(1)
+	}
+}
+
+func newCarouselExtractor(dir string, serviceId int) *carouselExtractor {
+	demux := tspacket.NewDemuxer(nil)
+	e := &carouselExtractor{
+		demux:     demux,
+		pidMap:    newPIDMap(demux),
+		serviceId: serviceId,
+		dir:       dir,
+		carousels: make(map[int]bool),
+		modules:   make(map[carouselKey]*carouselModule),
+	}
+	e.pidMap.onPMT = e.handlePMT
+	return e
+}
+
+// handlePMT reads the data carousels of the program, unless -service tells
+// another one.
+func (e *carouselExtractor) handlePMT(program_number int) {
+	if e.serviceId != -1 && program_number != e.serviceId {
+		return
+	}
+	for pid, es := range e.pidMap.streams {
+		// [B10] stream_type 0x0D, ISO/IEC 13818-6 type D
+		if es.StreamType != 0x0D || e.carousels[pid] || !containsInt(e.pidMap.programs[pid], program_number) {
+			continue
+		}
+		e.carousels[pid] = true
+		e.demux.HandleSections(pid, func(section []byte) {
+			e.handleSection(pid, es.ComponentTag, section)
+		})
+	}
+}
+
+func (e *carouselExtractor) handleSection(pid, componentTag int, section []byte) {
+	// CRC_32 follows when section_syntax_indicator is set, and a
+	// checksum otherwise.
+	if len(section) < 8 || section[1]&0x80 != 0 && tspacket.CRC32(section) != 0 {
+		return
+	}
+	section_length := int(section[1]&0x0F)<<8 | int(section[2])
+	if 3+section_length > len(section) || section_length < 9 {
+		return
+	}
+	message := section[8 : 3+section_length-4]
+	switch section[0] {
+	case 0x3B:
+		e.handleDII(pid, componentTag, message)
+	case 0x3C:
+		e.handleDDB(pid, message)
+	}
+}
+
+// dsmccHeader returns the messageId and transactionId or downloadId of a
+// dsmccMessageHeader or dsmccDownloadDataHeader, and the message after it.
+// ISO/IEC 13818-6 dsmccMessageHeader and dsmccDownloadDataHeader
+func dsmccHeader(message []byte) (messageId int, id uint32, body []byte, ok bool) {
+	if len(message) < 12 || message[0] != 0x11 || message[1] != 0x03 {
+		return 0, 0, nil, false
+	}
+	messageId = int(message[2])<<8 | int(message[3])
+	id = uint32(message[4])<<24 | uint32(message[5])<<16 | uint32(message[6])<<8 | uint32(message[7])
+	adaptationLength := int(message[9])
+	messageLength := int(message[10])<<8 | int(message[11])
+	if 12+messageLength > len(message) || adaptationLength > messageLength {
+		return 0, 0, nil, false
+	}
+	return messageId, id, message[12+adaptationLength : 12+messageLength], true
+}
+
+// handleDII starts gathering the modules of a DownloadInfoIndication, or
+// starts over for a module of a new version.
+// ISO/IEC 13818-6 DownloadInfoIndication, with the descriptors of ARIB
+// STD-B24 in moduleInfo
+func (e *carouselExtractor) handleDII(pid, componentTag int, message []byte) {
+	messageId, _, b, ok := dsmccHeader(message)
+	if !ok || messageId != 0x1002 || len(b) < 18 {
+		return
+	}
+	downloadId := uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+	blockSize := int(b[4])<<8 | int(b[5])
+	compatibilityDescriptorLength := int(b[16])<<8 | int(b[17])
+	index := 18 + compatibilityDescriptorLength
+	if index+2 > len(b) || blockSize == 0 {
+		return
+	}
+	numberOfModules := int(b[index])<<8 | int(b[index+1])
+	index += 2
+	for i := 0; i < numberOfModules && index+8 <= len(b); i++ {
+		moduleId := int(b[index])<<8 | int(b[index+1])
+		moduleSize := int(b[index+2])<<24 | int(b[index+3])<<16 | int(b[index+4])<<8 | int(b[index+5])
+		moduleVersion := int(b[index+6])
+		moduleInfoLength := int(b[index+7])
+		index += 8
+		if index+moduleInfoLength > len(b) {
+			return
+		}
+		key := carouselKey{pid, downloadId, moduleId}
+		if m, ok := e.modules[key]; ok && m.version == moduleVersion {
+			index += moduleInfoLength
+			continue
+		}
+		m := &carouselModule{
+			componentTag: componentTag,
+			moduleId:     moduleId,
+			version:      moduleVersion,
+			size:         moduleSize,
+			blockSize:    blockSize,
+			blocks:       make([][]byte, (moduleSize+blockSize-1)/blockSize),
+		}
+		forEachDescriptor(b[index:index+moduleInfoLength], func(tag byte, d []byte) {
+			switch tag {
+			case 0x01:
+				// Type descriptor
+				m.mimeType = string(d)
+			case 0x02:
+				// Name descriptor
+				m.name = string(d)
+			case 0xC2:
+				// Compression Type descriptor, of zlib for
+				// compression_type 0
+				m.compressed = len(d) >= 1 && d[0] == 0
+			}
+		})
+		index += moduleInfoLength
+		e.modules[key] = m
+		if moduleSize == 0 {
+			e.complete(m)
+		}
+	}
+}
+
+// handleDDB stores a DownloadDataBlock of a module announced by DII.
+// ISO/IEC 13818-6 DownloadDataBlock
+func (e *carouselExtractor) handleDDB(pid int, message []byte) {
+	messageId, downloadId, b, ok := dsmccHeader(message)
+	if !ok || messageId != 0x1003 || len(b) < 6 {
+		return
+	}
+	m, ok := e.modules[carouselKey{pid, downloadId, int(b[0])<<8 | int(b[1])}]
+	blockNumber := int(b[4])<<8 | int(b[5])
+	if !ok || m.done || int(b[2]) != m.version || blockNumber >= len(m.blocks) || m.blocks[blockNumber] != nil {
+		return
+	}
+	data := b[6:]
+	if len(data) > m.blockSize {
+		data = data[:m.blockSize]
+	}
+	m.blocks[blockNumber] = append([]byte(nil), data...)
+	m.received++
+	if m.received == len(m.blocks) {
+		e.complete(m)
+	}
+}
+
+// complete writes a module once all of its blocks have arrived. A module
+// of a multipart type is split into its resources named by
+// Content-Location, and any other one is written as it is.
+func (e *carouselExtractor) complete(m *carouselModule) {
+	m.done = true
+	data := bytes.Join(m.blocks, nil)
+	m.blocks = nil
+	if len(data) > m.size {
+		data = data[:m.size]
+	}
+	if m.compressed {
+		r, err := zlib.NewReader(bytes.NewReader(data))
+		if err == nil {
+			data, err = io.ReadAll(r)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipped module 0x%04x of component_tag 0x%02x: %v\n", m.moduleId, m.componentTag, err)
+			return
+		}
+	}
+	dir := filepath.Join(e.dir, fmt.Sprintf("%02x", m.componentTag), fmt.Sprintf("%04x", m.moduleId))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		panic(err)
+	}
+	if strings.HasPrefix(m.mimeType, "multipart/") {
+		if err := e.writeResources(dir, data); err == nil {
+			return
+		} else if debugMode() {
+			fmt.Fprintf(os.Stderr, "Module 0x%04x of component_tag 0x%02x isn't multipart: %v\n", m.moduleId, m.componentTag, err)
+		}
+	}
+	name := carouselFileName(m.name)
+	if name == "" {
+		name = "module"
+	}
+	e.writeFile(filepath.Join(dir, name), data)
+}
+
+// writeResources writes the resources of a module that is a MIME entity of
+// multipart/mixed.
+func (e *carouselExtractor) writeResources(dir string, data []byte) error {
+	r := bufio.NewReader(bytes.NewReader(data))
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil {
+		return err
+	}
+	_, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return err
+	}
+	if params["boundary"] == "" {
+		return fmt.Errorf("no boundary")
+	}
+	parts := multipart.NewReader(r, params["boundary"])
+	for i := 0; ; i++ {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		body, err := io.ReadAll(part)
+		if err != nil {
+			return err
+		}
+		name := carouselFileName(part.Header.Get("Content-Location"))
+		if name == "" {
+			name = fmt.Sprintf("part%d", i)
+		}
+		e.writeFile(filepath.Join(dir, name), body)
+	}
+}
+
+// carouselFileName makes a file name of a name from the broadcast, which
+// can't leave the directory of the module.
+func carouselFileName(name string) string {
+	name = path.Base("/" + name)
+	if name == "/" || name == "." {
+		return ""
+	}
+	return sanitizeFileName(name)
+}
+
+func (e *carouselExtractor) writeFile(path string, data []byte) {
+	f, err := createAtomicFile(path)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Abort()
+	if _, err := f.Write(data); err != nil {
+		panic(err)
+	}
+	if err := f.Commit(); err != nil {
+		panic(err)
+	}
+	e.written++
+	fmt.Fprintf(os.Stderr, "Wrote %s\n", path)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestCarousel gathers a multipart module from two blocks, the second of
+// which comes first, and writes its resource.
+func TestCarousel(t *testing.T) {
+	pat := []byte{0x00, 0xb0, 0x00, 0x7f, 0xe0, 0xc1, 0x00, 0x00, 0x04, 0x00, 0xe1, 0xf0}
+	pmt := []byte{
+		0x02, 0xb0, 0x00, 0x04, 0x00, 0xc1, 0x00, 0x00, 0xe1, 0x00, 0xf0, 0x00,
+		// The data ES on PID 0x140 of component_tag 0x40
+		0x0d, 0xe1, 0x40, 0xf0, 0x03, 0x52, 0x01, 0x40,
+	}
+	module := []byte("Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Location: ../startup.bml\r\n\r\n<bml/>\r\n--b--\r\n")
+	const blockSize = 64
+	dsmcc := func(table_id byte, messageId byte, body []byte) []byte {
+		section := []byte{table_id, 0xb0, 0x00, 0x00, 0x00, 0xc1, 0x00, 0x00}
+		// protocolDiscriminator, dsmccType, messageId, transactionId
+		// or downloadId 1, and no adaptation
+		section = append(section, 0x11, 0x03, 0x10, messageId, 0x00, 0x00, 0x00, 0x01, 0xff, 0x00, 0x00, byte(len(body)))
+		return append(section, body...)
+	}
+	dii := dsmcc(0x3b, 0x02, []byte{
+		// downloadId 1, blockSize, windowSize, ackPeriod,
+		// tCDownloadWindow, tCDownloadScenario, and no
+		// compatibilityDescriptor
+		0x00, 0x00, 0x00, 0x01, 0x00, blockSize, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		// One module of moduleId 0, version 2, with the Type descriptor
+		0x00, 0x01,
+		0x00, 0x00, 0x00, 0x00, 0x00, byte(len(module)), 0x02, 0x11,
+		0x01, 0x0f, 'm', 'u', 'l', 't', 'i', 'p', 'a', 'r', 't', '/', 'm', 'i', 'x', 'e', 'd',
+		// No privateData
+		0x00, 0x00,
+	})
+	ddb := func(blockNumber byte, data []byte) []byte {
+		return dsmcc(0x3c, 0x03, append([]byte{0x00, 0x00, 0x02, 0xff, 0x00, blockNumber}, data...))
+	}
+
+	dir := t.TempDir()
+	e := newCarouselExtractor(dir, -1)
+	for _, packet := range [][]byte{
+		sectionPacket(0x0000, 0, pat),
+		sectionPacket(0x01f0, 0, pmt),
+		sectionPacket(0x0140, 0, dii),
+		sectionPacket(0x0140, 1, ddb(1, module[blockSize:])),
+		sectionPacket(0x0140, 2, ddb(0, module[:blockSize])),
+	} {
+		e.demux.Push(packet)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "40", "0000", "startup.bml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "<bml/>" {
+		t.Errorf("startup.bml = %q", data)
+	}
+	if e.written != 1 {
+		t.Errorf("written = %d", e.written)
+	}
+}
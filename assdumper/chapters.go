@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// chapter is a caption session in seconds from the start of the recording.
+type chapter struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Title string  `json:"title"`
+}
+
+// chapterWriter turns caption sessions into chapters, titled after the first
+// caption of each session. PCR discontinuities are stitched like the ASS
+// renderer does, so that the chapters follow the media time of the input.
+type chapterWriter struct {
+	start    SystemClock
+	offset   SystemClock
+	last     SystemClock
+	chapters []chapter
+}
+
+func (w *chapterWriter) handle(ev Event) {
+	switch ev := ev.(type) {
+	case ClockStart:
+		if w.start == 0 {
+			w.start = ev.PCR
+		}
+		w.last = ev.PCR
+	case ClockDiscontinuity:
+		w.offset += ev.Previous - ev.Current
+		w.last = ev.Current
+	case CaptionSession:
+		if ev.Track != "" {
+			return
+		}
+		t := w.elapsed(ev.PCR)
+		if n := len(w.chapters); n != 0 {
+			w.chapters[n-1].End = t
+		} else {
+			// Let the first chapter cover the beginning of the recording.
+			t = 0
+		}
+		w.chapters = append(w.chapters, chapter{Start: t})
+		w.last = ev.PCR
+	case CaptionUnit:
+		if ev.Track != "" {
+			return
+		}
+		w.last = ev.PCR
+		n := len(w.chapters)
+		text := strings.Replace(ev.Text, "\f", "", -1)
+		if n != 0 && w.chapters[n-1].Title == "" && !isBlank(text) {
+			w.chapters[n-1].Title = truncateText(strings.NewReplacer("\\n", " ", "\\N", " ").Replace(text), 30)
+		}
+	}
+}
+
+func (w *chapterWriter) elapsed(pcr SystemClock) float64 {
+	if pcr == 0 {
+		return 0
+	}
+	return float64(pcr+w.offset-w.start) / float64(K)
+}
+
+// finish closes the last chapter at end, the last PCR of the input.
+func (w *chapterWriter) finish(end SystemClock) {
+	if n := len(w.chapters); n != 0 {
+		w.chapters[n-1].End = w.elapsed(end)
+	}
+	for i := range w.chapters {
+		if w.chapters[i].Title == "" {
+			w.chapters[i].Title = fmt.Sprintf("Chapter %d", i+1)
+		}
+	}
+}
+
+func (w *chapterWriter) writeJSON(out io.Writer) error {
+	enc := json.NewEncoder(out)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	chapters := w.chapters
+	if chapters == nil {
+		chapters = []chapter{}
+	}
+	return enc.Encode(chapters)
+}
+
+// writeFFMetadata writes the chapters in the metadata format of ffmpeg, which
+// can be muxed with `ffmpeg -i in.ts -i chapters.txt -map_metadata 1`.
+func (w *chapterWriter) writeFFMetadata(out io.Writer) error {
+	escaper := strings.NewReplacer("=", "\\=", ";", "\\;", "#", "\\#", "\\", "\\\\", "\n", "\\\n")
+	if _, err := fmt.Fprintln(out, ";FFMETADATA1"); err != nil {
+		return err
+	}
+	for _, c := range w.chapters {
+		_, err := fmt.Fprintf(out, "\n[CHAPTER]\nTIMEBASE=1/1000\nSTART=%d\nEND=%d\ntitle=%s\n",
+			int64(c.Start*1000), int64(c.End*1000), escaper.Replace(c.Title))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
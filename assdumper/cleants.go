@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+// tsCleaner drops the packets that are of no use in an archived recording:
+// null packets, those with transport_error_indicator, scrambled ones, and
+// with -service, those of the other services.
+type tsCleaner struct {
+	demux  *tspacket.Demuxer
+	pidMap *pidMap
+	// serviceId is the program_number to keep, or -1 to keep every service.
+	serviceId int
+
+	null, errors, scrambled, others int64
+}
+
+func runCleanTS(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("clean-ts", flag.ExitOnError)
+	outputPath := fs.String("o", "", "write the cleaned TS to `PATH` instead of stdout")
+	serviceId := fs.Int("service", -1, "drop the PIDs that don't belong to the program whose program_number (service_id) is `N`")
+	inputOpts := registerInputFlags(fs)
+	fs.Parse(args)
+
+	fin, err := openInput(ctx, fs.Arg(0), inputOpts)
+	if err != nil {
+		panic(err)
+	}
+	defer fin.Close()
+	var w io.Writer = os.Stdout
+	var fout *atomicFile
+	if *outputPath != "" {
+		fout, err = createAtomicFile(*outputPath)
+		if err != nil {
+			panic(err)
+		}
+		defer fout.Abort()
+		w = fout
+	}
+	out := bufio.NewWriter(w)
+
+	c := newTSCleaner(*serviceId)
+	c.demux.HandlePackets(func(packet tspacket.Packet) {
+		if !c.keep(packet) {
+			return
+		}
+		// Packets of 192 or 204 bytes come without their extra bytes, so
+		// the cleaned TS is always of 188-byte packets.
+		if _, err := out.Write(packet); err != nil {
+			panic(err)
+		}
+	})
+	if err := demuxInput(ctx, c.demux, fin); err != nil && ctx.Err() == nil {
+		panic(err)
+	}
+	if err := out.Flush(); err != nil {
+		panic(err)
+	}
+	if fout != nil {
+		if err := fout.Commit(); err != nil {
+			panic(err)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Dropped %d null, %d error and %d scrambled packets", c.null, c.errors, c.scrambled)
+	if c.serviceId != -1 {
+		fmt.Fprintf(os.Stderr, ", and %d packets of other services", c.others)
+	}
+	fmt.Fprintln(os.Stderr)
+}
+
+func newTSCleaner(serviceId int) *tsCleaner {
+	demux := tspacket.NewDemuxer(nil)
+	return &tsCleaner{demux: demux, pidMap: newPIDMap(demux), serviceId: serviceId}
+}
+
+// keep tells whether the packet goes into the cleaned TS.
+func (c *tsCleaner) keep(packet tspacket.Packet) bool {
+	pid := packet.PID()
+	switch {
+	case pid == tspacket.NullPID:
+		c.null++
+		return false
+	case packet.TransportError():
+		c.errors++
+		return false
+	case packet.Scrambled():
+		c.scrambled++
+		return false
+	}
+	if c.serviceId == -1 || c.belongs(pid) {
+		return true
+	}
+	c.others++
+	return false
+}
+
+// belongs tells whether pid is of the service, or carries PSI/SI, which is
+// on the PIDs up to 0x2F. [B10] 5.1.1
+// PIDs of the service that come before its PMT are dropped too.
+func (c *tsCleaner) belongs(pid int) bool {
+	if pid <= 0x002f {
+		return true
+	}
+	if program_number, ok := c.pidMap.pmtPids[pid]; ok {
+		return program_number == c.serviceId
+	}
+	return containsInt(c.pidMap.programs[pid], c.serviceId)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+func TestCleanTS(t *testing.T) {
+	pat := []byte{
+		0x00, 0xb0, 0x00, 0x7f, 0xe0, 0xc1, 0x00, 0x00,
+		// program_number 1 on PID 0x1f0, and 2 on 0x1f1
+		0x00, 0x01, 0xe1, 0xf0,
+		0x00, 0x02, 0xe1, 0xf1,
+	}
+	pmt := func(program_number byte, pid int) []byte {
+		return []byte{
+			0x02, 0xb0, 0x00, 0x00, program_number, 0xc1, 0x00, 0x00,
+			// PCR_PID, and no program_info
+			0xe0 | byte(pid>>8), byte(pid), 0xf0, 0x00,
+			// A stream of stream_type 0x06 on pid
+			0x06, 0xe0 | byte(pid>>8), byte(pid), 0xf0, 0x00,
+		}
+	}
+	packet := func(pid int, flags byte) tspacket.Packet {
+		p := make([]byte, 188)
+		p[0] = tspacket.SyncByte
+		p[1] = flags | byte(pid>>8)
+		p[2] = byte(pid)
+		p[3] = 0x10
+		return p
+	}
+	scrambled := packet(0x0100, 0)
+	// transport_scrambling_control of the odd key
+	scrambled[3] |= 0xc0
+	c := newTSCleaner(1)
+	var kept bool
+	c.demux.HandlePackets(func(packet tspacket.Packet) {
+		kept = c.keep(packet)
+	})
+	for _, test := range []struct {
+		name   string
+		packet tspacket.Packet
+		keep   bool
+	}{
+		{"PMT of 1 before PAT", sectionPacket(0x01f0, 0, pmt(1, 0x0100)), false},
+		{"PAT", sectionPacket(0x0000, 0, pat), true},
+		{"PMT of 1", sectionPacket(0x01f0, 1, pmt(1, 0x0100)), true},
+		{"PMT of 2", sectionPacket(0x01f1, 0, pmt(2, 0x0200)), false},
+		{"stream of 1", packet(0x0100, 0), true},
+		{"stream of 2", packet(0x0200, 0), false},
+		{"EIT", packet(0x0012, 0), true},
+		{"null", packet(tspacket.NullPID, 0), false},
+		{"transport error", packet(0x0100, 0x80), false},
+		{"scrambled", scrambled, false},
+	} {
+		c.demux.Push(test.packet)
+		if kept != test.keep {
+			t.Errorf("keep(%s) = %v", test.name, kept)
+		}
+	}
+	if c.null != 1 || c.errors != 1 || c.scrambled != 1 || c.others != 3 {
+		t.Errorf("null = %d, errors = %d, scrambled = %d, others = %d", c.null, c.errors, c.scrambled, c.others)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// clockFilter turns the PCR values read from the stream into the system
+// clock that captions are timed by. Noisy tuners deliver PCR with jitter,
+// which the filters other than raw smooth out against the packet count,
+// since the TS of a broadcast has a constant bitrate.
+type clockFilter interface {
+	// filter returns the system clock for pcr read in the packet-th packet.
+	filter(pcr SystemClock, packet int64) SystemClock
+	// reset forgets the history at a discontinuity of PCR.
+	reset()
+}
+
+var clockFilterNames = []string{"raw", "median", "pll"}
+
+func newClockFilter(name string) (clockFilter, error) {
+	switch name {
+	case "raw":
+		return rawClock{}, nil
+	case "median":
+		return &medianClock{}, nil
+	case "pll":
+		return &pllClock{}, nil
+	}
+	return nil, fmt.Errorf("unknown clock filter %q (want one of %v)", name, clockFilterNames)
+}
+
+// rawClock uses PCR as it is.
+type rawClock struct{}
+
+func (rawClock) filter(pcr SystemClock, packet int64) SystemClock {
+	return pcr
+}
+
+func (rawClock) reset() {}
+
+type pcrSample struct {
+	pcr    SystemClock
+	packet int64
+}
+
+// medianClockWindow is the number of PCR samples medianClock looks at,
+// about 0.5 seconds at the 40ms interval of ISDB.
+const medianClockWindow = 15
+
+// medianClock projects each of the recent PCR samples to the current packet
+// at the rate over the window and takes the median, which ignores samples
+// that arrived early or late.
+type medianClock struct {
+	samples []pcrSample
+}
+
+func (c *medianClock) filter(pcr SystemClock, packet int64) SystemClock {
+	c.samples = append(c.samples, pcrSample{pcr, packet})
+	if len(c.samples) > medianClockWindow {
+		c.samples = c.samples[1:]
+	}
+	first := c.samples[0]
+	if len(c.samples) < 3 || packet == first.packet {
+		return pcr
+	}
+	rate := float64(pcr-first.pcr) / float64(packet-first.packet)
+	projections := make([]SystemClock, len(c.samples))
+	for i, s := range c.samples {
+		projections[i] = s.pcr + SystemClock(rate*float64(packet-s.packet))
+	}
+	sort.Slice(projections, func(i, j int) bool { return projections[i] < projections[j] })
+	return projections[len(projections)/2]
+}
+
+func (c *medianClock) reset() {
+	c.samples = nil
+}
+
+// Gains of the phase and the frequency of pllClock. The phase follows an
+// error in about 10 samples, and the frequency much slower.
+const (
+	pllPhaseGain     = 0.1
+	pllFrequencyGain = 0.005
+)
+
+// pllClock is a second order phase-locked loop running on the packet count.
+// Its clock advances at the estimated PCR rate per packet and is pulled
+// toward each PCR by a fraction of the error, which also corrects the rate.
+type pllClock struct {
+	samples int
+	last    pcrSample
+	clock   float64
+	rate    float64
+}
+
+func (c *pllClock) filter(pcr SystemClock, packet int64) SystemClock {
+	switch {
+	case c.samples == 0 || packet <= c.last.packet:
+		c.clock = float64(pcr)
+		c.samples = 1
+	case c.samples == 1:
+		// The second sample gives the initial rate.
+		c.rate = float64(pcr-c.last.pcr) / float64(packet-c.last.packet)
+		c.clock = float64(pcr)
+		c.samples = 2
+	default:
+		elapsed := float64(packet - c.last.packet)
+		c.clock += c.rate * elapsed
+		e := float64(pcr) - c.clock
+		c.clock += pllPhaseGain * e
+		c.rate += pllFrequencyGain * e / elapsed
+	}
+	c.last = pcrSample{pcr, packet}
+	return SystemClock(c.clock)
+}
+
+func (c *pllClock) reset() {
+	*c = pllClock{}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// TestClockFilters analyzes a stream whose PCR jumps ahead, as at the seam
+// of two recordings, with each filter. The filters start over at the jump
+// rather than smoothing it, and time the captions on both sides of it by
+// their PCR. The stream of tsgen is far from a constant bitrate, which puts
+// the filters running on the packet count off by a fraction of a second,
+// though nowhere near the jump.
+func TestClockFilters(t *testing.T) {
+	const jump = 1000 * SystemClock(K)
+	ts := generateTS(t, fmt.Sprintf(`@start 2024-04-01T21:00:00+09:00
+@pcr 3s %d
+1s	前
+2s	前の二つ目
+4s	後
+5s	後の二つ目
+6s
+`, jump))
+	// The PCR of tsgen starts from 10 seconds.
+	want := []SystemClock{11 * SystemClock(K), 12 * SystemClock(K), jump + 1*SystemClock(K), jump + 2*SystemClock(K)}
+	const tolerance = SystemClock(K) / 2
+	for _, name := range clockFilterNames {
+		t.Run(name, func(t *testing.T) {
+			state := newAnalyzerState()
+			state.clock, _ = newClockFilter(name)
+			var discontinuities []ClockDiscontinuity
+			var captions []SystemClock
+			state.emit = func(ev Event) {
+				switch ev := ev.(type) {
+				case ClockDiscontinuity:
+					discontinuities = append(discontinuities, ev)
+				case CaptionUnit:
+					if !isBlank(strings.Replace(ev.Text, "\f", "", -1)) {
+						captions = append(captions, ev.PCR)
+					}
+				}
+			}
+			if err := analyzeStream(context.Background(), io.NopCloser(bytes.NewReader(ts)), state); err != nil {
+				t.Fatal(err)
+			}
+			if len(discontinuities) != 1 || discontinuities[0].Current != jump {
+				t.Fatalf("discontinuities = %+v", discontinuities)
+			}
+			if previous := discontinuities[0].Previous; abs(previous-(12*SystemClock(K)+9*SystemClock(K)/10)) > tolerance {
+				t.Errorf("discontinuity from %d", previous)
+			}
+			if len(captions) != len(want) {
+				t.Fatalf("captions at %v", captions)
+			}
+			for i, pcr := range captions {
+				if abs(pcr-want[i]) > tolerance {
+					t.Errorf("caption %d at %d, want %d", i, pcr, want[i])
+				}
+			}
+		})
+	}
+}
+
+func abs(d SystemClock) SystemClock {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
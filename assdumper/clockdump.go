@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+// clockEntry is a TOT or TDT along with the PCR of the program when it
+// arrived, or a PCR discontinuity, including the wraparound of PCR, for the
+// clock subcommand.
+type clockEntry struct {
+	Offset int64  `json:"offset"`
+	Table  string `json:"table"`
+	// Time is JST_time in RFC 3339, and PCR the last PCR before it in
+	// 27MHz units, or -1 before the first one.
+	Time string `json:"time,omitempty"`
+	PCR  int64  `json:"pcr"`
+	// Drift is how far the time has gone ahead of the PCR since the first
+	// TOT/TDT after the last discontinuity, in seconds. JST_time has a
+	// resolution of a second, so it only means something beyond ±1.
+	Drift *float64 `json:"drift,omitempty"`
+}
+
+// clockDumper follows PAT and PMT to the PCR_PID of a program and writes
+// every TOT and TDT with the PCR at its byte offset, to find out why the
+// subtitles of a recording are shifted, e.g. a PCR that wraps or jumps, or a
+// TOT that is late.
+type clockDumper struct {
+	demux     *tspacket.Demuxer
+	serviceId int
+	pmtPid    int
+	pcrPid    int
+	pcr       int64
+	// baseTime and basePCR are of the first TOT/TDT after the last
+	// discontinuity, to measure the drift from.
+	baseTime int64
+	basePCR  int64
+	write    func(e clockEntry)
+}
+
+func runClock(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("clock", flag.ExitOnError)
+	serviceId := fs.Int("service", -1, "follow the PCR of the program whose program_number (service_id) is `N` instead of the first one")
+	jsonOutput := fs.Bool("json", false, "print JSON Lines")
+	inputOpts := registerInputFlags(fs)
+	fs.Parse(args)
+
+	fin, err := openInput(ctx, fs.Arg(0), inputOpts)
+	if err != nil {
+		panic(err)
+	}
+	defer fin.Close()
+
+	write := writeClockEntry
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		write = func(e clockEntry) {
+			if err := enc.Encode(e); err != nil {
+				panic(err)
+			}
+		}
+	} else {
+		// Not tabwriter, so that the lines go out as they are found for
+		// a live input.
+		fmt.Printf("%12s  %-13s  %-25s  %12s  %8s\n", "OFFSET", "TABLE", "TIME", "PCR", "DRIFT")
+	}
+	d := newClockDumper(fin, *serviceId, write)
+	err = d.demux.Run(ctx)
+	if err != nil && err != io.ErrUnexpectedEOF && ctx.Err() == nil {
+		panic(err)
+	}
+	if d.pcrPid == -1 {
+		fmt.Fprintln(os.Stderr, "No PCR_PID found")
+	}
+}
+
+// newClockDumper returns a clockDumper of the program serviceId, or the
+// first one for -1, which gives the entries it finds in r to write.
+func newClockDumper(r io.Reader, serviceId int, write func(e clockEntry)) *clockDumper {
+	d := &clockDumper{demux: tspacket.NewDemuxer(r), serviceId: serviceId, pmtPid: -1, pcrPid: -1, pcr: -1, basePCR: -1, write: write}
+	d.demux.HandleSections(0x0000, d.handlePAT)
+	// TDT and TOT share the PID.
+	d.demux.HandleSections(0x0014, d.handleTime)
+	return d
+}
+
+func writeClockEntry(e clockEntry) {
+	pcr, drift := "-", "-"
+	if e.PCR >= 0 {
+		pcr = fmt.Sprintf("%.3f", float64(e.PCR)/27000000)
+	}
+	if e.Drift != nil {
+		drift = fmt.Sprintf("%+.3f", *e.Drift)
+	}
+	fmt.Printf("%12d  %-13s  %-25s  %12s  %8s\n", e.Offset, e.Table, orDash(e.Time), pcr, drift)
+}
+
+func (d *clockDumper) handlePAT(section []byte) {
+	if d.pmtPid != -1 || tspacket.CRC32(section) != 0 || section[0] != 0x00 {
+		return
+	}
+	pmtPids := tspacket.ParsePAT(section)
+	best := -1
+	for pmtPid, program_number := range pmtPids {
+		// The program with the smallest program_number unless told, as
+		// the order of PAT is lost in the map
+		if d.serviceId != -1 && program_number != d.serviceId || best != -1 && program_number >= pmtPids[best] {
+			continue
+		}
+		best = pmtPid
+	}
+	if best == -1 {
+		return
+	}
+	d.pmtPid = best
+	d.demux.HandleSections(best, d.handlePMT)
+}
+
+func (d *clockDumper) handlePMT(section []byte) {
+	if d.pcrPid != -1 || tspacket.CRC32(section) != 0 || section[0] != 0x02 {
+		return
+	}
+	if pcrPid := tspacket.PCRPID(section); pcrPid >= 0 && pcrPid < tspacket.NullPID {
+		d.pcrPid = pcrPid
+		d.demux.HandlePCR(pcrPid, d.handlePCR)
+	}
+}
+
+func (d *clockDumper) handlePCR(pcr int64, discontinuity bool) {
+	if d.pcr >= 0 && (discontinuity || tspacket.IsPCRDiscontinuity(d.pcr, pcr)) {
+		d.basePCR = -1
+		d.write(clockEntry{Offset: d.demux.Position().Offset, Table: "discontinuity", PCR: pcr})
+	}
+	d.pcr = pcr
+}
+
+func (d *clockDumper) handleTime(section []byte) {
+	var table string
+	switch {
+	case len(section) < 8:
+		return
+	case section[0] == 0x70:
+		// [B10] 5.2.8 Time and Date Table, which has no CRC_32
+		table = "TDT"
+	case section[0] == 0x73 && tspacket.CRC32(section) == 0:
+		// [B10] 5.2.9 Time Offset Table
+		table = "TOT"
+	default:
+		return
+	}
+	t := tspacket.DecodeJSTTime(section[3:8])
+	e := clockEntry{Offset: d.demux.Position().Offset, Table: table, Time: formatJst(t), PCR: d.pcr}
+	if d.pcr >= 0 {
+		if d.basePCR < 0 {
+			d.baseTime, d.basePCR = t, d.pcr
+		}
+		drift := float64(t-d.baseTime) - float64(d.pcr-d.basePCR)/27000000
+		e.Drift = &drift
+	}
+	d.write(e)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tsgen"
+)
+
+// TestClock dumps the TOT of a generated stream, sent every 5 seconds along
+// with the PCR, which keep pace with each other.
+func TestClock(t *testing.T) {
+	ts := generateTS(t, `@start 2024-04-01T21:00:00+09:00
+1s	字幕
+@duration 12s
+`)
+	var entries []clockEntry
+	d := newClockDumper(bytes.NewReader(ts), -1, func(e clockEntry) {
+		entries = append(entries, e)
+	})
+	if err := d.demux.Run(context.Background()); err != nil && err != io.ErrUnexpectedEOF {
+		t.Fatal(err)
+	}
+	if d.pcrPid != tsgen.PCRPID {
+		t.Errorf("PCR_PID = 0x%x", d.pcrPid)
+	}
+	want := []string{"2024-04-01T21:00:00+09:00", "2024-04-01T21:00:05+09:00", "2024-04-01T21:00:10+09:00"}
+	if len(entries) != len(want) {
+		t.Fatalf("entries = %+v", entries)
+	}
+	for i, e := range entries {
+		// The stream starts at PCR 10s.
+		pcr := int64(10+5*i) * 27000000
+		if e.Table != "TOT" || e.Time != want[i] || e.PCR != pcr {
+			t.Errorf("entry %d = %+v, want TOT at %s with PCR %d", i, e, want[i], pcr)
+		}
+		if e.Drift == nil || *e.Drift != 0 {
+			t.Errorf("entry %d has drift %v", i, e.Drift)
+		}
+		if i > 0 && e.Offset <= entries[i-1].Offset {
+			t.Errorf("entry %d at offset %d after %d", i, e.Offset, entries[i-1].Offset)
+		}
+	}
+}
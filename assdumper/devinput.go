@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// deviceReader reads a character or block device, e.g. the dvr device of a
+// DVB adapter. Such a device can't seek and may fail transiently while a live
+// stream is read, so reads are retried on EAGAIN and on an overflow of the
+// DVR buffer, which only loses packets. Reading ends with io.EOF when ctx is
+// done, like -listen.
+type deviceReader struct {
+	f *os.File
+	// tuner holds the frontend and the demux of -tune open while reading.
+	tuner  io.Closer
+	closed atomic.Bool
+}
+
+func openDeviceInput(ctx context.Context, path string, opts *inputOptions) (io.ReadCloser, error) {
+	r := &deviceReader{}
+	if opts.tune != 0 {
+		tuner, err := tuneISDBT(path, opts.tune)
+		if err != nil {
+			return nil, err
+		}
+		r.tuner = tuner
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if r.tuner != nil {
+			r.tuner.Close()
+		}
+		return nil, err
+	}
+	r.f = f
+	setDVRBufferSize(f)
+	context.AfterFunc(ctx, func() {
+		r.Close()
+	})
+	return r, nil
+}
+
+func (r *deviceReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.f.Read(p)
+		switch {
+		case r.closed.Load():
+			return 0, io.EOF
+		case errors.Is(err, syscall.EAGAIN):
+			time.Sleep(10 * time.Millisecond)
+			continue
+		case isDVROverflow(err):
+			fmt.Fprintln(os.Stderr, "DVR buffer overflowed; packets were lost")
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *deviceReader) Close() error {
+	if r.closed.Swap(true) {
+		return nil
+	}
+	err := r.f.Close()
+	if r.tuner != nil {
+		r.tuner.Close()
+	}
+	return err
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"image/color"
+	"os"
+	"sort"
+)
+
+// Magnification of glyph bitmaps in the web UI of drcs-label and the files
+// of -drcs-png.
+const drcsGlyphScale = 4
+
+// The Private Use Area of the BMP, from which -drcs-pua gives code points to
+// the glyphs without a replacement.
+const (
+	drcsPUAFirst = 0xe000
+	drcsPUALast  = 0xf8ff
+)
+
+// drcsEntry is a DRCS glyph seen in a stream. Replacement is empty until
+// somebody labels the glyph with drcs-label. Bits is 0 for a glyph of the
+// compressed modes recorded before they were drawn, whose Pattern is the
+// geometric data in a region of Width x Height.
+type drcsEntry struct {
+	Replacement string `json:"replacement"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Bits        int    `json:"bits"`
+	Pattern     string `json:"pattern"`
+}
+
+// drcsDB is a JSON file mapping the MD5 of DRCS patterns (DRCSFont.MD5 of
+// aribcaption) to their replacements. Runs with -drcs-db add the glyphs they
+// couldn't replace, and drcs-label fills in the replacements.
+type drcsDB struct {
+	path    string
+	entries map[string]*drcsEntry
+	dirty   bool
+}
+
+func loadDRCSDB(path string) (*drcsDB, error) {
+	db := &drcsDB{path: path, entries: make(map[string]*drcsEntry)}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return db, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &db.entries); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func (db *drcsDB) lookup(md5sum string) string {
+	if e, ok := db.entries[md5sum]; ok {
+		return e.Replacement
+	}
+	return ""
+}
+
+// record adds an unlabeled glyph unless it is already known.
+func (db *drcsDB) record(md5sum string, width, height, bits int, pattern []byte) {
+	if _, ok := db.entries[md5sum]; ok {
+		return
+	}
+	db.entries[md5sum] = &drcsEntry{
+		Width:   width,
+		Height:  height,
+		Bits:    bits,
+		Pattern: hex.EncodeToString(pattern),
+	}
+	db.dirty = true
+}
+
+// remember records a glyph with the replacement chosen for it, keeping the
+// one recorded before.
+func (db *drcsDB) remember(md5sum, replacement string, width, height, bits int, pattern []byte) {
+	db.record(md5sum, width, height, bits, pattern)
+	if replacement != "" && db.lookup(md5sum) == "" {
+		db.label(md5sum, replacement)
+	}
+}
+
+func (db *drcsDB) label(md5sum, replacement string) bool {
+	e, ok := db.entries[md5sum]
+	if !ok {
+		return false
+	}
+	e.Replacement = replacement
+	db.dirty = true
+	return true
+}
+
+// unlabeled returns the MD5 of the glyphs without a replacement.
+func (db *drcsDB) unlabeled() []string {
+	var keys []string
+	for k, e := range db.entries {
+		if e.Replacement == "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// save merges the changes into the file as it is now, since drcs-label may
+// have labeled glyphs while this run was going.
+func (db *drcsDB) save() error {
+	if !db.dirty {
+		return nil
+	}
+	current, err := loadDRCSDB(db.path)
+	if err != nil {
+		return err
+	}
+	for k, e := range db.entries {
+		if c, ok := current.entries[k]; !ok || e.Replacement != "" {
+			current.entries[k] = e
+		} else {
+			db.entries[k] = c
+		}
+	}
+	b, err := json.MarshalIndent(current.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := createAtomicFile(db.path)
+	if err != nil {
+		return err
+	}
+	defer f.Abort()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if err := f.Commit(); err != nil {
+		return err
+	}
+	db.dirty = false
+	return nil
+}
+
+// drcsPUA returns a code point of the Private Use Area derived from the MD5
+// of a glyph. The code points given to other glyphs in cache are skipped so
+// that a code point stands for one glyph across runs.
+func drcsPUA(md5sum string, cache *drcsDB) string {
+	b, err := hex.DecodeString(md5sum)
+	if err != nil || len(b) < 4 {
+		return ""
+	}
+	used := make(map[string]bool)
+	if cache != nil {
+		for k, e := range cache.entries {
+			if k != md5sum {
+				used[e.Replacement] = true
+			}
+		}
+	}
+	n := drcsPUALast - drcsPUAFirst + 1
+	start := int(binary.BigEndian.Uint32(b) % uint32(n))
+	for i := 0; i < n; i++ {
+		s := string(rune(drcsPUAFirst + (start+i)%n))
+		if !used[s] {
+			return s
+		}
+	}
+	return ""
+}
+
+// isDRCSPUA reports whether s is a code point given by drcsPUA.
+func isDRCSPUA(s string) bool {
+	r := []rune(s)
+	return len(r) == 1 && r[0] >= drcsPUAFirst && r[0] <= drcsPUALast
+}
+
+// pixel returns the gradation of the pixel at (x, y) from 0 (background) to
+// 1 (foreground).
+func (e *drcsEntry) pixel(pattern []byte, x, y int) float64 {
+	bit := (y*e.Width + x) * e.Bits
+	v := 0
+	for i := 0; i < e.Bits; i++ {
+		if bit/8 >= len(pattern) {
+			return 0
+		}
+		v = v<<1 | int(pattern[bit/8]>>(7-bit%8))&1
+		bit++
+	}
+	return float64(v) / float64(int(1)<<e.Bits-1)
+}
+
+// image draws the glyph in black on white, magnified by scale.
+func (e *drcsEntry) image(pattern []byte, scale int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, e.Width*scale, e.Height*scale))
+	for y := 0; y < e.Height*scale; y++ {
+		for x := 0; x < e.Width*scale; x++ {
+			v := e.pixel(pattern, x/scale, y/scale)
+			img.SetGray(x, y, color.Gray{Y: uint8(255 - v*255)})
+		}
+	}
+	return img
+}
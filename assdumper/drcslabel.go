@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"html/template"
+	"image/png"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+var drcsLabelTemplate = template.Must(template.New("drcs-label").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>assdumper drcs-label</title>
+</head>
+<body>
+<p>{{len .}} unlabeled DRCS glyphs</p>
+{{range .}}
+<form method="post" action="/label">
+<img src="/glyph/{{.}}.png" alt="{{.}}">
+<input type="hidden" name="md5" value="{{.}}">
+<input type="text" name="replacement">
+<input type="submit" value="Save">
+<code>{{.}}</code>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+// drcsLabelServer serves the glyphs of a DRCS database that have no
+// replacement yet and writes the labels typed by the user back to the file.
+// The file is read again on every request so that glyphs recorded by runs
+// in the meantime show up.
+type drcsLabelServer struct {
+	path string
+	mu   sync.Mutex
+}
+
+func runDRCSLabel(args []string) {
+	fs := flag.NewFlagSet("drcs-label", flag.ExitOnError)
+	listen := fs.String("listen", ":8082", "serve the web UI on `ADDR`")
+	dbPath := fs.String("db", "drcs.json", "DRCS database `FILE` shared with -drcs-db")
+	fs.Parse(args)
+
+	s := &drcsLabelServer{path: *dbPath}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.index)
+	mux.HandleFunc("/glyph/", s.glyph)
+	mux.HandleFunc("/label", s.label)
+	fmt.Fprintf(os.Stderr, "Serving %s on %s\n", *dbPath, *listen)
+	if err := http.ListenAndServe(*listen, mux); err != nil {
+		panic(err)
+	}
+}
+
+func (s *drcsLabelServer) load(w http.ResponseWriter) *drcsDB {
+	db, err := loadDRCSDB(s.path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	return db
+}
+
+func (s *drcsLabelServer) index(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	s.mu.Lock()
+	db := s.load(w)
+	s.mu.Unlock()
+	if db == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := drcsLabelTemplate.Execute(w, db.unlabeled()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+func (s *drcsLabelServer) glyph(w http.ResponseWriter, r *http.Request) {
+	md5sum := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/glyph/"), ".png")
+	s.mu.Lock()
+	db := s.load(w)
+	s.mu.Unlock()
+	if db == nil {
+		return
+	}
+	e, ok := db.entries[md5sum]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if e.Bits == 0 {
+		http.Error(w, "geometric glyph without a bitmap", http.StatusNotFound)
+		return
+	}
+	pattern, err := hex.DecodeString(e.Pattern)
+	if err != nil || e.Bits < 0 {
+		http.Error(w, "broken pattern", http.StatusInternalServerError)
+		return
+	}
+	img := e.image(pattern, drcsGlyphScale)
+	w.Header().Set("Content-Type", "image/png")
+	png.Encode(w, img)
+}
+
+func (s *drcsLabelServer) label(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	md5sum := r.FormValue("md5")
+	replacement := r.FormValue("replacement")
+	if replacement == "" {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	db := s.load(w)
+	if db == nil {
+		return
+	}
+	if !db.label(md5sum, replacement) {
+		http.NotFound(w, r)
+		return
+	}
+	if err := db.save(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s => %s\n", md5sum, replacement)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
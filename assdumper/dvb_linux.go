@@ -0,0 +1,191 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Linux DVB API, linux/dvb/frontend.h and linux/dvb/dmx.h
+const (
+	dtvTune             = 1
+	dtvClear            = 2
+	dtvFrequency        = 3
+	dtvBandwidthHz      = 5
+	dtvDeliverySystem   = 17
+	sysISDBT            = 8
+	feHasLock           = 0x10
+	dmxInFrontend       = 0
+	dmxOutTSTap         = 2
+	dmxPESOther         = 20
+	dmxImmediateStart   = 4
+	dmxAllPIDs          = 0x2000
+	dvrBufferSize       = 4 * 1024 * 1024
+	isdbtBandwidth      = 6000000
+	isdbtLockTimeout    = 10 * time.Second
+	isdbtLowestChannel  = 13
+	isdbtHighestChannel = 62
+)
+
+// struct dtv_property, which is packed
+type dtvProperty struct {
+	cmd      uint32
+	reserved [3]uint32
+	data     uint32
+	// the rest of the union, whose buffer ends with a pointer
+	buffer [44 + unsafe.Sizeof(uintptr(0))]byte
+	result int32
+}
+
+// struct dtv_properties
+type dtvProperties struct {
+	num   uint32
+	props *dtvProperty
+}
+
+// struct dmx_pes_filter_params
+type dmxPESFilterParams struct {
+	pid     uint16
+	input   uint32
+	output  uint32
+	pesType uint32
+	flags   uint32
+}
+
+func ioc(dir, nr, size uintptr) uintptr {
+	return dir<<30 | size<<16 | 'o'<<8 | nr
+}
+
+var (
+	feSetProperty   = ioc(1, 82, unsafe.Sizeof(dtvProperties{}))
+	feReadStatus    = ioc(2, 69, 4)
+	dmxSetPESFilter = ioc(1, 44, unsafe.Sizeof(dmxPESFilterParams{}))
+	dmxSetBufSize   = ioc(0, 45, 0)
+)
+
+func ioctl(fd, req, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// isdbtFrequency returns the center frequency of an ISDB-T physical channel
+// in the UHF band, which is offset by 1/7 MHz from the channel raster.
+func isdbtFrequency(channel int) uint32 {
+	return uint32(473000000 + 1000000/7 + (channel-isdbtLowestChannel)*6000000)
+}
+
+// dvbTuner keeps the frontend and the demux open, which would otherwise
+// release the tuner and stop the stream.
+type dvbTuner struct {
+	frontend *os.File
+	demux    *os.File
+}
+
+func (t *dvbTuner) Close() error {
+	t.demux.Close()
+	return t.frontend.Close()
+}
+
+// tuneISDBT tunes the frontend of the adapter of the dvr device at dvrPath
+// (/dev/dvb/adapterN/dvrM) to an ISDB-T physical channel and routes every
+// PID to the dvr device, which is what dvbv5-zap -r does.
+func tuneISDBT(dvrPath string, channel int) (io.Closer, error) {
+	if channel < isdbtLowestChannel || channel > isdbtHighestChannel {
+		return nil, fmt.Errorf("-tune: ISDB-T channel must be %d to %d", isdbtLowestChannel, isdbtHighestChannel)
+	}
+	base := filepath.Base(dvrPath)
+	if !strings.HasPrefix(base, "dvr") {
+		return nil, fmt.Errorf("-tune needs the dvr device of a DVB adapter, not %s", dvrPath)
+	}
+	dir, index := filepath.Dir(dvrPath), strings.TrimPrefix(base, "dvr")
+
+	frontend, err := os.OpenFile(filepath.Join(dir, "frontend"+index), os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	props := []dtvProperty{
+		{cmd: dtvClear},
+		{cmd: dtvDeliverySystem, data: sysISDBT},
+		{cmd: dtvFrequency, data: isdbtFrequency(channel)},
+		{cmd: dtvBandwidthHz, data: isdbtBandwidth},
+		{cmd: dtvTune},
+	}
+	arg := dtvProperties{num: uint32(len(props)), props: &props[0]}
+	if err := ioctl(frontend.Fd(), feSetProperty, uintptr(unsafe.Pointer(&arg))); err != nil {
+		frontend.Close()
+		return nil, fmt.Errorf("FE_SET_PROPERTY: %v", err)
+	}
+	if err := waitForLock(frontend); err != nil {
+		frontend.Close()
+		return nil, err
+	}
+
+	demux, err := os.OpenFile(filepath.Join(dir, "demux"+index), os.O_RDWR, 0)
+	if err != nil {
+		frontend.Close()
+		return nil, err
+	}
+	filter := dmxPESFilterParams{
+		pid:     dmxAllPIDs,
+		input:   dmxInFrontend,
+		output:  dmxOutTSTap,
+		pesType: dmxPESOther,
+		flags:   dmxImmediateStart,
+	}
+	if err := ioctl(demux.Fd(), dmxSetPESFilter, uintptr(unsafe.Pointer(&filter))); err != nil {
+		demux.Close()
+		frontend.Close()
+		return nil, fmt.Errorf("DMX_SET_PES_FILTER: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Tuned to ISDB-T channel %d (%d Hz)\n", channel, isdbtFrequency(channel))
+	return &dvbTuner{frontend: frontend, demux: demux}, nil
+}
+
+func waitForLock(frontend *os.File) error {
+	deadline := time.Now().Add(isdbtLockTimeout)
+	for {
+		var status uint32
+		if err := ioctl(frontend.Fd(), feReadStatus, uintptr(unsafe.Pointer(&status))); err != nil {
+			return fmt.Errorf("FE_READ_STATUS: %v", err)
+		}
+		if status&feHasLock != 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.New("the frontend didn't lock; is there a signal on the channel?")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// setDVRBufferSize enlarges the ring buffer of a dvr device, which the
+// default of the driver lets overflow while the analyzer falls behind for a
+// moment.
+func setDVRBufferSize(f *os.File) {
+	if !strings.HasPrefix(filepath.Base(f.Name()), "dvr") {
+		return
+	}
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return
+	}
+	conn.Control(func(fd uintptr) {
+		ioctl(fd, dmxSetBufSize, dvrBufferSize)
+	})
+}
+
+// isDVROverflow reports whether a read of a dvr device failed since its
+// buffer overflowed, which the driver reports once and then reads on.
+func isDVROverflow(err error) bool {
+	return errors.Is(err, syscall.EOVERFLOW)
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// DVB adapters are only supported on Linux, see dvb_linux.go.
+
+func tuneISDBT(dvrPath string, channel int) (io.Closer, error) {
+	return nil, errors.New("-tune is only supported on Linux")
+}
+
+func setDVRBufferSize(f *os.File) {}
+
+func isDVROverflow(err error) bool {
+	return false
+}
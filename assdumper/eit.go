@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/aribcaption"
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+// [B10] 5.1.5 running_status
+const runningStatusRunning = 4
+
+// eitEvent is an event in the event loop of an EIT section.
+type eitEvent struct {
+	eventId       int
+	startTime     int64
+	duration      int
+	runningStatus int
+	freeCAMode    bool
+	title         string
+	// description is text_char of the short event descriptor.
+	description string
+	genres      []eitGenre
+	// extended are the items of the extended event descriptors, joined
+	// across the descriptors they're split into.
+	extended []eitItem
+}
+
+// eitGenre is an entry of the content descriptor.
+// [B10] 6.2.4 Content descriptor, Appendix H
+type eitGenre struct {
+	level1, level2 int
+	user           int
+}
+
+type eitItem struct {
+	description string
+	text        string
+}
+
+// extractEitEvents parses an EIT section.
+func extractEitEvents(payload []byte) (service_id int, section_number int, events []eitEvent, ok bool) {
+	// [B10] 5.2.7 Event Information Table
+	if len(payload) < 14 {
+		return 0, 0, nil, false
+	}
+	section_length := int(payload[1]&0x0F)<<8 | int(payload[2])
+	if 3+section_length > len(payload) || section_length < 15 {
+		return 0, 0, nil, false
+	}
+	service_id = int(payload[3])<<8 | int(payload[4])
+	section_number = int(payload[6])
+	index := 14
+	end := 3 + section_length - 4
+	for index+12 <= end {
+		e := payload[index:]
+		ev := eitEvent{eventId: int(e[0])<<8 | int(e[1])}
+		if e[2] != 0xff || e[3] != 0xff {
+			ev.startTime = tspacket.DecodeJSTTime(e[2:7])
+		}
+		if e[7] != 0xff {
+			ev.duration = tspacket.DecodeBCD(e[7])*3600 + tspacket.DecodeBCD(e[8])*60 + tspacket.DecodeBCD(e[9])
+		}
+		ev.runningStatus = int(e[10] >> 5)
+		ev.freeCAMode = e[10]&0x10 != 0
+		descriptors_loop_length := int(e[10]&0x0F)<<8 | int(e[11])
+		subIndex := index + 12
+		// The items of extended event descriptors, undecoded since a
+		// character may be split across descriptors.
+		var itemDescriptions, items [][]byte
+		for subIndex+2 <= index+12+descriptors_loop_length && subIndex+2 <= end {
+			descriptor_tag := payload[subIndex]
+			descriptor_length := int(payload[subIndex+1])
+			d := payload[subIndex+2:]
+			if descriptor_tag == 0x4D && descriptor_length >= 4 && subIndex+2+descriptor_length <= end {
+				// [B10] 6.2.15 Short event descriptor
+				event_name_length := int(d[3])
+				if 4+event_name_length <= descriptor_length {
+					ev.title = aribcaption.DecodeSIString(d[4 : 4+event_name_length])
+					if 5+event_name_length <= descriptor_length {
+						text_length := int(d[4+event_name_length])
+						if 5+event_name_length+text_length <= descriptor_length {
+							ev.description = aribcaption.DecodeSIString(d[5+event_name_length : 5+event_name_length+text_length])
+						}
+					}
+				}
+			} else if descriptor_tag == 0x54 && subIndex+2+descriptor_length <= end {
+				// [B10] 6.2.4 Content descriptor
+				for i := 0; i+2 <= descriptor_length; i += 2 {
+					ev.genres = append(ev.genres, eitGenre{level1: int(d[i] >> 4), level2: int(d[i] & 0x0F), user: int(d[i+1])})
+				}
+			} else if descriptor_tag == 0x4E && descriptor_length >= 5 && subIndex+2+descriptor_length <= end {
+				// [B10] 6.2.7 Extended event descriptor
+				length_of_items := int(d[4])
+				if 5+length_of_items > descriptor_length {
+					length_of_items = 0
+				}
+				for i := 5; i+1 <= 5+length_of_items; {
+					item_description_length := int(d[i])
+					if i+1+item_description_length+1 > 5+length_of_items {
+						break
+					}
+					description := d[i+1 : i+1+item_description_length]
+					i += 1 + item_description_length
+					item_length := int(d[i])
+					if i+1+item_length > 5+length_of_items {
+						break
+					}
+					item := d[i+1 : i+1+item_length]
+					i += 1 + item_length
+					if item_description_length == 0 && len(items) != 0 {
+						// [TR-B14] An item longer than a descriptor goes on
+						// in the next one without a description.
+						items[len(items)-1] = append(items[len(items)-1], item...)
+					} else {
+						itemDescriptions = append(itemDescriptions, description)
+						items = append(items, append([]byte(nil), item...))
+					}
+				}
+			}
+			subIndex += 2 + descriptor_length
+		}
+		for i := range items {
+			ev.extended = append(ev.extended, eitItem{
+				description: aribcaption.DecodeSIString(itemDescriptions[i]),
+				text:        aribcaption.DecodeSIString(items[i]),
+			})
+		}
+		events = append(events, ev)
+		index += 12 + descriptors_loop_length
+	}
+	return service_id, section_number, events, true
+}
+
+// handleEIT emits a ProgramStatus whenever running_status of an event of the
+// selected service changes in EIT[p/f].
+func handleEIT(section []byte, state *AnalyzerState) {
+	// EIT[p/f actual]
+	if section[0] != 0x4E {
+		return
+	}
+	service_id, section_number, events, ok := extractEitEvents(section)
+	if !ok || service_id != state.programNumber {
+		return
+	}
+	for _, ev := range events {
+		prev, seen := state.runningStatus[ev.eventId]
+		if seen && prev == ev.runningStatus {
+			continue
+		}
+		state.runningStatus[ev.eventId] = ev.runningStatus
+		state.send(ProgramStatus{
+			PCR:           state.currentTimestamp,
+			EventId:       ev.eventId,
+			Present:       section_number == 0,
+			RunningStatus: ev.runningStatus,
+			StartTime:     ev.startTime,
+			Duration:      ev.duration,
+			Title:         ev.title,
+		})
+	}
+}
+
+// manifestProgram is a program of the manifest. The actual start and end are
+// when running_status turned to and from "running", which differ from the
+// schedule when the program is delayed by e.g. a sports overrun. They are
+// unknown when the input starts or ends in the middle of the program.
+type manifestProgram struct {
+	EventId           int    `json:"event_id"`
+	Title             string `json:"title,omitempty"`
+	ScheduledStart    string `json:"scheduled_start,omitempty"`
+	ScheduledDuration int    `json:"scheduled_duration,omitempty"`
+	ActualStart       string `json:"actual_start,omitempty"`
+	ActualEnd         string `json:"actual_end,omitempty"`
+	StartDelay        *int64 `json:"start_delay,omitempty"`
+
+	scheduledStart int64
+	status         int
+	actualStart    SystemClock
+	actualEnd      SystemClock
+}
+
+type manifest struct {
+	ServiceId   int                `json:"service_id"`
+	ServiceName string             `json:"service_name,omitempty"`
+	Programs    []*manifestProgram `json:"programs"`
+	// Recording is the metadata fetched from the recorder with
+	// -metadata-from.
+	Recording *recordingMetadata `json:"recording,omitempty"`
+}
+
+// manifestWriter collects what downstream tools need to align the subtitles
+// with an EPG. PCRs are converted to wall clock time at the end, so that
+// transitions seen before the first TOT get a time as well.
+type manifestWriter struct {
+	manifest manifest
+	programs map[int]*manifestProgram
+	anchors  []ClockAnchor
+	stitches []ClockDiscontinuity
+}
+
+func newManifestWriter() *manifestWriter {
+	return &manifestWriter{
+		manifest: manifest{Programs: []*manifestProgram{}},
+		programs: make(map[int]*manifestProgram),
+	}
+}
+
+func (w *manifestWriter) handle(ev Event) {
+	switch ev := ev.(type) {
+	case ClockAnchor:
+		w.anchors = append(w.anchors, ev)
+	case ClockDiscontinuity:
+		w.stitches = append(w.stitches, ev)
+	case TableChange:
+		switch ev.Table {
+		case "PMT":
+			w.manifest.ServiceId = ev.ProgramNumber
+		case "SDT":
+			w.manifest.ServiceName = ev.ServiceName
+		}
+	case ProgramStatus:
+		p, ok := w.programs[ev.EventId]
+		if !ok {
+			p = &manifestProgram{EventId: ev.EventId, status: -1}
+			w.programs[ev.EventId] = p
+			w.manifest.Programs = append(w.manifest.Programs, p)
+		}
+		if ev.Title != "" {
+			p.Title = ev.Title
+		}
+		if ev.StartTime != 0 {
+			p.scheduledStart = ev.StartTime
+			p.ScheduledDuration = ev.Duration
+		}
+		if ev.RunningStatus == runningStatusRunning && p.status != -1 && p.status != runningStatusRunning {
+			p.actualStart = ev.PCR
+		} else if ev.RunningStatus != runningStatusRunning && p.status == runningStatusRunning {
+			p.actualEnd = ev.PCR
+		}
+		p.status = ev.RunningStatus
+	}
+}
+
+// wallClock converts pcr to UNIX time with the last TOT before it, or the
+// first one when there is none. Discontinuities in between are stitched.
+func (w *manifestWriter) wallClock(pcr SystemClock) (int64, bool) {
+	if len(w.anchors) == 0 || pcr == 0 {
+		return 0, false
+	}
+	anchor := w.anchors[0]
+	for _, a := range w.anchors {
+		if a.PCR <= pcr {
+			anchor = a
+		}
+	}
+	offset := SystemClock(0)
+	for _, d := range w.stitches {
+		if anchor.PCR <= d.Previous && d.Current <= pcr {
+			offset += d.Previous - d.Current
+		}
+	}
+	return anchor.Time + int64(pcr+offset-anchor.PCR)/K, true
+}
+
+func (w *manifestWriter) write(out io.Writer) error {
+	for _, p := range w.manifest.Programs {
+		if p.scheduledStart != 0 {
+			p.ScheduledStart = formatJst(p.scheduledStart)
+		}
+		if t, ok := w.wallClock(p.actualStart); ok {
+			p.ActualStart = formatJst(t)
+			if p.scheduledStart != 0 {
+				delay := t - p.scheduledStart
+				p.StartDelay = &delay
+			}
+		}
+		if t, ok := w.wallClock(p.actualEnd); ok {
+			p.ActualEnd = formatJst(t)
+		}
+	}
+	sort.SliceStable(w.manifest.Programs, func(i, j int) bool {
+		return w.manifest.Programs[i].scheduledStart < w.manifest.Programs[j].scheduledStart
+	})
+	enc := json.NewEncoder(out)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(w.manifest)
+}
+
+var jst = time.FixedZone("JST", 9*60*60)
+
+func formatJst(t int64) string {
+	return time.Unix(t, 0).In(jst).Format(time.RFC3339)
+}
+
+func writeManifest(path string, w *manifestWriter) error {
+	f, err := createAtomicFile(path)
+	if err != nil {
+		return err
+	}
+	defer f.Abort()
+	if err := w.write(f); err != nil {
+		return err
+	}
+	return f.Commit()
+}
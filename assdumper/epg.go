@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+// [B10] 5.2.7 table_id of EIT, from p/f of the TS itself to the schedule of
+// the others
+const (
+	eitTableIdFirst = 0x4E
+	eitTableIdLast  = 0x6F
+)
+
+type epgService struct {
+	OriginalNetworkID int `json:"original_network_id"`
+	TransportStreamID int `json:"transport_stream_id"`
+	ServiceID         int `json:"service_id"`
+	// Name is the service name of SDT, if it was found.
+	Name   string      `json:"name,omitempty"`
+	Events []*epgEvent `json:"events"`
+}
+
+type epgEvent struct {
+	EventID int `json:"event_id"`
+	// StartTime is empty and Duration 0 when they're undefined, e.g. for
+	// the following event of a program that is extended.
+	StartTime   string     `json:"start_time,omitempty"`
+	Duration    int        `json:"duration"`
+	Title       string     `json:"title"`
+	Description string     `json:"description,omitempty"`
+	Genres      []epgGenre `json:"genres,omitempty"`
+	Extended    []epgItem  `json:"extended,omitempty"`
+	FreeCAMode  bool       `json:"free_ca_mode"`
+
+	startTime int64
+}
+
+type epgGenre struct {
+	ContentNibbleLevel1 int `json:"content_nibble_level_1"`
+	ContentNibbleLevel2 int `json:"content_nibble_level_2"`
+	UserNibble          int `json:"user_nibble"`
+	// Name is the name of content_nibble_level_1, empty for the reserved
+	// ones and 0xE, which tells the meaning of user_nibble.
+	Name string `json:"name,omitempty"`
+}
+
+type epgItem struct {
+	Description string `json:"description"`
+	Text        string `json:"text"`
+}
+
+type epgServiceKey struct {
+	originalNetworkId, transportStreamId, serviceId int
+}
+
+// epgCollector gathers the events of EIT p/f and schedule of every service,
+// in the manner of epgdump. An event in more than one table, like p/f and
+// the basic and extended schedule, is merged, the later section winning
+// for what both tell.
+type epgCollector struct {
+	demux     *tspacket.Demuxer
+	serviceId int
+	services  map[epgServiceKey]map[int]*epgEvent
+	names     map[epgServiceKey]string
+}
+
+func newEPGCollector(serviceId int) *epgCollector {
+	c := &epgCollector{
+		demux:     tspacket.NewDemuxer(nil),
+		serviceId: serviceId,
+		services:  make(map[epgServiceKey]map[int]*epgEvent),
+		names:     make(map[epgServiceKey]string),
+	}
+	c.demux.HandleSections(0x0011, func(section []byte) {
+		if tspacket.CRC32(section) == 0 {
+			c.handleSDT(section)
+		}
+	})
+	c.demux.HandleSections(0x0012, func(section []byte) {
+		if tspacket.CRC32(section) == 0 {
+			c.handleEIT(section)
+		}
+	})
+	return c
+}
+
+func runEPG(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("epg", flag.ExitOnError)
+	outputPath := fs.String("o", "", "write the EPG to `FILE` instead of stdout")
+	serviceId := fs.Int("service", -1, "only write the events of `SERVICE_ID`")
+	format := fs.String("format", "json", "write the EPG as `FORMAT`: json, or xmltv for tvheadend, Jellyfin, Plex and the like")
+	inputOpts := registerInputFlags(fs)
+	fs.Parse(args)
+	if *format != "json" && *format != "xmltv" {
+		fmt.Fprintln(os.Stderr, "-format must be json or xmltv")
+		os.Exit(2)
+	}
+	write := (*epgCollector).write
+	if *format == "xmltv" {
+		write = (*epgCollector).writeXMLTV
+	}
+
+	fin, err := openInput(ctx, fs.Arg(0), inputOpts)
+	if err != nil {
+		panic(err)
+	}
+	defer fin.Close()
+	c := newEPGCollector(*serviceId)
+	if err := demuxInput(ctx, c.demux, fin); err != nil && ctx.Err() == nil {
+		panic(err)
+	}
+
+	if *outputPath == "" {
+		if err := write(c, os.Stdout); err != nil {
+			panic(err)
+		}
+		return
+	}
+	f, err := createAtomicFile(*outputPath)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Abort()
+	if err := write(c, f); err != nil {
+		panic(err)
+	}
+	if err := f.Commit(); err != nil {
+		panic(err)
+	}
+}
+
+// handleSDT takes the service names of the TS itself and of the others.
+func (c *epgCollector) handleSDT(section []byte) {
+	// [B10] 5.2.6 table_id 0x42 for the TS itself and 0x46 for the others
+	if (section[0] != 0x42 && section[0] != 0x46) || len(section) < 11 {
+		return
+	}
+	transport_stream_id := int(section[3])<<8 | int(section[4])
+	original_network_id := int(section[8])<<8 | int(section[9])
+	for service_id, name := range extractServiceNames(section) {
+		c.names[epgServiceKey{original_network_id, transport_stream_id, service_id}] = name
+	}
+}
+
+func (c *epgCollector) handleEIT(section []byte) {
+	if section[0] < eitTableIdFirst || section[0] > eitTableIdLast {
+		return
+	}
+	service_id, _, events, ok := extractEitEvents(section)
+	if !ok || c.serviceId >= 0 && service_id != c.serviceId {
+		return
+	}
+	key := epgServiceKey{
+		originalNetworkId: int(section[10])<<8 | int(section[11]),
+		transportStreamId: int(section[8])<<8 | int(section[9]),
+		serviceId:         service_id,
+	}
+	service, ok := c.services[key]
+	if !ok {
+		service = make(map[int]*epgEvent)
+		c.services[key] = service
+	}
+	for _, ev := range events {
+		e, ok := service[ev.eventId]
+		if !ok {
+			e = &epgEvent{EventID: ev.eventId}
+			service[ev.eventId] = e
+		}
+		e.merge(ev)
+	}
+}
+
+// merge takes what an EIT section tells of the event. The extended schedule
+// has no short event descriptor, and the basic one no extended event
+// descriptor.
+func (e *epgEvent) merge(ev eitEvent) {
+	if ev.startTime != 0 {
+		e.startTime = ev.startTime
+		e.StartTime = formatJst(ev.startTime)
+	}
+	if ev.duration != 0 {
+		e.Duration = ev.duration
+	}
+	e.FreeCAMode = ev.freeCAMode
+	if ev.title != "" {
+		e.Title = ev.title
+		e.Description = ev.description
+	}
+	if len(ev.genres) != 0 {
+		e.Genres = nil
+		for _, g := range ev.genres {
+			e.Genres = append(e.Genres, epgGenre{
+				ContentNibbleLevel1: g.level1,
+				ContentNibbleLevel2: g.level2,
+				UserNibble:          g.user,
+				Name:                genreNames[g.level1],
+			})
+		}
+	}
+	if len(ev.extended) != 0 {
+		e.Extended = nil
+		for _, item := range ev.extended {
+			e.Extended = append(e.Extended, epgItem{Description: item.description, Text: item.text})
+		}
+	}
+}
+
+// guide returns the services in the order of their IDs, and their events
+// in the order of start_time.
+func (c *epgCollector) guide() []*epgService {
+	services := []*epgService{}
+	for key, events := range c.services {
+		s := &epgService{
+			OriginalNetworkID: key.originalNetworkId,
+			TransportStreamID: key.transportStreamId,
+			ServiceID:         key.serviceId,
+			Name:              c.names[key],
+		}
+		for _, e := range events {
+			s.Events = append(s.Events, e)
+		}
+		sort.Slice(s.Events, func(i, j int) bool {
+			if s.Events[i].startTime != s.Events[j].startTime {
+				return s.Events[i].startTime < s.Events[j].startTime
+			}
+			return s.Events[i].EventID < s.Events[j].EventID
+		})
+		services = append(services, s)
+	}
+	sort.Slice(services, func(i, j int) bool {
+		a, b := services[i], services[j]
+		if a.OriginalNetworkID != b.OriginalNetworkID {
+			return a.OriginalNetworkID < b.OriginalNetworkID
+		}
+		if a.TransportStreamID != b.TransportStreamID {
+			return a.TransportStreamID < b.TransportStreamID
+		}
+		return a.ServiceID < b.ServiceID
+	})
+	return services
+}
+
+func (c *epgCollector) write(out io.Writer) error {
+	enc := json.NewEncoder(out)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(c.guide())
+}
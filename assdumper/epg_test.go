@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// TestEPGExtendedEvent merges the basic and the extended schedule of an
+// event, whose extended item goes on in a second extended event descriptor.
+func TestEPGExtendedEvent(t *testing.T) {
+	basic := []byte{
+		0x50, 0xf0, 0x00, 0x04, 0x00, 0xc1, 0x00, 0x00,
+		// transport_stream_id 0x7fe0, original_network_id 0x7fe0
+		0x7f, 0xe0, 0x7f, 0xe0, 0x00, 0x50,
+		// event_id 1 at 2021-12-01 21:00:00 for 00:30:00
+		0x00, 0x01, 0xe8, 0x9d, 0x21, 0x00, 0x00, 0x00, 0x30, 0x00, 0x80, 0x0f,
+		// Short event descriptor of あ, with the text い
+		0x4d, 0x09, 'j', 'p', 'n', 0x02, 0x24, 0x22, 0x02, 0x24, 0x24,
+		// Content descriptor of anime
+		0x54, 0x02, 0x70, 0xff,
+	}
+	extended := []byte{
+		0x58, 0xf0, 0x00, 0x04, 0x00, 0xc1, 0x00, 0x00,
+		0x7f, 0xe0, 0x7f, 0xe0, 0x00, 0x58,
+		0x00, 0x01, 0xe8, 0x9d, 0x21, 0x00, 0x00, 0x00, 0x30, 0x00, 0x80, 0x1a,
+		// Item う: え
+		0x4e, 0x0c, 0x01, 'j', 'p', 'n', 0x06, 0x02, 0x24, 0x26, 0x02, 0x24, 0x28, 0x00,
+		// The item goes on with お
+		0x4e, 0x0a, 0x11, 'j', 'p', 'n', 0x04, 0x00, 0x02, 0x24, 0x2a, 0x00,
+	}
+	c := newEPGCollector(-1)
+	for i, section := range [][]byte{basic, extended} {
+		c.demux.Push(sectionPacket(0x0012, i, section))
+	}
+	var out bytes.Buffer
+	if err := c.write(&out); err != nil {
+		t.Fatal(err)
+	}
+	var services []epgService
+	if err := json.Unmarshal(out.Bytes(), &services); err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 || services[0].ServiceID != 0x400 || services[0].OriginalNetworkID != 0x7fe0 || len(services[0].Events) != 1 {
+		t.Fatalf("services = %s", out.Bytes())
+	}
+	e := services[0].Events[0]
+	if e.StartTime != "2021-12-01T21:00:00+09:00" || e.Duration != 1800 || e.Title != "あ" || e.Description != "い" {
+		t.Errorf("event = %s", out.Bytes())
+	}
+	if len(e.Genres) != 1 || e.Genres[0].Name != "アニメ／特撮" {
+		t.Errorf("genres = %+v", e.Genres)
+	}
+	if len(e.Extended) != 1 || e.Extended[0].Description != "う" || e.Extended[0].Text != "えお" {
+		t.Errorf("extended = %+v", e.Extended)
+	}
+
+	out.Reset()
+	if err := c.writeXMLTV(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`<channel id="32736.32736.1024">`,
+		`<programme start="20211201210000 +0900" stop="20211201213000 +0900" channel="32736.32736.1024">`,
+		`<desc lang="ja">い&#xA;&#xA;う&#xA;えお</desc>`,
+		`<category lang="ja">アニメ／特撮</category>`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("XMLTV doesn't contain %s:\n%s", want, out.Bytes())
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+// Event is an entry of the normalized event log produced by the analyzer.
+// Renderers consume events only, so they can run either while the stream is
+// being read or afterwards over the whole log (see -two-pass). Events are
+// plain values without references into the analyzer, so they may be kept or
+// passed to other goroutines freely.
+type Event interface {
+	eventType() string
+}
+
+// ClockAnchor ties a PCR value to the JST wall clock, as announced by a TOT.
+type ClockAnchor struct {
+	PCR  SystemClock `json:"pcr"`
+	Time int64       `json:"time"`
+}
+
+// ClockStart carries the first PCR of the stream, which is where the media
+// time of the recording starts.
+type ClockStart struct {
+	PCR SystemClock `json:"pcr"`
+}
+
+// ClockDiscontinuity reports that PCR jumped from Previous to Current, which
+// has nothing to do with the passage of wall clock time.
+type ClockDiscontinuity struct {
+	Previous SystemClock `json:"previous"`
+	Current  SystemClock `json:"current"`
+}
+
+// CaptionUnit is a decoded caption statement whose PES started to arrive at
+// PCR. Confidence is
+// 1 for a statement received intact and drops towards 0 with packet loss,
+// CRC errors and characters that could not be decoded.
+//
+// PTS is the presentation time stamp of the PES in 90kHz units when HasPTS
+// is set, which it isn't when the PES doesn't carry a valid one. Track is
+// "superimpose" for units of the superimpose ES, "other" for captions of the
+// ES of the other language when both are extracted, and empty for captions.
+//
+// Language is the ISO 639 code of the caption language announced by the
+// management data. When the program has dual mono audio (e.g. bilingual
+// broadcasts), AudioChannel tells which channel, "main" or "sub", speaks
+// that language.
+type CaptionUnit struct {
+	Track        string      `json:"track,omitempty"`
+	PCR          SystemClock `json:"pcr"`
+	PTS          int64       `json:"pts,omitempty"`
+	HasPTS       bool        `json:"has_pts,omitempty"`
+	Text         string      `json:"text"`
+	Confidence   float64     `json:"confidence"`
+	Language     string      `json:"language,omitempty"`
+	AudioChannel string      `json:"audio_channel,omitempty"`
+}
+
+// presentationTime returns when the unit should be displayed.
+func (u CaptionUnit) presentationTime() SystemClock {
+	return SystemClock(tspacket.PresentationTime(int64(u.PCR), u.PTS, u.HasPTS))
+}
+
+// CaptionSession marks the start of a caption session, that is the first
+// management data or a switch of its data group between A and B. PCR and
+// PTS are of the PES of the management data, as for CaptionUnit.
+type CaptionSession struct {
+	Track       string      `json:"track,omitempty"`
+	PCR         SystemClock `json:"pcr"`
+	PTS         int64       `json:"pts,omitempty"`
+	HasPTS      bool        `json:"has_pts,omitempty"`
+	DataGroupId int         `json:"data_group_id"`
+}
+
+// presentationTime returns when the session erases the screen.
+func (s CaptionSession) presentationTime() SystemClock {
+	return SystemClock(tspacket.PresentationTime(int64(s.PCR), s.PTS, s.HasPTS))
+}
+
+// DRCSPattern is the bitmap of a DRCS glyph defined in the caption ES of
+// Track, which captions refer to with {drcs MD5} comments when the glyphs are
+// composited (see -burn-in). Data has Bits bits per pixel, row by row from
+// the most significant bit, and 0 is the background.
+type DRCSPattern struct {
+	Track  string      `json:"track,omitempty"`
+	PCR    SystemClock `json:"pcr"`
+	MD5    string      `json:"md5"`
+	Width  int         `json:"width"`
+	Height int         `json:"height"`
+	Bits   int         `json:"bits"`
+	Data   []byte      `json:"data"`
+}
+
+// ProgramStatus reports a new running_status of an event in EIT[p/f] of the
+// selected service. StartTime and Duration are the schedule, or 0 when
+// undefined.
+type ProgramStatus struct {
+	PCR           SystemClock `json:"pcr"`
+	EventId       int         `json:"event_id"`
+	Present       bool        `json:"present"`
+	RunningStatus int         `json:"running_status"`
+	StartTime     int64       `json:"start_time,omitempty"`
+	Duration      int         `json:"duration,omitempty"`
+	Title         string      `json:"title,omitempty"`
+}
+
+// TableChange records a PSI/SI table that changed what the analyzer does.
+type TableChange struct {
+	PCR            SystemClock `json:"pcr"`
+	Table          string      `json:"table"`
+	PID            int         `json:"pid"`
+	ProgramNumber  int         `json:"program_number,omitempty"`
+	PcrPid         int         `json:"pcr_pid,omitempty"`
+	CaptionPid     int         `json:"caption_pid,omitempty"`
+	SuperimposePid int         `json:"superimpose_pid,omitempty"`
+	ServiceName    string      `json:"service_name,omitempty"`
+}
+
+// TableUpdate reports a new version of a PSI/SI table in the stream, whether
+// or not it changes what the analyzer does, for programs that want to react
+// to reconfigurations of the channel (see -table-updates). It's sent for PAT,
+// PMT, SDT and EIT[p/f], per section, and for every TOT, which has no
+// version_number and reports -1.
+type TableUpdate struct {
+	PCR              SystemClock `json:"pcr"`
+	Table            string      `json:"table"`
+	PID              int         `json:"pid"`
+	TableId          int         `json:"table_id"`
+	TableIdExtension int         `json:"table_id_extension"`
+	Version          int         `json:"version"`
+	SectionNumber    int         `json:"section_number"`
+}
+
+func (ClockAnchor) eventType() string        { return "clock" }
+func (ClockStart) eventType() string         { return "start" }
+func (ClockDiscontinuity) eventType() string { return "discontinuity" }
+func (CaptionUnit) eventType() string        { return "caption" }
+func (CaptionSession) eventType() string     { return "session" }
+func (DRCSPattern) eventType() string        { return "drcs" }
+func (ProgramStatus) eventType() string      { return "program" }
+func (TableChange) eventType() string        { return "table" }
+func (TableUpdate) eventType() string        { return "table_update" }
+
+// eventLogWriter writes events as JSON Lines.
+type eventLogWriter struct {
+	enc *json.Encoder
+}
+
+func newEventLogWriter(w io.Writer) *eventLogWriter {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &eventLogWriter{enc: enc}
+}
+
+func (w *eventLogWriter) write(ev Event) error {
+	return w.enc.Encode(struct {
+		Type  string `json:"type"`
+		Event Event  `json:"event"`
+	}{ev.eventType(), ev})
+}
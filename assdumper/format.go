@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Formatter writes the captions timed by assRenderer in a subtitle format.
+// The renderer owns the buffered writer the formatter is created with and
+// flushes it, so a formatter only has to write.
+type Formatter interface {
+	// Prelude writes what comes before the first caption. It isn't called
+	// for an output without captions.
+	Prelude(script ScriptHeader)
+	// Write writes a caption, in the order of their start times.
+	Write(c Caption)
+	// Flush writes what comes after the last caption, if the format has
+	// anything to close.
+	Flush() error
+}
+
+// ScriptHeader is what the prelude of a script tells about it.
+type ScriptHeader struct {
+	Title string
+	// Info are more lines of [Script Info] in ASS, like the metadata of the
+	// recording.
+	Info []string
+	// Styles are the styles of the captions besides Default, one for each
+	// language of -multilang single-file.
+	Styles []string
+}
+
+// Caption is a caption from Start to End, in centiseconds since the Unix
+// epoch.
+type Caption struct {
+	Start, End int64
+	// Layer and Style tell languages apart in one script.
+	Layer int
+	Style string
+	// Text is the caption with ASS override tags and the comments of the
+	// decoder, such as {flash}, without the form feeds of clearing.
+	Text string
+	// Ruby is set for ruby placed over the base text by \pos on the layer
+	// above it.
+	Ruby       bool
+	Confidence float64
+}
+
+// formats are the formats of -format. A fork can add a format of its own
+// with registerFormat in an init function of a file of its own.
+var formats = map[string]func(w *bufio.Writer) Formatter{}
+
+// formatContentTypes are the media types serve responds with in the formats.
+var formatContentTypes = map[string]string{}
+
+func registerFormat(name, contentType string, newFormatter func(w *bufio.Writer) Formatter) {
+	if _, ok := formats[name]; ok {
+		panic("format registered twice: " + name)
+	}
+	formats[name] = newFormatter
+	formatContentTypes[name] = contentType
+}
+
+func init() {
+	registerFormat("ass", "text/x-ass; charset=utf-8", func(w *bufio.Writer) Formatter {
+		return &assFormatter{out: w}
+	})
+	registerFormat("ssa", "text/x-ssa; charset=utf-8", func(w *bufio.Writer) Formatter {
+		return &assFormatter{out: w, legacy: true}
+	})
+}
+
+func formatNames() []string {
+	var names []string
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func checkFormat(name string) error {
+	if _, ok := formats[name]; !ok {
+		return fmt.Errorf("unknown format %s, not one of %s", name, strings.Join(formatNames(), ", "))
+	}
+	return nil
+}
+
+// assFormatter writes ASS v4+, or SSA v4 in legacy mode for old players
+// that don't understand ASS.
+type assFormatter struct {
+	out    *bufio.Writer
+	legacy bool
+}
+
+func (f *assFormatter) Prelude(script ScriptHeader) {
+	fmt.Fprintln(f.out, "[Script Info]")
+	if script.Title != "" {
+		fmt.Fprintf(f.out, "Title: %s\n", script.Title)
+	}
+	for _, line := range script.Info {
+		fmt.Fprintln(f.out, line)
+	}
+	if f.legacy {
+		// Unlike ASS, SSA players may refuse a script without styles.
+		fmt.Fprintln(f.out, "ScriptType: v4.00")
+		fmt.Fprintln(f.out, "Collisions: Normal")
+		fmt.Fprintln(f.out, "Timer: 100.0000")
+		fmt.Fprintln(f.out, "\n[V4 Styles]")
+		fmt.Fprintln(f.out, "Format: Name, Fontname, Fontsize, PrimaryColour, SecondaryColour, TertiaryColour, BackColour, Bold, Italic, BorderStyle, Outline, Shadow, Alignment, MarginL, MarginR, MarginV, AlphaLevel, Encoding")
+		for _, style := range append([]string{"Default"}, script.Styles...) {
+			fmt.Fprintf(f.out, "Style: %s,Arial,18,16777215,65535,65535,0,0,0,1,2,2,2,30,30,10,0,1\n", style)
+		}
+		fmt.Fprintln(f.out, "\n[Events]")
+		fmt.Fprintln(f.out, "Format: Marked, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text")
+		return
+	}
+	fmt.Fprintln(f.out, "ScriptType: v4.00+")
+	fmt.Fprintln(f.out, "Collisions: Normal")
+	fmt.Fprintln(f.out, "ScaledBorderAndShadow: yes")
+	fmt.Fprintln(f.out, "Timer: 100.0000")
+	if len(script.Styles) != 0 {
+		// The same look as the Default style of libass, under other names
+		fmt.Fprintln(f.out, "\n[V4+ Styles]")
+		fmt.Fprintln(f.out, "Format: Name, Fontname, Fontsize, PrimaryColour, SecondaryColour, OutlineColour, BackColour, Bold, Italic, Underline, StrikeOut, ScaleX, ScaleY, Spacing, Angle, BorderStyle, Outline, Shadow, Alignment, MarginL, MarginR, MarginV, Encoding")
+		for _, style := range script.Styles {
+			fmt.Fprintf(f.out, "Style: %s,Arial,18,&H00FFFFFF,&H0000FFFF,&H00000000,&H00000000,0,0,0,0,100,100,0,0,1,2,2,2,20,20,20,1\n", style)
+		}
+	}
+	fmt.Fprintln(f.out, "\n[Events]")
+}
+
+// Write writes a Dialogue line.
+func (f *assFormatter) Write(c Caption) {
+	text := c.Text
+	if c.Confidence < lowConfidence && !c.Ruby {
+		// Override blocks without tags are comments, which players
+		// ignore and editors show.
+		text = fmt.Sprintf("{low-confidence %.2f}", c.Confidence) + text
+	}
+	prev := time.Unix(c.Start/100, 0)
+	cur := time.Unix(c.End/100, 0)
+	if f.legacy {
+		// SSA has no layers, so only the style tells languages apart.
+		fmt.Fprintf(f.out, "Dialogue: Marked=0,%d:%02d:%02d.%02d,%d:%02d:%02d.%02d,%s,,0000,0000,0000,,%s\n",
+			prev.Hour(), prev.Minute(), prev.Second(), c.Start%100,
+			cur.Hour(), cur.Minute(), cur.Second(), c.End%100,
+			c.Style, downgradeOverrides(text))
+		return
+	}
+	fmt.Fprintf(f.out, "Dialogue: %d,%02d:%02d:%02d.%02d,%02d:%02d:%02d.%02d,%s,,,,,,%s\n",
+		c.Layer,
+		prev.Hour(), prev.Minute(), prev.Second(), c.Start%100,
+		cur.Hour(), cur.Minute(), cur.Second(), c.End%100,
+		c.Style, animateFlashing(text, c.End-c.Start))
+}
+
+func (f *assFormatter) Flush() error {
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// tsvFormatter is a format of a fork, registered by the test as a fork
+// would in a file of its own.
+type tsvFormatter struct {
+	out *bufio.Writer
+}
+
+func init() {
+	registerFormat("test-tsv", "text/tab-separated-values; charset=utf-8", func(w *bufio.Writer) Formatter {
+		return &tsvFormatter{out: w}
+	})
+}
+
+func (f *tsvFormatter) Prelude(script ScriptHeader) {
+	fmt.Fprintln(f.out, "start\tend\ttext")
+}
+
+func (f *tsvFormatter) Write(c Caption) {
+	fmt.Fprintf(f.out, "%d\t%d\t%s\n", c.Start%6000, c.End%6000, c.Text)
+}
+
+func (f *tsvFormatter) Flush() error {
+	_, err := fmt.Fprintln(f.out, "end")
+	return err
+}
+
+// TestRegisteredFormat renders a generated stream with a registered format,
+// which gets the captions timed by the renderer in order.
+func TestRegisteredFormat(t *testing.T) {
+	if err := checkFormat("test-tsv"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkFormat("tsv"); err == nil || !strings.Contains(err.Error(), "ass, ssa, test-tsv") {
+		t.Errorf("checkFormat of an unknown format: %v", err)
+	}
+
+	ts := generateTS(t, `@start 2024-04-01T21:00:00+09:00
+1s	字幕
+2.5s	もう一つ
+3s
+`)
+	var out bytes.Buffer
+	r := newFormatRenderer(&out, "test-tsv")
+	state := newAnalyzerState()
+	state.emit = r.handle
+	if err := analyzeStream(context.Background(), io.NopCloser(bytes.NewReader(ts)), state); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// The times are in centiseconds, here of the minute.
+	want := "start\tend\ttext\n100\t250\t字幕\n250\t300\tもう一つ\nend\n"
+	if out.String() != want {
+		t.Errorf("got\n%swant\n%s", out.String(), want)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/aribcaption"
+)
+
+// glyphCounter counts the characters of the captions written to the output,
+// for users who subset a font to burn the captions into video. Override
+// blocks, comments, drawings and the escapes of ASS are not text and are
+// skipped.
+type glyphCounter struct {
+	counts map[rune]int
+	// symbols are the characters of the additional symbols in the gaiji
+	// mapping in use.
+	symbols map[rune]bool
+}
+
+func newGlyphCounter(gaiji aribcaption.GaijiMap) *glyphCounter {
+	return &glyphCounter{counts: make(map[rune]int), symbols: gaiji.AdditionalSymbols()}
+}
+
+func (g *glyphCounter) handle(ev Event) {
+	unit, ok := ev.(CaptionUnit)
+	if !ok {
+		return
+	}
+	text := unit.Text
+	drawing := false
+	for len(text) != 0 {
+		switch {
+		case text[0] == '{':
+			end := strings.IndexByte(text, '}')
+			if end == -1 {
+				return
+			}
+			for _, tag := range strings.Split(text[1:end], "\\")[1:] {
+				if isDrawingTag(tag) {
+					drawing = tag != "p0"
+				}
+			}
+			text = text[end+1:]
+		case drawing:
+			end := strings.IndexByte(text, '{')
+			if end == -1 {
+				return
+			}
+			text = text[end:]
+		case strings.HasPrefix(text, "\\N"), strings.HasPrefix(text, "\\n"), strings.HasPrefix(text, "\\h"):
+			text = text[2:]
+		case text[0] == '\f':
+			text = text[1:]
+		default:
+			r, n := utf8.DecodeRuneInString(text)
+			g.counts[r]++
+			text = text[n:]
+		}
+	}
+}
+
+// write writes a line of the code point, the character and its count for
+// each character in the order of code points, with "arib" at the end of the
+// lines of the ARIB additional symbols.
+func (g *glyphCounter) write(w io.Writer) error {
+	runes := make([]rune, 0, len(g.counts))
+	for r := range g.counts {
+		runes = append(runes, r)
+	}
+	sort.Slice(runes, func(i, j int) bool { return runes[i] < runes[j] })
+	b := bufio.NewWriter(w)
+	for _, r := range runes {
+		fmt.Fprintf(b, "U+%04X\t%c\t%d", r, r, g.counts[r])
+		if g.symbols[r] {
+			fmt.Fprint(b, "\tarib")
+		}
+		fmt.Fprintln(b)
+	}
+	return b.Flush()
+}
+
+func writeGlyphReport(path string, glyphs *glyphCounter) error {
+	f, err := createAtomicFile(path)
+	if err != nil {
+		return err
+	}
+	defer f.Abort()
+	if err := glyphs.write(f); err != nil {
+		return err
+	}
+	return f.Commit()
+}
@@ -0,0 +1,289 @@
+//go:build go1.24
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/aribcaption"
+)
+
+// The gRPC service of captions.proto is served with net/http over HTTP/2
+// without TLS (h2c), the way gRPC clients connect to a plaintext target. The
+// messages are few and flat enough to encode by hand, which keeps assdumper
+// free of the gRPC and protobuf modules.
+// https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md
+const extractCaptionsPath = "/assdumper.CaptionExtractor/ExtractCaptions"
+
+// maxGRPCMessageSize is the largest TSChunk accepted, as gRPC servers limit
+// the messages they receive to 4MiB by default.
+const maxGRPCMessageSize = 4 * 1024 * 1024
+
+// grpcQueueLength is the number of Caption messages queued for a client
+// that reads slower than the captions come. A caption arriving with the queue
+// full is dropped rather than holding up the extraction.
+const grpcQueueLength = 256
+
+// gRPC status codes
+const (
+	grpcOK              = 0
+	grpcCanceled        = 1
+	grpcInvalidArgument = 3
+	grpcUnimplemented   = 12
+)
+
+func runGRPC(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("grpc", flag.ExitOnError)
+	listen := fs.String("listen", ":50051", "serve the CaptionExtractor service of captions.proto on `ADDR` over plaintext HTTP/2")
+	metricsAddr := fs.String("metrics", "", "serve the counters of streams, captions sent and captions dropped for slow clients on http://`ADDR`/metrics for Prometheus")
+	fs.Parse(args)
+
+	g := &grpcServer{queueLength: grpcQueueLength}
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", g.serveMetrics)
+		go func() {
+			if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+				fmt.Fprintf(os.Stderr, "Stopped serving metrics: %v\n", err)
+			}
+		}()
+	}
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	server := &http.Server{Addr: *listen, Handler: g, Protocols: &protocols}
+	context.AfterFunc(ctx, func() {
+		server.Close()
+	})
+	fmt.Fprintf(os.Stderr, "Serving gRPC on %s\n", *listen)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		panic(err)
+	}
+}
+
+// grpcServer serves the CaptionExtractor service. Every client is sent its
+// captions from a queue of its own by another goroutine, so that a client
+// that stops reading only loses captions and never stalls the demuxer.
+type grpcServer struct {
+	queueLength int
+
+	streams  atomic.Int64
+	captions atomic.Int64
+	sent     atomic.Int64
+	dropped  atomic.Int64
+}
+
+func (g *grpcServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC only", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	if r.URL.Path != extractCaptionsPath {
+		// A response of trailers only
+		w.Header().Set("Grpc-Status", strconv.Itoa(grpcUnimplemented))
+		w.Header().Set("Grpc-Message", "unknown method "+r.URL.Path)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	g.streams.Add(1)
+	defer g.streams.Add(-1)
+
+	queue := make(chan []byte, g.queueLength)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var werr error
+		for frame := range queue {
+			// The queue is drained even after the client is gone, so
+			// that its captions aren't counted as dropped.
+			if werr != nil {
+				continue
+			}
+			if _, werr = w.Write(frame); werr == nil {
+				http.NewResponseController(w).Flush()
+				g.sent.Add(1)
+			}
+		}
+	}()
+
+	// The TS is decoded while it's still being received.
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(readTSChunks(r.Body, pw))
+	}()
+	dropped := 0
+	err := aribcaption.ExtractFunc(r.Context(), pr, func(c aribcaption.Caption) {
+		g.captions.Add(1)
+		select {
+		case queue <- grpcFrame(encodeCaption(c)):
+		default:
+			if dropped == 0 {
+				fmt.Fprintf(os.Stderr, "Dropping captions for %s, which has %d queued\n", r.RemoteAddr, g.queueLength)
+			}
+			dropped++
+			g.dropped.Add(1)
+		}
+	})
+	pr.Close()
+	close(queue)
+	<-done
+
+	code, message := grpcOK, ""
+	switch {
+	case r.Context().Err() != nil:
+		code, message = grpcCanceled, r.Context().Err().Error()
+	case err != nil:
+		code, message = grpcInvalidArgument, err.Error()
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", message)
+	}
+}
+
+func (g *grpcServer) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, metric := range []struct {
+		name, kind, help string
+		value            int64
+	}{
+		{"assdumper_grpc_streams", "gauge", "ExtractCaptions calls in progress.", g.streams.Load()},
+		{"assdumper_grpc_captions_total", "counter", "Captions extracted for the clients.", g.captions.Load()},
+		{"assdumper_grpc_captions_sent_total", "counter", "Captions written to the clients.", g.sent.Load()},
+		{"assdumper_grpc_captions_dropped_total", "counter", "Captions dropped with the queue of a slow client full.", g.dropped.Load()},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", metric.name, metric.help, metric.name, metric.kind, metric.name, metric.value)
+	}
+}
+
+var errGRPCCompressed = errors.New("compressed gRPC messages are not supported")
+
+// readTSChunks writes the data of the TSChunk messages of a request body
+// to w.
+func readTSChunks(body io.Reader, w io.Writer) error {
+	var header [5]byte
+	for {
+		if _, err := io.ReadFull(body, header[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		// Compressed-Flag and Message-Length
+		if header[0] != 0 {
+			return errGRPCCompressed
+		}
+		length := binary.BigEndian.Uint32(header[1:])
+		if length > maxGRPCMessageSize {
+			return fmt.Errorf("TSChunk of %d bytes is larger than %d", length, maxGRPCMessageSize)
+		}
+		message := make([]byte, length)
+		if _, err := io.ReadFull(body, message); err != nil {
+			return err
+		}
+		data, err := decodeTSChunk(message)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+}
+
+func grpcFrame(message []byte) []byte {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	return append(frame, message...)
+}
+
+// decodeTSChunk returns the data field of a TSChunk, skipping the fields it
+// doesn't know.
+// https://protobuf.dev/programming-guides/encoding/
+func decodeTSChunk(b []byte) ([]byte, error) {
+	var data []byte
+	for len(b) != 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errors.New("malformed TSChunk")
+		}
+		b = b[n:]
+		size := 0
+		switch wireType := key & 7; wireType {
+		case 0:
+			// VARINT
+			if _, n = binary.Uvarint(b); n <= 0 {
+				return nil, errors.New("malformed TSChunk")
+			}
+			size = n
+		case 1:
+			// I64
+			size = 8
+		case 2:
+			// LEN
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return nil, errors.New("malformed TSChunk")
+			}
+			b = b[n:]
+			size = int(l)
+			if key>>3 == 1 {
+				data = b[:size]
+			}
+		case 5:
+			// I32
+			size = 4
+		default:
+			return nil, fmt.Errorf("unsupported wire type %d in TSChunk", wireType)
+		}
+		if size > len(b) {
+			return nil, errors.New("malformed TSChunk")
+		}
+		b = b[size:]
+	}
+	return data, nil
+}
+
+func encodeCaption(c aribcaption.Caption) []byte {
+	var b []byte
+	b = appendTimestampField(b, 1, c.Start)
+	b = appendTimestampField(b, 2, c.End)
+	b = appendStringField(b, 3, c.Text)
+	b = appendStringField(b, 4, c.Styled)
+	b = appendStringField(b, 5, c.Lang)
+	return b
+}
+
+// appendTimestampField appends a google.protobuf.Timestamp.
+func appendTimestampField(b []byte, field int, t time.Time) []byte {
+	var ts []byte
+	if seconds := t.Unix(); seconds != 0 {
+		ts = binary.AppendUvarint(append(ts, 1<<3|0), uint64(seconds))
+	}
+	if nanos := t.Nanosecond(); nanos != 0 {
+		ts = binary.AppendUvarint(append(ts, 2<<3|0), uint64(nanos))
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(ts)))
+	return append(b, ts...)
+}
+
+func appendStringField(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
@@ -0,0 +1,16 @@
+//go:build !go1.24
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// runGRPC is implemented in grpc.go, which needs HTTP/2 without TLS from
+// net/http of Go 1.24.
+func runGRPC(ctx context.Context, args []string) {
+	fmt.Fprintln(os.Stderr, "grpc needs assdumper built with Go 1.24 or later")
+	os.Exit(1)
+}
@@ -0,0 +1,160 @@
+//go:build go1.24
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tsgen"
+)
+
+// grpcRequestBody returns the TS of script as the TSChunk messages of an
+// ExtractCaptions request, in chunks that split packets.
+func grpcRequestBody(t *testing.T, script string) (*tsgen.Script, []byte) {
+	t.Helper()
+	s, err := tsgen.ParseScript(strings.NewReader(script))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ts bytes.Buffer
+	if err := tsgen.Write(&ts, s); err != nil {
+		t.Fatal(err)
+	}
+	var body []byte
+	for data := ts.Bytes(); len(data) != 0; {
+		n := min(1000, len(data))
+		// TSChunk.data
+		chunk := binary.AppendUvarint([]byte{1<<3 | 2}, uint64(n))
+		body = append(body, grpcFrame(append(chunk, data[:n]...))...)
+		data = data[n:]
+	}
+	return s, body
+}
+
+// TestGRPCExtractCaptions streams a TS in chunks that split packets to the
+// gRPC service over h2c and reads back the Caption messages.
+func TestGRPCExtractCaptions(t *testing.T) {
+	script, body := grpcRequestBody(t, "1s\tこんにちは\n3s\tさようなら\n@duration 5s\n")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	server := &http.Server{Handler: &grpcServer{queueLength: grpcQueueLength}, Protocols: &protocols}
+	go server.Serve(l)
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+	req, err := http.NewRequestWithContext(context.Background(), "POST", "http://"+l.Addr().String()+extractCaptionsPath, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	reply, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := resp.Trailer.Get("Grpc-Status"); status != "0" {
+		t.Fatalf("grpc-status %q: %s", status, resp.Trailer.Get("Grpc-Message"))
+	}
+
+	var texts []string
+	var starts []int64
+	for len(reply) != 0 {
+		length := int(binary.BigEndian.Uint32(reply[1:5]))
+		message := reply[5 : 5+length]
+		reply = reply[5+length:]
+		for len(message) != 0 {
+			key, n := binary.Uvarint(message)
+			l, m := binary.Uvarint(message[n:])
+			value := message[n+m : n+m+int(l)]
+			message = message[n+m+int(l):]
+			switch key >> 3 {
+			case 1:
+				seconds, _ := binary.Uvarint(value[1:])
+				starts = append(starts, int64(seconds))
+			case 3:
+				texts = append(texts, string(value))
+			}
+		}
+	}
+	if strings.Join(texts, ",") != "こんにちは,さようなら" {
+		t.Errorf("texts = %q", texts)
+	}
+	start := script.Start.Unix()
+	if len(starts) != 2 || starts[0] != start+1 || starts[1] != start+3 {
+		t.Errorf("starts = %v, want %v and %v", starts, time.Unix(start+1, 0), time.Unix(start+3, 0))
+	}
+}
+
+// blockedResponseWriter is a client that stops reading: Write blocks until
+// release is closed.
+type blockedResponseWriter struct {
+	*httptest.ResponseRecorder
+	release chan struct{}
+}
+
+func (w *blockedResponseWriter) Write(b []byte) (int, error) {
+	<-w.release
+	return w.ResponseRecorder.Write(b)
+}
+
+// TestGRPCSlowClient checks that the extraction for a client that doesn't
+// read finishes anyway, dropping the captions that don't fit its queue.
+func TestGRPCSlowClient(t *testing.T) {
+	_, body := grpcRequestBody(t, "1s\t一\n2s\t二\n3s\t三\n4s\t四\n5s\t五\n6s\t六\n@duration 8s\n")
+	req := httptest.NewRequest("POST", extractCaptionsPath, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/grpc")
+	w := &blockedResponseWriter{httptest.NewRecorder(), make(chan struct{})}
+	g := &grpcServer{queueLength: 1}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		g.ServeHTTP(w, req)
+	}()
+
+	// Every caption is extracted while the first Write is still blocked.
+	deadline := time.Now().Add(10 * time.Second)
+	for g.captions.Load() != 6 {
+		if time.Now().After(deadline) {
+			t.Fatalf("extracted %d captions with the client blocked", g.captions.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// One caption is blocked in Write and one is queued at most.
+	if dropped := g.dropped.Load(); dropped < 4 {
+		t.Errorf("dropped %d captions, want 4 or more", dropped)
+	}
+	close(w.release)
+	<-served
+
+	if status := w.Header().Get(http.TrailerPrefix + "Grpc-Status"); status != "0" {
+		t.Fatalf("grpc-status %q", status)
+	}
+	frames := 0
+	for reply := w.Body.Bytes(); len(reply) != 0; frames++ {
+		reply = reply[5+int(binary.BigEndian.Uint32(reply[1:5])):]
+	}
+	if int64(frames) != g.sent.Load() || g.sent.Load()+g.dropped.Load() != 6 {
+		t.Errorf("%d frames written, %d sent and %d dropped of 6", frames, g.sent.Load(), g.dropped.Load())
+	}
+	if g.streams.Load() != 0 {
+		t.Errorf("%d streams left", g.streams.Load())
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+// tsInfo is PAT and every PMT it points at, for the info subcommand.
+type tsInfo struct {
+	TransportStreamID int           `json:"transport_stream_id"`
+	Version           int           `json:"version"`
+	NetworkPID        int           `json:"network_pid,omitempty"`
+	Programs          []programInfo `json:"programs"`
+}
+
+type programInfo struct {
+	ProgramNumber int              `json:"program_number"`
+	PmtPid        int              `json:"pmt_pid"`
+	Version       int              `json:"version"`
+	PcrPid        int              `json:"pcr_pid"`
+	Descriptors   []descriptorInfo `json:"descriptors"`
+	Streams       []streamInfo     `json:"streams"`
+	found         bool
+}
+
+type streamInfo struct {
+	StreamType  int              `json:"stream_type"`
+	Type        string           `json:"type"`
+	PID         int              `json:"pid"`
+	Descriptors []descriptorInfo `json:"descriptors"`
+	// Video is what the first sequence header or SPS of a video ES of
+	// MPEG-2 or H.264 tells.
+	Video *videoInfo `json:"video,omitempty"`
+}
+
+// descriptorInfo is a descriptor with the fields of those known decoded
+// into Text, and the others only as Data.
+type descriptorInfo struct {
+	Tag  int    `json:"tag"`
+	Name string `json:"name"`
+	Text string `json:"text,omitempty"`
+	Data []byte `json:"data"`
+}
+
+type infoScanner struct {
+	demux    *tspacket.Demuxer
+	info     *tsInfo
+	programs map[int]*programInfo
+	// videos are the video ES peeked at for their sequence headers or SPS,
+	// when peekVideo is set.
+	peekVideo bool
+	videos    map[int]*videoPeeker
+}
+
+func runInfo(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	jsonOutput := fs.Bool("json", false, "print PAT and PMT as JSON")
+	inputOpts := registerInputFlags(fs)
+	fs.Parse(args)
+
+	fin, err := openInput(ctx, fs.Arg(0), inputOpts)
+	if err != nil {
+		panic(err)
+	}
+	defer fin.Close()
+	s := newInfoScanner(tspacket.NewDemuxer(nil), true)
+	s.demux.HandlePackets(func(tspacket.Packet) {
+		if s.done() {
+			s.demux.Stop()
+		}
+	})
+	if err := demuxInput(ctx, s.demux, fin); err != nil && ctx.Err() == nil {
+		panic(err)
+	}
+	info := s.result()
+	if info == nil {
+		fmt.Fprintln(os.Stderr, "No PAT found")
+		os.Exit(1)
+	}
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(info); err != nil {
+			panic(err)
+		}
+		return
+	}
+	printInfo(info)
+}
+
+// newInfoScanner returns an infoScanner reading PAT and PMT on demux, and the
+// video ES as well with peekVideo.
+func newInfoScanner(demux *tspacket.Demuxer, peekVideo bool) *infoScanner {
+	s := &infoScanner{demux: demux, programs: make(map[int]*programInfo), peekVideo: peekVideo, videos: make(map[int]*videoPeeker)}
+	demux.HandleSections(0x0000, func(section []byte) {
+		if tspacket.CRC32(section) == 0 {
+			s.handleSection(0x0000, section)
+		}
+	})
+	return s
+}
+
+// result returns PAT with the programs found in the order of program_number,
+// or nil without PAT.
+func (s *infoScanner) result() *tsInfo {
+	if s.info == nil {
+		return nil
+	}
+	for _, p := range s.programs {
+		for i, es := range p.Streams {
+			if v, ok := s.videos[es.PID]; ok {
+				p.Streams[i].Video = v.info
+			}
+		}
+		s.info.Programs = append(s.info.Programs, *p)
+	}
+	sort.Slice(s.info.Programs, func(i, j int) bool {
+		return s.info.Programs[i].ProgramNumber < s.info.Programs[j].ProgramNumber
+	})
+	return s.info
+}
+
+func printInfo(info *tsInfo) {
+	fmt.Printf("PAT: transport_stream_id 0x%04x, version %d\n", info.TransportStreamID, info.Version)
+	if info.NetworkPID != 0 {
+		fmt.Printf("  network_PID 0x%04x\n", info.NetworkPID)
+	}
+	for _, p := range info.Programs {
+		fmt.Printf("  program_number %d: PMT PID 0x%04x\n", p.ProgramNumber, p.PmtPid)
+	}
+	for _, p := range info.Programs {
+		if !p.found {
+			fmt.Printf("\nPMT of program_number %d: not found\n", p.ProgramNumber)
+			continue
+		}
+		fmt.Printf("\nPMT of program_number %d: PID 0x%04x, version %d, PCR_PID 0x%04x\n", p.ProgramNumber, p.PmtPid, p.Version, p.PcrPid)
+		printDescriptors(p.Descriptors, "  ")
+		for _, es := range p.Streams {
+			fmt.Printf("  PID 0x%04x: stream_type 0x%02x (%s)\n", es.PID, es.StreamType, es.Type)
+			printDescriptors(es.Descriptors, "    ")
+			if es.Video != nil {
+				fmt.Printf("    video: %s\n", es.Video)
+			}
+		}
+	}
+}
+
+func printDescriptors(descriptors []descriptorInfo, indent string) {
+	for _, d := range descriptors {
+		text := d.Text
+		if text == "" {
+			text = fmt.Sprintf("% x", d.Data)
+		}
+		fmt.Printf("%s0x%02x %s: %s\n", indent, d.Tag, d.Name, text)
+	}
+}
+
+// done tells whether PAT, the PMT of every program in it and the sequence
+// headers or SPS of the video ES have been read, or servicesScanLimit
+// packets without some of them once PAT is found.
+func (s *infoScanner) done() bool {
+	if s.info == nil {
+		return false
+	}
+	for _, program := range s.programs {
+		if !program.found {
+			return s.demux.Packets() >= servicesScanLimit
+		}
+	}
+	for _, v := range s.videos {
+		if v.info == nil {
+			return s.demux.Packets() >= servicesScanLimit
+		}
+	}
+	return true
+}
+
+func (s *infoScanner) handleSection(pid int, section []byte) {
+	if pid == 0 {
+		// [ISO] 2.4.4.3 Program association section
+		if s.info != nil || section[0] != 0x00 || len(section) < 12 {
+			return
+		}
+		s.info = &tsInfo{
+			TransportStreamID: int(section[3])<<8 | int(section[4]),
+			Version:           int(section[5]>>1) & 0x1f,
+			Programs:          []programInfo{},
+		}
+		section_length := int(section[1]&0x0F)<<8 | int(section[2])
+		for index := 8; index+4 <= 3+section_length-4 && index+4 <= len(section); index += 4 {
+			program_number := int(section[index])<<8 | int(section[index+1])
+			pid := int(section[index+2]&0x1F)<<8 | int(section[index+3])
+			if program_number == 0 {
+				s.info.NetworkPID = pid
+				continue
+			}
+			s.programs[program_number] = &programInfo{ProgramNumber: program_number, PmtPid: pid}
+			s.demux.HandleSections(pid, func(section []byte) {
+				if tspacket.CRC32(section) == 0 {
+					s.handleSection(pid, section)
+				}
+			})
+		}
+		return
+	}
+	// [ISO] 2.4.4.8 Program map section
+	if section[0] != 0x02 || len(section) < 16 {
+		return
+	}
+	program, ok := s.programs[int(section[3])<<8|int(section[4])]
+	if !ok || program.found || program.PmtPid != pid {
+		return
+	}
+	section_length := int(section[1]&0x0F)<<8 | int(section[2])
+	if 3+section_length > len(section) {
+		return
+	}
+	end := 3 + section_length - 4
+	program.found = true
+	program.Version = int(section[5]>>1) & 0x1f
+	program.PcrPid = tspacket.PCRPID(section)
+	program.Descriptors = []descriptorInfo{}
+	program.Streams = []streamInfo{}
+	program_info_length := int(section[10]&0x0F)<<8 | int(section[11])
+	index := 12
+	if index+program_info_length > end {
+		return
+	}
+	forEachDescriptor(section[index:index+program_info_length], func(tag byte, d []byte) {
+		program.Descriptors = append(program.Descriptors, decodeDescriptor(tag, d))
+	})
+	index += program_info_length
+	for index+5 <= end {
+		es := streamInfo{
+			StreamType:  int(section[index]),
+			Type:        streamTypeName(section[index]),
+			PID:         int(section[index+1]&0x1F)<<8 | int(section[index+2]),
+			Descriptors: []descriptorInfo{},
+		}
+		ES_info_length := int(section[index+3]&0x0F)<<8 | int(section[index+4])
+		index += 5
+		if index+ES_info_length > end {
+			break
+		}
+		forEachDescriptor(section[index:index+ES_info_length], func(tag byte, d []byte) {
+			es.Descriptors = append(es.Descriptors, decodeDescriptor(tag, d))
+		})
+		index += ES_info_length
+		program.Streams = append(program.Streams, es)
+		if s.peekVideo && s.videos[es.PID] == nil {
+			switch es.StreamType {
+			case 0x01, 0x02, 0x1b:
+				v := &videoPeeker{streamType: byte(es.StreamType)}
+				s.videos[es.PID] = v
+				s.demux.HandlePayload(es.PID, func(payload []byte, start, gap bool) {
+					v.push(payload, start)
+				})
+			}
+		}
+	}
+}
+
+// videoEncodeFormats are the names of video_encode_format.
+// [B10] Video decode control descriptor
+var videoEncodeFormats = map[int]string{
+	0: "1080p", 1: "1080i", 2: "720p", 3: "480p", 4: "480i", 5: "240p", 6: "120p", 7: "2160p",
+}
+
+// decodeDescriptor decodes the descriptors that PMT of ISDB carries.
+func decodeDescriptor(tag byte, d []byte) descriptorInfo {
+	info := descriptorInfo{Tag: int(tag), Name: "unknown", Data: append([]byte(nil), d...)}
+	var fields []string
+	field := func(format string, args ...interface{}) {
+		fields = append(fields, fmt.Sprintf(format, args...))
+	}
+	switch tag {
+	case 0x02:
+		// [ISO] 2.6.2 Video stream descriptor
+		info.Name = "video_stream"
+		if len(d) >= 1 {
+			field("frame_rate_code %d", d[0]>>3&0x0f)
+		}
+		if len(d) >= 3 && d[0]&0x04 == 0 {
+			field("profile_and_level_indication 0x%02x", d[1])
+		}
+	case 0x09:
+		// [ISO] 2.6.16 Conditional access descriptor
+		info.Name = "conditional_access"
+		if len(d) >= 4 {
+			field("CA_system_ID 0x%04x", int(d[0])<<8|int(d[1]))
+			field("CA_PID 0x%04x", int(d[2]&0x1f)<<8|int(d[3]))
+		}
+	case 0x0A:
+		// [ISO] 2.6.18 ISO 639 language descriptor
+		info.Name = "ISO_639_language"
+		for i := 0; i+4 <= len(d); i += 4 {
+			field("%s", d[i:i+3])
+		}
+	case 0x1C:
+		// [ISO] MPEG-4 audio descriptor
+		info.Name = "MPEG-4_audio"
+		if len(d) >= 1 {
+			field("MPEG-4_audio_profile_and_level 0x%02x", d[0])
+		}
+	case 0x28:
+		// [ISO] AVC video descriptor
+		info.Name = "AVC_video"
+		if len(d) >= 3 {
+			field("profile_idc %d", d[0])
+			field("level_idc %d", d[2])
+		}
+	case 0x52:
+		// [B10] 6.2.16 Stream identifier descriptor
+		info.Name = "stream_identifier"
+		if len(d) >= 1 {
+			field("component_tag 0x%02x", d[0])
+		}
+	case 0x7C:
+		// [B10] AAC descriptor
+		info.Name = "AAC"
+		if len(d) >= 1 {
+			field("profile_and_level 0x%02x", d[0])
+		}
+	case 0xC1:
+		// [B10] Digital copy control descriptor
+		info.Name = "digital_copy_control"
+		if len(d) >= 1 {
+			field("digital_recording_control_data %d", d[0]>>6)
+		}
+	case 0xC4:
+		// [B10] 6.2.26 Audio component descriptor
+		info.Name = "audio_component"
+		if len(d) >= 9 {
+			field("component_type 0x%02x", d[1])
+			field("component_tag 0x%02x", d[2])
+			field("sampling_rate %d", d[5]>>1&0x07)
+			field("ISO_639_language_code %s", d[6:9])
+		}
+	case 0xC8:
+		// [B10] Video decode control descriptor
+		info.Name = "video_decode_control"
+		if len(d) >= 1 {
+			format, ok := videoEncodeFormats[int(d[0]>>2&0x0f)]
+			if !ok {
+				format = fmt.Sprintf("0x%x", d[0]>>2&0x0f)
+			}
+			field("video_encode_format %s", format)
+			field("still_picture_flag %d", d[0]>>7)
+		}
+	case 0xDE:
+		// [B10] Content availability descriptor
+		info.Name = "content_availability"
+		if len(d) >= 1 {
+			field("copy_restriction_mode %d", d[0]>>6&1)
+			field("image_constraint_token %d", d[0]>>5&1)
+			field("retention_mode %d", d[0]>>4&1)
+			field("retention_state %d", d[0]>>1&7)
+			field("encryption_mode %d", d[0]&1)
+		}
+	case 0xFD:
+		// [B10] 6.2.20 Data component descriptor
+		info.Name = "data_component"
+		if len(d) >= 2 {
+			field("data_component_id 0x%04x", int(d[0])<<8|int(d[1]))
+		}
+		if len(d) >= 3 {
+			field("additional_data_component_info % x", d[2:])
+		}
+	}
+	info.Text = strings.Join(fields, ", ")
+	return info
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tsgen"
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+// TestInfo reads PAT and PMT of a generated stream, with the descriptors of
+// its caption ES decoded.
+func TestInfo(t *testing.T) {
+	ts := generateTS(t, `@start 2024-04-01T21:00:00+09:00
+1s	字幕
+`)
+	s := newInfoScanner(tspacket.NewDemuxer(nil), true)
+	if err := demuxInput(context.Background(), s.demux, bytes.NewReader(ts)); err != nil {
+		t.Fatal(err)
+	}
+	info := s.result()
+	if info == nil || info.TransportStreamID != 1 || len(info.Programs) != 1 {
+		t.Fatalf("info = %+v", info)
+	}
+	p := info.Programs[0]
+	if !p.found || p.ProgramNumber != tsgen.ProgramNumber || p.PmtPid != tsgen.PMTPID || p.PcrPid != tsgen.PCRPID || len(p.Streams) != 1 {
+		t.Fatalf("program = %+v", p)
+	}
+	es := p.Streams[0]
+	if es.PID != tsgen.CaptionPID || es.StreamType != 0x06 || es.Video != nil {
+		t.Errorf("stream = %+v", es)
+	}
+	want := []string{
+		"stream_identifier: component_tag 0x87",
+		"data_component: data_component_id 0x0008, additional_data_component_info 3d",
+	}
+	if len(es.Descriptors) != len(want) {
+		t.Fatalf("descriptors = %+v", es.Descriptors)
+	}
+	for i, d := range es.Descriptors {
+		if got := d.Name + ": " + d.Text; got != want[i] {
+			t.Errorf("descriptor %d is %s, want %s", i, got, want[i])
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type inputOptions struct {
+	httpTimeout time.Duration
+	httpRetries int
+	listen      string
+	tune        int
+	readBuffer  byteSize
+	mmap        bool
+}
+
+func registerInputFlags(fs *flag.FlagSet) *inputOptions {
+	opts := new(inputOptions)
+	fs.DurationVar(&opts.httpTimeout, "http-timeout", 30*time.Second, "give up on an HTTP input when no data arrives for `DURATION`")
+	fs.IntVar(&opts.httpRetries, "http-retries", 5, "retry a failed HTTP request up to `N` times")
+	fs.StringVar(&opts.listen, "listen", "", "receive the TS from `udp://ADDR:PORT` (unicast or multicast, raw or RTP) instead of a file")
+	fs.IntVar(&opts.tune, "tune", 0, "tune the DVB adapter of a /dev/dvb/adapterN/dvrM input to ISDB-T physical channel `CH` (13-62) first (Linux only)")
+	opts.readBuffer = 1024 * 1024
+	fs.Var(&opts.readBuffer, "read-buffer", "read files and stdin ahead in chunks of `SIZE` bytes (K and M for KiB and MiB)")
+	fs.BoolVar(&opts.mmap, "mmap", false, "map input files into memory instead of reading them (Unix only)")
+	return opts
+}
+
+// byteSize is a flag value of a size in bytes, which may end with K or M for
+// KiB or MiB.
+type byteSize int
+
+func (size *byteSize) String() string {
+	switch {
+	case *size != 0 && *size%(1024*1024) == 0:
+		return strconv.Itoa(int(*size)/(1024*1024)) + "M"
+	case *size != 0 && *size%1024 == 0:
+		return strconv.Itoa(int(*size)/1024) + "K"
+	}
+	return strconv.Itoa(int(*size))
+}
+
+func (size *byteSize) Set(s string) error {
+	digits, unit := s, 1
+	switch {
+	case strings.HasSuffix(s, "K"):
+		digits, unit = s[:len(s)-1], 1024
+	case strings.HasSuffix(s, "M"):
+		digits, unit = s[:len(s)-1], 1024*1024
+	}
+	n, err := strconv.Atoi(digits)
+	if err != nil {
+		return err
+	}
+	if n <= 0 || n > 1<<30/unit {
+		return fmt.Errorf("%s is out of range", s)
+	}
+	*size = byteSize(n * unit)
+	return nil
+}
+
+// openInput opens the TS at path. path may be a file, a device such as the
+// dvr device of a DVB adapter, an http:// or https:// URL, or empty or "-" for
+// stdin. The -listen address takes precedence. Network and device inputs
+// end when ctx is done. Files and stdin are read ahead on a goroutine
+// in chunks of -read-buffer, unless files are mapped into memory by -mmap.
+func openInput(ctx context.Context, path string, opts *inputOptions) (io.ReadCloser, error) {
+	if opts.listen != "" {
+		if path != "" {
+			return nil, fmt.Errorf("cannot read %s while listening on %s", path, opts.listen)
+		}
+		return openUDPInput(ctx, opts.listen)
+	}
+	if path == "" || path == "-" {
+		return newReadAheadReader(os.Stdin, int(opts.readBuffer)), nil
+	}
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		body, err := openHTTPInput(ctx, path, opts)
+		if err != nil {
+			return nil, err
+		}
+		return &httpInput{ReadCloser: body, ctx: ctx, url: path, opts: opts}, nil
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeDevice != 0 {
+		return openDeviceInput(ctx, path, opts)
+	}
+	if opts.tune != 0 {
+		return nil, fmt.Errorf("-tune needs the dvr device of a DVB adapter, not %s", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if opts.mmap {
+		return openMappedInput(f)
+	}
+	return newReadAheadReader(f, int(opts.readBuffer)), nil
+}
+
+// mappedInput is a file mapped into memory, which tspacket.Reader slices the
+// packets out of without copying them.
+type mappedInput struct {
+	data []byte
+	pos  int
+}
+
+func openMappedInput(f *os.File) (*mappedInput, error) {
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("-mmap needs a regular file, not %s", f.Name())
+	}
+	if info.Size() == 0 {
+		// An empty mapping is an error.
+		return &mappedInput{}, nil
+	}
+	data, err := mapFile(f, info.Size())
+	if err != nil {
+		return nil, fmt.Errorf("mmap %s: %v", f.Name(), err)
+	}
+	return &mappedInput{data: data}, nil
+}
+
+func (in *mappedInput) Mapped() []byte {
+	return in.data[in.pos:]
+}
+
+func (in *mappedInput) Read(p []byte) (int, error) {
+	if in.pos == len(in.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, in.data[in.pos:])
+	in.pos += n
+	return n, nil
+}
+
+// Close unmaps the file, after which the packets sliced out of it must not
+// be touched.
+func (in *mappedInput) Close() error {
+	data := in.data
+	in.data, in.pos = nil, 0
+	if data == nil {
+		return nil
+	}
+	return unmapFile(data)
+}
+
+var errReadTimeout = errors.New("HTTP read timed out")
+
+// openHTTPInput starts streaming url, e.g. Mirakurun's
+// /api/services/{id}/stream. Connection failures and 5xx responses (Mirakurun
+// answers 503 while all tuners are busy) are retried with exponential backoff.
+func openHTTPInput(ctx context.Context, url string, opts *inputOptions) (io.ReadCloser, error) {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		body, retryable, err := requestHTTPInput(ctx, url, opts.httpTimeout)
+		if err == nil {
+			return body, nil
+		}
+		if !retryable || attempt >= opts.httpRetries || ctx.Err() != nil {
+			return nil, err
+		}
+		fmt.Fprintf(os.Stderr, "%v; retrying in %v\n", err, backoff)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// resumableInput is an input that can reconnect when reading from it fails
+// in the middle, like an HTTP stream over a flaky network. What was sent
+// while it was disconnected is lost.
+type resumableInput interface {
+	io.Reader
+	resume(err error) error
+}
+
+// httpInput is an HTTP stream that reconnects to the same URL when the
+// connection drops. onResume is called after reconnecting, to tell the
+// analyzer that packets were lost. Connections that drop before any data
+// arrives count as failed attempts, so that a stalled server still makes
+// assdumper give up after -http-retries. It doesn't reconnect once ctx is
+// done.
+type httpInput struct {
+	io.ReadCloser
+	ctx      context.Context
+	url      string
+	opts     *inputOptions
+	onResume func()
+	received bool
+	failures int
+}
+
+func (in *httpInput) Read(p []byte) (int, error) {
+	n, err := in.ReadCloser.Read(p)
+	if n > 0 {
+		in.received = true
+	}
+	return n, err
+}
+
+func (in *httpInput) resume(err error) error {
+	if in.ctx.Err() != nil {
+		return err
+	}
+	if !in.received {
+		in.failures++
+		if in.failures > in.opts.httpRetries {
+			return err
+		}
+	} else {
+		in.failures = 0
+	}
+	in.received = false
+	fmt.Fprintf(os.Stderr, "HTTP input interrupted: %v; reconnecting\n", err)
+	in.ReadCloser.Close()
+	body, err := openHTTPInput(in.ctx, in.url, in.opts)
+	if err != nil {
+		return err
+	}
+	in.ReadCloser = body
+	if in.onResume != nil {
+		in.onResume()
+	}
+	return nil
+}
+
+// requestHTTPInput returns the response body, or whether the failure is worth
+// retrying.
+func requestHTTPInput(parent context.Context, url string, timeout time.Duration) (io.ReadCloser, bool, error) {
+	ctx, cancel := context.WithCancel(parent)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		cancel()
+		return nil, false, err
+	}
+	r := &timeoutReader{cancel: cancel, timeout: timeout}
+	r.timer = time.AfterFunc(timeout, r.expire)
+	resp, err := http.DefaultClient.Do(req)
+	r.timer.Stop()
+	if err != nil {
+		cancel()
+		return nil, true, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, resp.StatusCode >= 500, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	r.body = resp.Body
+	return r, false, nil
+}
+
+// timeoutReader cancels the underlying request when a single Read blocks for
+// longer than timeout, so that a stalled tuner doesn't hang assdumper forever.
+type timeoutReader struct {
+	body     io.ReadCloser
+	cancel   context.CancelFunc
+	timeout  time.Duration
+	timer    *time.Timer
+	timedOut atomic.Bool
+}
+
+func (r *timeoutReader) expire() {
+	r.timedOut.Store(true)
+	r.cancel()
+}
+
+func (r *timeoutReader) Read(p []byte) (int, error) {
+	r.timer.Reset(r.timeout)
+	n, err := r.body.Read(p)
+	r.timer.Stop()
+	if err != nil && r.timedOut.Load() {
+		err = errReadTimeout
+	}
+	return n, err
+}
+
+func (r *timeoutReader) Close() error {
+	r.timer.Stop()
+	r.cancel()
+	return r.body.Close()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tsgen"
+)
+
+// generateTS writes the stream of a tsgen script.
+func generateTS(t *testing.T, script string) []byte {
+	t.Helper()
+	s, err := tsgen.ParseScript(strings.NewReader(script))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ts bytes.Buffer
+	if err := tsgen.Write(&ts, s); err != nil {
+		t.Fatal(err)
+	}
+	return ts.Bytes()
+}
+
+// dialogueTime formats the time of a Dialogue line at d after start.
+func dialogueTime(start time.Time, d time.Duration) string {
+	return start.Add(d).Local().Format("15:04:05.00")
+}
+
+// TestLive analyzes a stream with -live -live-hold 1s, which has to write
+// the caption held on the screen every second and each line as soon as its
+// end is known, before the renderer is flushed at the end.
+func TestLive(t *testing.T) {
+	ts := generateTS(t, `@start 2024-04-01T21:00:00+09:00
+1s	長い字幕
+4.5s	次
+5s
+@duration 6s
+`)
+	var out bytes.Buffer
+	r := newASSRenderer(&out)
+	r.liveHold = 100
+	state := newAnalyzerState()
+	state.emit = r.handle
+	state.clockTick = func(snapshot analyzerSnapshot) {
+		r.advance(snapshot.Clock)
+	}
+	if err := analyzeStream(context.Background(), io.NopCloser(bytes.NewReader(ts)), state); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2024, time.April, 1, 21, 0, 0, 0, time.FixedZone("JST", 9*60*60))
+	var want []string
+	for _, line := range []struct {
+		start, end time.Duration
+		text       string
+	}{
+		{1 * time.Second, 2 * time.Second, "長い字幕"},
+		{2 * time.Second, 3 * time.Second, "長い字幕"},
+		{3 * time.Second, 4 * time.Second, "長い字幕"},
+		{4 * time.Second, 4500 * time.Millisecond, "長い字幕"},
+		{4500 * time.Millisecond, 5 * time.Second, "次"},
+	} {
+		want = append(want, "Dialogue: 0,"+dialogueTime(start, line.start)+","+dialogueTime(start, line.end)+",Default,,,,,,"+line.text)
+	}
+	var got []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.HasPrefix(line, "Dialogue: ") {
+			got = append(got, line)
+		}
+	}
+	testDialogueLines(t, "live", got, want)
+}
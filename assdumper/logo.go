@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"image/color"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/aribcaption"
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+// stationLogo is a logo of the logo data of CDT.
+type stationLogo struct {
+	originalNetworkId int
+	logoType          int
+	logoId            int
+	logoVersion       int
+	png               []byte
+}
+
+type logoKey struct {
+	originalNetworkId int
+	logoId            int
+	logoType          int
+}
+
+// logoCollector gathers the logos of CDT, and the services that show them
+// from the logo transmission descriptors of SDT.
+type logoCollector struct {
+	demux *tspacket.Demuxer
+	logos map[logoKey]*stationLogo
+	// services maps original_network_id and logo_id to the names of the
+	// services by service_id.
+	services map[[2]int]map[int]string
+}
+
+func runLogo(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("logo", flag.ExitOnError)
+	outputDir := fs.String("o", ".", "write the logos to `DIR`")
+	inputOpts := registerInputFlags(fs)
+	fs.Parse(args)
+	if info, err := os.Stat(*outputDir); err != nil || !info.IsDir() {
+		fmt.Fprintf(os.Stderr, "-o %s is not a directory\n", *outputDir)
+		os.Exit(2)
+	}
+
+	fin, err := openInput(ctx, fs.Arg(0), inputOpts)
+	if err != nil {
+		panic(err)
+	}
+	defer fin.Close()
+	c := newLogoCollector()
+	// Logos come around every few minutes at most, so the whole input is
+	// read.
+	if err := demuxInput(ctx, c.demux, fin); err != nil && ctx.Err() == nil {
+		panic(err)
+	}
+	if len(c.logos) == 0 {
+		fmt.Fprintln(os.Stderr, "No logos found")
+		os.Exit(1)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tTYPE\tSIZE\tVERSION\tSERVICES")
+	for _, logo := range c.sortedLogos() {
+		name := fmt.Sprintf("logo_%d_%d_%d.png", logo.originalNetworkId, logo.logoId, logo.logoType)
+		if err := writeLogo(filepath.Join(*outputDir, name), logo.png); err != nil {
+			panic(err)
+		}
+		size := "-"
+		if width, height, ok := pngSize(logo.png); ok {
+			size = fmt.Sprintf("%dx%d", width, height)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%s\n", name, logo.logoType, size, logo.logoVersion, orDash(strings.Join(c.serviceNames(logo), ", ")))
+	}
+	w.Flush()
+}
+
+func newLogoCollector() *logoCollector {
+	c := &logoCollector{demux: tspacket.NewDemuxer(nil), logos: make(map[logoKey]*stationLogo), services: make(map[[2]int]map[int]string)}
+	c.demux.HandleSections(0x0011, c.handleSection)
+	c.demux.HandleSections(0x0029, c.handleSection)
+	return c
+}
+
+// handleSection takes the logos of CDT, and the services that show them of
+// SDT.
+func (c *logoCollector) handleSection(section []byte) {
+	if tspacket.CRC32(section) != 0 {
+		return
+	}
+	switch {
+	case section[0] == 0xC8:
+		if logo, ok := parseLogo(section); ok {
+			c.logos[logoKey{logo.originalNetworkId, logo.logoId, logo.logoType}] = logo
+		}
+	case (section[0] == 0x42 || section[0] == 0x46) && len(section) >= 11:
+		original_network_id := int(section[8])<<8 | int(section[9])
+		for service_id, service := range extractServices(section) {
+			if service.logoId == -1 {
+				continue
+			}
+			key := [2]int{original_network_id, service.logoId}
+			if c.services[key] == nil {
+				c.services[key] = make(map[int]string)
+			}
+			c.services[key][service_id] = service.name
+		}
+	}
+}
+
+// parseLogo returns the logo of a CDT section of logo data.
+func parseLogo(section []byte) (*stationLogo, bool) {
+	// [B10] Common Data Table
+	if len(section) < 17 {
+		return nil, false
+	}
+	section_length := int(section[1]&0x0F)<<8 | int(section[2])
+	end := 3 + section_length - 4
+	if 3+section_length > len(section) {
+		return nil, false
+	}
+	data_type := section[10]
+	if data_type != 0x01 {
+		return nil, false
+	}
+	descriptors_loop_length := int(section[11]&0x0F)<<8 | int(section[12])
+	index := 13 + descriptors_loop_length
+	// The data module of logo data
+	if index+7 > end {
+		return nil, false
+	}
+	m := section[index:end]
+	data_size := int(m[5])<<8 | int(m[6])
+	if 7+data_size > len(m) {
+		return nil, false
+	}
+	return &stationLogo{
+		originalNetworkId: int(section[8])<<8 | int(section[9]),
+		logoType:          int(m[0]),
+		logoId:            int(m[1]&0x01)<<8 | int(m[2]),
+		logoVersion:       int(m[3]&0x0F)<<8 | int(m[4]),
+		png:               restoreLogoPalette(m[7 : 7+data_size]),
+	}, true
+}
+
+// restoreLogoPalette adds PLTE and tRNS chunks of the default CLUT to a PNG
+// of indexed color that has no PLTE, as logos are broadcast, so that image
+// viewers can show it.
+func restoreLogoPalette(data []byte) []byte {
+	signature := []byte("\x89PNG\r\n\x1a\n")
+	// The signature and IHDR of 13 bytes, whose color type is at 25
+	ihdrEnd := 8 + 4 + 4 + 13 + 4
+	if len(data) < ihdrEnd || !bytes.HasPrefix(data, signature) || string(data[12:16]) != "IHDR" || data[25] != 3 {
+		return append([]byte(nil), data...)
+	}
+	for index := 8; index+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[index:]))
+		if string(data[index+4:index+8]) == "PLTE" {
+			return append([]byte(nil), data...)
+		}
+		index += 12 + length
+	}
+	clut := aribcaption.CLUT()
+	// PLTE can't have more entries than the bit depth at 24 allows.
+	if n := 1 << data[24]; n < len(clut) {
+		clut = clut[:n]
+	}
+	var plte, trns []byte
+	for _, c := range clut {
+		c := c.(color.NRGBA)
+		plte = append(plte, c.R, c.G, c.B)
+		trns = append(trns, c.A)
+	}
+	out := append([]byte(nil), data[:ihdrEnd]...)
+	out = appendPNGChunk(out, "PLTE", plte)
+	out = appendPNGChunk(out, "tRNS", trns)
+	return append(out, data[ihdrEnd:]...)
+}
+
+func appendPNGChunk(out []byte, chunkType string, data []byte) []byte {
+	out = binary.BigEndian.AppendUint32(out, uint32(len(data)))
+	chunk := append([]byte(chunkType), data...)
+	out = append(out, chunk...)
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(chunk))
+}
+
+// pngSize returns the width and height in IHDR of a PNG.
+func pngSize(data []byte) (int, int, bool) {
+	if len(data) < 24 || string(data[12:16]) != "IHDR" {
+		return 0, 0, false
+	}
+	return int(binary.BigEndian.Uint32(data[16:])), int(binary.BigEndian.Uint32(data[20:])), true
+}
+
+func writeLogo(path string, data []byte) error {
+	f, err := createAtomicFile(path)
+	if err != nil {
+		return err
+	}
+	defer f.Abort()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	return f.Commit()
+}
+
+func (c *logoCollector) sortedLogos() []*stationLogo {
+	var logos []*stationLogo
+	for _, logo := range c.logos {
+		logos = append(logos, logo)
+	}
+	sort.Slice(logos, func(i, j int) bool {
+		a, b := logos[i], logos[j]
+		if a.originalNetworkId != b.originalNetworkId {
+			return a.originalNetworkId < b.originalNetworkId
+		}
+		if a.logoId != b.logoId {
+			return a.logoId < b.logoId
+		}
+		return a.logoType < b.logoType
+	})
+	return logos
+}
+
+// serviceNames returns the names of the services that show the logo, in
+// the order of service_id.
+func (c *logoCollector) serviceNames(logo *stationLogo) []string {
+	services := c.services[[2]int{logo.originalNetworkId, logo.logoId}]
+	var ids []int
+	for service_id := range services {
+		ids = append(ids, service_id)
+	}
+	sort.Ints(ids)
+	var names []string
+	for _, service_id := range ids {
+		names = append(names, services[service_id])
+	}
+	return names
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// TestLogo restores the palette of a logo sent without PLTE, as broadcasters
+// do, and finds the service showing it in SDT.
+func TestLogo(t *testing.T) {
+	img := image.NewPaletted(image.Rect(0, 0, 2, 1), color.Palette{color.Black, color.White})
+	img.SetColorIndex(1, 0, 1)
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil {
+		t.Fatal(err)
+	}
+	// Drop PLTE, so that the indices refer to the CLUT: 0 is black and 1
+	// red.
+	var broadcast []byte
+	data := encoded.Bytes()
+	broadcast = append(broadcast, data[:8]...)
+	for index := 8; index < len(data); {
+		length := int(binary.BigEndian.Uint32(data[index:]))
+		if string(data[index+4:index+8]) != "PLTE" {
+			broadcast = append(broadcast, data[index:index+12+length]...)
+		}
+		index += 12 + length
+	}
+
+	cdt := []byte{
+		0xc8, 0xf0, 0x00, 0x00, 0x01, 0xc1, 0x00, 0x00,
+		// original_network_id 0x7fe0, data_type of logo data, and no
+		// descriptors
+		0x7f, 0xe0, 0x01, 0xf0, 0x00,
+		// logo_type 5, logo_id 0x101, logo_version 3
+		0x05, 0xff, 0x01, 0xf0, 0x03, byte(len(broadcast) >> 8), byte(len(broadcast)),
+	}
+	cdt = append(cdt, broadcast...)
+	sdt := []byte{
+		0x42, 0xf0, 0x00, 0x7f, 0xe0, 0xc1, 0x00, 0x00, 0x7f, 0xe0, 0xff,
+		// service_id 0x400
+		0x04, 0x00, 0xfc, 0x80, 0x10,
+		// Service descriptor of digital TV named あ
+		0x48, 0x05, 0x01, 0x00, 0x02, 0x24, 0x22,
+		// Logo transmission descriptor of CDT for logo_id 0x101, with
+		// download_data_id 1
+		0xcf, 0x07, 0x01, 0xff, 0x01, 0xf0, 0x03, 0x00, 0x01,
+	}
+
+	c := newLogoCollector()
+	c.demux.Push(sectionPacket(0x0011, 0, sdt))
+	c.demux.Push(sectionPacket(0x0029, 0, cdt))
+	logos := c.sortedLogos()
+	if len(logos) != 1 {
+		t.Fatalf("logos = %v", logos)
+	}
+	logo := logos[0]
+	if logo.originalNetworkId != 0x7fe0 || logo.logoId != 0x101 || logo.logoType != 5 || logo.logoVersion != 3 {
+		t.Errorf("logo = %+v", logo)
+	}
+	if names := c.serviceNames(logo); len(names) != 1 || names[0] != "あ" {
+		t.Errorf("services = %v", names)
+	}
+	decoded, err := png.Decode(bytes.NewReader(logo.png))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, g, b, _ := decoded.At(1, 0).RGBA(); r != 0xffff || g != 0 || b != 0 {
+		t.Errorf("color of index 1 = %v", decoded.At(1, 0))
+	}
+	if _, _, _, a := decoded.At(0, 0).RGBA(); a != 0xffff {
+		t.Errorf("color of index 0 = %v", decoded.At(0, 0))
+	}
+}
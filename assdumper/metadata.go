@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// recordingMetadata is the program of a recording as the database of the
+// recorder has it, fetched with -metadata-from to label the outputs the
+// same way the recorder does.
+type recordingMetadata struct {
+	Source      string   `json:"source"`
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Genres      []string `json:"genres,omitempty"`
+	Start       string   `json:"start,omitempty"`
+	End         string   `json:"end,omitempty"`
+}
+
+// Names of content_nibble_level_1 of the content descriptor
+// ARIB STD-B10 第2部 付録H
+var genreNames = map[int]string{
+	0x0: "ニュース／報道",
+	0x1: "スポーツ",
+	0x2: "情報／ワイドショー",
+	0x3: "ドラマ",
+	0x4: "音楽",
+	0x5: "バラエティ",
+	0x6: "映画",
+	0x7: "アニメ／特撮",
+	0x8: "ドキュメンタリー／教養",
+	0x9: "劇場／公演",
+	0xA: "趣味／教育",
+	0xB: "福祉",
+	0xF: "その他",
+}
+
+// fetchMetadata fetches the program of a recording from the API of
+// EPGStation (epgstation://HOST:PORT/recorded/ID) or Mirakurun
+// (mirakurun://HOST:PORT/programs/ID).
+func fetchMetadata(source string, timeout time.Duration) (*recordingMetadata, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	dir, id := path.Split(strings.TrimSuffix(u.Path, "/"))
+	api := url.URL{Scheme: "http", Host: u.Host}
+	switch {
+	case u.Scheme == "epgstation" && (dir == "/" || dir == "/recorded/"):
+		api.Path = "/api/recorded/" + id
+		api.RawQuery = "isHalfWidth=true"
+	case u.Scheme == "mirakurun" && dir == "/programs/":
+		api.Path = "/api/programs/" + id
+	default:
+		return nil, fmt.Errorf("-metadata-from must be epgstation://HOST:PORT/recorded/ID or mirakurun://HOST:PORT/programs/ID, not %s", source)
+	}
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(api.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", api.String(), resp.Status)
+	}
+
+	meta := &recordingMetadata{Source: source}
+	var genres []int
+	// Both APIs have times in milliseconds since the epoch.
+	var start, end int64
+	if u.Scheme == "epgstation" {
+		var item struct {
+			Name        string `json:"name"`
+			Description string `json:"description"`
+			StartAt     int64  `json:"startAt"`
+			EndAt       int64  `json:"endAt"`
+			Genre1      *int   `json:"genre1"`
+			Genre2      *int   `json:"genre2"`
+			Genre3      *int   `json:"genre3"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&item); err != nil {
+			return nil, fmt.Errorf("%s: %v", api.String(), err)
+		}
+		meta.Name, meta.Description = item.Name, item.Description
+		start, end = item.StartAt, item.EndAt
+		for _, g := range []*int{item.Genre1, item.Genre2, item.Genre3} {
+			if g != nil {
+				genres = append(genres, *g)
+			}
+		}
+	} else {
+		var program struct {
+			Name        string `json:"name"`
+			Description string `json:"description"`
+			StartAt     int64  `json:"startAt"`
+			Duration    int64  `json:"duration"`
+			Genres      []struct {
+				Lv1 int `json:"lv1"`
+			} `json:"genres"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&program); err != nil {
+			return nil, fmt.Errorf("%s: %v", api.String(), err)
+		}
+		meta.Name, meta.Description = program.Name, program.Description
+		start, end = program.StartAt, program.StartAt+program.Duration
+		for _, g := range program.Genres {
+			genres = append(genres, g.Lv1)
+		}
+	}
+	for _, g := range genres {
+		if name, ok := genreNames[g]; ok && !containsString(meta.Genres, name) {
+			meta.Genres = append(meta.Genres, name)
+		}
+	}
+	if start != 0 {
+		meta.Start = formatJst(start / 1000)
+		meta.End = formatJst(end / 1000)
+	}
+	return meta, nil
+}
+
+// scriptInfo returns the comment lines of [Script Info] that carry the
+// metadata other than the name, which is the title of the script.
+func (meta *recordingMetadata) scriptInfo() []string {
+	lines := []string{"; Metadata: " + meta.Source}
+	if meta.Start != "" {
+		lines = append(lines, "; Broadcast: "+meta.Start+" - "+meta.End)
+	}
+	if len(meta.Genres) != 0 {
+		lines = append(lines, "; Genre: "+strings.Join(meta.Genres, ", "))
+	}
+	if meta.Description != "" {
+		lines = append(lines, "; Description: "+strings.Join(strings.Fields(meta.Description), " "))
+	}
+	return lines
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// metricsExporter serves the counters of the analyzer on /metrics in the
+// Prometheus text format for -metrics, to watch a long-running live input.
+// The analyzer publishes a snapshot on every PCR, since AnalyzerState is only
+// touched by its own goroutine.
+type metricsExporter struct {
+	anchor *ClockAnchor
+
+	mu     sync.Mutex
+	values analyzerMetrics
+}
+
+type analyzerMetrics struct {
+	snapshot analyzerSnapshot
+	captions int
+	// latency is how far the PCR lags behind the wall clock, by the time
+	// of the last TOT, or 0 before the first one.
+	latency time.Duration
+}
+
+// serveMetrics starts serving /metrics and the pprof profiles on addr.
+func serveMetrics(addr string) (*metricsExporter, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	m := &metricsExporter{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", m.serve)
+	handlePprof(mux)
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			fmt.Fprintf(os.Stderr, "Stopped serving metrics: %v\n", err)
+		}
+	}()
+	return m, nil
+}
+
+func (m *metricsExporter) handle(ev Event) {
+	switch ev := ev.(type) {
+	case ClockAnchor:
+		m.anchor = &ev
+	case CaptionUnit:
+		m.mu.Lock()
+		m.values.captions++
+		m.mu.Unlock()
+	}
+}
+
+// tick publishes the snapshot of the analyzer.
+func (m *metricsExporter) tick(snapshot analyzerSnapshot) {
+	clock := snapshot.Clock
+	var latency time.Duration
+	if m.anchor != nil {
+		streamTime := m.anchor.Time*100 + (clock - m.anchor.PCR).centitime()
+		latency = time.Duration(time.Now().UnixMilli()/10-streamTime) * 10 * time.Millisecond
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values.snapshot = snapshot
+	m.values.latency = latency
+}
+
+func (m *metricsExporter) serve(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	v := m.values
+	m.mu.Unlock()
+	s := v.snapshot
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, metric := range []struct {
+		name, kind, help string
+		value            float64
+	}{
+		{"assdumper_packets_total", "counter", "TS packets processed.", float64(s.Packets)},
+		{"assdumper_continuity_errors_total", "counter", "Gaps of continuity_counter.", float64(s.ContinuityErrors)},
+		{"assdumper_scrambled_packets_total", "counter", "Scrambled packets dropped.", float64(s.ScrambledPackets)},
+		{"assdumper_section_crc_errors_total", "counter", "PSI/SI sections skipped for CRC_32 errors.", float64(s.SectionCRCErrors)},
+		{"assdumper_caption_crc_errors_total", "counter", "Caption data groups with CRC_16 errors.", float64(s.CaptionCRCErrors)},
+		{"assdumper_unhandled_codes_total", "counter", "Control codes and characters the caption decoder couldn't handle.", float64(s.UnhandledCodes)},
+		{"assdumper_retransmissions_total", "counter", "Caption statements skipped as retransmitted.", float64(s.Retransmissions)},
+		{"assdumper_captions_total", "counter", "Caption statements decoded.", float64(v.captions)},
+		{"assdumper_caption_pid", "gauge", "PID of the caption ES, or -1 until it's found.", float64(s.CaptionPid)},
+		{"assdumper_stream_latency_seconds", "gauge", "How far the stream lags behind the wall clock, by TOT.", v.latency.Seconds()},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", metric.name, metric.help, metric.name, metric.kind, metric.name, strconv.FormatFloat(metric.value, 'f', -1, 64))
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// Memory-mapped inputs are only supported on Unix, see mmap_unix.go.
+
+func mapFile(f *os.File, size int64) ([]byte, error) {
+	return nil, errors.New("-mmap is not supported on this platform")
+}
+
+func unmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// languageKey tells the captions of a language apart. The languages of a
+// caption ES are told by their ISO 639 codes, and track tells the ES when
+// the other language is carried in an ES of its own.
+type languageKey struct {
+	track    string
+	language string
+}
+
+// languageRouter hands the events of each language to a renderer of its
+// own, so that a caption of one language doesn't erase the other. The
+// renderer of a language is created when the language first appears, and
+// the clock and table events so far are replayed to put it on the same
+// clock.
+type languageRouter struct {
+	create    func(key languageKey, index int) *assRenderer
+	renderers map[languageKey]*assRenderer
+	keys      []languageKey
+	prepared  []Event
+	context   []Event
+}
+
+func (l *languageRouter) prepare(events []Event) {
+	l.prepared = events
+	for _, r := range l.renderers {
+		r.prepare(events)
+	}
+}
+
+func (l *languageRouter) handle(ev Event) {
+	switch ev := ev.(type) {
+	case CaptionUnit:
+		l.renderer(languageKey{ev.Track, ev.Language}).handle(ev)
+	case CaptionSession:
+		// The session erases the screen of every language in the ES.
+		for key, r := range l.renderers {
+			if key.track == ev.Track {
+				r.handle(ev)
+			}
+		}
+	default:
+		l.context = append(l.context, ev)
+		for _, r := range l.renderers {
+			r.handle(ev)
+		}
+	}
+}
+
+func (l *languageRouter) renderer(key languageKey) *assRenderer {
+	if r, ok := l.renderers[key]; ok {
+		return r
+	}
+	if l.renderers == nil {
+		l.renderers = make(map[languageKey]*assRenderer)
+	}
+	r := l.create(key, len(l.keys))
+	if l.prepared != nil {
+		r.prepare(l.prepared)
+	}
+	for _, ev := range l.context {
+		r.handle(ev)
+	}
+	l.renderers[key] = r
+	l.keys = append(l.keys, key)
+	return r
+}
+
+// styleName returns the style of the language, its ISO 639 code in upper
+// case.
+func (key languageKey) styleName() string {
+	if key.language == "" {
+		return "Default"
+	}
+	return strings.ToUpper(key.language)
+}
+
+// multiLanguageRenderer writes the captions of every language into one
+// script. Each language gets a style named after its ISO 639 code (JPN,
+// ENG, ...) and layers of its own, so that players that hide styles can show
+// either language. The styles are only known at the end, so the Dialogue
+// lines are held until Flush writes the prelude.
+type multiLanguageRenderer struct {
+	languageRouter
+	header    *assRenderer
+	dialogues bytes.Buffer
+	// out is shared by the renderers of the languages, which would break
+	// lines flushing buffers of their own.
+	out    *bufio.Writer
+	styles []string
+}
+
+func newMultiLanguageRenderer(w io.Writer, newRenderer func(w io.Writer) *assRenderer) *multiLanguageRenderer {
+	m := &multiLanguageRenderer{header: newRenderer(w)}
+	m.out = bufio.NewWriter(&m.dialogues)
+	m.create = func(key languageKey, index int) *assRenderer {
+		r := newRenderer(nil)
+		r.setOutput(m.out)
+		r.preludePrinted = true
+		r.style = key.styleName()
+		if r.style != "Default" && !containsString(m.styles, r.style) {
+			m.styles = append(m.styles, r.style)
+		}
+		// Layer 1 above each language is for its ruby.
+		r.layer = 2 * index
+		return r
+	}
+	return m
+}
+
+func (m *multiLanguageRenderer) prepare(events []Event) {
+	m.header.prepare(events)
+	m.languageRouter.prepare(events)
+}
+
+func (m *multiLanguageRenderer) handle(ev Event) {
+	switch ev.(type) {
+	case CaptionUnit, CaptionSession:
+	default:
+		m.header.handle(ev)
+	}
+	m.languageRouter.handle(ev)
+}
+
+func (m *multiLanguageRenderer) Flush() error {
+	if err := m.out.Flush(); err != nil {
+		return err
+	}
+	if m.dialogues.Len() == 0 {
+		// Like assRenderer, write nothing without captions.
+		return nil
+	}
+	m.header.styles = m.styles
+	m.header.printPrelude()
+	m.header.preludePrinted = true
+	if _, err := m.header.out.Write(m.dialogues.Bytes()); err != nil {
+		return err
+	}
+	return m.header.Flush()
+}
+
+// languageFileRenderer writes the captions of each language to a file of
+// its own, named after the output path with the ISO 639 code before the
+// extension, like news.jpn.ass.
+type languageFileRenderer struct {
+	languageRouter
+	files []*atomicFile
+}
+
+func newLanguageFileRenderer(path string, newRenderer func(w io.Writer) *assRenderer) *languageFileRenderer {
+	r := &languageFileRenderer{}
+	r.create = func(key languageKey, index int) *assRenderer {
+		name := key.language
+		if name == "" {
+			name = key.track
+		}
+		if name == "" {
+			name = "und"
+		}
+		ext := filepath.Ext(path)
+		name = strings.TrimSuffix(path, ext) + "." + name
+		for _, f := range r.files {
+			if f.path == name+ext {
+				// Both ES announce the same language.
+				name += "-other"
+			}
+		}
+		f, err := createAtomicFile(name + ext)
+		if err != nil {
+			panic(err)
+		}
+		r.files = append(r.files, f)
+		return newRenderer(f)
+	}
+	return r
+}
+
+// Flush writes out and commits the file of every language.
+func (r *languageFileRenderer) Flush() error {
+	for i, key := range r.keys {
+		if err := r.renderers[key].Flush(); err != nil {
+			return err
+		}
+		if err := r.files[i].Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Abort removes the files of the languages unless they were committed.
+func (r *languageFileRenderer) Abort() {
+	for _, f := range r.files {
+		f.Abort()
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, t := range list {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Longest title kept in a file name, in bytes, so that the name fits in the
+// 255 bytes most filesystems allow.
+const maxTitleBytes = 160
+
+// outputNamer names the output after the program of the recording when -o is
+// a directory, as YYYYMMDD-HHMM_ServiceName_EventTitle.ass. The program is
+// the first present event of EIT[p/f] seen running, or the first present
+// event at all when the broadcaster leaves running_status undefined.
+type outputNamer struct {
+	// extension is ".ass", or ".ssa" with -ssa
+	extension   string
+	serviceName string
+	startTime   int64
+	title       string
+	found       bool
+	running     bool
+}
+
+func (n *outputNamer) handle(ev Event) {
+	switch ev := ev.(type) {
+	case TableChange:
+		if ev.Table == "SDT" && n.serviceName == "" {
+			n.serviceName = ev.ServiceName
+		}
+	case ProgramStatus:
+		if !ev.Present || n.running {
+			return
+		}
+		running := ev.RunningStatus == runningStatusRunning
+		if !n.found || running {
+			n.found = true
+			n.running = running
+			n.startTime = ev.StartTime
+			n.title = ev.Title
+		}
+	}
+}
+
+// name returns the file name of the output, or a name derived from input
+// when EIT had no present event.
+func (n *outputNamer) name(input string) string {
+	if !n.found {
+		if input == "" || input == "-" || strings.Contains(input, "://") {
+			return "assdumper" + n.extension
+		}
+		base := filepath.Base(input)
+		return strings.TrimSuffix(base, filepath.Ext(base)) + n.extension
+	}
+	var parts []string
+	if n.startTime != 0 {
+		parts = append(parts, time.Unix(n.startTime, 0).In(jst).Format("20060102-1504"))
+	}
+	if s := sanitizeFileName(n.serviceName); s != "" {
+		parts = append(parts, s)
+	}
+	if s := sanitizeFileName(n.title); s != "" {
+		for len(s) > maxTitleBytes {
+			_, size := utf8.DecodeLastRuneInString(s)
+			s = s[:len(s)-size]
+		}
+		parts = append(parts, s)
+	}
+	if len(parts) == 0 {
+		return "assdumper" + n.extension
+	}
+	return strings.Join(parts, "_") + n.extension
+}
+
+// sanitizeFileName replaces characters that are not allowed in file names on
+// common filesystems, including Windows ones the files are often shared to.
+func sanitizeFileName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r < 0x20 || r == 0x7f:
+			return -1
+		case strings.ContainsRune(`/\:*?"<>|`, r):
+			return '_'
+		}
+		return r
+	}, s)
+	return strings.Trim(s, " .")
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/aribcaption"
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+// Give up waiting for the rest of the NIT after this many packets, as it's
+// sent every 10 seconds at most.
+const nitScanLimit = 200000
+
+// networkInfo is the network of the NIT of the TS itself.
+type networkInfo struct {
+	NetworkID        int                   `json:"network_id"`
+	Name             string                `json:"name"`
+	TransportStreams []transportStreamInfo `json:"transport_streams"`
+}
+
+type transportStreamInfo struct {
+	TransportStreamID int `json:"transport_stream_id"`
+	OriginalNetworkID int `json:"original_network_id"`
+	// Name and RemoteControlKeyID are of the TS information descriptor,
+	// which is only in the NIT of terrestrial networks.
+	Name               string `json:"name,omitempty"`
+	RemoteControlKeyID int    `json:"remote_control_key_id,omitempty"`
+	// AreaCode and Frequencies are of the terrestrial delivery system
+	// descriptor, with the frequencies in MHz. A satellite delivery system
+	// descriptor gives a frequency in GHz instead.
+	AreaCode    int       `json:"area_code,omitempty"`
+	Frequencies []float64 `json:"frequencies,omitempty"`
+	Satellite   float64   `json:"satellite_frequency,omitempty"`
+	Services    []int     `json:"services"`
+}
+
+type nitScanner struct {
+	demux   *tspacket.Demuxer
+	network *networkInfo
+	// sections are the section_number received of the NIT, up to
+	// last_section_number.
+	sections []bool
+}
+
+func runNIT(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("nit", flag.ExitOnError)
+	jsonOutput := fs.Bool("json", false, "print the network as JSON")
+	inputOpts := registerInputFlags(fs)
+	fs.Parse(args)
+
+	fin, err := openInput(ctx, fs.Arg(0), inputOpts)
+	if err != nil {
+		panic(err)
+	}
+	defer fin.Close()
+	s := newNITScanner()
+	if err := demuxInput(ctx, s.demux, fin); err != nil && ctx.Err() == nil {
+		panic(err)
+	}
+	if s.network == nil {
+		fmt.Fprintln(os.Stderr, "No NIT found")
+		os.Exit(1)
+	}
+	sort.Slice(s.network.TransportStreams, func(i, j int) bool {
+		return s.network.TransportStreams[i].TransportStreamID < s.network.TransportStreams[j].TransportStreamID
+	})
+	printNetwork(s.network, *jsonOutput)
+}
+
+func printNetwork(n *networkInfo, jsonOutput bool) {
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(n); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	fmt.Printf("network_id 0x%04x %s\n", n.NetworkID, orDash(n.Name))
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TSID\tONID\tNAME\tKEY\tAREA\tFREQUENCY\tSERVICES")
+	for _, ts := range n.TransportStreams {
+		var frequencies, services []string
+		for _, f := range ts.Frequencies {
+			frequencies = append(frequencies, strconv.FormatFloat(f, 'f', 3, 64)+"MHz")
+		}
+		if ts.Satellite != 0 {
+			frequencies = append(frequencies, strconv.FormatFloat(ts.Satellite, 'f', 5, 64)+"GHz")
+		}
+		for _, id := range ts.Services {
+			services = append(services, strconv.Itoa(id))
+		}
+		key, area := "-", "-"
+		if ts.RemoteControlKeyID != 0 {
+			key = strconv.Itoa(ts.RemoteControlKeyID)
+		}
+		if ts.AreaCode != 0 {
+			area = fmt.Sprintf("0x%03x", ts.AreaCode)
+		}
+		fmt.Fprintf(w, "0x%04x\t0x%04x\t%s\t%s\t%s\t%s\t%s\n",
+			ts.TransportStreamID, ts.OriginalNetworkID, orDash(ts.Name), key, area,
+			orDash(strings.Join(frequencies, ",")), orDash(strings.Join(services, ",")))
+	}
+	w.Flush()
+}
+
+// newNITScanner returns a nitScanner that reads the NIT of the TS itself
+// until every section of it has been received.
+func newNITScanner() *nitScanner {
+	s := &nitScanner{demux: tspacket.NewDemuxer(nil)}
+	s.demux.HandleSections(0x0010, func(section []byte) {
+		if tspacket.CRC32(section) == 0 {
+			s.handleSection(section)
+		}
+	})
+	s.demux.HandlePackets(func(tspacket.Packet) {
+		if s.done() {
+			s.demux.Stop()
+		}
+	})
+	return s
+}
+
+// done tells whether every section of the NIT has been received, or
+// nitScanLimit packets without some of them once the first one is.
+func (s *nitScanner) done() bool {
+	if s.network == nil {
+		return false
+	}
+	for _, received := range s.sections {
+		if !received {
+			return s.demux.Packets() >= nitScanLimit
+		}
+	}
+	return true
+}
+
+func (s *nitScanner) handleSection(section []byte) {
+	// [B10] 5.2.4 Network Information Table, table_id 0x40 of the actual
+	// network
+	if section[0] != 0x40 || len(section) < 14 {
+		return
+	}
+	section_length := int(section[1]&0x0F)<<8 | int(section[2])
+	if 3+section_length > len(section) || section_length < 13 {
+		return
+	}
+	network_id := int(section[3])<<8 | int(section[4])
+	section_number, last_section_number := int(section[6]), int(section[7])
+	if s.network == nil || s.network.NetworkID != network_id {
+		s.network = &networkInfo{NetworkID: network_id}
+		s.sections = make([]bool, last_section_number+1)
+	}
+	if section_number >= len(s.sections) || s.sections[section_number] {
+		return
+	}
+	s.sections[section_number] = true
+	end := 3 + section_length - 4
+
+	network_descriptors_length := int(section[8]&0x0F)<<8 | int(section[9])
+	index := 10
+	if index+network_descriptors_length > end {
+		return
+	}
+	forEachDescriptor(section[index:index+network_descriptors_length], func(tag byte, d []byte) {
+		if tag == 0x40 {
+			// [B10] 6.2.11 Network name descriptor
+			s.network.Name = aribcaption.DecodeSIString(d)
+		}
+	})
+	index += network_descriptors_length
+	// transport_stream_loop_length
+	if index+2 > end {
+		return
+	}
+	index += 2
+	for index+6 <= end {
+		ts := transportStreamInfo{
+			TransportStreamID: int(section[index])<<8 | int(section[index+1]),
+			OriginalNetworkID: int(section[index+2])<<8 | int(section[index+3]),
+			Services:          []int{},
+		}
+		transport_descriptors_length := int(section[index+4]&0x0F)<<8 | int(section[index+5])
+		index += 6
+		if index+transport_descriptors_length > end {
+			break
+		}
+		forEachDescriptor(section[index:index+transport_descriptors_length], ts.handleDescriptor)
+		index += transport_descriptors_length
+		s.network.TransportStreams = append(s.network.TransportStreams, ts)
+	}
+}
+
+func (ts *transportStreamInfo) handleDescriptor(tag byte, d []byte) {
+	switch tag {
+	case 0x41:
+		// [B10] 6.2.14 Service list descriptor
+		for i := 0; i+3 <= len(d); i += 3 {
+			ts.Services = append(ts.Services, int(d[i])<<8|int(d[i+1]))
+		}
+	case 0x43:
+		// [B10] 6.2.6 Satellite delivery system descriptor, whose
+		// frequency is 8 BCD digits in GHz with 5 after the point
+		if len(d) >= 4 {
+			frequency := 0
+			for _, b := range d[:4] {
+				frequency = frequency*100 + tspacket.DecodeBCD(b)
+			}
+			ts.Satellite = float64(frequency) / 100000
+		}
+	case 0xCD:
+		// [B10] 6.2.42 TS information descriptor
+		if len(d) >= 2 {
+			ts.RemoteControlKeyID = int(d[0])
+			if length_of_ts_name := int(d[1] >> 2); 2+length_of_ts_name <= len(d) {
+				ts.Name = aribcaption.DecodeSIString(d[2 : 2+length_of_ts_name])
+			}
+		}
+	case 0xFA:
+		// [B10] 6.2.31 Terrestrial delivery system descriptor, whose
+		// frequencies are in 1/7 MHz
+		if len(d) >= 2 {
+			ts.AreaCode = int(d[0])<<4 | int(d[1]>>4)
+			for i := 2; i+2 <= len(d); i += 2 {
+				ts.Frequencies = append(ts.Frequencies, float64(int(d[i])<<8|int(d[i+1]))/7)
+			}
+		}
+	}
+}
+
+// forEachDescriptor calls fn with the tag and the body of every descriptor
+// in a descriptor loop, stopping at one that overruns it.
+func forEachDescriptor(loop []byte, fn func(tag byte, d []byte)) {
+	for len(loop) >= 2 {
+		descriptor_length := int(loop[1])
+		if 2+descriptor_length > len(loop) {
+			return
+		}
+		fn(loop[0], loop[2:2+descriptor_length])
+		loop = loop[2+descriptor_length:]
+	}
+}
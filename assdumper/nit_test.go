@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestNITTerrestrial(t *testing.T) {
+	nit := []byte{
+		0x40, 0xf0, 0x00, 0x7f, 0xe0, 0xc1, 0x00, 0x00,
+		// Network name descriptor of あ
+		0xf0, 0x04, 0x40, 0x02, 0x24, 0x22,
+		// transport_stream_loop_length
+		0xf0, 0x17,
+		// transport_stream_id 0x7fe0 of original_network_id 0x7fe0
+		0x7f, 0xe0, 0x7f, 0xe0, 0xf0, 0x11,
+		// Service list descriptor of 0x400
+		0x41, 0x03, 0x04, 0x00, 0x01,
+		// TS information descriptor of remote control key 9, named い
+		0xcd, 0x04, 0x09, 0x08, 0x24, 0x24,
+		// Terrestrial delivery system descriptor of area 0x5a1 on 599.143MHz
+		0xfa, 0x04, 0x5a, 0x1a, 0x10, 0x62,
+	}
+	s := newNITScanner()
+	s.demux.Push(sectionPacket(0x0010, 0, nit))
+	if !s.done() {
+		t.Error("not done after the only section of NIT")
+	}
+	n := s.network
+	if n == nil || n.NetworkID != 0x7fe0 || n.Name != "あ" || len(n.TransportStreams) != 1 {
+		t.Fatalf("network = %+v", n)
+	}
+	ts := n.TransportStreams[0]
+	if ts.Name != "い" || ts.RemoteControlKeyID != 9 || ts.AreaCode != 0x5a1 {
+		t.Errorf("transport stream = %+v", ts)
+	}
+	if len(ts.Frequencies) != 1 || int(ts.Frequencies[0]*1000) != 599142 || len(ts.Services) != 1 || ts.Services[0] != 0x400 {
+		t.Errorf("frequencies = %v, services = %v", ts.Frequencies, ts.Services)
+	}
+}
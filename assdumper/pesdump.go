@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// pesDumper writes every caption PES as it's reassembled, before it's
+// decoded, to a numbered file of its own, and lists them in index.tsv with
+// where they came from, for -dump-pes. It stays a flag rather than a
+// subcommand like remux, since the PES are dumped while the captions are
+// converted, with the same -service, -lang and inputs, so that a caption
+// that comes out wrong can be found among them by its PTS.
+type pesDumper struct {
+	dir   string
+	count int
+	index *atomicFile
+	w     *bufio.Writer
+}
+
+func newPESDumper(dir string) (*pesDumper, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	index, err := createAtomicFile(filepath.Join(dir, "index.tsv"))
+	if err != nil {
+		return nil, err
+	}
+	d := &pesDumper{dir: dir, index: index, w: bufio.NewWriter(index)}
+	fmt.Fprintln(d.w, "file\ttrack\tpid\toffset\tpcr\tpts\tsize")
+	return d, nil
+}
+
+// dump writes the PES of stream, whose PTS is pts in 90kHz units if
+// hasPTS. The offset is of the packet that started the PES, and PCR is the
+// time it arrived at in 27MHz units.
+func (d *pesDumper) dump(assembled assembledPES, track string, pts int64, hasPTS bool) error {
+	pes := assembled.payload
+	// The payload of the last packet may go on with stuffing after the PES.
+	// [ISO] 2.4.3.7 PES_packet_length
+	if len(pes) >= 6 {
+		if PES_packet_length := int(pes[4])<<8 | int(pes[5]); PES_packet_length != 0 && 6+PES_packet_length < len(pes) {
+			pes = pes[:6+PES_packet_length]
+		}
+	}
+	d.count++
+	name := fmt.Sprintf("%06d.pes", d.count)
+	if err := os.WriteFile(filepath.Join(d.dir, name), pes, 0644); err != nil {
+		return err
+	}
+	offset, ptsText := "-", "-"
+	if assembled.offset != -1 {
+		offset = fmt.Sprint(assembled.offset)
+	}
+	if hasPTS {
+		ptsText = fmt.Sprint(pts)
+	}
+	_, err := fmt.Fprintf(d.w, "%s\t%s\t0x%04x\t%s\t%d\t%s\t%d\n", name, orDash(track), assembled.pid, offset, assembled.pcr, ptsText, len(pes))
+	return err
+}
+
+// close commits index.tsv.
+func (d *pesDumper) close() error {
+	if err := d.w.Flush(); err != nil {
+		return err
+	}
+	if err := d.index.Commit(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %d caption PES to %s\n", d.count, d.dir)
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tsgen"
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+// TestDumpPES writes the caption PES of a tsgen stream as they are, with an
+// index of their PTS.
+func TestDumpPES(t *testing.T) {
+	var ts bytes.Buffer
+	if err := tsgen.Write(&ts, &tsgen.Script{
+		Start: time.Date(2024, time.April, 1, 21, 0, 0, 0, time.UTC),
+		Cues: []tsgen.Cue{
+			{Time: 100 * time.Millisecond, Text: "字幕ABC"},
+			{Time: 200 * time.Millisecond},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	state := newAnalyzerState()
+	state.emit = func(Event) {}
+	var err error
+	if state.pesDump, err = newPESDumper(dir); err != nil {
+		t.Fatal(err)
+	}
+	data := ts.Bytes()
+	for i := 0; i+tspacket.Size <= len(data); i += tspacket.Size {
+		state.demux.Push(tspacket.Packet(data[i : i+tspacket.Size]))
+	}
+	if len(state.caption.payload) != 0 {
+		dumpCaption(state.caption.payload, state.caption, state)
+	}
+	if err := state.pesDump.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := os.ReadFile(filepath.Join(dir, "index.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(index), "\n"), "\n")
+	if len(lines) < 3 || lines[0] != "file\ttrack\tpid\toffset\tpcr\tpts\tsize" {
+		t.Fatalf("index.tsv = %s", index)
+	}
+	fields := strings.Split(lines[1], "\t")
+	if fields[0] != "000001.pes" || fields[2] != "0x0130" || fields[3] != "-" || fields[5] == "-" {
+		t.Errorf("first line = %q", lines[1])
+	}
+	pes, err := os.ReadFile(filepath.Join(dir, "000001.pes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(pes, []byte{0x00, 0x00, 0x01, 0xbd}) || len(pes) != 6+(int(pes[4])<<8|int(pes[5])) {
+		t.Errorf("000001.pes = % x", pes)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+// pidMap follows PAT and the PMT of every program on a Demuxer to tell what
+// each PID carries, for the reports per PID of stats and bitrate.
+type pidMap struct {
+	demux *tspacket.Demuxer
+	// pmtPids maps program_map_PID to program_number.
+	pmtPids map[int]int
+	// streams maps the PIDs of PMT to their ES, and programs to the
+	// program_number of the programs they belong to.
+	streams  map[int]tspacket.ElementaryStream
+	programs map[int][]int
+	// pcrPids maps program_number to PCR_PID.
+	pcrPids map[int]int
+	// onPMT is called, unless nil, once the PIDs of a PMT are mapped.
+	onPMT func(program_number int)
+}
+
+func newPIDMap(demux *tspacket.Demuxer) *pidMap {
+	m := &pidMap{
+		demux:    demux,
+		streams:  make(map[int]tspacket.ElementaryStream),
+		programs: make(map[int][]int),
+		pcrPids:  make(map[int]int),
+	}
+	demux.HandleSections(0x0000, m.handlePAT)
+	return m
+}
+
+// handlePAT reads the PMT of the programs of the first PAT. Later versions of
+// PAT and PMT aren't followed.
+func (m *pidMap) handlePAT(section []byte) {
+	if m.pmtPids != nil || tspacket.CRC32(section) != 0 || section[0] != 0x00 {
+		return
+	}
+	m.pmtPids = tspacket.ParsePAT(section)
+	for pid := range m.pmtPids {
+		m.demux.HandleSections(pid, func(section []byte) {
+			m.handlePMT(pid, section)
+		})
+	}
+}
+
+func (m *pidMap) handlePMT(pid int, section []byte) {
+	program_number := m.pmtPids[pid]
+	if tspacket.CRC32(section) != 0 || section[0] != 0x02 || containsInt(m.programs[pid], program_number) {
+		return
+	}
+	m.programs[pid] = append(m.programs[pid], program_number)
+	if pcrPid := tspacket.PCRPID(section); pcrPid >= 0 {
+		m.pcrPids[program_number] = pcrPid
+		if !containsInt(m.programs[pcrPid], program_number) {
+			m.programs[pcrPid] = append(m.programs[pcrPid], program_number)
+		}
+	}
+	for _, es := range tspacket.ParsePMT(section) {
+		m.streams[es.PID] = es
+		if !containsInt(m.programs[es.PID], program_number) {
+			m.programs[es.PID] = append(m.programs[es.PID], program_number)
+		}
+	}
+	if m.onPMT != nil {
+		m.onPMT(program_number)
+	}
+}
+
+// label tells what pid carries: a table of PSI/SI, PMT, captions or the
+// stream_type of an ES.
+func (m *pidMap) label(pid int) string {
+	// [ISO] Table 2-3 and [B10] 5.1.1
+	switch pid {
+	case 0x0000:
+		return "PAT"
+	case 0x0001:
+		return "CAT"
+	case 0x0010:
+		return "NIT"
+	case 0x0011:
+		return "SDT/BAT"
+	case 0x0012:
+		return "EIT"
+	case 0x0013:
+		return "RST"
+	case 0x0014:
+		return "TDT/TOT"
+	case 0x0023:
+		return "SDTT"
+	case 0x0024:
+		return "BIT"
+	case 0x0029:
+		return "CDT"
+	case tspacket.NullPID:
+		return "null"
+	}
+	if program_number, ok := m.pmtPids[pid]; ok {
+		return fmt.Sprintf("PMT of %d", program_number)
+	}
+	if es, ok := m.streams[pid]; ok {
+		switch {
+		case es.StreamType != 0x06:
+		case es.ComponentTag == 0x87, es.ComponentTag == 0x88:
+			return "caption"
+		case es.ComponentTag == 0x89, es.ComponentTag == 0x8a:
+			return "superimpose"
+		}
+		return streamTypeName(es.StreamType)
+	}
+	if len(m.programs[pid]) != 0 {
+		return "PCR"
+	}
+	return "-"
+}
+
+func containsInt(list []int, n int) bool {
+	for _, m := range list {
+		if m == n {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package main
+
+import "github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+
+// decodeStageJobs is the number of jobs queued for the decoding stage before
+// demuxing waits for it, a few seconds of caption PES and PCR of a
+// full-segment stream.
+const decodeStageJobs = 1024
+
+// decodeStage runs the decoding of caption PES on a goroutine of its own,
+// so that demuxing goes on while a caption is decoded and rendered. Reading
+// is done ahead by readAheadReader, which makes the three stages of the
+// pipeline. Demuxing hands over the caption PES along with every event and
+// clock tick, which have to stay in order with the captions, and the jobs
+// run in the order they were given, so the output is the same as decoding on
+// the goroutine of demuxing.
+type decodeStage struct {
+	jobs chan func()
+	done chan struct{}
+}
+
+func startDecodeStage() *decodeStage {
+	s := &decodeStage{jobs: make(chan func(), decodeStageJobs), done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		for job := range s.jobs {
+			job()
+		}
+	}()
+	return s
+}
+
+// wait returns once the jobs given so far have run, after which demuxing may
+// touch what the decoding stage owns until it gives the next job.
+func (s *decodeStage) wait() {
+	ch := make(chan struct{})
+	s.jobs <- func() {
+		close(ch)
+	}
+	<-ch
+}
+
+// stop runs the jobs left and ends the goroutine.
+func (s *decodeStage) stop() {
+	close(s.jobs)
+	<-s.done
+}
+
+// decode runs fn, which touches what the decoding stage owns, after the jobs
+// given before it: on the goroutine of the decoding stage when there is one,
+// and right away otherwise.
+func (state *AnalyzerState) decode(fn func()) {
+	if state.decoder == nil {
+		fn()
+		return
+	}
+	state.decoder.jobs <- fn
+}
+
+// send emits an event found while demuxing, in order with the captions
+// decoded from the PES demuxed before it.
+func (state *AnalyzerState) send(ev Event) {
+	state.decode(func() {
+		state.emit(ev)
+	})
+}
+
+// assembledPES is a caption PES with what decoding needs to know of where it
+// came from, since demuxing goes on to the next packets meanwhile.
+type assembledPES struct {
+	payload []byte
+	pid     int
+	pcr     SystemClock
+	// offset is the byte offset of the packet that started the PES, or -1
+	// for a packet pushed by Push, and position that of the packet that
+	// completed it.
+	offset   int64
+	position tspacket.Position
+	dualMono []string
+}
+
+// dumpCaption hands the PES reassembled on stream to decoding.
+func dumpCaption(payload []byte, stream *captionStream, state *AnalyzerState) {
+	pes := assembledPES{
+		payload:  payload,
+		pid:      stream.pid,
+		pcr:      stream.pcr,
+		offset:   stream.offset,
+		position: state.demux.Position(),
+		dualMono: state.dualMono,
+	}
+	if state.decoder != nil {
+		// The buffer of the payload is reused for the next PES.
+		pes.payload = append([]byte(nil), payload...)
+	}
+	state.decode(func() {
+		decodeCaption(pes, stream, state)
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tsgen"
+)
+
+// TestDecodeStageOrder analyzes the same stream with and without the
+// decoding stage, and expects the events and the clock ticks in the same
+// order.
+func TestDecodeStageOrder(t *testing.T) {
+	script := &tsgen.Script{
+		Start: time.Date(2024, time.April, 1, 21, 0, 0, 0, time.UTC),
+	}
+	for i := 0; i < 40; i++ {
+		cue := tsgen.Cue{Time: time.Duration(i+1) * 150 * time.Millisecond, Text: fmt.Sprintf("字幕%d", i)}
+		if i%5 == 4 {
+			cue.Text = ""
+		}
+		script.Cues = append(script.Cues, cue)
+	}
+	var ts bytes.Buffer
+	if err := tsgen.Write(&ts, script); err != nil {
+		t.Fatal(err)
+	}
+
+	analyze := func(pipelined bool) []string {
+		state := newAnalyzerState()
+		if pipelined {
+			state.decoder = startDecodeStage()
+		}
+		var log []string
+		state.emit = func(ev Event) {
+			log = append(log, fmt.Sprintf("%T %+v", ev, ev))
+		}
+		state.clockTick = func(snapshot analyzerSnapshot) {
+			log = append(log, fmt.Sprintf("tick %d at %d", snapshot.Clock, snapshot.Offset))
+		}
+		if err := analyzeStream(context.Background(), io.NopCloser(bytes.NewReader(ts.Bytes())), state); err != nil {
+			t.Fatal(err)
+		}
+		if pipelined {
+			state.decoder.stop()
+		}
+		return log
+	}
+	want := analyze(false)
+	got := analyze(true)
+	captions := 0
+	for _, line := range want {
+		if strings.HasPrefix(line, "main.CaptionUnit") {
+			captions++
+		}
+	}
+	if captions != len(script.Cues) {
+		t.Errorf("decoded %d captions of %d", captions, len(script.Cues))
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d lines, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("line %d: got\n%s\nwant\n%s", i, got[i], want[i])
+		}
+	}
+}
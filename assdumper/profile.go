@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	runtimepprof "runtime/pprof"
+)
+
+// startProfiles starts writing a CPU profile to cpuPath for -cpuprofile, and
+// returns the function to call at the end, which stops it and writes a heap
+// profile to memPath for -memprofile. Empty paths profile nothing.
+func startProfiles(cpuPath, memPath string) (stop func()) {
+	var cpu *os.File
+	if cpuPath != "" {
+		f, err := os.Create(cpuPath)
+		if err != nil {
+			panic(err)
+		}
+		if err := runtimepprof.StartCPUProfile(f); err != nil {
+			panic(err)
+		}
+		cpu = f
+	}
+	return func() {
+		if cpu != nil {
+			runtimepprof.StopCPUProfile()
+			if err := cpu.Close(); err != nil {
+				panic(err)
+			}
+		}
+		if memPath != "" {
+			f, err := os.Create(memPath)
+			if err != nil {
+				panic(err)
+			}
+			defer f.Close()
+			// Count what is still live at the end, not the garbage.
+			runtime.GC()
+			if err := runtimepprof.WriteHeapProfile(f); err != nil {
+				panic(err)
+			}
+		}
+	}
+}
+
+// handlePprof serves the profiles of net/http/pprof on mux under
+// /debug/pprof/, next to /metrics.
+func handlePprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// progressInterval is how often -progress reports.
+const progressInterval = 5 * time.Second
+
+// progressReporter writes how far the inputs have been processed to stderr
+// for -progress. It's driven by the PCR of the program, which arrives many
+// times a second, so that it runs on the analyzer's goroutine.
+type progressReporter struct {
+	state *AnalyzerState
+	// sizes are the sizes of the inputs, or -1 for those whose size isn't
+	// known, such as stdin and network streams.
+	sizes []int64
+	// input is the index of the input being processed, and done the bytes
+	// of the inputs before it.
+	input int
+	done  int64
+
+	start    time.Time
+	reported time.Time
+	// stream is the stream time processed so far, summed over the PCR
+	// increments so that discontinuities don't count.
+	stream time.Duration
+	clock  SystemClock
+	// processed is the bytes of the current input processed by the last
+	// tick.
+	processed int64
+}
+
+func newProgressReporter(inputs []string, state *AnalyzerState) *progressReporter {
+	p := &progressReporter{state: state, start: time.Now()}
+	p.reported = p.start
+	for _, path := range inputs {
+		size := int64(-1)
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			size = info.Size()
+		}
+		p.sizes = append(p.sizes, size)
+	}
+	return p
+}
+
+// tick counts the stream time up to the clock of snapshot and reports at
+// every progressInterval.
+func (p *progressReporter) tick(snapshot analyzerSnapshot) {
+	clock := snapshot.Clock
+	p.processed = snapshot.Processed
+	if p.clock != 0 {
+		if d := clock - p.clock; 0 <= d && !isPcrDiscontinuity(p.clock, clock) {
+			p.stream += time.Duration(d.centitime()) * 10 * time.Millisecond
+		}
+	}
+	p.clock = clock
+	if now := time.Now(); now.Sub(p.reported) >= progressInterval {
+		p.reported = now
+		p.report()
+	}
+}
+
+// nextInput tells that the current input has been processed, once the
+// decoding stage has caught up.
+func (p *progressReporter) nextInput() {
+	if p.input < len(p.sizes) && p.sizes[p.input] > 0 {
+		p.done += p.sizes[p.input]
+	} else {
+		p.done += p.state.demuxSnapshot().Processed
+	}
+	p.input++
+	p.processed = 0
+}
+
+// report writes the bytes processed, the percentage of the whole inputs
+// when all of their sizes are known, the speed and the stream time.
+func (p *progressReporter) report() {
+	processed := p.done
+	if p.input < len(p.sizes) {
+		processed += p.processed
+	}
+	percentage := ""
+	total := int64(0)
+	for _, size := range p.sizes {
+		if size < 0 {
+			total = 0
+			break
+		}
+		total += size
+	}
+	if total > 0 {
+		percentage = fmt.Sprintf(" (%.1f%%)", float64(processed)*100/float64(total))
+	}
+	speed := float64(processed) / 1e6 / time.Since(p.start).Seconds()
+	fmt.Fprintf(os.Stderr, "Processed %.1f MB%s at %.1f MB/s, stream time %s\n",
+		float64(processed)/1e6, percentage, speed, formatOffset(p.stream))
+}
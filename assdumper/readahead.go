@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// readAheadReader reads the input on a goroutine of its own into a bounded
+// number of chunks, so that reading a file from a slow disk or NAS overlaps
+// with demuxing and decoding rather than taking turns with them.
+//
+// It's the first stage of the pipeline that decodeStage ends: demuxing goes
+// on with the chunks read on the goroutine reading from it, and hands the
+// caption PES to the decoding stage.
+type readAheadReader struct {
+	in io.ReadCloser
+	// free holds the chunks to read into and full the ones read, in
+	// order. The last one carries the error that ended reading.
+	free    chan []byte
+	full    chan readAheadChunk
+	done    chan struct{}
+	current readAheadChunk
+	pending []byte
+	once    sync.Once
+}
+
+type readAheadChunk struct {
+	buf []byte
+	n   int
+	err error
+}
+
+// readAheadChunks is the number of chunks read ahead, about 4 seconds of a
+// full-segment stream with the default -read-buffer.
+const readAheadChunks = 8
+
+func newReadAheadReader(in io.ReadCloser, chunkSize int) *readAheadReader {
+	r := &readAheadReader{
+		in:   in,
+		free: make(chan []byte, readAheadChunks),
+		full: make(chan readAheadChunk, readAheadChunks),
+		done: make(chan struct{}),
+	}
+	for i := 0; i < readAheadChunks; i++ {
+		r.free <- make([]byte, chunkSize)
+	}
+	go r.readAhead()
+	return r
+}
+
+func (r *readAheadReader) readAhead() {
+	for {
+		var buf []byte
+		select {
+		case buf = <-r.free:
+		case <-r.done:
+			return
+		}
+		// A pipe gives what has been written so far rather than a full
+		// chunk, which keeps -live from waiting for the chunk to fill.
+		n, err := r.in.Read(buf)
+		select {
+		case r.full <- readAheadChunk{buf: buf, n: n, err: err}:
+		case <-r.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (r *readAheadReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.current.err != nil {
+			return 0, r.current.err
+		}
+		if r.current.buf != nil {
+			r.free <- r.current.buf
+		}
+		r.current = <-r.full
+		r.pending = r.current.buf[:r.current.n]
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// Close stops reading ahead and closes the input. A Read blocked on the
+// input is waited for by the goroutine only, which ends after it.
+func (r *readAheadReader) Close() error {
+	r.once.Do(func() {
+		close(r.done)
+	})
+	return r.in.Close()
+}
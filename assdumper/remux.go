@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/aribcaption"
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+// tsRemuxer keeps a single program of a TS: its PMT, PCR, video, audio and
+// caption PIDs, under a PAT rewritten to list the program alone. SDT, EIT and
+// TOT are kept as they are, so that assdumper names and times the captions
+// of the remuxed TS as those of the original. It follows later versions of
+// PAT and the PMT, as the PIDs may move when the next event starts.
+type tsRemuxer struct {
+	demux     *tspacket.Demuxer
+	serviceId int
+	out       io.Writer
+	pmtPid    int
+	// pids are the PIDs of the program that are kept, from its PMT.
+	pids map[int]bool
+	// patContinuity is continuity_counter of the rewritten PAT.
+	patContinuity int
+	// err is the first error writing out, which stops the demuxer.
+	err error
+
+	packets, kept int64
+}
+
+// runRemux writes the program -service of the inputs, as one stream, to -o
+// or stdout. -remux-service of assdumper itself does the same.
+func runRemux(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("remux", flag.ExitOnError)
+	outputPath := fs.String("o", "", "write the remuxed TS to `FILE` instead of stdout")
+	serviceId := fs.Int("service", -1, "keep the program whose program_number (service_id) is `N`")
+	opts := registerInputFlags(fs)
+	fs.Parse(args)
+	if *serviceId == -1 {
+		fmt.Fprintln(os.Stderr, "-service N is required")
+		os.Exit(2)
+	}
+	inputs := fs.Args()
+	if len(inputs) == 0 {
+		inputs = []string{""}
+	}
+	remux(ctx, inputs, opts, *serviceId, *outputPath)
+}
+
+// remux writes the program serviceId of the inputs, as one stream, to
+// outputPath or stdout.
+func remux(ctx context.Context, inputs []string, opts *inputOptions, serviceId int, outputPath string) {
+	var w io.Writer = os.Stdout
+	var fout *atomicFile
+	if outputPath != "" {
+		var err error
+		fout, err = createAtomicFile(outputPath)
+		if err != nil {
+			panic(err)
+		}
+		defer fout.Abort()
+		w = fout
+	}
+	out := bufio.NewWriter(w)
+	r := newTSRemuxer(tspacket.NewDemuxer(nil), out, serviceId)
+	for _, path := range inputs {
+		fin, err := openInput(ctx, path, opts)
+		if err != nil {
+			panic(err)
+		}
+		err = demuxInput(ctx, r.demux, fin)
+		fin.Close()
+		if r.err != nil {
+			panic(r.err)
+		}
+		if err != nil && ctx.Err() == nil {
+			panic(err)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if r.pmtPid == -1 {
+		fmt.Fprintf(os.Stderr, "No program_number %d found in PAT\n", serviceId)
+		os.Exit(1)
+	}
+	if err := out.Flush(); err != nil {
+		panic(err)
+	}
+	if fout != nil {
+		if err := fout.Commit(); err != nil {
+			panic(err)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Kept %d of %d packets\n", r.kept, r.packets)
+}
+
+func newTSRemuxer(demux *tspacket.Demuxer, out io.Writer, serviceId int) *tsRemuxer {
+	r := &tsRemuxer{
+		demux:     demux,
+		serviceId: serviceId,
+		out:       out,
+		pmtPid:    -1,
+		pids:      make(map[int]bool),
+	}
+	demux.HandleSections(0x0000, func(section []byte) {
+		if r.err == nil && tspacket.CRC32(section) == 0 {
+			r.fail(r.handlePAT(section))
+		}
+	})
+	demux.HandlePackets(r.write)
+	return r
+}
+
+// write writes the packet if it's of the program. PAT is written rewritten
+// as its sections complete instead.
+func (r *tsRemuxer) write(packet tspacket.Packet) {
+	r.packets++
+	switch pid := packet.PID(); {
+	case r.err != nil, pid == 0x0000:
+		return
+	case pid == r.pmtPid, pid == 0x0011, pid == 0x0012, pid == 0x0014, r.pids[pid]:
+		// [B10] 5.1.1 SDT, EIT and TOT
+	default:
+		return
+	}
+	r.kept++
+	_, err := r.out.Write(packet)
+	r.fail(err)
+}
+
+// fail keeps err and stops the demuxer, unless err is nil.
+func (r *tsRemuxer) fail(err error) {
+	if err != nil {
+		r.err = err
+		r.demux.Stop()
+	}
+}
+
+// handlePAT finds the PMT of the program, and writes a PAT of the program
+// alone with the version of the original.
+func (r *tsRemuxer) handlePAT(section []byte) error {
+	// [ISO] 2.4.4.3 Program association section
+	if section[0] != 0x00 || len(section) < 8 || section[5]&0x01 == 0 {
+		return nil
+	}
+	pmtPid := -1
+	for pid, program_number := range tspacket.ParsePAT(section) {
+		if program_number == r.serviceId {
+			pmtPid = pid
+		}
+	}
+	if pmtPid == -1 {
+		return nil
+	}
+	if pmtPid != r.pmtPid {
+		if r.pmtPid != -1 {
+			r.demux.HandleSections(r.pmtPid, nil)
+		}
+		r.pmtPid = pmtPid
+		r.pids = make(map[int]bool)
+		r.demux.HandleSections(pmtPid, func(section []byte) {
+			if tspacket.CRC32(section) == 0 {
+				r.handlePMT(section)
+			}
+		})
+	}
+	pat := []byte{
+		0x00, 0xb0, 0x00, section[3], section[4], section[5], 0x00, 0x00,
+		byte(r.serviceId >> 8), byte(r.serviceId), 0xe0 | byte(pmtPid>>8), byte(pmtPid),
+	}
+	// section_length counts the bytes after it, including CRC_32.
+	pat[2] = byte(len(pat) - 3 + 4)
+	crc := tspacket.CRC32(pat)
+	pat = append(pat, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+
+	packet := make([]byte, tspacket.Size)
+	for i := range packet {
+		packet[i] = 0xff
+	}
+	packet[0] = tspacket.SyncByte
+	// payload_unit_start_indicator, PID 0 and payload only
+	packet[1] = 0x40
+	packet[2] = 0x00
+	packet[3] = 0x10 | byte(r.patContinuity)
+	r.patContinuity = (r.patContinuity + 1) & 0x0f
+	// pointer_field
+	packet[4] = 0
+	copy(packet[5:], pat)
+	r.kept++
+	_, err := r.out.Write(packet)
+	return err
+}
+
+// handlePMT keeps the PCR, video, audio and caption PIDs of the current
+// PMT of the program.
+func (r *tsRemuxer) handlePMT(section []byte) {
+	// [ISO] 2.4.4.8 Program map section
+	if section[0] != 0x02 || len(section) < 12 || section[5]&0x01 == 0 {
+		return
+	}
+	if int(section[3])<<8|int(section[4]) != r.serviceId {
+		return
+	}
+	pids := make(map[int]bool)
+	if pcrPid := tspacket.PCRPID(section); pcrPid >= 0 {
+		pids[pcrPid] = true
+	}
+	for _, es := range tspacket.ParsePMT(section) {
+		if isVideoStreamType(es.StreamType) || isAudioStreamType(es.StreamType) || isCaptionStream(es) {
+			pids[es.PID] = true
+		}
+	}
+	r.pids = pids
+}
+
+// isCaptionStream tells the ES of captions and superimpose, of either
+// language, and the caption ES of 1seg.
+func isCaptionStream(es tspacket.ElementaryStream) bool {
+	if es.StreamType != 0x06 {
+		return false
+	}
+	// component_tag 0x87 and 0x88 of captions, and 0x89 and 0x8A of
+	// superimpose
+	return 0x87 <= es.ComponentTag && es.ComponentTag <= 0x8a || es.DataComponentID == aribcaption.DataComponentMobileCaption
+}
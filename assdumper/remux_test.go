@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+// TestRemuxService keeps the PIDs of one of two programs, under a PAT that
+// lists it alone.
+func TestRemuxService(t *testing.T) {
+	pat := []byte{
+		0x00, 0xb0, 0x00, 0x7f, 0xe0, 0xc3, 0x00, 0x00,
+		// NIT, and program_number 0x400 on PID 0x1f0 and 0x408 on 0x1f8
+		0x00, 0x00, 0xe0, 0x10, 0x04, 0x00, 0xe1, 0xf0, 0x04, 0x08, 0xe1, 0xf8,
+	}
+	pmt := []byte{
+		0x02, 0xb0, 0x00, 0x04, 0x00, 0xc1, 0x00, 0x00, 0xe1, 0x00, 0xf0, 0x00,
+		0x02, 0xe1, 0x11, 0xf0, 0x00,
+		0x0f, 0xe1, 0x12, 0xf0, 0x00,
+		0x06, 0xe1, 0x30, 0xf0, 0x03, 0x52, 0x01, 0x87,
+		// Data broadcasting, which isn't kept
+		0x0d, 0xe1, 0x40, 0xf0, 0x03, 0x52, 0x01, 0x40,
+	}
+	packet := func(pid int) tspacket.Packet {
+		p := make(tspacket.Packet, tspacket.Size)
+		copy(p, []byte{tspacket.SyncByte, byte(pid >> 8), byte(pid), 0x10})
+		return p
+	}
+
+	var out bytes.Buffer
+	r := newTSRemuxer(tspacket.NewDemuxer(nil), &out, 0x400)
+	for _, p := range []tspacket.Packet{
+		sectionPacket(0x0000, 0, pat),
+		// Before PMT
+		packet(0x0111),
+		sectionPacket(0x01f0, 0, pmt),
+		packet(0x0100), packet(0x0111), packet(0x0112), packet(0x0130), packet(0x0140),
+		packet(0x01f8), packet(0x0208), packet(0x0014), packet(tspacket.NullPID),
+	} {
+		r.demux.Push(p)
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+	}
+
+	var pids []int
+	data := out.Bytes()
+	for i := 0; i+tspacket.Size <= len(data); i += tspacket.Size {
+		pids = append(pids, tspacket.Packet(data[i:i+tspacket.Size]).PID())
+	}
+	want := []int{0x0000, 0x01f0, 0x0100, 0x0111, 0x0112, 0x0130, 0x0014}
+	if len(pids) != len(want) {
+		t.Fatalf("PIDs = %x, want %x", pids, want)
+	}
+	for i := range want {
+		if pids[i] != want[i] {
+			t.Fatalf("PIDs = %x, want %x", pids, want)
+		}
+	}
+
+	var a tspacket.SectionAssembler
+	var programs map[int]int
+	a.Push(tspacket.Packet(data[:tspacket.Size])[4:], true, func(section []byte) {
+		if tspacket.CRC32(section) != 0 || section[5] != 0xc3 {
+			t.Errorf("PAT = % x", section)
+		}
+		programs = tspacket.ParsePAT(section)
+	})
+	if len(programs) != 1 || programs[0x1f0] != 0x400 {
+		t.Errorf("programs = %v", programs)
+	}
+}
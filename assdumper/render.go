@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Dialogue lines assembled from caption units below this confidence are
+// flagged with a comment.
+const lowConfidence = 1.0
+
+// assRenderer times caption units and writes them with a Formatter, ASS
+// Dialogue lines unless told otherwise. Each caption is displayed until the
+// next one arrives.
+type assRenderer struct {
+	out       *bufio.Writer
+	format    func(w *bufio.Writer) Formatter
+	formatter Formatter
+	// rubyParen writes ruby in parentheses instead of on a layer of its own.
+	rubyParen bool
+	// style and layer are the style of the Dialogue lines and the layer
+	// their layers start from, which tell languages apart in one script.
+	style string
+	layer int
+	// styles are the styles declared in the prelude besides Default.
+	styles []string
+	title  string
+	// info are more lines of [Script Info], like the metadata of the
+	// recording.
+	info               []string
+	clockOffset        int64
+	previousSubtitle   string
+	previousConfidence float64
+	previousIsBlank    bool
+	previousTimestamp  SystemClock
+	previousTime       int64
+	lastEndTime        int64
+	preludePrinted     bool
+	// liveHold is the longest a caption is held in live mode before its
+	// Dialogue line is written, in centiseconds, and 0 otherwise. Every
+	// line is flushed as soon as it's written in live mode.
+	liveHold int64
+	anchored bool
+}
+
+// captionRenderer renders the events of the main caption track.
+type captionRenderer interface {
+	prepare(events []Event)
+	handle(ev Event)
+	Flush() error
+}
+
+func newASSRenderer(w io.Writer) *assRenderer {
+	return newFormatRenderer(w, "ass")
+}
+
+// newSSARenderer writes SSA v4 for old players that don't understand ASS
+// v4+. SSA has no \pos to put ruby over the base text.
+func newSSARenderer(w io.Writer) *assRenderer {
+	r := newFormatRenderer(w, "ssa")
+	r.rubyParen = true
+	return r
+}
+
+// newFormatRenderer writes in a format registered with registerFormat.
+func newFormatRenderer(w io.Writer, format string) *assRenderer {
+	r := &assRenderer{format: formats[format], style: "Default"}
+	r.setOutput(bufio.NewWriter(w))
+	return r
+}
+
+// setOutput makes the renderer write to out with a formatter of its own.
+func (r *assRenderer) setOutput(out *bufio.Writer) {
+	r.out = out
+	r.formatter = r.format(out)
+}
+
+// prepare gathers metadata from the whole event log before rendering it, so
+// that captions preceding the first TOT get correct times and the service
+// name is known in advance.
+func (r *assRenderer) prepare(events []Event) {
+	anchored := false
+	for _, ev := range events {
+		switch ev := ev.(type) {
+		case ClockAnchor:
+			if !anchored {
+				r.handle(ev)
+				anchored = true
+			}
+		case TableChange:
+			r.handle(ev)
+		}
+	}
+}
+
+func (r *assRenderer) handle(ev Event) {
+	switch ev := ev.(type) {
+	case ClockAnchor:
+		r.clockOffset = ev.Time*100 - ev.PCR.centitime()
+		r.anchored = true
+	case ClockDiscontinuity:
+		// Stitch the new time base onto the old one until the next TOT
+		// gives the exact offset again.
+		r.clockOffset += ev.Previous.centitime() - ev.Current.centitime()
+	case TableChange:
+		if ev.Table == "SDT" && r.title == "" {
+			r.title = ev.ServiceName
+		}
+	case CaptionSession:
+		// Management data of another data group initializes the
+		// receiver, which erases the screen when the PES is presented.
+		r.handleCaption(CaptionUnit{PCR: ev.PCR, PTS: ev.PTS, HasPTS: ev.HasPTS, Text: "\f", Confidence: 1})
+	case CaptionUnit:
+		r.handleCaption(ev)
+	}
+}
+
+func (r *assRenderer) handleCaption(unit CaptionUnit) {
+	subtitle := unit.Text
+	timestamp := unit.presentationTime()
+	if r.showing() {
+		if r.previousTimestamp == timestamp {
+			r.previousSubtitle += subtitle
+			if unit.Confidence < r.previousConfidence {
+				r.previousConfidence = unit.Confidence
+			}
+			return
+		}
+		r.writePrevious(timestamp.centitime() + r.clockOffset)
+	}
+	r.previousIsBlank = isBlank(r.previousSubtitle)
+	if isErase(subtitle) {
+		// The screen stays empty until the next caption, which needs no
+		// Dialogue line.
+		subtitle = ""
+	}
+	r.previousSubtitle = subtitle
+	r.previousConfidence = unit.Confidence
+	r.previousTimestamp = timestamp
+	r.previousTime = timestamp.centitime() + r.clockOffset
+}
+
+// showing reports whether the previous caption is on the screen and needs
+// Dialogue lines once its end is known.
+func (r *assRenderer) showing() bool {
+	return len(r.previousSubtitle) != 0 && !(isBlank(r.previousSubtitle) && r.previousIsBlank)
+}
+
+// writePrevious writes the Dialogue lines of the previous caption, ending
+// at curTimeCenti.
+func (r *assRenderer) writePrevious(curTimeCenti int64) {
+	prevTimeCenti := r.previousTime
+	// Keep Dialogue lines in order even when a TOT moves the clock
+	// backwards after stitching.
+	if prevTimeCenti < r.lastEndTime {
+		prevTimeCenti = r.lastEndTime
+	}
+	if curTimeCenti < prevTimeCenti {
+		curTimeCenti = prevTimeCenti
+	}
+	if curTimeCenti == prevTimeCenti && r.liveHold != 0 {
+		// Cut at the hold just before the next caption
+		return
+	}
+	r.lastEndTime = curTimeCenti
+	if !r.preludePrinted {
+		r.printPrelude()
+		r.preludePrinted = true
+	}
+	subtitle, rubies := extractRuby(strings.Replace(r.previousSubtitle, "\f", "", -1), r.rubyParen)
+	c := Caption{
+		Start:      prevTimeCenti,
+		End:        curTimeCenti,
+		Layer:      r.layer,
+		Style:      r.style,
+		Text:       subtitle,
+		Confidence: r.previousConfidence,
+	}
+	r.formatter.Write(c)
+	for _, ruby := range rubies {
+		c.Layer, c.Text, c.Ruby = r.layer+1, ruby, true
+		r.formatter.Write(c)
+	}
+	if r.liveHold != 0 {
+		// A write error is kept by the writer and returned by Flush at
+		// the end.
+		r.out.Flush()
+	}
+}
+
+// advance tells the time of the stream in live mode. A caption that has
+// been on the screen for liveHold is written up to then, without waiting
+// for the next caption to end it, and goes on in another Dialogue line.
+// Until the first TOT, the times aren't known yet and captions are held
+// as usual.
+func (r *assRenderer) advance(clock SystemClock) {
+	if r.liveHold == 0 || !r.anchored || !r.showing() {
+		return
+	}
+	if now := clock.centitime() + r.clockOffset; now >= r.previousTime+r.liveHold {
+		// The last hold boundary, so that the time jumping forward, e.g.
+		// at the first TOT, doesn't write a line for every hold skipped.
+		end := now - (now-r.previousTime)%r.liveHold
+		r.writePrevious(end)
+		r.previousIsBlank = isBlank(r.previousSubtitle)
+		r.previousTime = end
+	}
+}
+
+// extractRuby takes out the ruby runs, which the decoder encloses in
+// {ruby X,Y} and {/ruby} comments. A run placed by APS is returned as a line
+// of its own in small characters at X,Y, to be rendered on a layer above
+// the base text. The other runs, and every run when paren is set, are left
+// in parentheses where they were.
+func extractRuby(text string, paren bool) (string, []string) {
+	var b strings.Builder
+	var rubies []string
+	for {
+		start := strings.Index(text, "{ruby")
+		if start == -1 {
+			break
+		}
+		end := strings.IndexByte(text[start:], '}')
+		if end == -1 {
+			break
+		}
+		marker := text[start+len("{ruby") : start+end]
+		b.WriteString(text[:start])
+		text = text[start+end+1:]
+		ruby := text
+		if n := strings.Index(text, "{/ruby}"); n != -1 {
+			ruby = text[:n]
+			text = text[n+len("{/ruby}"):]
+		} else {
+			text = ""
+		}
+		if isBlank(ruby) {
+			continue
+		}
+		var x, y int
+		if _, err := fmt.Sscanf(marker, " %d,%d", &x, &y); err == nil && !paren {
+			rubies = append(rubies, fmt.Sprintf("{\\an7\\pos(%d,%d)\\fscx50\\fscy50}%s", x, y, ruby))
+		} else {
+			b.WriteString("(" + strings.Trim(ruby, " ") + ")")
+		}
+	}
+	b.WriteString(text)
+	return b.String(), rubies
+}
+
+// Flashing text is shown and hidden every half of flashPeriod, in
+// centiseconds, for at most maxFlashes periods.
+const (
+	flashPeriod = 100
+	maxFlashes  = 30
+)
+
+// animateFlashing follows the {flash} and {/flash} comments of the decoder
+// with \t animations of alpha over duration centiseconds. The comments are
+// kept so that parseASS can take the animations out again.
+func animateFlashing(text string, duration int64) string {
+	if !strings.Contains(text, "{flash") {
+		return text
+	}
+	animation := func(hidden bool) string {
+		var b strings.Builder
+		b.WriteString("{")
+		if hidden {
+			b.WriteString("\\alpha&HFF&")
+		}
+		alphas := [2]string{"&HFF&", "&H00&"}
+		if hidden {
+			alphas[0], alphas[1] = alphas[1], alphas[0]
+		}
+		for i := int64(1); i*flashPeriod/2 < duration && i <= 2*maxFlashes; i++ {
+			t := i * flashPeriod / 2 * 10
+			fmt.Fprintf(&b, "\\t(%d,%d,\\alpha%s)", t, t, alphas[(i+1)%2])
+		}
+		b.WriteString("}")
+		return b.String()
+	}
+	return strings.NewReplacer(
+		"{flash}", "{flash}"+animation(false),
+		"{flash inverted}", "{flash inverted}"+animation(true),
+		"{/flash}", "{/flash}{\\alpha}",
+	).Replace(text)
+}
+
+func (r *assRenderer) Flush() error {
+	if r.preludePrinted {
+		if err := r.formatter.Flush(); err != nil {
+			return err
+		}
+	}
+	return r.out.Flush()
+}
+
+func (r *assRenderer) printPrelude() {
+	r.formatter.Prelude(ScriptHeader{Title: r.title, Info: r.info, Styles: r.styles})
+}
+
+// downgradeOverrides rewrites the override blocks of an ASS line for SSA v4.
+// \an becomes the legacy \a, tags that SSA has are kept, and the others
+// (\pos, \fscx, ...) are dropped since SSA can't express them. Blocks
+// left without tags are removed, except for comments that had none in the
+// first place. Drawings are removed with their commands, which SSA would
+// show as text.
+func downgradeOverrides(text string) string {
+	var b strings.Builder
+	drawing := false
+	for {
+		start := strings.IndexByte(text, '{')
+		if start == -1 {
+			break
+		}
+		end := strings.IndexByte(text[start:], '}')
+		if end == -1 {
+			break
+		}
+		if !drawing {
+			b.WriteString(text[:start])
+		}
+		block := text[start+1 : start+end]
+		text = text[start+end+1:]
+		if !strings.Contains(block, "\\") {
+			b.WriteString("{" + block + "}")
+			continue
+		}
+		var kept []string
+		for _, tag := range strings.Split(block, "\\")[1:] {
+			if isDrawingTag(tag) {
+				drawing = tag != "p0"
+				continue
+			}
+			if t, ok := downgradeTag(tag); ok {
+				kept = append(kept, t)
+			}
+		}
+		if len(kept) != 0 {
+			b.WriteString("{\\" + strings.Join(kept, "\\") + "}")
+		}
+	}
+	if !drawing {
+		b.WriteString(text)
+	}
+	return b.String()
+}
+
+// isDrawingTag reports whether tag is \p, which switches the drawing mode.
+func isDrawingTag(tag string) bool {
+	if !strings.HasPrefix(tag, "p") || len(tag) == 1 {
+		return false
+	}
+	_, err := strconv.Atoi(tag[1:])
+	return err == nil
+}
+
+// SSA v4 alignment of \an1 to \an9: 1-3 at the bottom, +4 at the top and
+// +8 in the middle.
+var legacyAlignments = [10]int{0, 1, 2, 3, 9, 10, 11, 5, 6, 7}
+
+func downgradeTag(tag string) (string, bool) {
+	switch {
+	case strings.HasPrefix(tag, "an"):
+		n, err := strconv.Atoi(tag[2:])
+		if err != nil || n < 1 || n > 9 {
+			return "", false
+		}
+		return fmt.Sprintf("a%d", legacyAlignments[n]), true
+	case strings.HasPrefix(tag, "c&"), strings.HasPrefix(tag, "fn"),
+		strings.HasPrefix(tag, "fs") && !strings.HasPrefix(tag, "fsc") && !strings.HasPrefix(tag, "fsp"),
+		tag == "b0", tag == "b1", tag == "i0", tag == "i1":
+		return tag, true
+	}
+	return "", false
+}
+
+// isErase reports whether a caption only clears the screen with CS, which
+// ends the Dialogue line displayed so far.
+func isErase(str string) bool {
+	return str != "" && strings.Trim(str, "\f") == ""
+}
+
+func isBlank(str string) bool {
+	for _, c := range str {
+		if c != ' ' {
+			return false
+		}
+	}
+	return true
+}
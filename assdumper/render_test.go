@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialogueLines renders events and returns the Dialogue lines written.
+func dialogueLines(t *testing.T, r *assRenderer, out *bytes.Buffer, events []Event) []string {
+	t.Helper()
+	var lines []string
+	for _, line := range strings.Split(renderASSEvents(t, r, out, events), "\n") {
+		if strings.HasPrefix(line, "Dialogue: ") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func testDialogueLines(t *testing.T, name string, got, want []string) {
+	t.Helper()
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("%s: got\n%s\nwant\n%s", name, strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// TestRenderRuby checks that ruby placed by APS goes on the layer above the
+// base text, and that the other ruby, and every ruby with -ruby paren, is
+// left in parentheses.
+func TestRenderRuby(t *testing.T) {
+	anchor := time.Date(2024, time.April, 1, 21, 0, 0, 0, time.Local).Unix()
+	unit := func(seconds float64, text string) CaptionUnit {
+		return CaptionUnit{PCR: SystemClock(seconds * float64(K)), Text: text, Confidence: 1}
+	}
+	events := []Event{
+		ClockAnchor{PCR: 0, Time: anchor},
+		unit(1, "\f{ruby 100,200}かんじ{/ruby}{\\an7\\pos(100,210)}漢字"),
+		unit(4, "\f{ruby}ふりがな{/ruby}振り仮名"),
+		unit(6, "\f"),
+	}
+	for _, c := range []struct {
+		name  string
+		paren bool
+		want  []string
+	}{
+		{"layer", false, []string{
+			"Dialogue: 0,21:00:01.00,21:00:04.00,Default,,,,,,{\\an7\\pos(100,210)}漢字",
+			"Dialogue: 1,21:00:01.00,21:00:04.00,Default,,,,,,{\\an7\\pos(100,200)\\fscx50\\fscy50}かんじ",
+			"Dialogue: 0,21:00:04.00,21:00:06.00,Default,,,,,,(ふりがな)振り仮名",
+		}},
+		{"paren", true, []string{
+			"Dialogue: 0,21:00:01.00,21:00:04.00,Default,,,,,,(かんじ){\\an7\\pos(100,210)}漢字",
+			"Dialogue: 0,21:00:04.00,21:00:06.00,Default,,,,,,(ふりがな)振り仮名",
+		}},
+	} {
+		var out bytes.Buffer
+		r := newASSRenderer(&out)
+		r.rubyParen = c.paren
+		testDialogueLines(t, c.name, dialogueLines(t, r, &out, events), c.want)
+	}
+}
+
+// TestRenderClearScreen checks that CS and management data of another data
+// group end the displayed caption then, rather than at the next caption.
+func TestRenderClearScreen(t *testing.T) {
+	anchor := time.Date(2024, time.April, 1, 21, 0, 0, 0, time.Local).Unix()
+	unit := func(seconds float64, text string) CaptionUnit {
+		return CaptionUnit{PCR: SystemClock(seconds * float64(K)), Text: text, Confidence: 1}
+	}
+	var out bytes.Buffer
+	got := dialogueLines(t, newASSRenderer(&out), &out, []Event{
+		ClockAnchor{PCR: 0, Time: anchor},
+		unit(1, "\f字幕"),
+		unit(3, "\f"),
+		unit(10, "\f次の字幕"),
+		CaptionSession{PCR: SystemClock(12 * K), DataGroupId: 0x21},
+		unit(20, "\f最後"),
+		unit(22, "\f"),
+	})
+	testDialogueLines(t, "CS", got, []string{
+		"Dialogue: 0,21:00:01.00,21:00:03.00,Default,,,,,,字幕",
+		"Dialogue: 0,21:00:10.00,21:00:12.00,Default,,,,,,次の字幕",
+		"Dialogue: 0,21:00:20.00,21:00:22.00,Default,,,,,,最後",
+	})
+}
+
+// TestRenderClearScreenPTS ends the displayed caption at the PTS of the PES
+// that erases it, as it starts at the PTS of its own, rather than at the
+// PCR the PES arrived at.
+func TestRenderClearScreenPTS(t *testing.T) {
+	anchor := time.Date(2024, time.April, 1, 21, 0, 0, 0, time.Local).Unix()
+	unit := func(arrival, presentation float64, text string) CaptionUnit {
+		return CaptionUnit{PCR: SystemClock(arrival * float64(K)), PTS: int64(presentation * 90000), HasPTS: true, Text: text, Confidence: 1}
+	}
+	var out bytes.Buffer
+	got := dialogueLines(t, newASSRenderer(&out), &out, []Event{
+		ClockAnchor{PCR: 0, Time: anchor},
+		unit(1, 1.5, "\f字幕"),
+		unit(3, 3.5, "\f"),
+		unit(10, 10.5, "\f次の字幕"),
+		CaptionSession{PCR: SystemClock(12 * K), PTS: 12*90000 + 45000, HasPTS: true, DataGroupId: 0x21},
+	})
+	testDialogueLines(t, "CS", got, []string{
+		"Dialogue: 0,21:00:01.50,21:00:03.50,Default,,,,,,字幕",
+		"Dialogue: 0,21:00:10.50,21:00:12.50,Default,,,,,,次の字幕",
+	})
+}
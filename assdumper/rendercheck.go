@@ -0,0 +1,14 @@
+//go:build !libass
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// runRenderCheck is implemented in rendercheck_libass.go, which links libass.
+func runRenderCheck(args []string) {
+	fmt.Fprintln(os.Stderr, "render-check needs libass: build with -tags libass")
+	os.Exit(1)
+}
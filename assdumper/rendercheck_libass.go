@@ -0,0 +1,299 @@
+//go:build libass
+
+package main
+
+/*
+#cgo pkg-config: libass
+#include <stdlib.h>
+#include <ass/ass.h>
+*/
+import "C"
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"time"
+	"unsafe"
+)
+
+// Frames are rendered at the default PlayResX/PlayResY of libass, which the
+// ASS output doesn't override.
+const (
+	renderCheckWidth  = 384
+	renderCheckHeight = 288
+	// Largest difference of a color channel tolerated against the golden
+	// image, to absorb rounding differences between libass versions.
+	renderCheckTolerance = 8
+)
+
+// renderFixture is a short event log rendered to ASS, of which frames are
+// taken at the given milliseconds.
+type renderFixture struct {
+	name   string
+	events []Event
+	frames []int64
+}
+
+func fixtureUnit(seconds float64, text string, confidence float64) CaptionUnit {
+	return CaptionUnit{PCR: SystemClock(seconds * float64(K)), Text: text, Confidence: confidence}
+}
+
+// renderFixtures cover what the ASS output varies in. Every fixture ends with
+// a blank caption since a Dialogue line is written when the next caption
+// arrives.
+var renderFixtures = []renderFixture{
+	{
+		name: "single-line",
+		events: []Event{
+			ClockAnchor{PCR: 0, Time: 0},
+			fixtureUnit(1, "\fこんにちは", 1),
+			fixtureUnit(3, "\f ", 1),
+		},
+		frames: []int64{2000},
+	},
+	{
+		name: "two-lines",
+		events: []Event{
+			ClockAnchor{PCR: 0, Time: 0},
+			fixtureUnit(1, "\f字幕の一行目\\n二行目", 1),
+			fixtureUnit(3, "\f ", 1),
+		},
+		frames: []int64{2000},
+	},
+	{
+		name: "merged-units",
+		events: []Event{
+			ClockAnchor{PCR: 0, Time: 0},
+			fixtureUnit(1, "\fつながった", 1),
+			fixtureUnit(1, "字幕", 1),
+			fixtureUnit(3, "\f ", 1),
+		},
+		frames: []int64{2000},
+	},
+	{
+		name: "low-confidence",
+		events: []Event{
+			ClockAnchor{PCR: 0, Time: 0},
+			fixtureUnit(1, "\f受信エラー{gaiji 0x7a50}", 0.45),
+			fixtureUnit(3, "\f ", 1),
+		},
+		frames: []int64{2000},
+	},
+	{
+		name: "positioned",
+		events: []Event{
+			ClockAnchor{PCR: 0, Time: 0},
+			fixtureUnit(1, "\f{\\an7\\pos(132,208)}一人目\\N二人目", 1),
+			fixtureUnit(3, "\f ", 1),
+		},
+		frames: []int64{2000},
+	},
+	{
+		name: "ruby",
+		events: []Event{
+			ClockAnchor{PCR: 0, Time: 0},
+			fixtureUnit(1, "\f{ruby 100,224}かんじ{/ruby}{\\an7\\pos(100,240)}漢字です", 1),
+			fixtureUnit(3, "\f ", 1),
+		},
+		frames: []int64{2000},
+	},
+	{
+		name: "sequence",
+		events: []Event{
+			ClockAnchor{PCR: 0, Time: 0},
+			fixtureUnit(1, "\f最初", 1),
+			fixtureUnit(2, "\f次", 1),
+			fixtureUnit(3, "\f ", 1),
+		},
+		frames: []int64{1500, 2500},
+	},
+}
+
+// runRenderCheck renders the fixtures through libass and compares the frames
+// with the golden PNGs in -dir, to catch styling regressions that don't
+// show in a diff of the ASS text. -update writes the frames as the new
+// golden images instead. Fonts found by fontconfig differ between machines,
+// so -font should point to the same font file whenever the golden images
+// are compared.
+func runRenderCheck(args []string) {
+	fs := flag.NewFlagSet("render-check", flag.ExitOnError)
+	dir := fs.String("dir", "testdata/render", "read and write golden images in `DIR`")
+	update := fs.Bool("update", false, "write the rendered frames as the golden images")
+	font := fs.String("font", "", "render with the font `FILE` instead of asking fontconfig")
+	fs.Parse(args)
+
+	// Dialogue times are formatted in the local time zone.
+	time.Local = time.UTC
+
+	lib := C.ass_library_init()
+	if lib == nil {
+		fmt.Fprintln(os.Stderr, "ass_library_init failed")
+		os.Exit(1)
+	}
+	defer C.ass_library_done(lib)
+	renderer := C.ass_renderer_init(lib)
+	if renderer == nil {
+		fmt.Fprintln(os.Stderr, "ass_renderer_init failed")
+		os.Exit(1)
+	}
+	defer C.ass_renderer_done(renderer)
+	C.ass_set_frame_size(renderer, renderCheckWidth, renderCheckHeight)
+	family := C.CString("sans-serif")
+	defer C.free(unsafe.Pointer(family))
+	if *font != "" {
+		path := C.CString(*font)
+		defer C.free(unsafe.Pointer(path))
+		C.ass_set_fonts(renderer, path, family, C.ASS_FONTPROVIDER_NONE, nil, 0)
+	} else {
+		C.ass_set_fonts(renderer, nil, family, C.ASS_FONTPROVIDER_AUTODETECT, nil, 1)
+	}
+
+	if *update {
+		if err := os.MkdirAll(*dir, 0755); err != nil {
+			panic(err)
+		}
+	} else if _, err := os.Stat(*dir); os.IsNotExist(err) {
+		// The golden images depend on the font, so they aren't committed.
+		fmt.Fprintf(os.Stderr, "Skipping the render check: no golden images in %s (run with -update to create them)\n", *dir)
+		return
+	}
+	failures := 0
+	missing := 0
+	for _, fixture := range renderFixtures {
+		var ass bytes.Buffer
+		r := newASSRenderer(&ass)
+		for _, ev := range fixture.events {
+			r.handle(ev)
+		}
+		if err := r.Flush(); err != nil {
+			panic(err)
+		}
+		for _, ms := range fixture.frames {
+			frame := renderASSFrame(lib, renderer, ass.Bytes(), ms)
+			path := filepath.Join(*dir, fmt.Sprintf("%s-%d.png", fixture.name, ms))
+			if *update {
+				if err := writePNG(path, frame); err != nil {
+					panic(err)
+				}
+				fmt.Fprintf(os.Stderr, "Wrote %s\n", path)
+				continue
+			}
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				missing++
+				continue
+			}
+			if !matchGolden(path, frame) {
+				failures++
+			}
+		}
+	}
+	if missing != 0 {
+		fmt.Fprintf(os.Stderr, "Skipped %d frames without golden images (run with -update to create them)\n", missing)
+	}
+	if failures != 0 {
+		fmt.Fprintf(os.Stderr, "%d frames differ from the golden images\n", failures)
+		os.Exit(1)
+	}
+}
+
+// renderASSFrame renders the ASS script at ms over a gray background.
+func renderASSFrame(lib *C.ASS_Library, renderer *C.ASS_Renderer, script []byte, ms int64) *image.RGBA {
+	buf := C.CBytes(script)
+	defer C.free(buf)
+	track := C.ass_read_memory(lib, (*C.char)(buf), C.size_t(len(script)), nil)
+	if track == nil {
+		panic("ass_read_memory failed")
+	}
+	defer C.ass_free_track(track)
+
+	frame := image.NewRGBA(image.Rect(0, 0, renderCheckWidth, renderCheckHeight))
+	for i := 0; i < len(frame.Pix); i += 4 {
+		frame.Pix[i], frame.Pix[i+1], frame.Pix[i+2], frame.Pix[i+3] = 0x80, 0x80, 0x80, 0xff
+	}
+	var changed C.int
+	for img := C.ass_render_frame(renderer, track, C.longlong(ms), &changed); img != nil; img = img.next {
+		blendASSImage(frame, img)
+	}
+	return frame
+}
+
+// blendASSImage draws an alpha bitmap of libass in its single color.
+func blendASSImage(frame *image.RGBA, img *C.ASS_Image) {
+	w, h, stride := int(img.w), int(img.h), int(img.stride)
+	if w == 0 || h == 0 {
+		return
+	}
+	bitmap := unsafe.Slice((*byte)(unsafe.Pointer(img.bitmap)), stride*(h-1)+w)
+	c := uint32(img.color)
+	red, green, blue := c>>24, (c>>16)&0xff, (c>>8)&0xff
+	opacity := 255 - c&0xff
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			px, py := int(img.dst_x)+x, int(img.dst_y)+y
+			if !image.Pt(px, py).In(frame.Rect) {
+				continue
+			}
+			a := uint32(bitmap[y*stride+x]) * opacity / 255
+			i := frame.PixOffset(px, py)
+			frame.Pix[i] = uint8((red*a + uint32(frame.Pix[i])*(255-a)) / 255)
+			frame.Pix[i+1] = uint8((green*a + uint32(frame.Pix[i+1])*(255-a)) / 255)
+			frame.Pix[i+2] = uint8((blue*a + uint32(frame.Pix[i+2])*(255-a)) / 255)
+		}
+	}
+}
+
+// matchGolden compares frame with the golden image at path. A frame that
+// doesn't match is written next to it as .actual.png for inspection.
+func matchGolden(path string, frame *image.RGBA) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		return false
+	}
+	golden, err := png.Decode(f)
+	f.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		return false
+	}
+	differs := 0
+	if golden.Bounds() != frame.Bounds() {
+		differs = frame.Bounds().Dx() * frame.Bounds().Dy()
+	} else {
+		for y := frame.Rect.Min.Y; y < frame.Rect.Max.Y; y++ {
+			for x := frame.Rect.Min.X; x < frame.Rect.Max.X; x++ {
+				if !similarColor(golden.At(x, y), frame.At(x, y)) {
+					differs++
+				}
+			}
+		}
+	}
+	if differs == 0 {
+		return true
+	}
+	actual := path[:len(path)-len(filepath.Ext(path))] + ".actual.png"
+	fmt.Fprintf(os.Stderr, "%s: %d pixels differ, see %s\n", path, differs, actual)
+	if err := writePNG(actual, frame); err != nil {
+		panic(err)
+	}
+	return false
+}
+
+func similarColor(a, b color.Color) bool {
+	ar, ag, ab, aa := a.RGBA()
+	br, bg, bb, ba := b.RGBA()
+	for _, d := range [][2]uint32{{ar, br}, {ag, bg}, {ab, bb}, {aa, ba}} {
+		// RGBA returns 16-bit channels.
+		x, y := d[0]>>8, d[1]>>8
+		if x > y+renderCheckTolerance || y > x+renderCheckTolerance {
+			return false
+		}
+	}
+	return true
+}
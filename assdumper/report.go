@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// unhandledReport counts the codes the decoder couldn't handle for -report,
+// which summarizes them at the end instead of logging every occurrence.
+type unhandledReport struct {
+	kinds  []string
+	counts map[string]map[string]int
+}
+
+func newUnhandledReport() *unhandledReport {
+	return &unhandledReport{counts: make(map[string]map[string]int)}
+}
+
+// note counts an occurrence of key of kind, and reports whether it did so,
+// in which case the occurrence isn't logged by itself. A nil r is -report
+// not given, which counts nothing.
+func (r *unhandledReport) note(kind, key string) bool {
+	if r == nil {
+		return false
+	}
+	counts, ok := r.counts[kind]
+	if !ok {
+		counts = make(map[string]int)
+		r.counts[kind] = counts
+		r.kinds = append(r.kinds, kind)
+	}
+	counts[key]++
+	return true
+}
+
+// write writes a line for every kind in the order seen, with the most
+// frequent keys first.
+func (r *unhandledReport) write(w io.Writer) {
+	if len(r.kinds) == 0 {
+		fmt.Fprintln(w, "No unhandled codes")
+		return
+	}
+	for _, kind := range r.kinds {
+		counts := r.counts[kind]
+		keys := make([]string, 0, len(counts))
+		for k := range counts {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if counts[keys[i]] != counts[keys[j]] {
+				return counts[keys[i]] > counts[keys[j]]
+			}
+			return keys[i] < keys[j]
+		})
+		var s []string
+		for _, k := range keys {
+			s = append(s, fmt.Sprintf("%s x%d", k, counts[k]))
+		}
+		fmt.Fprintf(w, "%s: %s\n", kind, strings.Join(s, ", "))
+	}
+}
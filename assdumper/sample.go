@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+// Bytes read from the end of a file to find its last PCR.
+const sampleTailSize = 4 * 1024 * 1024
+
+// sampleSpec is the argument of -sample, e.g. "every=10m,window=30s".
+type sampleSpec struct {
+	every  time.Duration
+	window time.Duration
+}
+
+func parseSampleSpec(s string) (*sampleSpec, error) {
+	spec := &sampleSpec{every: 10 * time.Minute, window: 30 * time.Second}
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid -sample %q: expected KEY=DURATION", kv)
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -sample %q: %v", kv, err)
+		}
+		switch k {
+		case "every":
+			spec.every = d
+		case "window":
+			spec.window = d
+		default:
+			return nil, fmt.Errorf("invalid -sample %q: unknown key %s", kv, k)
+		}
+	}
+	if spec.every <= 0 || spec.window <= 0 {
+		return nil, fmt.Errorf("invalid -sample %q: durations must be positive", s)
+	}
+	return spec, nil
+}
+
+// sampleWindow is what was found in one window of a recording.
+type sampleWindow struct {
+	captionPid    int
+	captions      int
+	lowConfidence int
+	text          string
+}
+
+func (w *sampleWindow) status() string {
+	switch {
+	case w.captionPid == -1:
+		return "no caption PID"
+	case w.captions == 0:
+		return "no captions"
+	case w.lowConfidence > 0:
+		return "noisy"
+	default:
+		return "ok"
+	}
+}
+
+// runSample decodes only short windows spread across the file at path and
+// reports what each of them holds to out, as a quick check of huge
+// recordings. Each window is analyzed with a fresh state from newState.
+// Windows are located by assuming a constant bitrate between the first and
+// the last PCR. When ctx is done, the windows sampled so far are reported.
+func runSample(ctx context.Context, out io.Writer, path string, spec *sampleSpec, newState func() *AnalyzerState) {
+	f, err := os.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		panic(err)
+	}
+	if !info.Mode().IsRegular() {
+		fmt.Fprintln(os.Stderr, "-sample needs a regular file to seek in")
+		os.Exit(1)
+	}
+
+	packetSize, _ := tspacket.DetectSize(bufio.NewReader(f))
+	firstPcr, ok := scanPcr(ctx, f, 0, false)
+	if !ok {
+		fmt.Fprintln(os.Stderr, "No PCR found")
+		os.Exit(1)
+	}
+	tail := info.Size() - sampleTailSize
+	if tail < 0 {
+		tail = 0
+	}
+	lastPcr, _ := scanPcr(ctx, f, tail-tail%int64(packetSize), true)
+	duration := time.Duration(lastPcr.since(firstPcr).centitime()) * 10 * time.Millisecond
+	if duration <= 0 {
+		fmt.Fprintln(os.Stderr, "Unable to estimate the duration")
+		os.Exit(1)
+	}
+	bytesPerSecond := float64(info.Size()) / duration.Seconds()
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "OFFSET\tCAPTIONS\tLOW_CONFIDENCE\tSTATUS\tTEXT")
+	for offset := time.Duration(0); offset < duration && ctx.Err() == nil; offset += spec.every {
+		pos := int64(offset.Seconds() * bytesPerSecond)
+		pos -= pos % int64(packetSize)
+		window := sampleAt(ctx, f, pos, spec.window, int64(spec.window.Seconds()*bytesPerSecond)*2, newState())
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n",
+			formatOffset(offset), window.captions, window.lowConfidence, window.status(), window.text)
+	}
+	w.Flush()
+}
+
+// sampleAt runs the analyzer with state from pos until window has passed on the PCR,
+// or until limit bytes have been read when no PCR shows up.
+func sampleAt(ctx context.Context, f *os.File, pos int64, window time.Duration, limit int64, state *AnalyzerState) *sampleWindow {
+	if _, err := f.Seek(pos, io.SeekStart); err != nil {
+		panic(err)
+	}
+	result := &sampleWindow{captionPid: -1}
+	state.emit = func(ev Event) {
+		unit, ok := ev.(CaptionUnit)
+		if !ok || isBlank(strings.Replace(unit.Text, "\f", "", -1)) {
+			return
+		}
+		result.captions++
+		if unit.Confidence < lowConfidence {
+			result.lowConfidence++
+		}
+		if result.text == "" {
+			result.text = truncateText(strings.Replace(unit.Text, "\f", "", -1), 20)
+		}
+	}
+
+	var start SystemClock
+	state.demux.HandlePackets(func(tspacket.Packet) {
+		if state.currentTimestamp == 0 {
+			return
+		}
+		if start == 0 {
+			start = state.currentTimestamp
+		}
+		// A PCR a little behind start, of the jitter of a noisy tuner,
+		// is nearly a whole wrap around after it.
+		elapsed := state.currentTimestamp.since(start)
+		if elapsed >= SystemClock(window.Seconds()*float64(K)) && elapsed < tspacket.PCRWrap/2 {
+			state.demux.Stop()
+		}
+	})
+	err := demuxInput(ctx, state.demux, io.LimitReader(f, limit))
+	if err != nil && ctx.Err() == nil {
+		panic(err)
+	}
+	result.captionPid = state.snapshot().CaptionPid
+	return result
+}
+
+// scanPcr returns the first PCR found from pos, or the last one before EOF
+// when last is true.
+func scanPcr(ctx context.Context, f *os.File, pos int64, last bool) (SystemClock, bool) {
+	if _, err := f.Seek(pos, io.SeekStart); err != nil {
+		panic(err)
+	}
+	var pcr SystemClock
+	found := false
+	demux := tspacket.NewDemuxer(nil)
+	demux.HandlePackets(func(packet tspacket.Packet) {
+		field, _, _ := packet.AdaptationField()
+		if !tspacket.HasPCR(field) {
+			return
+		}
+		pcr = SystemClock(tspacket.PCR(field))
+		found = true
+		if !last {
+			demux.Stop()
+		}
+	})
+	// The tail may start off a packet boundary of a file cut short, so a
+	// lost sync ends the scan as the end of the input does.
+	err := demuxInput(ctx, demux, io.LimitReader(f, sampleTailSize))
+	if err != nil && !errors.Is(err, tspacket.ErrSync) && ctx.Err() == nil {
+		panic(err)
+	}
+	return pcr, found
+}
+
+func formatOffset(d time.Duration) string {
+	s := int64(d.Seconds())
+	return fmt.Sprintf("%02d:%02d:%02d", s/3600, s/60%60, s%60)
+}
+
+func truncateText(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n]) + "…"
+}
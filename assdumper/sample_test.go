@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/aribcaption"
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tsgen"
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+func newSampleState() *AnalyzerState {
+	state := newAnalyzerState()
+	state.gaiji = aribcaption.DefaultGaijiMap()
+	state.caption.session.Decoder.Gaiji = state.gaiji
+	return state
+}
+
+// TestSample samples a stream whose PCR wraps around in the middle, which
+// still has to be estimated 12 seconds long for the windows to land on the
+// captions.
+func TestSample(t *testing.T) {
+	ts := generateTS(t, fmt.Sprintf(`@start 2024-04-01T21:00:00+09:00
+@pcr 0s %d
+1s	一つ目
+1.5s
+9s	二つ目
+9.5s
+@duration 12s
+`, tspacket.PCRWrap-6*27000000))
+	path := filepath.Join(t.TempDir(), "sample.ts")
+	if err := os.WriteFile(path, ts, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	runSample(context.Background(), &out, path, &sampleSpec{every: 4 * time.Second, window: 2 * time.Second}, newSampleState)
+	var rows []string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n")[1:] {
+		rows = append(rows, strings.Join(strings.Fields(line), " "))
+	}
+	want := []string{
+		"00:00:00 1 0 ok 一つ目",
+		"00:00:04 0 0 no captions",
+		"00:00:08 1 0 ok 二つ目",
+	}
+	if strings.Join(rows, "\n") != strings.Join(want, "\n") {
+		t.Errorf("rows =\n%s\nwant\n%s", strings.Join(rows, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// TestSampleNoCaptionPID samples a window without PMT, which doesn't tell
+// the caption PID.
+func TestSampleNoCaptionPID(t *testing.T) {
+	ts := generateTS(t, `@start 2024-04-01T21:00:00+09:00
+1s	字幕
+`)
+	for i := 0; i+tspacket.Size <= len(ts); i += tspacket.Size {
+		if tspacket.Packet(ts[i:i+tspacket.Size]).PID() == tsgen.PMTPID {
+			// Turn it into a null packet.
+			ts[i+1] = ts[i+1]&0xe0 | tspacket.NullPID>>8
+			ts[i+2] = tspacket.NullPID & 0xff
+		}
+	}
+	f, err := os.Create(filepath.Join(t.TempDir(), "sample.ts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(ts); err != nil {
+		t.Fatal(err)
+	}
+
+	w := sampleAt(context.Background(), f, 0, time.Second, int64(len(ts)), newSampleState())
+	if w.captionPid != -1 || w.captions != 0 || w.status() != "no caption PID" {
+		t.Errorf("window = %+v, status = %s", w, w.status())
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/aribcaption"
+)
+
+// convertServer converts TS to subtitles over HTTP for web frontends of
+// recorders: POST /convert with the TS as the body, or with ?url= of a
+// stream such as Mirakurun's, and the subtitles come back as they are
+// written. Every request is analyzed with a state of its own.
+type convertServer struct {
+	gaiji     aribcaption.GaijiMap
+	inputOpts inputOptions
+}
+
+func runServe(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", ":8080", "serve POST /convert on `ADDR`")
+	port := fs.Int("port", 0, "serve on `PORT` of every address, the same as -listen :PORT")
+	httpTimeout := fs.Duration("http-timeout", 30*time.Second, "give up on a ?url= input when no data arrives for `DURATION`")
+	fs.Parse(args)
+	if *port != 0 {
+		*listen = fmt.Sprintf(":%d", *port)
+	}
+
+	s := &convertServer{
+		gaiji:     aribcaption.DefaultGaijiMap(),
+		inputOpts: inputOptions{httpTimeout: *httpTimeout, httpRetries: 5, readBuffer: 1024 * 1024},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/convert", s.convert)
+	server := &http.Server{Addr: *listen, Handler: mux}
+	context.AfterFunc(ctx, func() {
+		server.Close()
+	})
+	fmt.Fprintf(os.Stderr, "Serving on %s\n", *listen)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		panic(err)
+	}
+}
+
+// convert takes format=ass, ssa or another of -format, lang=1 or 2 and service=N like the flags
+// of assdumper. Only http:// and https:// are accepted as url, not to read
+// the files of the server.
+func (s *convertServer) convert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "POST the TS or ?url= of it", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = "ass"
+	}
+	if err := checkFormat(format); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lang := 1
+	if v := q.Get("lang"); v != "" {
+		lang, _ = strconv.Atoi(v)
+		if lang != 1 && lang != 2 {
+			http.Error(w, "lang must be 1 or 2", http.StatusBadRequest)
+			return
+		}
+	}
+	serviceId := -1
+	if v := q.Get("service"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "invalid service", http.StatusBadRequest)
+			return
+		}
+		serviceId = n
+	}
+
+	var fin io.ReadCloser = io.NopCloser(r.Body)
+	if url := q.Get("url"); url != "" {
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			http.Error(w, "url must be http:// or https://", http.StatusBadRequest)
+			return
+		}
+		in, err := openInput(r.Context(), url, &s.inputOpts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		fin = in
+	}
+
+	state := newAnalyzerState()
+	state.gaiji = s.gaiji
+	state.caption.session.Decoder.Gaiji = s.gaiji
+	state.serviceId = serviceId
+	state.caption.componentTag = 0x86 + lang
+	out := &responseWriter{ResponseWriter: w}
+	w.Header().Set("Content-Type", formatContentTypes[format])
+	renderer := newFormatRenderer(out, format)
+	if format == "ssa" {
+		renderer = newSSARenderer(out)
+	}
+	state.emit = renderer.handle
+
+	err := analyzeStream(r.Context(), fin, state)
+	if err != nil && r.Context().Err() == nil {
+		if !out.written {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// The status has gone out with the subtitles so far.
+		fmt.Fprintf(os.Stderr, "%s: %v\n", r.RemoteAddr, err)
+	}
+	if err := renderer.Flush(); err != nil && r.Context().Err() == nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", r.RemoteAddr, err)
+	}
+}
+
+// responseWriter tells whether anything has been written, after which the
+// status of the response can't be changed, and flushes every write so that
+// the subtitles reach the client as they are rendered.
+type responseWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	w.written = true
+	n, err := w.ResponseWriter.Write(p)
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
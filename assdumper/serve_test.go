@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/aribcaption"
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tsgen"
+)
+
+// TestServeConvert posts a generated stream to /convert and expects its
+// captions back in the format asked for.
+func TestServeConvert(t *testing.T) {
+	var ts bytes.Buffer
+	if err := tsgen.Write(&ts, &tsgen.Script{
+		Start: time.Date(2024, time.April, 1, 21, 0, 0, 0, time.UTC),
+		Cues: []tsgen.Cue{
+			{Time: time.Second, Text: "字幕"},
+			{Time: 2 * time.Second},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	s := &convertServer{gaiji: aribcaption.DefaultGaijiMap()}
+
+	for _, c := range []struct {
+		format, contentType, header string
+	}{
+		{"ass", "text/x-ass; charset=utf-8", "ScriptType: v4.00+"},
+		{"ssa", "text/x-ssa; charset=utf-8", "ScriptType: v4.00\n"},
+	} {
+		w := httptest.NewRecorder()
+		s.convert(w, httptest.NewRequest("POST", "/convert?format="+c.format, bytes.NewReader(ts.Bytes())))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", c.format, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("Content-Type"); got != c.contentType {
+			t.Errorf("%s: Content-Type %q, want %q", c.format, got, c.contentType)
+		}
+		if body := w.Body.String(); !strings.Contains(body, c.header) || !strings.Contains(body, "字幕") {
+			t.Errorf("%s: got\n%s", c.format, body)
+		}
+	}
+}
+
+// TestServeConvertErrors expects the requests /convert can't answer to be
+// refused before anything is written.
+func TestServeConvertErrors(t *testing.T) {
+	s := &convertServer{gaiji: aribcaption.DefaultGaijiMap()}
+	for _, c := range []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{"GET", httptest.NewRequest("GET", "/convert", nil), http.StatusMethodNotAllowed},
+		{"not TS", httptest.NewRequest("POST", "/convert", strings.NewReader(strings.Repeat("not a transport stream\n", 100))), http.StatusBadRequest},
+		{"unknown format", httptest.NewRequest("POST", "/convert?format=txt", nil), http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		s.convert(w, c.req)
+		if w.Code != c.status {
+			t.Errorf("%s: status %d, want %d: %s", c.name, w.Code, c.status, w.Body.String())
+		}
+		if c.status == http.StatusMethodNotAllowed && w.Header().Get("Allow") != http.MethodPost {
+			t.Errorf("%s: Allow %q", c.name, w.Header().Get("Allow"))
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/aribcaption"
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+// Give up waiting for an SDT after this many packets once every PMT is known.
+const servicesScanLimit = 200000
+
+type serviceInfo struct {
+	ServiceID   int      `json:"service_id"`
+	ServiceType int      `json:"service_type"`
+	Provider    string   `json:"provider"`
+	Name        string   `json:"name"`
+	PmtPid      int      `json:"pmt_pid"`
+	Video       []string `json:"video"`
+	Audio       []string `json:"audio"`
+	Caption     bool     `json:"caption"`
+	Superimpose bool     `json:"superimpose"`
+}
+
+type serviceScanner struct {
+	demux   *tspacket.Demuxer
+	pmtPids map[int]int
+	streams map[int][]tspacket.ElementaryStream
+	sdt     map[int]sdtService
+	// sdtSections are the section_number received of SDT, up to
+	// last_section_number, as the services of a TS may not fit in one.
+	sdtSections []bool
+}
+
+func runServices(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("services", flag.ExitOnError)
+	jsonOutput := fs.Bool("json", false, "print services as JSON")
+	inputOpts := registerInputFlags(fs)
+	fs.Parse(args)
+
+	printServices(scanServices(ctx, fs.Arg(0), inputOpts), *jsonOutput)
+}
+
+// scanServices reads the input until the PAT, every PMT and the SDT are
+// found, or what was found until ctx is done.
+func scanServices(ctx context.Context, path string, opts *inputOptions) []serviceInfo {
+	fin, err := openInput(ctx, path, opts)
+	if err != nil {
+		panic(err)
+	}
+	defer fin.Close()
+
+	scanner := newServiceScanner()
+	if err := demuxInput(ctx, scanner.demux, fin); err != nil && ctx.Err() == nil {
+		panic(err)
+	}
+	return scanner.services()
+}
+
+func printServices(services []serviceInfo, jsonOutput bool) {
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(services); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE_ID\tPMT_PID\tTYPE\tPROVIDER\tNAME\tVIDEO\tAUDIO\tCAPTION\tSUPERIMPOSE")
+	for _, s := range services {
+		fmt.Fprintf(w, "%d\t0x%04x\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			s.ServiceID, s.PmtPid, serviceTypeName(s.ServiceType), orDash(s.Provider), orDash(s.Name),
+			orDash(strings.Join(s.Video, ",")), orDash(strings.Join(s.Audio, ",")),
+			yesNo(s.Caption), yesNo(s.Superimpose))
+	}
+	w.Flush()
+}
+
+func newServiceScanner() *serviceScanner {
+	s := &serviceScanner{
+		demux:   tspacket.NewDemuxer(nil),
+		streams: make(map[int][]tspacket.ElementaryStream),
+		sdt:     make(map[int]sdtService),
+	}
+	s.handleSections(0x0000)
+	s.handleSections(0x0011)
+	s.demux.HandlePackets(func(tspacket.Packet) {
+		if s.done() {
+			s.demux.Stop()
+		}
+	})
+	return s
+}
+
+func (s *serviceScanner) handleSections(pid int) {
+	s.demux.HandleSections(pid, func(section []byte) {
+		if tspacket.CRC32(section) == 0 {
+			s.handleSection(pid, section)
+		}
+	})
+}
+
+// done tells whether the PAT, every PMT and every section of the SDT have
+// been found, or servicesScanLimit packets have gone by without some of the
+// SDT.
+func (s *serviceScanner) done() bool {
+	if s.pmtPids == nil || len(s.streams) < len(s.pmtPids) {
+		return false
+	}
+	if s.sdtSections == nil {
+		return s.demux.Packets() >= servicesScanLimit
+	}
+	for _, received := range s.sdtSections {
+		if !received {
+			return s.demux.Packets() >= servicesScanLimit
+		}
+	}
+	return true
+}
+
+func (s *serviceScanner) handleSection(pid int, section []byte) {
+	if pid == 0 {
+		if s.pmtPids == nil && section[0] == 0x00 {
+			s.pmtPids = tspacket.ParsePAT(section)
+			for pmtPid := range s.pmtPids {
+				s.handleSections(pmtPid)
+			}
+		}
+	} else if pid == 0x0011 {
+		// [B10] 5.2.6 SDT of the actual TS
+		if section[0] != 0x42 || len(section) < 11 {
+			return
+		}
+		section_number, last_section_number := int(section[6]), int(section[7])
+		if s.sdtSections == nil {
+			s.sdtSections = make([]bool, last_section_number+1)
+		}
+		if section_number >= len(s.sdtSections) || s.sdtSections[section_number] {
+			return
+		}
+		s.sdtSections[section_number] = true
+		for service_id, service := range extractServices(section) {
+			s.sdt[service_id] = service
+		}
+	} else if program_number, ok := s.pmtPids[pid]; ok {
+		if _, ok := s.streams[program_number]; !ok && section[0] == 0x02 {
+			s.streams[program_number] = tspacket.ParsePMT(section)
+		}
+	}
+}
+
+// sdtService is what the service descriptor of SDT tells of a service.
+type sdtService struct {
+	serviceType int
+	provider    string
+	name        string
+	// logoId is logo_id of the logo transmission descriptor, or -1.
+	logoId int
+}
+
+// extractServiceNames returns a map from service_id to service name.
+func extractServiceNames(payload []byte) map[int]string {
+	names := make(map[int]string)
+	for service_id, service := range extractServices(payload) {
+		names[service_id] = service.name
+	}
+	return names
+}
+
+// extractServices returns a map from service_id to the service descriptor
+// of the service.
+func extractServices(payload []byte) map[int]sdtService {
+	// [B10] 5.2.6 Service Description Table
+	services := make(map[int]sdtService)
+	if len(payload) < 11 {
+		return services
+	}
+	section_length := int(payload[1]&0x0F)<<8 | int(payload[2])
+	if 3+section_length > len(payload) {
+		return services
+	}
+	end := 3 + section_length - 4
+	index := 11
+	for index+5 <= end {
+		service_id := int(payload[index+0])<<8 | int(payload[index+1])
+		descriptors_loop_length := int(payload[index+3]&0x0F)<<8 | int(payload[index+4])
+		subIndex := index + 5
+		loopEnd := index + 5 + descriptors_loop_length
+		if loopEnd > end {
+			loopEnd = end
+		}
+		logoId := -1
+		for subIndex+2 <= loopEnd {
+			descriptor_tag := payload[subIndex+0]
+			descriptor_length := int(payload[subIndex+1])
+			if subIndex+2+descriptor_length > loopEnd {
+				break
+			}
+			d := payload[subIndex+2 : subIndex+2+descriptor_length]
+			if descriptor_tag == 0x48 && len(d) >= 3 {
+				// [B10] 6.2.13 Service descriptor
+				service := sdtService{serviceType: int(d[0])}
+				service_provider_name_length := int(d[1])
+				if 2+service_provider_name_length < len(d) {
+					service.provider = aribcaption.DecodeSIString(d[2 : 2+service_provider_name_length])
+					d = d[2+service_provider_name_length:]
+					if service_name_length := int(d[0]); 1+service_name_length <= len(d) {
+						service.name = aribcaption.DecodeSIString(d[1 : 1+service_name_length])
+						services[service_id] = service
+					}
+				}
+			} else if descriptor_tag == 0xCF && len(d) >= 3 && (d[0] == 0x01 || d[0] == 0x02) {
+				// [B10] Logo transmission descriptor, of logo_transmission_type
+				// 1 or 2, which both have logo_id
+				logoId = int(d[1]&0x01)<<8 | int(d[2])
+			}
+			subIndex += 2 + descriptor_length
+		}
+		if service, ok := services[service_id]; ok {
+			service.logoId = logoId
+			services[service_id] = service
+		}
+		index += 5 + descriptors_loop_length
+	}
+	return services
+}
+
+func (s *serviceScanner) services() []serviceInfo {
+	var services []serviceInfo
+	for pmtPid, program_number := range s.pmtPids {
+		sdt := s.sdt[program_number]
+		info := serviceInfo{
+			ServiceID:   program_number,
+			ServiceType: sdt.serviceType,
+			Provider:    sdt.provider,
+			Name:        sdt.name,
+			PmtPid:      pmtPid,
+			Video:       []string{},
+			Audio:       []string{},
+		}
+		for _, es := range s.streams[program_number] {
+			if isVideoStreamType(es.StreamType) {
+				info.Video = append(info.Video, streamTypeName(es.StreamType))
+			} else if isAudioStreamType(es.StreamType) {
+				info.Audio = append(info.Audio, streamTypeName(es.StreamType))
+			} else if es.StreamType == 0x06 {
+				switch {
+				case es.ComponentTag == 0x87, es.ComponentTag == 0x88, es.DataComponentID == aribcaption.DataComponentMobileCaption:
+					info.Caption = true
+				case es.ComponentTag == 0x89, es.ComponentTag == 0x8a:
+					info.Superimpose = true
+				}
+			}
+		}
+		services = append(services, info)
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].ServiceID < services[j].ServiceID
+	})
+	return services
+}
+
+func isVideoStreamType(stream_type byte) bool {
+	switch stream_type {
+	case 0x01, 0x02, 0x1b, 0x24:
+		return true
+	default:
+		return false
+	}
+}
+
+func isAudioStreamType(stream_type byte) bool {
+	switch stream_type {
+	case 0x03, 0x04, 0x0f, 0x11:
+		return true
+	default:
+		return false
+	}
+}
+
+func streamTypeName(stream_type byte) string {
+	// [ISO] Table 2-34
+	switch stream_type {
+	case 0x01:
+		return "MPEG-1"
+	case 0x02:
+		return "MPEG-2"
+	case 0x03:
+		return "MPEG-1 Audio"
+	case 0x04:
+		return "MPEG-2 Audio"
+	case 0x0f:
+		return "AAC"
+	case 0x11:
+		return "AAC-LATM"
+	case 0x1b:
+		return "H.264"
+	case 0x24:
+		return "H.265"
+	default:
+		return fmt.Sprintf("0x%02x", stream_type)
+	}
+}
+
+func serviceTypeName(service_type int) string {
+	// [B10] 6.2.13 service_type
+	switch service_type {
+	case 0:
+		// No SDT
+		return "-"
+	case 0x01:
+		return "TV"
+	case 0x02:
+		return "Radio"
+	case 0xA1:
+		return "Temporary TV"
+	case 0xA2:
+		return "Temporary radio"
+	case 0xA3:
+		return "Temporary data"
+	case 0xA4:
+		return "Engineering"
+	case 0xA5:
+		return "Promotion TV"
+	case 0xA6:
+		return "Promotion radio"
+	case 0xA7:
+		return "Promotion data"
+	case 0xA8:
+		return "Pre-accumulation data"
+	case 0xA9:
+		return "Accumulation data"
+	case 0xAA:
+		return "Bookmark list data"
+	case 0xAD:
+		return "UHD TV"
+	case 0xC0:
+		return "Data"
+	default:
+		return fmt.Sprintf("0x%02x", service_type)
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tsgen"
+)
+
+// TestServices scans a generated stream carrying SDT for its service, with
+// the type, provider and name of SDT and the streams of PMT.
+func TestServices(t *testing.T) {
+	ts := insertPackets(generateTS(t, `@start 2024-04-01T21:00:00+09:00
+1s	字幕
+2s
+`), sectionPacket(0x0011, 0, sdtSection(t, 0x01, "放送局", "テスト")))
+	path := filepath.Join(t.TempDir(), "services.ts")
+	if err := os.WriteFile(path, ts, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	services := scanServices(context.Background(), path, &inputOptions{readBuffer: 1024 * 1024})
+	if len(services) != 1 {
+		t.Fatalf("services = %+v", services)
+	}
+	s := services[0]
+	if s.ServiceID != tsgen.ProgramNumber || s.PmtPid != tsgen.PMTPID {
+		t.Errorf("service %d of PMT 0x%x", s.ServiceID, s.PmtPid)
+	}
+	if serviceTypeName(s.ServiceType) != "TV" || s.Provider != "放送局" || s.Name != "テスト" {
+		t.Errorf("service of type 0x%02x, provider %q and name %q", s.ServiceType, s.Provider, s.Name)
+	}
+	if !s.Caption || s.Superimpose || len(s.Video) != 0 || len(s.Audio) != 0 {
+		t.Errorf("streams = %+v", s)
+	}
+}
+
+// TestServicesSDTSections waits for every section of an SDT whose services
+// are split in two.
+func TestServicesSDTSections(t *testing.T) {
+	pat := []byte{0x00, 0xb0, 0x00, 0x00, 0x01, 0xc1, 0x00, 0x00, 0x00, 0x01, 0xe1, 0xf0}
+	pmt := []byte{
+		0x02, 0xb0, 0x00, 0x00, 0x01, 0xc1, 0x00, 0x00, 0xe1, 0x00, 0xf0, 0x00,
+		0x06, 0xe1, 0x30, 0xf0, 0x03, 0x52, 0x01, 0x87,
+	}
+	sdt := func(section_number, service_id int, name string) []byte {
+		section := sdtSection(t, 0x01, "放送局", name)
+		// section_number and last_section_number
+		section[6], section[7] = byte(section_number), 1
+		section[11], section[12] = byte(service_id>>8), byte(service_id)
+		return section
+	}
+	s := newServiceScanner()
+	s.demux.Push(sectionPacket(0x0000, 0, pat))
+	s.demux.Push(sectionPacket(0x01f0, 0, pmt))
+	s.demux.Push(sectionPacket(0x0011, 0, sdt(0, 1, "一")))
+	if s.done() {
+		t.Error("done with the first section of SDT")
+	}
+	s.demux.Push(sectionPacket(0x0011, 1, sdt(1, 2, "二")))
+	if !s.done() {
+		t.Error("not done with every section of SDT")
+	}
+	if len(s.sdt) != 2 || s.sdt[1].name != "一" || s.sdt[2].name != "二" {
+		t.Errorf("SDT = %+v", s.sdt)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/aribcaption"
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+// splitPiece is the TS and the subtitles of one program of a recording that
+// spans several.
+type splitPiece struct {
+	eventId  int
+	ts       *atomicFile
+	out      *bufio.Writer
+	subs     *atomicFile
+	renderer *assRenderer
+	namer    *outputNamer
+}
+
+// tsSplitter cuts a recording where the present event of EIT[p/f] of the
+// service changes, which is a few seconds off the actual boundary at worst
+// since broadcasters update EIT[p/f] as the program changes. EIT is read
+// apart from the analyzer, whose ProgramStatus misses an event turning
+// present when running_status is left undefined.
+type tsSplitter struct {
+	state  *AnalyzerState
+	dir    string
+	format string
+	piece  *splitPiece
+	// sdt and clock are the events a new piece starts with: SDT to name
+	// the files, and the last TOT with the discontinuities after it to
+	// time the captions before the next TOT.
+	sdt   Event
+	clock []Event
+}
+
+func runSplit(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("split", flag.ExitOnError)
+	outputDir := fs.String("o", ".", "write the pieces to `DIR`")
+	serviceId := fs.Int("service", -1, "follow EIT of the program whose program_number (service_id) is `N` instead of the first one")
+	format := fs.String("format", "ass", "write the captions as `FORMAT`: "+strings.Join(formatNames(), ", "))
+	inputOpts := registerInputFlags(fs)
+	fs.Parse(args)
+	if err := checkFormat(*format); err != nil {
+		fmt.Fprintf(os.Stderr, "-format: %v\n", err)
+		os.Exit(2)
+	}
+	if info, err := os.Stat(*outputDir); err != nil || !info.IsDir() {
+		fmt.Fprintf(os.Stderr, "-o %s is not a directory\n", *outputDir)
+		os.Exit(2)
+	}
+
+	fin, err := openInput(ctx, fs.Arg(0), inputOpts)
+	if err != nil {
+		panic(err)
+	}
+	defer fin.Close()
+
+	s := newTSSplitter(*outputDir, *format, *serviceId)
+	if err := s.split(ctx, fin); err != nil && ctx.Err() == nil {
+		panic(err)
+	}
+}
+
+func newTSSplitter(dir, format string, serviceId int) *tsSplitter {
+	state := newAnalyzerState()
+	state.gaiji = aribcaption.DefaultGaijiMap()
+	state.caption.session.Decoder.Gaiji = state.gaiji
+	state.serviceId = serviceId
+	s := &tsSplitter{state: state, dir: dir, format: format}
+	state.emit = s.handle
+	state.demux.HandleSections(0x0012, func(section []byte) {
+		handleSection(0x0012, pidEIT, section, state)
+		s.handleEIT(section)
+	})
+	state.demux.HandlePackets(func(packet tspacket.Packet) {
+		if _, err := s.piece.out.Write(packet); err != nil {
+			panic(err)
+		}
+	})
+	return s
+}
+
+// split writes the pieces of the TS read from r. What was read until an
+// error or until ctx is done is written as well.
+func (s *tsSplitter) split(ctx context.Context, r io.Reader) error {
+	s.start(-1)
+	defer func() {
+		if s.piece != nil {
+			s.piece.ts.Abort()
+			s.piece.subs.Abort()
+		}
+	}()
+	err := demuxInput(ctx, s.state.demux, r)
+	if stream := s.state.caption; len(stream.payload) != 0 {
+		dumpCaption(stream.payload, stream, s.state)
+	}
+	s.finish()
+	return err
+}
+
+// start opens the files of a new piece, named once it's finished.
+func (s *tsSplitter) start(eventId int) {
+	ts, err := createAtomicFile(filepath.Join(s.dir, "assdumper.ts"))
+	if err != nil {
+		panic(err)
+	}
+	subs, err := createAtomicFile(filepath.Join(s.dir, "assdumper."+s.format))
+	if err != nil {
+		ts.Abort()
+		panic(err)
+	}
+	r := newFormatRenderer(subs, s.format)
+	if s.format == "ssa" {
+		r = newSSARenderer(subs)
+	}
+	p := &splitPiece{
+		eventId:  eventId,
+		ts:       ts,
+		out:      bufio.NewWriter(ts),
+		subs:     subs,
+		renderer: r,
+		namer:    &outputNamer{extension: ".ts"},
+	}
+	if s.sdt != nil {
+		p.renderer.handle(s.sdt)
+		p.namer.handle(s.sdt)
+	}
+	for _, ev := range s.clock {
+		p.renderer.handle(ev)
+	}
+	s.piece = p
+}
+
+// finish ends the captions of the piece at the current PCR and commits its
+// files. The subtitles are left out when the piece has no captions.
+func (s *tsSplitter) finish() {
+	p := s.piece
+	s.piece = nil
+	if s.state.currentTimestamp != 0 {
+		p.renderer.handleCaption(CaptionUnit{PCR: s.state.currentTimestamp, Text: "\f", Confidence: 1})
+	}
+	if err := p.out.Flush(); err != nil {
+		panic(err)
+	}
+	name := p.namer.name("")
+	p.ts.path = filepath.Join(s.dir, name)
+	if err := p.ts.Commit(); err != nil {
+		panic(err)
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %s\n", p.ts.path)
+	if !p.renderer.preludePrinted {
+		p.subs.Abort()
+		return
+	}
+	if err := p.renderer.Flush(); err != nil {
+		panic(err)
+	}
+	p.subs.path = filepath.Join(s.dir, strings.TrimSuffix(name, ".ts")+"."+s.format)
+	if err := p.subs.Commit(); err != nil {
+		panic(err)
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %s\n", p.subs.path)
+}
+
+// handle renders the events of the analyzer into the current piece.
+func (s *tsSplitter) handle(ev Event) {
+	switch ev := ev.(type) {
+	case ClockAnchor:
+		s.clock = append(s.clock[:0], ev)
+	case ClockDiscontinuity:
+		s.clock = append(s.clock, ev)
+	case TableChange:
+		if ev.Table == "SDT" {
+			s.sdt = ev
+			s.piece.namer.handle(ev)
+		}
+	}
+	s.piece.renderer.handle(ev)
+}
+
+// handleEIT cuts the recording when the present event of EIT[p/f actual] of
+// the service changes.
+func (s *tsSplitter) handleEIT(section []byte) {
+	if section[0] != 0x4E || tspacket.CRC32(section) != 0 {
+		return
+	}
+	service_id, section_number, events, ok := extractEitEvents(section)
+	if !ok || section_number != 0 || len(events) == 0 || service_id != s.state.programNumber {
+		return
+	}
+	ev := events[0]
+	switch s.piece.eventId {
+	case ev.eventId:
+		return
+	case -1:
+		// The program the recording starts in
+		s.piece.eventId = ev.eventId
+	default:
+		s.flushCaption()
+		s.finish()
+		s.start(ev.eventId)
+	}
+	s.piece.namer.handle(ProgramStatus{
+		Present:       true,
+		EventId:       ev.eventId,
+		RunningStatus: ev.runningStatus,
+		StartTime:     ev.startTime,
+		Duration:      ev.duration,
+		Title:         ev.title,
+	})
+}
+
+// flushCaption decodes the caption PES that the analyzer holds until the next
+// one starts, once all of its PES_packet_length has arrived, so that the
+// caption goes to the piece it was sent in.
+func (s *tsSplitter) flushCaption() {
+	stream := s.state.caption
+	if len(stream.payload) < 6 {
+		return
+	}
+	PES_packet_length := int(stream.payload[4])<<8 | int(stream.payload[5])
+	if PES_packet_length != 0 && len(stream.payload) >= 6+PES_packet_length {
+		dumpCaption(stream.payload, stream, s.state)
+		stream.payload = stream.payload[:0]
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tsgen"
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+// TestSplit cuts a stream whose present event changes at 5s into two
+// pieces, each with the caption shown in it.
+func TestSplit(t *testing.T) {
+	script, err := tsgen.ParseScript(strings.NewReader(`@start 2021-12-01T20:59:58+09:00
+1s	あ
+7s	い
+8s
+@duration 9s
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var generated bytes.Buffer
+	if err := tsgen.Write(&generated, script); err != nil {
+		t.Fatal(err)
+	}
+	eit := func(event_id, hour byte, title byte) []byte {
+		return []byte{
+			0x4e, 0xf0, 0x00, 0x04, 0x00, 0xc1, 0x00, 0x01,
+			0x00, 0x01, 0x00, 0x04, 0x01, 0x4e,
+			// event_id at 2021-12-01 hour:00:00 for 01:00:00, running
+			0x00, event_id, 0xe8, 0x9d, hour, 0x00, 0x00, 0x01, 0x00, 0x00, 0x80, 0x09,
+			// Short event descriptor of the title, a kana
+			0x4d, 0x07, 'j', 'p', 'n', 0x02, 0x24, title, 0x00,
+		}
+	}
+
+	var ts bytes.Buffer
+	packets := generated.Bytes()
+	inserted := 0
+	for i := 0; i+tspacket.Size <= len(packets); i += tspacket.Size {
+		packet := tspacket.Packet(packets[i : i+tspacket.Size])
+		if field, _, _ := packet.AdaptationField(); inserted == 1 && tspacket.HasPCR(field) && tspacket.PCR(field) >= (10+5)*27000000 {
+			ts.Write(sectionPacket(0x0012, 1, eit(2, 0x21, 0x24)))
+			inserted++
+		}
+		ts.Write(packet)
+		if packet.PID() == tsgen.PMTPID && inserted == 0 {
+			ts.Write(sectionPacket(0x0012, 0, eit(1, 0x20, 0x22)))
+			inserted++
+		}
+	}
+
+	dir := t.TempDir()
+	s := newTSSplitter(dir, "ass", -1)
+	if err := s.split(context.Background(), &ts); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	want := []string{
+		"20211201-2000_あ.ass", "20211201-2000_あ.ts",
+		"20211201-2100_い.ass", "20211201-2100_い.ts",
+	}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Fatalf("files = %v, want %v", names, want)
+	}
+	for i, text := range []string{",Default,,,,,,あ\n", ",Default,,,,,,い\n"} {
+		ass, err := os.ReadFile(filepath.Join(dir, want[i*2]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(ass, []byte(text)) || bytes.Count(ass, []byte("Dialogue:")) != 1 {
+			t.Errorf("%s = %s", want[i*2], ass)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+// pidStats counts the packets of a PID the way tsselect does, to check the
+// quality of a recording before archiving it.
+type pidStats struct {
+	PID   int    `json:"pid"`
+	Label string `json:"label"`
+	// Packets are all the packets of the PID, and Drops the gaps of
+	// continuity_counter, skipping the duplicates that [ISO] allows.
+	Packets int64 `json:"packets"`
+	Drops   int   `json:"drops"`
+	// Errors are the packets with transport_error_indicator, which aren't
+	// checked for continuity, and Scrambled those with
+	// transport_scrambling_control.
+	Errors    int64 `json:"errors"`
+	Scrambled int64 `json:"scrambled"`
+
+	continuity int
+}
+
+type statsCollector struct {
+	demux  *tspacket.Demuxer
+	pids   map[int]*pidStats
+	pidMap *pidMap
+}
+
+func runStats(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	jsonOutput := fs.Bool("json", false, "print the statistics as JSON")
+	inputOpts := registerInputFlags(fs)
+	fs.Parse(args)
+
+	fin, err := openInput(ctx, fs.Arg(0), inputOpts)
+	if err != nil {
+		panic(err)
+	}
+	defer fin.Close()
+	c := newStatsCollector()
+	if err := demuxInput(ctx, c.demux, fin); err != nil && ctx.Err() == nil {
+		panic(err)
+	}
+	stats := c.stats()
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(stats); err != nil {
+			panic(err)
+		}
+		return
+	}
+	var total pidStats
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "PID\tTYPE\tPACKETS\tDROPS\tERRORS\tSCRAMBLED\t")
+	for _, s := range stats {
+		fmt.Fprintf(w, "0x%04x\t%s\t%d\t%d\t%d\t%d\t\n", s.PID, s.Label, s.Packets, s.Drops, s.Errors, s.Scrambled)
+		total.Packets += s.Packets
+		total.Drops += s.Drops
+		total.Errors += s.Errors
+		total.Scrambled += s.Scrambled
+	}
+	fmt.Fprintf(w, "total\t\t%d\t%d\t%d\t%d\t\n", total.Packets, total.Drops, total.Errors, total.Scrambled)
+	w.Flush()
+}
+
+func newStatsCollector() *statsCollector {
+	demux := tspacket.NewDemuxer(nil)
+	c := &statsCollector{demux: demux, pids: make(map[int]*pidStats), pidMap: newPIDMap(demux)}
+	demux.HandlePackets(c.count)
+	return c
+}
+
+// count counts every packet of the input, the duplicates and those with
+// transport_error_indicator that Demuxer drops as well.
+func (c *statsCollector) count(packet tspacket.Packet) {
+	pid := packet.PID()
+	s, ok := c.pids[pid]
+	if !ok {
+		s = &pidStats{PID: pid, continuity: -1}
+		c.pids[pid] = s
+	}
+	s.Packets++
+	if packet.TransportError() {
+		s.Errors++
+		return
+	}
+	if packet.Scrambled() {
+		s.Scrambled++
+	}
+	// [ISO] 2.4.3.3 continuity_counter, as Demuxer checks it
+	field, _, _ := packet.AdaptationField()
+	if !packet.HasPayload() || pid == tspacket.NullPID {
+		return
+	}
+	continuity_counter := packet.ContinuityCounter()
+	if s.continuity != -1 && !tspacket.Discontinuity(field) {
+		if continuity_counter == s.continuity {
+			return
+		}
+		if continuity_counter != (s.continuity+1)&0x0f {
+			s.Drops++
+		}
+	}
+	s.continuity = continuity_counter
+}
+
+// stats returns the statistics in the order of PID.
+func (c *statsCollector) stats() []*pidStats {
+	stats := []*pidStats{}
+	for pid, s := range c.pids {
+		s.Label = c.pidMap.label(pid)
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].PID < stats[j].PID
+	})
+	return stats
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tsgen"
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+// TestStats counts the packets of a generated stream, from which a packet of
+// PAT is dropped, one of PMT has transport_error_indicator set and one of
+// the caption ES is scrambled.
+func TestStats(t *testing.T) {
+	generated := generateTS(t, `@start 2024-04-01T21:00:00+09:00
+1s	字幕
+2s	もう一つ
+3s
+`)
+	var ts bytes.Buffer
+	counts := make(map[int]int64)
+	var dropped, errored, scrambled bool
+	for i := 0; i+tspacket.Size <= len(generated); i += tspacket.Size {
+		packet := append(tspacket.Packet(nil), generated[i:i+tspacket.Size]...)
+		pid := packet.PID()
+		switch {
+		case pid == 0x0000 && counts[pid] == 3 && !dropped:
+			dropped = true
+			continue
+		case pid == tsgen.PMTPID && counts[pid] == 3 && !errored:
+			errored = true
+			packet[1] |= 0x80
+		case pid == tsgen.CaptionPID && counts[pid] == 1 && !scrambled:
+			scrambled = true
+			packet[3] |= 0xc0
+		}
+		counts[pid]++
+		ts.Write(packet)
+	}
+
+	c := newStatsCollector()
+	if err := demuxInput(context.Background(), c.demux, &ts); err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]pidStats{
+		0x0000:           {Packets: counts[0x0000], Drops: 1},
+		tsgen.PCRPID:     {Packets: counts[tsgen.PCRPID]},
+		tsgen.CaptionPID: {Packets: counts[tsgen.CaptionPID], Scrambled: 1},
+		// The packet with the error isn't counted on for continuity,
+		// which makes the next one a drop.
+		tsgen.PMTPID: {Packets: counts[tsgen.PMTPID], Drops: 1, Errors: 1},
+		0x0014:       {Packets: counts[0x0014]},
+	}
+	stats := c.stats()
+	if len(stats) != len(want) {
+		t.Fatalf("stats = %+v", stats)
+	}
+	for i, s := range stats {
+		if i > 0 && s.PID <= stats[i-1].PID {
+			t.Errorf("PID 0x%x after 0x%x", s.PID, stats[i-1].PID)
+		}
+		w, ok := want[s.PID]
+		if !ok || s.Packets != w.Packets || s.Drops != w.Drops || s.Errors != w.Errors || s.Scrambled != w.Scrambled {
+			t.Errorf("PID 0x%x %s: %d packets, %d drops, %d errors and %d scrambled, want %+v", s.PID, s.Label, s.Packets, s.Drops, s.Errors, s.Scrambled, w)
+		}
+	}
+}
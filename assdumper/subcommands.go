@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// subcommand is a tool of its own that shares the packages of assdumper,
+// run as "assdumper NAME ARGS...". Converting captions stays the default,
+// so that the flags of assdumper aren't crowded with those of the others.
+type subcommand struct {
+	name    string
+	summary string
+	run     func(ctx context.Context, args []string)
+}
+
+var subcommands = []subcommand{
+	{"services", "list the services with their PIDs and whether they carry captions", runServices},
+	{"stats", "count the packets, drops, errors and scrambled packets of every PID, like tsselect", runStats},
+	{"bitrate", "print the average and peak bitrates of every PID and program, measured with PCR", runBitrate},
+	{"split", "cut the TS and its subtitles into a file per program where the present event of EIT changes", runSplit},
+	{"logo", "write the station logos of CDT as PNG, with the services of SDT that show them", runLogo},
+	{"carousel", "extract the modules of the data carousels of data broadcasting, BML documents and images, into a directory tree", runCarousel},
+	{"remux", "write a TS of a single program, its PMT, PCR, video, audio and caption PIDs under a rewritten PAT", runRemux},
+	{"clean-ts", "write a copy of the TS without null, error and scrambled packets, or the PIDs of other services", runCleanTS},
+	{"info", "print PAT and every PMT with the stream types, PIDs and decoded descriptors, and the resolution and frame rate of the video", runInfo},
+	{"audio", "list the audio streams of every program with their codecs, languages and whether they're dual mono", runAudio},
+	{"ca", "list the EMM PIDs of CAT and the ECM PIDs of every program with their CA systems, and whether the recording still needs descrambling", runCA},
+	{"nit", "show the network name and the transport streams of the NIT, with their frequencies and remote control keys", runNIT},
+	{"clock", "print every TOT and TDT with its byte offset and the PCR, to find out why subtitle times are shifted", runClock},
+	{"epg", "write the events of EIT p/f and schedule as JSON", runEPG},
+	{"drcs-label", "label DRCS glyphs in a web UI for -drcs-db", func(ctx context.Context, args []string) {
+		runDRCSLabel(args)
+	}},
+	{"tsgen", "write a TS with captions from a script, for tests", func(ctx context.Context, args []string) {
+		runTSGen(args)
+	}},
+	{"serve", "convert TS posted to /convert, or the stream at its ?url=, to subtitles over HTTP", runServe},
+	{"grpc", "serve the CaptionExtractor service of captions.proto over plaintext HTTP/2", runGRPC},
+	{"render-check", "compare the rendering of test captions with libass against reference images", func(ctx context.Context, args []string) {
+		runRenderCheck(args)
+	}},
+}
+
+// findSubcommand returns the subcommand named by the first argument, if any.
+func findSubcommand(args []string) *subcommand {
+	if len(args) == 0 {
+		return nil
+	}
+	for i := range subcommands {
+		if subcommands[i].name == args[0] {
+			return &subcommands[i]
+		}
+	}
+	return nil
+}
+
+func printSubcommands(w io.Writer, program string) {
+	fmt.Fprintln(w, "Subcommands, which take -h for their flags:")
+	for _, c := range subcommands {
+		fmt.Fprintf(w, "  %s %s\n    \t%s\n", program, c.name, c.summary)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+// Exit codes for wrapper scripts to branch on. 1 is a failure of anything
+// else, and 2 is a usage error (or a panic).
+const (
+	// exitNoCaptions is a run that went through but found no caption to
+	// write, e.g. a program without captions or the wrong -service.
+	exitNoCaptions = 3
+	// exitInputError is an input that couldn't be opened or read.
+	exitInputError = 4
+	// exitCorruptStream is an input that isn't a TS, or lost its packet
+	// alignment.
+	exitCorruptStream = 5
+)
+
+// runSummary is what -summary writes at the end of a run as JSON.
+type runSummary struct {
+	Inputs           []string `json:"inputs"`
+	ExitCode         int      `json:"exit_code"`
+	Error            string   `json:"error,omitempty"`
+	Captions         int      `json:"captions"`
+	Superimposes     int      `json:"superimposes"`
+	Packets          int64    `json:"packets"`
+	ContinuityErrors int      `json:"continuity_errors"`
+	Duplicates       int      `json:"duplicates"`
+	ScrambledPackets int64    `json:"scrambled_packets"`
+	SectionCRCErrors int      `json:"section_crc_errors"`
+	CaptionCRCErrors int      `json:"caption_crc_errors"`
+	UnhandledCodes   int      `json:"unhandled_codes"`
+	EmptyPES         int      `json:"empty_pes"`
+	Retransmissions  int      `json:"retransmissions"`
+}
+
+// handle counts the caption statements with any text, of the captions of
+// either language and of superimpose.
+func (s *runSummary) handle(ev Event) {
+	unit, ok := ev.(CaptionUnit)
+	if !ok || isBlank(strings.Replace(unit.Text, "\f", "", -1)) {
+		return
+	}
+	if unit.Track == "superimpose" {
+		s.Superimposes++
+	} else {
+		s.Captions++
+	}
+}
+
+// finish fills in the counters of state and the outcome of the run, which
+// is err of reading the inputs or nil, and returns the exit code.
+func (s *runSummary) finish(state *AnalyzerState, err error) int {
+	s.Packets = state.demux.Packets()
+	s.ContinuityErrors = state.demux.ContinuityErrors()
+	s.Duplicates = state.demux.Duplicates()
+	s.ScrambledPackets = state.demux.ScrambledPackets()
+	s.SectionCRCErrors = state.crcErrors
+	s.CaptionCRCErrors = state.captionCRCErrors
+	s.UnhandledCodes = state.unhandledCodes
+	s.EmptyPES = state.emptyPes
+	s.Retransmissions = state.retransmissions
+	switch {
+	case errors.Is(err, tspacket.ErrSync):
+		s.ExitCode = exitCorruptStream
+	case err != nil:
+		s.ExitCode = exitInputError
+	case s.Captions == 0 && s.Superimposes == 0:
+		s.ExitCode = exitNoCaptions
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	return s.ExitCode
+}
+
+func writeSummary(path string, s *runSummary) error {
+	f, err := createAtomicFile(path)
+	if err != nil {
+		return err
+	}
+	defer f.Abort()
+	enc := json.NewEncoder(f)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(s); err != nil {
+		return err
+	}
+	return f.Commit()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// TestSummary analyzes generated streams, and broken ones, and expects the
+// exit code and the counters of -summary.
+func TestSummary(t *testing.T) {
+	captions := generateTS(t, `@start 2024-04-01T21:00:00+09:00
+1s	字幕
+2s	もう一つ
+3s
+`)
+	silent := generateTS(t, `@start 2024-04-01T21:00:00+09:00
+@duration 3s
+`)
+	cases := []struct {
+		name     string
+		in       io.Reader
+		exitCode int
+		captions int
+	}{
+		{"captions", bytes.NewReader(captions), 0, 2},
+		{"no captions", bytes.NewReader(silent), exitNoCaptions, 0},
+		{"not TS", strings.NewReader(strings.Repeat("not a transport stream\n", 100)), exitCorruptStream, 0},
+		{"read error", io.MultiReader(bytes.NewReader(captions[:len(captions)/2]), iotest.ErrReader(errors.New("disk error"))), exitInputError, 1},
+	}
+	for _, c := range cases {
+		summary := &runSummary{Inputs: []string{c.name}}
+		state := newAnalyzerState()
+		state.emit = summary.handle
+		err := analyzeStream(context.Background(), io.NopCloser(c.in), state)
+		if exitCode := summary.finish(state, err); exitCode != c.exitCode {
+			t.Errorf("%s: exit code %d, want %d (%v)", c.name, exitCode, c.exitCode, err)
+		}
+		if summary.Captions != c.captions {
+			t.Errorf("%s: %d captions, want %d", c.name, summary.Captions, c.captions)
+		}
+		if (summary.Error != "") != (c.exitCode == exitInputError || c.exitCode == exitCorruptStream) {
+			t.Errorf("%s: error %q", c.name, summary.Error)
+		}
+
+		path := filepath.Join(t.TempDir(), "summary.json")
+		if err := writeSummary(path, summary); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var written runSummary
+		if err := json.Unmarshal(b, &written); err != nil {
+			t.Fatalf("%s: %v:\n%s", c.name, err, b)
+		}
+		if written.ExitCode != c.exitCode || written.Captions != c.captions || written.Packets != summary.Packets {
+			t.Errorf("%s: wrote\n%s", c.name, b)
+		}
+	}
+}
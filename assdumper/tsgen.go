@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tsgen"
+)
+
+// runTSGen writes a TS with the captions of a script, for reproducing
+// problems and making test inputs without broadcast recordings.
+func runTSGen(args []string) {
+	fs := flag.NewFlagSet("tsgen", flag.ExitOnError)
+	outputPath := fs.String("o", "", "write the TS to `FILE` instead of stdout")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: assdumper tsgen [-o FILE] SCRIPT")
+		os.Exit(2)
+	}
+
+	fin, err := os.Open(fs.Arg(0))
+	if err != nil {
+		panic(err)
+	}
+	script, err := tsgen.ParseScript(fin)
+	fin.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", fs.Arg(0), err)
+		os.Exit(1)
+	}
+
+	var w io.Writer = os.Stdout
+	var fout *atomicFile
+	if *outputPath != "" {
+		fout, err = createAtomicFile(*outputPath)
+		if err != nil {
+			panic(err)
+		}
+		defer fout.Abort()
+		w = fout
+	}
+	if err := tsgen.Write(w, script); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", fs.Arg(0), err)
+		os.Exit(1)
+	}
+	if fout != nil {
+		if err := fout.Commit(); err != nil {
+			panic(err)
+		}
+	}
+}
@@ -0,0 +1,400 @@
+// Package tsgen writes minimal transport streams with ARIB captions from a
+// script of captions and their times: one program of PAT, PMT, PCR, TOT and
+// a caption ES, without video or audio. They reproduce what the decoder
+// does with a caption without sharing a broadcast recording, and make the
+// inputs of golden tests.
+package tsgen
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/aribcaption"
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+// PIDs and program_number of the stream
+const (
+	PMTPID        = 0x1f0
+	PCRPID        = 0x100
+	CaptionPID    = 0x130
+	ProgramNumber = 0x400
+)
+
+const (
+	// The interval of PCR, and of the captions sent on it
+	tick = 100 * time.Millisecond
+	// PAT and PMT are sent every 500ms, TOT and caption management data
+	// every 5s, at least as often as ARIB TR-B14 wants them.
+	psiInterval        = 5
+	totInterval        = 50
+	managementInterval = 50
+	// The PCR of the start of the stream. Readers take PCR 0 for not yet
+	// seen.
+	firstPCR = 10 * 27000000
+)
+
+// Cue is a caption of a script.
+type Cue struct {
+	// Time is the time from the start of the stream.
+	Time time.Duration
+	// Text is the caption, which replaces the one on the screen. An empty
+	// Text erases the screen.
+	Text string
+}
+
+// ClockReset is where the time base of the stream restarts, as at the
+// boundary of two recordings.
+type ClockReset struct {
+	// Time is the time from the start of the stream.
+	Time time.Duration
+	// PCR is the PCR in 27MHz at Time, from which PCR and PTS go on.
+	PCR int64
+}
+
+// Script is what Write makes a stream of.
+type Script struct {
+	// Start is JST_time of the first TOT, truncated to seconds.
+	Start time.Time
+	// Duration is the length of the stream, or one second after the last
+	// cue when it's 0.
+	Duration time.Duration
+	// Cues are sorted by Time.
+	Cues []Cue
+	// ClockResets are sorted by Time. PCR starts from 10 seconds unless
+	// one of them is at 0.
+	ClockResets []ClockReset
+}
+
+// ParseScript reads a script of lines of a duration from the start and the
+// caption then, separated by a tab or spaces, like
+//
+//	@start 2024-04-01T21:00:00+09:00
+//	1s	こんにちは
+//	3.5s	二行目は\n改行で
+//	5s
+//
+// A line without a caption erases the screen, and \n in a caption is a line
+// break. "@start TIME" sets Start in RFC 3339, "@duration DURATION" sets
+// Duration, and "@pcr DURATION PCR" adds a ClockReset to PCR in 27MHz at
+// DURATION. Lines starting with # are comments.
+func ParseScript(r io.Reader) (*Script, error) {
+	s := &Script{Start: time.Date(2000, time.January, 1, 0, 0, 0, 0, time.FixedZone("JST", 9*60*60))}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		field, rest := strings.TrimLeft(line, " \t"), ""
+		if i := strings.IndexAny(field, " \t"); i != -1 {
+			field, rest = field[:i], strings.TrimLeft(field[i+1:], " \t")
+		}
+		switch field {
+		case "@start":
+			t, err := time.Parse(time.RFC3339, rest)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			s.Start = t
+		case "@duration":
+			d, err := time.ParseDuration(rest)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			s.Duration = d
+		case "@pcr":
+			at, pcr, _ := strings.Cut(rest, " ")
+			d, err := time.ParseDuration(at)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			reset := ClockReset{Time: d}
+			if _, err := fmt.Sscan(pcr, &reset.PCR); err != nil {
+				return nil, fmt.Errorf("line %d: PCR: %v", n, err)
+			}
+			if len(s.ClockResets) != 0 && d < s.ClockResets[len(s.ClockResets)-1].Time {
+				return nil, fmt.Errorf("line %d: %s is before the previous @pcr", n, at)
+			}
+			s.ClockResets = append(s.ClockResets, reset)
+		default:
+			d, err := time.ParseDuration(field)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			if len(s.Cues) != 0 && d < s.Cues[len(s.Cues)-1].Time {
+				return nil, fmt.Errorf("line %d: %s is before the previous caption", n, field)
+			}
+			s.Cues = append(s.Cues, Cue{Time: d, Text: strings.ReplaceAll(rest, `\n`, "\n")})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Write writes the stream of s to w in 188-byte packets. It fails on a
+// caption Encode can't encode, before writing anything.
+func Write(w io.Writer, s *Script) error {
+	statements := make([][]byte, len(s.Cues))
+	for i, cue := range s.Cues {
+		text, err := aribcaption.Encode(cue.Text)
+		if err != nil {
+			return fmt.Errorf("caption at %v: %v", cue.Time, err)
+		}
+		// CS
+		statements[i] = append([]byte{0x0c}, text...)
+	}
+	duration := s.Duration
+	if duration == 0 && len(s.Cues) != 0 {
+		duration = s.Cues[len(s.Cues)-1].Time + time.Second
+	}
+
+	bw := bufio.NewWriter(w)
+	g := &generator{w: bw, counters: make(map[int]byte)}
+	start := s.Start.Truncate(time.Second)
+	next := 0
+	for i := 0; time.Duration(i)*tick <= duration; i++ {
+		t := time.Duration(i) * tick
+		pcr := s.systemClock(t)
+		if i%psiInterval == 0 {
+			g.section(0x0000, pat())
+			g.section(PMTPID, pmt())
+		}
+		g.pcr(pcr)
+		if i%totInterval == 0 {
+			g.section(0x0014, tot(start.Add(t)))
+		}
+		if i%managementInterval == 0 {
+			g.pes(CaptionPID, captionPES(pcr/300, dataGroup(0x00, managementData())))
+		}
+		for ; next < len(s.Cues) && s.Cues[next].Time < t+tick; next++ {
+			pts := s.systemClock(s.Cues[next].Time) / 300
+			g.pes(CaptionPID, captionPES(pts, dataGroup(0x01, statementData(statements[next]))))
+		}
+	}
+	if g.err != nil {
+		return g.err
+	}
+	return bw.Flush()
+}
+
+// systemClock returns the PCR in 27MHz at t from the start, counted from the
+// last ClockReset before t. It wraps around as PCR does.
+func (s *Script) systemClock(t time.Duration) int64 {
+	reset := ClockReset{PCR: firstPCR}
+	for _, r := range s.ClockResets {
+		if r.Time <= t {
+			reset = r
+		}
+	}
+	t -= reset.Time
+	return (reset.PCR + int64(t/time.Second)*27000000 + int64(t%time.Second)*27/1000) % tspacket.PCRWrap
+}
+
+// generator writes TS packets, keeping continuity_counter of each PID.
+type generator struct {
+	w        io.Writer
+	counters map[int]byte
+	err      error
+}
+
+func (g *generator) write(packet []byte) {
+	if g.err == nil {
+		_, g.err = g.w.Write(packet)
+	}
+}
+
+// payload writes payload in packets of pid. The last packet is filled with
+// 0xff after the payload for sections, and with stuffing bytes of the
+// adaptation field for PES, whose payload has to end with the packet.
+// [ISO] 2.4.3.2, 2.4.3.5
+func (g *generator) payload(pid int, payload []byte, sectionStuffing bool) {
+	for start := true; start || len(payload) != 0; start = false {
+		packet := make([]byte, 4, tspacket.Size)
+		packet[0] = tspacket.SyncByte
+		packet[1] = byte(pid >> 8)
+		if start {
+			// payload_unit_start_indicator
+			packet[1] |= 0x40
+		}
+		packet[2] = byte(pid)
+		packet[3] = 0x10 | g.counters[pid]
+		g.counters[pid] = (g.counters[pid] + 1) & 0x0f
+		n := len(payload)
+		if n > tspacket.Size-4 {
+			n = tspacket.Size - 4
+		}
+		if stuffing := tspacket.Size - 4 - n; stuffing != 0 && !sectionStuffing {
+			// adaptation_field_control 11
+			packet[3] |= 0x20
+			packet = append(packet, byte(stuffing-1))
+			if stuffing > 1 {
+				packet = append(packet, 0x00)
+			}
+			for len(packet) < tspacket.Size-n {
+				packet = append(packet, 0xff)
+			}
+		}
+		packet = append(packet, payload[:n]...)
+		payload = payload[n:]
+		for len(packet) < tspacket.Size {
+			packet = append(packet, 0xff)
+		}
+		g.write(packet)
+	}
+}
+
+// section writes a PSI section starting in a packet of its own.
+func (g *generator) section(pid int, section []byte) {
+	// pointer_field
+	g.payload(pid, append([]byte{0x00}, section...), true)
+}
+
+func (g *generator) pes(pid int, pes []byte) {
+	g.payload(pid, pes, false)
+}
+
+// pcr writes a packet of PCRPID with only the adaptation field carrying pcr
+// in 27MHz.
+// [ISO] 2.4.3.4, 2.4.3.5
+func (g *generator) pcr(pcr int64) {
+	base, extension := pcr/300, pcr%300
+	packet := []byte{
+		tspacket.SyncByte, byte(PCRPID >> 8), byte(PCRPID & 0xff),
+		// adaptation_field_control 10. continuity_counter stays 0, since
+		// it only counts packets with payload.
+		0x20,
+		tspacket.Size - 5,
+		// PCR_flag
+		0x10,
+		byte(base >> 25), byte(base >> 17), byte(base >> 9), byte(base >> 1),
+		byte(base<<7) | 0x7e | byte(extension>>8), byte(extension),
+	}
+	for len(packet) < tspacket.Size {
+		packet = append(packet, 0xff)
+	}
+	g.write(packet)
+}
+
+// withCRC32 fills section_length and CRC_32 of a long form section.
+func withCRC32(section []byte) []byte {
+	section_length := len(section) - 3 + 4
+	section[1] = section[1]&0xf0 | byte(section_length>>8)
+	section[2] = byte(section_length)
+	crc := tspacket.CRC32(section)
+	return append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
+
+// [ISO] 2.4.4.3 Table 2-25
+func pat() []byte {
+	return withCRC32([]byte{
+		0x00, 0xb0, 0,
+		// transport_stream_id
+		0x00, 0x01,
+		// version_number 0, current_next_indicator 1
+		0xc1, 0x00, 0x00,
+		byte(ProgramNumber >> 8), byte(ProgramNumber & 0xff),
+		0xe0 | byte(PMTPID>>8), byte(PMTPID & 0xff),
+	})
+}
+
+// The caption ES has the component_tag and data component descriptor of
+// the first caption language.
+// [ISO] 2.4.4.8 Table 2-28, [B10] 6.2.16, 6.2.20
+func pmt() []byte {
+	return withCRC32([]byte{
+		0x02, 0xb0, 0,
+		byte(ProgramNumber >> 8), byte(ProgramNumber & 0xff),
+		0xc1, 0x00, 0x00,
+		0xe0 | byte(PCRPID>>8), byte(PCRPID & 0xff),
+		// program_info_length
+		0xf0, 0x00,
+		// stream_type private data
+		0x06,
+		0xe0 | byte(CaptionPID>>8), byte(CaptionPID & 0xff),
+		0xf0, 8,
+		// stream_identifier_descriptor
+		0x52, 1, 0x87,
+		// data_component_descriptor with additional_arib_caption_info
+		0xfd, 3, byte(aribcaption.DataComponentCaption >> 8), byte(aribcaption.DataComponentCaption & 0xff), 0x3d,
+	})
+}
+
+// [B10] 5.2.9 Time Offset Table
+func tot(t time.Time) []byte {
+	section := append([]byte{0x73, 0x70, 0}, tspacket.EncodeJSTTime(t)...)
+	// descriptors_loop_length
+	section = append(section, 0xf0, 0x00)
+	return withCRC32(section)
+}
+
+// captionPES returns a synchronized PES of a data group with pts in 90kHz.
+// ARIB STD-B24 第三編 5
+func captionPES(pts int64, group []byte) []byte {
+	pes := []byte{
+		0x00, 0x00, 0x01,
+		// private_stream_1
+		0xbd,
+		0, 0,
+		0x80,
+		// PTS_DTS_flags 10
+		0x80,
+		// PES_header_data_length
+		5,
+		0x21 | byte(pts>>29)&0x0e, byte(pts >> 22), 0x01 | byte(pts>>14)&0xfe, byte(pts >> 7), 0x01 | byte(pts<<1)&0xfe,
+		// data_identifier, private_stream_id,
+		// PES_data_packet_header_length
+		0x80, 0xff, 0xf0,
+	}
+	pes = append(pes, group...)
+	PES_packet_length := len(pes) - 6
+	pes[4] = byte(PES_packet_length >> 8)
+	pes[5] = byte(PES_packet_length)
+	return pes
+}
+
+// dataGroup returns a data group of group A with CRC_16.
+// ARIB STD-B24 第三編 表9-1
+func dataGroup(data_group_id byte, data []byte) []byte {
+	group := []byte{data_group_id << 2, 0x00, 0x00, byte(len(data) >> 8), byte(len(data))}
+	group = append(group, data...)
+	crc := aribcaption.CRC16(group)
+	return append(group, byte(crc>>8), byte(crc))
+}
+
+// managementData returns caption_management_data of one language, Japanese,
+// without data units.
+// ARIB STD-B24 第三編 表9-3
+func managementData() []byte {
+	return []byte{
+		// TMD free
+		0x3f,
+		// num_languages
+		1,
+		// language_tag 0, DMF automatic display
+		0x10,
+		'j', 'p', 'n',
+		// Format, TCS 8-bit, rollup_mode
+		0x00,
+		// data_unit_loop_length
+		0, 0, 0,
+	}
+}
+
+// statementData returns caption_data with a data unit of statement body.
+// ARIB STD-B24 第三編 表9-3, 表9-11
+func statementData(statement []byte) []byte {
+	unit := []byte{
+		// unit_separator, data_unit_parameter
+		0x1f, 0x20,
+		byte(len(statement) >> 16), byte(len(statement) >> 8), byte(len(statement)),
+	}
+	unit = append(unit, statement...)
+	data := []byte{0x3f, byte(len(unit) >> 16), byte(len(unit) >> 8), byte(len(unit))}
+	return append(data, unit...)
+}
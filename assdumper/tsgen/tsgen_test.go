@@ -0,0 +1,67 @@
+package tsgen
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/aribcaption"
+)
+
+// TestWriteExtract writes a stream from a script and extracts the captions
+// of it again.
+func TestWriteExtract(t *testing.T) {
+	script, err := ParseScript(strings.NewReader(`# greetings
+@start 2024-04-01T21:00:00+09:00
+1s	こんにちは
+2.5s	NHK¥100\n二行目
+4s
+6s	さようなら
+@duration 8s
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ts bytes.Buffer
+	if err := Write(&ts, script); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []aribcaption.Caption
+	if err := aribcaption.ExtractFunc(context.Background(), &ts, func(c aribcaption.Caption) {
+		got = append(got, c)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, time.April, 1, 21, 0, 0, 0, time.FixedZone("JST", 9*60*60))
+	want := []struct {
+		start, end time.Duration
+		text       string
+	}{
+		{1 * time.Second, 2500 * time.Millisecond, "こんにちは"},
+		{2500 * time.Millisecond, 4 * time.Second, "NHK¥100\n二行目"},
+		{6 * time.Second, 8 * time.Second, "さようなら"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d captions %v, want %d", len(got), got, len(want))
+	}
+	for i, w := range want {
+		c := got[i]
+		if !c.Start.Equal(start.Add(w.start)) || !c.End.Equal(start.Add(w.end)) || c.Text != w.text {
+			t.Errorf("caption %d = %v-%v %q, want %v-%v %q", i, c.Start, c.End, c.Text, start.Add(w.start), start.Add(w.end), w.text)
+		}
+	}
+}
+
+func TestWriteUnencodable(t *testing.T) {
+	script := &Script{Cues: []Cue{{Time: time.Second, Text: "😀"}}}
+	var ts bytes.Buffer
+	if err := Write(&ts, script); err == nil {
+		t.Error("Write succeeded with an emoji")
+	}
+	if ts.Len() != 0 {
+		t.Errorf("Write wrote %d bytes before failing", ts.Len())
+	}
+}
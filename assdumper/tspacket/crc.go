@@ -0,0 +1,27 @@
+package tspacket
+
+var crc32Table = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// CRC32 computes CRC-32/MPEG-2, which is not reflected unlike hash/crc32.
+// Running it over a section including its CRC_32 yields 0.
+func CRC32(data []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, b := range data {
+		crc = crc<<8 ^ crc32Table[byte(crc>>24)^b]
+	}
+	return crc
+}
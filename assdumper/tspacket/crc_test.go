@@ -0,0 +1,22 @@
+package tspacket
+
+import "testing"
+
+func TestCRC32(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		data []byte
+		want uint32
+	}{
+		// The check value of CRC-32/MPEG-2
+		{"check", []byte("123456789"), 0x0376e6e7},
+		{"empty", nil, 0xffffffff},
+		// The PAT that FFmpeg writes, before its CRC_32
+		{"PAT", []byte{0x00, 0xb0, 0x0d, 0x00, 0x01, 0xc1, 0x00, 0x00, 0x00, 0x01, 0xf0, 0x00}, 0x2ab104b2},
+		{"PAT with CRC_32", []byte{0x00, 0xb0, 0x0d, 0x00, 0x01, 0xc1, 0x00, 0x00, 0x00, 0x01, 0xf0, 0x00, 0x2a, 0xb1, 0x04, 0xb2}, 0},
+	} {
+		if got := CRC32(test.data); got != test.want {
+			t.Errorf("%s: CRC32 = %08x, want %08x", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package tspacket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrSync is returned by Demuxer.Run when a packet doesn't start with
+// SyncByte, which means the input isn't a TS or lost its packet alignment.
+var ErrSync = errors.New("sync_byte failed")
+
+// Demuxer reads TS packets from an io.Reader and hands the PCR, sections and
+// payloads of the PIDs registered with it to their handlers. It tracks
+// continuity_counter of every PID: duplicate packets are dropped, and the
+// section or PES being assembled is dropped at a gap. Packets with
+// transport_error_indicator aren't demuxed, as even their PID can't be
+// trusted.
+type Demuxer struct {
+	reader   *Reader
+	pids     [NullPID + 1]demuxPID
+	packetFn func(packet Packet)
+	stopped  bool
+
+	packets          int64
+	continuityErrors int
+	duplicates       int
+	scrambled        int64
+	transportErrors  int64
+	position         Position
+
+	// ContinuityError is called, unless nil, at a gap of continuity_counter
+	// on a PID with a section, payload or PES handler.
+	ContinuityError func(pid, previous, current int)
+	// Scrambled is called, unless nil, for every packet with
+	// transport_scrambling_control on a PID with a section, payload or PES
+	// handler, whose payload can't be handed to them.
+	Scrambled func(pid int)
+}
+
+type demuxPID struct {
+	// continuity is the continuity_counter of the last packet with payload,
+	// or -1 before the first one.
+	continuity int
+	// lost is set when packets may have been lost before the next one,
+	// which continuity_counter can't tell.
+	lost bool
+
+	pcr       func(pcr int64, discontinuity bool)
+	sections  func(section []byte)
+	assembler SectionAssembler
+	payload   func(payload []byte, start, gap bool)
+	pes       func(pes []byte)
+	pesBuf    []byte
+}
+
+// NewDemuxer returns a Demuxer reading from r. r may be nil when the input
+// is given later by Reset.
+func NewDemuxer(r io.Reader) *Demuxer {
+	d := new(Demuxer)
+	for i := range d.pids {
+		d.pids[i].continuity = -1
+	}
+	if r != nil {
+		d.Reset(r)
+	}
+	return d
+}
+
+// Reset makes the Demuxer read from in, which must start on a packet
+// boundary, e.g. the next input of a recording split into files or a new
+// connection. The handlers and what is being assembled are kept.
+func (d *Demuxer) Reset(in io.Reader) {
+	if d.reader == nil {
+		d.reader = NewReader(in)
+	} else {
+		d.reader.Reset(in)
+	}
+}
+
+// PacketSize returns the size of the packets in the input, as Reader tells.
+func (d *Demuxer) PacketSize() int {
+	return d.reader.PacketSize()
+}
+
+// HandlePCR registers fn to receive the PCR of pid in 27MHz units along with
+// discontinuity_indicator. A nil fn stops it.
+func (d *Demuxer) HandlePCR(pid int, fn func(pcr int64, discontinuity bool)) {
+	d.pids[pid].pcr = fn
+}
+
+// HandleSections registers fn to receive the PSI/SI sections of pid, as
+// SectionAssembler passes them. CRC_32 is left to fn. A nil fn stops it.
+func (d *Demuxer) HandleSections(pid int, fn func(section []byte)) {
+	d.pids[pid].sections = fn
+}
+
+// HandlePayload registers fn to receive the payload of every packet of pid,
+// for those who assemble PES themselves. start is payload_unit_start_indicator
+// and gap tells that packets were lost right before this one. The payload is
+// only valid during the call. A nil fn stops it.
+func (d *Demuxer) HandlePayload(pid int, fn func(payload []byte, start, gap bool)) {
+	d.pids[pid].payload = fn
+}
+
+// HandlePES registers fn to receive the PES packets of pid. A PES is passed
+// once PES_packet_length bytes have arrived, or when the next one starts if
+// the length is unbounded, and dropped when packets are lost in the middle of
+// it. The PES is only valid during the call. A nil fn stops it, discarding
+// the PES being assembled.
+func (d *Demuxer) HandlePES(pid int, fn func(pes []byte)) {
+	d.pids[pid].pes = fn
+	d.pids[pid].pesBuf = nil
+}
+
+// HandlePackets registers fn to receive every packet once its PCR, sections
+// and payload have gone to their handlers, including the duplicates, the
+// scrambled packets and those with transport_error_indicator that they
+// don't get, for those who count or copy packets. The packet is only valid
+// during the call. A nil fn stops it.
+func (d *Demuxer) HandlePackets(fn func(packet Packet)) {
+	d.packetFn = fn
+}
+
+// Stop makes Run return nil once the packet being demuxed has gone to every
+// handler, for a handler that has found what it was looking for. Run goes on
+// from the next packet when called again.
+func (d *Demuxer) Stop() {
+	d.stopped = true
+}
+
+// Position locates a packet in the input, so that a diagnostic about what
+// was rejected can point at the exact place of a corrupted recording.
+type Position struct {
+	// Offset is the byte offset of the packet from the head of the input
+	// given to the last Reset, or -1 for a packet pushed by Push.
+	Offset            int64
+	PID               int
+	ContinuityCounter int
+}
+
+func (p Position) String() string {
+	if p.Offset == -1 {
+		return fmt.Sprintf("PID 0x%04x, continuity_counter %d", p.PID, p.ContinuityCounter)
+	}
+	return fmt.Sprintf("offset %d, PID 0x%04x, continuity_counter %d", p.Offset, p.PID, p.ContinuityCounter)
+}
+
+// Position returns the position of the packet being demuxed, which is the
+// one that completed the section or PES given to a handler. After Run
+// returns ErrSync, only its Offset is of the packet that failed.
+func (d *Demuxer) Position() Position {
+	return d.position
+}
+
+// Packets returns the number of packets demuxed so far.
+func (d *Demuxer) Packets() int64 {
+	return d.packets
+}
+
+// ContinuityErrors returns the number of gaps of continuity_counter seen on
+// any PID but null packets.
+func (d *Demuxer) ContinuityErrors() int {
+	return d.continuityErrors
+}
+
+// Duplicates returns the number of packets dropped as duplicates.
+func (d *Demuxer) Duplicates() int {
+	return d.duplicates
+}
+
+// ScrambledPackets returns the number of packets dropped as scrambled on the
+// PIDs with handlers.
+func (d *Demuxer) ScrambledPackets() int64 {
+	return d.scrambled
+}
+
+// TransportErrors returns the number of packets dropped for
+// transport_error_indicator.
+func (d *Demuxer) TransportErrors() int64 {
+	return d.transportErrors
+}
+
+// Interrupted tells that packets of every PID may have been lost, e.g. when
+// the input reconnected. The sections and PES being assembled are dropped
+// like at a gap of continuity_counter, which may happen to look continuous.
+func (d *Demuxer) Interrupted() {
+	for i := range d.pids {
+		if d.pids[i].continuity != -1 {
+			d.pids[i].continuity = -1
+			d.pids[i].lost = true
+		}
+	}
+}
+
+// Run demuxes the packets of the input until its end, until ctx is done or
+// until a handler calls Stop. It returns nil at the end or at Stop,
+// io.ErrUnexpectedEOF when the input ends in the middle of a packet, ErrSync,
+// ctx.Err(), or the error of reading the input.
+// A read blocked on the input isn't interrupted by ctx, which inputs such as
+// network connections can do themselves by closing.
+func (d *Demuxer) Run(ctx context.Context) error {
+	d.stopped = false
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		packet, err := d.reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if packet[0] != SyncByte {
+			d.position = Position{Offset: d.reader.Offset(), PID: -1, ContinuityCounter: -1}
+			return ErrSync
+		}
+		d.push(packet, d.reader.Offset())
+		if d.stopped {
+			d.stopped = false
+			return nil
+		}
+	}
+}
+
+// Flush passes the PES still being assembled with an unbounded length to
+// their handlers, at the end of the input.
+func (d *Demuxer) Flush() {
+	for i := range d.pids {
+		entry := &d.pids[i]
+		if entry.pes != nil && len(entry.pesBuf) != 0 {
+			pes := entry.pesBuf
+			entry.pesBuf = entry.pesBuf[:0]
+			entry.pes(pes)
+		}
+	}
+}
+
+// Push demuxes a packet read by other means than Run.
+func (d *Demuxer) Push(packet Packet) {
+	d.push(packet, -1)
+}
+
+func (d *Demuxer) push(packet Packet, offset int64) {
+	d.packets++
+	d.position = Position{Offset: offset, PID: packet.PID(), ContinuityCounter: packet.ContinuityCounter()}
+	if packet.TransportError() {
+		// Dropping it makes a gap of continuity_counter at the next
+		// packet of its PID, if the PID was right.
+		d.transportErrors++
+	} else {
+		d.demux(packet)
+	}
+	if d.packetFn != nil {
+		d.packetFn(packet)
+	}
+}
+
+func (d *Demuxer) demux(packet Packet) {
+	pid := packet.PID()
+	entry := &d.pids[pid]
+	field, p, ok := packet.AdaptationField()
+	discontinuity := Discontinuity(field)
+	if entry.pcr != nil && HasPCR(field) {
+		entry.pcr(PCR(field), discontinuity)
+	}
+	if !ok || !packet.HasPayload() {
+		// No room is left for payload, or the adaptation field is
+		// broken.
+		return
+	}
+	// [ISO] 2.4.3.3 continuity_counter
+	// It's incremented only by packets with payload, and a packet may be
+	// sent twice in a row. It's not continuous after discontinuity_indicator.
+	continuity_counter := packet.ContinuityCounter()
+	gap := entry.lost
+	entry.lost = false
+	if entry.continuity != -1 && !discontinuity && pid != NullPID {
+		if continuity_counter == entry.continuity {
+			d.duplicates++
+			return
+		}
+		if continuity_counter != (entry.continuity+1)&0x0f {
+			gap = true
+			d.continuityErrors++
+			if d.ContinuityError != nil && (entry.sections != nil || entry.payload != nil || entry.pes != nil) {
+				d.ContinuityError(pid, entry.continuity, continuity_counter)
+			}
+		}
+	}
+	entry.continuity = continuity_counter
+
+	if packet.Scrambled() && (entry.sections != nil || entry.payload != nil || entry.pes != nil) {
+		// The payload is garbage until descrambled, and the section or
+		// PES being assembled is dropped as at a gap.
+		d.scrambled++
+		entry.lost = true
+		if d.Scrambled != nil {
+			d.Scrambled(pid)
+		}
+		return
+	}
+
+	start := packet.PayloadUnitStart()
+	if entry.sections != nil {
+		if gap {
+			entry.assembler.Reset()
+		}
+		entry.assembler.Push(p, start, entry.sections)
+	}
+	if entry.payload != nil {
+		entry.payload(p, start, gap)
+	}
+	if entry.pes != nil {
+		entry.pushPES(p, start, gap)
+	}
+}
+
+func (entry *demuxPID) pushPES(p []byte, start, gap bool) {
+	if start {
+		if len(entry.pesBuf) != 0 {
+			entry.pes(entry.pesBuf)
+		}
+		entry.pesBuf = append(entry.pesBuf[:0], p...)
+	} else if gap {
+		entry.pesBuf = entry.pesBuf[:0]
+	} else if len(entry.pesBuf) != 0 {
+		entry.pesBuf = append(entry.pesBuf, p...)
+	}
+	// [ISO] 2.4.3.7 PES_packet_length, 0 for an unbounded length
+	if len(entry.pesBuf) < 6 {
+		return
+	}
+	PES_packet_length := int(entry.pesBuf[4])<<8 | int(entry.pesBuf[5])
+	if PES_packet_length != 0 && len(entry.pesBuf) >= 6+PES_packet_length {
+		pes := entry.pesBuf[:6+PES_packet_length]
+		entry.pesBuf = entry.pesBuf[:0]
+		entry.pes(pes)
+	}
+}
@@ -0,0 +1,49 @@
+package tspacket
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// FuzzSections parses whatever sections SectionAssembler makes of a
+// payload, as the handlers of PAT, PMT and TOT do.
+func FuzzSections(f *testing.F) {
+	f.Add([]byte{0x00, 0x00, 0xb0, 0x0d, 0x00, 0x01, 0xc1, 0x00, 0x00, 0x04, 0x00, 0xe1, 0xf0, 0x00, 0x00, 0x00, 0x00})
+	f.Add([]byte{0x00, 0x02, 0xb0, 0x17, 0x04, 0x00, 0xc1, 0x00, 0x00, 0xe1, 0x00, 0xf0, 0x00, 0x06, 0xe1, 0x30, 0xf0, 0x03, 0x52, 0x01, 0x87, 0x00, 0x00, 0x00, 0x00})
+	f.Add([]byte{0x00, 0x73, 0x70, 0x0b, 0xe8, 0x9d, 0x21, 0x00, 0x00, 0xf0, 0x00, 0x00, 0x00, 0x00, 0x00})
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		var a SectionAssembler
+		a.Push(payload, true, func(section []byte) {
+			ParsePAT(section)
+			if len(ParsePMT(section)) != 0 {
+				PCRPID(section)
+			}
+			ParseTOT(section)
+		})
+	})
+}
+
+// FuzzDemuxer runs Demuxer over arbitrary bytes, parsing its PES headers.
+func FuzzDemuxer(f *testing.F) {
+	packet := make([]byte, Size)
+	packet[0] = SyncByte
+	packet[1] = 0x41
+	packet[3] = 0x30
+	packet[4] = 7
+	packet[5] = 0x10
+	copy(packet[12:], []byte{0x00, 0x00, 0x01, 0xbd, 0x00, 0x08, 0x80, 0x80, 0x05, 0x21, 0x00, 0x01, 0x00, 0x01})
+	f.Add(packet)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		d := NewDemuxer(bytes.NewReader(data))
+		d.HandlePCR(0x100, func(int64, bool) {})
+		d.HandlePES(0x100, func(pes []byte) {
+			PESTimestamps(pes)
+		})
+		d.HandleSections(0x0000, func(section []byte) {
+			ParsePAT(section)
+		})
+		d.Run(context.Background())
+		d.Flush()
+	})
+}
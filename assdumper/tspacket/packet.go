@@ -0,0 +1,129 @@
+// Package tspacket reads MPEG-2 transport streams and parses the TS packet
+// headers, PSI sections and PES headers that caption extraction needs, along
+// with the ARIB SI that go with them.
+//
+// [ISO]: ISO/IEC 13818-1
+// [B10]: ARIB STD-B10
+package tspacket
+
+// Size is the size of a TS packet. Packets of other sizes are reduced to it
+// by Reader.
+const Size = 188
+
+// SyncByte is the first byte of every TS packet.
+const SyncByte = 0x47
+
+// NullPID is the PID of null packets, which carry no data.
+const NullPID = 0x1fff
+
+// Packet is a TS packet of Size bytes.
+// [ISO] 2.4.3.2 Table 2-2
+type Packet []byte
+
+// PID returns the PID of the packet.
+func (p Packet) PID() int {
+	return int(p[1]&0x1f)<<8 | int(p[2])
+}
+
+// TransportError reports transport_error_indicator, which the demodulator
+// sets on a packet with errors it couldn't correct.
+func (p Packet) TransportError() bool {
+	return p[1]&0x80 != 0
+}
+
+// PayloadUnitStart reports payload_unit_start_indicator, which is set when a
+// PES or a section starts in the packet.
+func (p Packet) PayloadUnitStart() bool {
+	return p[1]&0x40 != 0
+}
+
+// HasAdaptationField reports whether the packet has an adaptation field.
+func (p Packet) HasAdaptationField() bool {
+	return p[3]&0x20 != 0
+}
+
+// HasPayload reports whether the packet has payload.
+func (p Packet) HasPayload() bool {
+	return p[3]&0x10 != 0
+}
+
+// Scrambled reports whether transport_scrambling_control is set, which
+// means the payload is encrypted.
+func (p Packet) Scrambled() bool {
+	return p[3]&0xc0 != 0
+}
+
+// ContinuityCounter returns continuity_counter, which is incremented by each
+// packet with payload of the PID.
+func (p Packet) ContinuityCounter() int {
+	return int(p[3] & 0x0f)
+}
+
+// AdaptationField returns the adaptation field following
+// adaptation_field_length and the payload after it. ok is false when the
+// field leaves no room for payload or overruns the packet.
+// [ISO] 2.4.3.4 Table 2-6
+func (p Packet) AdaptationField() (field []byte, payload []byte, ok bool) {
+	b := p[4:]
+	if !p.HasAdaptationField() {
+		return nil, b, true
+	}
+	adaptation_field_length := int(b[0])
+	b = b[1:]
+	if adaptation_field_length >= len(b) {
+		return b, nil, false
+	}
+	return b[:adaptation_field_length], b[adaptation_field_length:], true
+}
+
+// Discontinuity reports discontinuity_indicator of an adaptation field.
+func Discontinuity(field []byte) bool {
+	return len(field) > 0 && field[0]&0x80 != 0
+}
+
+// HasPCR reports whether an adaptation field carries PCR.
+func HasPCR(field []byte) bool {
+	return len(field) >= 7 && field[0]&0x10 != 0
+}
+
+// PCR returns the PCR of an adaptation field in 27MHz units. The field must
+// carry it, which HasPCR tells.
+// [ISO] 2.4.2.2
+func PCR(field []byte) int64 {
+	pcr_base := (int64(field[1]) << 25) |
+		(int64(field[2]) << 17) |
+		(int64(field[3]) << 9) |
+		(int64(field[4]) << 1) |
+		(int64(field[5]&0x80) >> 7)
+	pcr_ext := (int64(field[5] & 0x01)) | int64(field[6])
+	return pcr_base*300 + pcr_ext
+}
+
+// PCR must be sent at least every 100ms ([ISO] 2.7.2). A much larger jump,
+// or one backwards beyond the jitter of noisy tuners, means the time base
+// was reset, e.g. at the boundary of two recordings or at the 33-bit wrap
+// around.
+const (
+	MaxPCRGap    = 10 * 27000000
+	MaxPCRJitter = 27000000 / 2
+)
+
+// PCRWrap is where PCR, of a 33-bit base in 90kHz and an extension in 27MHz,
+// wraps around to 0, after about 26.5 hours.
+const PCRWrap = (1 << 33) * 300
+
+// PCRSince returns the time from previous to current PCR in 27MHz, taking
+// current for the later one even when PCR has wrapped around in between.
+func PCRSince(previous, current int64) int64 {
+	d := (current - previous) % PCRWrap
+	if d < 0 {
+		d += PCRWrap
+	}
+	return d
+}
+
+// IsPCRDiscontinuity reports whether the time base was reset between two
+// PCRs, even without discontinuity_indicator.
+func IsPCRDiscontinuity(previous, current int64) bool {
+	return current < previous-MaxPCRJitter || current-previous > MaxPCRGap
+}
@@ -0,0 +1,68 @@
+package tspacket
+
+// PESTimestamps returns PTS and DTS of a PES packet in 90kHz units.
+// hasPTS and hasDTS tell whether the header carries them, since 0 is a
+// timestamp like any other. ok is false when PTS_DTS_flags or the marker
+// bits are broken, or the PES is too short for the header.
+func PESTimestamps(pes []byte) (pts, dts int64, hasPTS, hasDTS, ok bool) {
+	// [ISO] 2.4.3.7 Table 2-21
+	if len(pes) < 9 {
+		return 0, 0, false, false, false
+	}
+	PTS_DTS_flags := pes[7] >> 6
+	PES_header_data_length := int(pes[8])
+	header := pes[9:]
+	if len(header) > PES_header_data_length {
+		header = header[:PES_header_data_length]
+	}
+	switch PTS_DTS_flags {
+	case 0x00:
+		return 0, 0, false, false, true
+	case 0x01:
+		// forbidden
+		return 0, 0, false, false, false
+	case 0x02:
+		if len(header) < 5 {
+			return 0, 0, false, false, false
+		}
+		pts, ok = decodeTimestamp(header, 0x02)
+		return pts, 0, ok, false, ok
+	default:
+		if len(header) < 10 {
+			return 0, 0, false, false, false
+		}
+		pts, ok = decodeTimestamp(header, 0x03)
+		if !ok {
+			return 0, 0, false, false, false
+		}
+		dts, ok = decodeTimestamp(header[5:], 0x01)
+		return pts, dts, ok, ok, ok
+	}
+}
+
+// decodeTimestamp decodes a 33-bit PTS or DTS, checking the leading 4 bits
+// against prefix and the three marker bits.
+func decodeTimestamp(b []byte, prefix byte) (int64, bool) {
+	if b[0]>>4 != prefix || b[0]&0x01 == 0 || b[2]&0x01 == 0 || b[4]&0x01 == 0 {
+		return 0, false
+	}
+	return int64(b[0]&0x0e)<<29 |
+		int64(b[1])<<22 |
+		int64(b[2]&0xfe)<<14 |
+		int64(b[3])<<7 |
+		int64(b[4])>>1, true
+}
+
+// PresentationTime returns when a PES with pts in 90kHz units, unless hasPTS
+// is false, should be presented if it arrived at pcr. PTS is on the same time
+// base as PCR, and it is trusted unless it's more than MaxPCRGap away from
+// the arrival time.
+func PresentationTime(pcr, pts int64, hasPTS bool) int64 {
+	if !hasPTS || pcr == 0 {
+		return pcr
+	}
+	if d := pts*300 - pcr; -MaxPCRGap < d && d < MaxPCRGap {
+		return pts * 300
+	}
+	return pcr
+}
@@ -0,0 +1,62 @@
+package tspacket
+
+import "testing"
+
+// timestampBytes encodes a 33-bit PTS or DTS with its leading 4 bits prefix
+// and the marker bits.
+func timestampBytes(prefix byte, ts int64) []byte {
+	return []byte{
+		prefix<<4 | byte(ts>>29)&0x0e | 0x01,
+		byte(ts >> 22),
+		byte(ts>>14)&0xfe | 0x01,
+		byte(ts >> 7),
+		byte(ts<<1) | 0x01,
+	}
+}
+
+func TestPESTimestamps(t *testing.T) {
+	pes := func(PTS_DTS_flags byte, header ...byte) []byte {
+		return append([]byte{0x00, 0x00, 0x01, 0xbd, 0x00, 0x00, 0x80, PTS_DTS_flags << 6, byte(len(header))}, header...)
+	}
+	for _, test := range []struct {
+		name           string
+		pes            []byte
+		pts, dts       int64
+		hasPTS, hasDTS bool
+		ok             bool
+	}{
+		{"none", pes(0x00), 0, 0, false, false, true},
+		{"PTS only", pes(0x02, timestampBytes(0x02, 0x1_2345_6789)...), 0x1_2345_6789, 0, true, false, true},
+		{"PTS and DTS", pes(0x03, append(timestampBytes(0x03, 900900), timestampBytes(0x01, 900000)...)...), 900900, 900000, true, true, true},
+		{"PTS 0", pes(0x02, timestampBytes(0x02, 0)...), 0, 0, true, false, true},
+		{"forbidden PTS_DTS_flags", pes(0x01), 0, 0, false, false, false},
+		{"broken marker bit", pes(0x02, 0x20, 0x00, 0x01, 0x00, 0x01), 0, 0, false, false, false},
+		{"short header", pes(0x02, 0x21, 0x00), 0, 0, false, false, false},
+	} {
+		pts, dts, hasPTS, hasDTS, ok := PESTimestamps(test.pes)
+		if pts != test.pts || dts != test.dts || hasPTS != test.hasPTS || hasDTS != test.hasDTS || ok != test.ok {
+			t.Errorf("%s: PESTimestamps = %d, %d, %v, %v, %v, want %d, %d, %v, %v, %v",
+				test.name, pts, dts, hasPTS, hasDTS, ok, test.pts, test.dts, test.hasPTS, test.hasDTS, test.ok)
+		}
+	}
+}
+
+func TestPresentationTime(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		pcr    int64
+		pts    int64
+		hasPTS bool
+		want   int64
+	}{
+		{"PTS", 27000000, 90000 + 45000, true, (90000 + 45000) * 300},
+		{"no PTS", 27000000, 0, false, 27000000},
+		// PCR has just wrapped around to where PTS 0 is due.
+		{"PTS 0", 300, 0, true, 0},
+		{"PTS too far", 27000000, 90000 * 100, true, 27000000},
+	} {
+		if got := PresentationTime(test.pcr, test.pts, test.hasPTS); got != test.want {
+			t.Errorf("%s: PresentationTime = %d, want %d", test.name, got, test.want)
+		}
+	}
+}
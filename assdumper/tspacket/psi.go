@@ -0,0 +1,118 @@
+package tspacket
+
+// ParsePAT returns a map from program_map_PID to program_number of a PAT
+// section, leaving out the network PID.
+// [ISO] 2.4.4.3 Table 2-25
+func ParsePAT(section []byte) map[int]int {
+	pids := make(map[int]int)
+	end, ok := sectionEnd(section, 0x00, 8)
+	if !ok {
+		return pids
+	}
+	index := 8
+	for index+4 <= end {
+		program_number := int(section[index+0])<<8 | int(section[index+1])
+		if program_number != 0 {
+			program_map_PID := int(section[index+2]&0x1F)<<8 | int(section[index+3])
+			pids[program_map_PID] = program_number
+		}
+		index += 4
+	}
+	return pids
+}
+
+// PCRPID returns PCR_PID of a PMT section, or -1 when it's too short.
+func PCRPID(section []byte) int {
+	if len(section) < 10 {
+		return -1
+	}
+	return (int(section[8]&0x1f) << 8) | int(section[9])
+}
+
+// sectionEnd returns the end of the data of a long form section with
+// table_id, before CRC_32, when section_length fits in the section and
+// leaves at least header bytes before it.
+func sectionEnd(section []byte, table_id byte, header int) (int, bool) {
+	if len(section) < 3 || section[0] != table_id {
+		return 0, false
+	}
+	section_length := int(section[1]&0x0F)<<8 | int(section[2])
+	end := 3 + section_length - 4
+	if 3+section_length > len(section) || end < header {
+		return 0, false
+	}
+	return end, true
+}
+
+// ElementaryStream is an entry of the ES loop of a PMT, with what the ARIB
+// descriptors tell about it.
+type ElementaryStream struct {
+	StreamType byte
+	PID        int
+	// ComponentTag is component_tag of the stream identifier descriptor,
+	// or -1.
+	ComponentTag int
+	// DataComponentID is data_component_id of the data component
+	// descriptor, or -1.
+	DataComponentID int
+	// DualMono is ISO_639_language_code of the main and sub channel when
+	// the audio component descriptor says the ES is dual mono.
+	DualMono []string
+}
+
+// ParsePMT returns the ES loop of a PMT section.
+// [ISO] 2.4.4.8 Program Map Table, Table 2-28
+func ParsePMT(section []byte) []ElementaryStream {
+	end, ok := sectionEnd(section, 0x02, 12)
+	if !ok {
+		return nil
+	}
+
+	program_info_length := int(section[10]&0x0F)<<8 | int(section[11])
+	index := 12 + program_info_length
+
+	var streams []ElementaryStream
+	for index+5 <= end {
+		stream_type := section[index+0]
+		elementary_PID := int(section[index+1]&0x1F)<<8 | int(section[index+2])
+		ES_info_length := int(section[index+3]&0xF)<<8 | int(section[index+4])
+		es := ElementaryStream{StreamType: stream_type, PID: elementary_PID, ComponentTag: -1, DataComponentID: -1}
+		subIndex := index + 5
+		infoEnd := index + 5 + ES_info_length
+		if infoEnd > end {
+			infoEnd = end
+		}
+		for subIndex+2 <= infoEnd {
+			// [ISO] 2.6 Program and program element descriptors
+			descriptor_tag := section[subIndex+0]
+			descriptor_length := int(section[subIndex+1])
+			if subIndex+2+descriptor_length > infoEnd {
+				break
+			}
+			if descriptor_tag == 0x52 && descriptor_length >= 1 {
+				// [B10] 6.2.16 Stream identifier descriptor
+				// 表 6-28
+				es.ComponentTag = int(section[subIndex+2])
+			} else if descriptor_tag == 0xFD && descriptor_length >= 2 {
+				// [B10] 6.2.20 Data component descriptor
+				es.DataComponentID = int(section[subIndex+2])<<8 | int(section[subIndex+3])
+			} else if descriptor_tag == 0xC4 && descriptor_length >= 9 {
+				// [B10] 6.2.26 Audio component descriptor
+				d := section[subIndex+2:]
+				component_type := d[1]
+				ES_multi_lingual_flag := d[5]&0x80 != 0
+				if component_type == 0x02 {
+					// 1/0+1/0 mode (dual mono)
+					es.DualMono = []string{string(d[6:9]), ""}
+					if ES_multi_lingual_flag && descriptor_length >= 12 {
+						es.DualMono[1] = string(d[9:12])
+					}
+				}
+			}
+			subIndex += 2 + descriptor_length
+		}
+		streams = append(streams, es)
+		index += 5 + ES_info_length
+	}
+	return streams
+}
@@ -0,0 +1,77 @@
+package tspacket
+
+import (
+	"reflect"
+	"testing"
+)
+
+// The PAT and PMT that FFmpeg writes for a single H.264 program
+var (
+	testPAT = []byte{
+		0x00, 0xb0, 0x0d, 0x00, 0x01, 0xc1, 0x00, 0x00,
+		// program_number 1 on PID 0x1000
+		0x00, 0x01, 0xf0, 0x00,
+		0x2a, 0xb1, 0x04, 0xb2,
+	}
+	testPMT = []byte{
+		0x02, 0xb0, 0x12, 0x00, 0x01, 0xc1, 0x00, 0x00,
+		// PCR_PID 0x100 and no program info
+		0xe1, 0x00, 0xf0, 0x00,
+		// H.264 on PID 0x100
+		0x1b, 0xe1, 0x00, 0xf0, 0x00,
+		0x15, 0xbd, 0x4d, 0x56,
+	}
+)
+
+func TestParsePAT(t *testing.T) {
+	if crc := CRC32(testPAT); crc != 0 {
+		t.Fatalf("CRC32 = %08x", crc)
+	}
+	if got, want := ParsePAT(testPAT), map[int]int{0x1000: 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ParsePAT = %v, want %v", got, want)
+	}
+	// section_length beyond the section
+	if got := ParsePAT(testPAT[:12]); len(got) != 0 {
+		t.Errorf("ParsePAT of a short section = %v", got)
+	}
+}
+
+func TestParsePMT(t *testing.T) {
+	if crc := CRC32(testPMT); crc != 0 {
+		t.Fatalf("CRC32 = %08x", crc)
+	}
+	if pid := PCRPID(testPMT); pid != 0x100 {
+		t.Errorf("PCRPID = 0x%x", pid)
+	}
+	want := []ElementaryStream{{StreamType: 0x1b, PID: 0x100, ComponentTag: -1, DataComponentID: -1}}
+	if got := ParsePMT(testPMT); !reflect.DeepEqual(got, want) {
+		t.Errorf("ParsePMT = %+v, want %+v", got, want)
+	}
+	// A PAT isn't a PMT.
+	if got := ParsePMT(testPAT); got != nil {
+		t.Errorf("ParsePMT of PAT = %+v", got)
+	}
+}
+
+// TestParsePMTDescriptors reads the descriptors ARIB adds to the ES loop.
+func TestParsePMTDescriptors(t *testing.T) {
+	section := []byte{
+		0x02, 0xb0, 0x00, 0x04, 0x00, 0xc1, 0x00, 0x00,
+		0xe1, 0x00, 0xf0, 0x00,
+		// Caption ES with stream identifier descriptor of component_tag
+		// 0x87 and data component descriptor of 0x0008
+		0x06, 0xe1, 0x30, 0xf0, 0x07, 0x52, 0x01, 0x87, 0xfd, 0x02, 0x00, 0x08,
+		// AAC of dual mono in Japanese and English
+		0x0f, 0xe1, 0x10, 0xf0, 0x0e, 0xc4, 0x0c, 0xf2, 0x02, 0x10, 0x0f, 0xff, 0xce, 'j', 'p', 'n', 'e', 'n', 'g',
+	}
+	section[2] = byte(len(section) - 3 + 4)
+	crc := CRC32(section)
+	section = append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+	want := []ElementaryStream{
+		{StreamType: 0x06, PID: 0x130, ComponentTag: 0x87, DataComponentID: 0x0008},
+		{StreamType: 0x0f, PID: 0x110, ComponentTag: -1, DataComponentID: -1, DualMono: []string{"jpn", "eng"}},
+	}
+	if got := ParsePMT(section); !reflect.DeepEqual(got, want) {
+		t.Errorf("ParsePMT = %+v, want %+v", got, want)
+	}
+}
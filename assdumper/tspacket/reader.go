@@ -0,0 +1,137 @@
+package tspacket
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// Number of consecutive sync bytes required to accept a packet size.
+const sizeProbeCount = 8
+
+// Reader reads TS packets from an input of 188-byte packets, 192-byte
+// packets of BDAV/M2TS or 204-byte packets with Reed-Solomon parity, which
+// it tells apart by the spacing of the sync bytes at the head.
+type Reader struct {
+	r *bufio.Reader
+	// mapped is the content of a MappedInput, read in place of r.
+	mapped []byte
+	size   int
+	offset int
+	// next is the byte offset of the next packet in the input, and last
+	// the one of the packet Next returned last.
+	next int64
+	last int64
+}
+
+// readerBufferSize is the size of the buffer packets are sliced out of.
+const readerBufferSize = 64 * 1024
+
+// MappedInput is an input whose content is in memory as a whole, e.g. a
+// memory-mapped file. Reader slices the packets out of Mapped rather than
+// reading them.
+type MappedInput interface {
+	io.Reader
+	Mapped() []byte
+}
+
+// NewReader returns a Reader reading from r.
+func NewReader(r io.Reader) *Reader {
+	reader := new(Reader)
+	reader.Reset(r)
+	return reader
+}
+
+// PacketSize returns the size of the packets in the input, which is Size
+// unless they carry more than a TS packet.
+func (r *Reader) PacketSize() int {
+	return r.size
+}
+
+// Reset makes the Reader read from in, e.g. after reconnecting, detecting
+// the packet size again. in must start on a packet boundary.
+func (r *Reader) Reset(in io.Reader) {
+	r.next = 0
+	r.last = 0
+	if m, ok := in.(MappedInput); ok {
+		r.mapped = m.Mapped()
+		if r.mapped == nil {
+			r.mapped = []byte{}
+		}
+		r.size, r.offset = DetectSize(bufio.NewReader(bytes.NewReader(r.mapped)))
+		return
+	}
+	r.mapped = nil
+	if r.r == nil {
+		r.r = bufio.NewReaderSize(in, readerBufferSize)
+	} else {
+		r.r.Reset(in)
+	}
+	r.size, r.offset = DetectSize(r.r)
+}
+
+// Offset returns the byte offset of the packet Next returned last, from the
+// head of the input given to NewReader or Reset.
+func (r *Reader) Offset() int64 {
+	return r.last
+}
+
+// Next returns the next TS packet, which is valid until the next call. The
+// packet is sliced out of the read buffer or the MappedInput rather than
+// copied. It returns io.EOF at the end of the input, and
+// io.ErrUnexpectedEOF when the input ends in the middle of a packet.
+func (r *Reader) Next() (Packet, error) {
+	r.last = r.next
+	if r.mapped != nil {
+		rest := r.mapped[r.next:]
+		if len(rest) == 0 {
+			return nil, io.EOF
+		}
+		if len(rest) < r.size {
+			r.next += int64(len(rest))
+			return nil, io.ErrUnexpectedEOF
+		}
+		r.next += int64(r.size)
+		return Packet(rest[r.offset : r.offset+Size]), nil
+	}
+	buf, err := r.r.Peek(r.size)
+	if len(buf) < r.size {
+		if err == io.EOF && len(buf) != 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	r.r.Discard(r.size)
+	r.next += int64(r.size)
+	return Packet(buf[r.offset : r.offset+Size]), nil
+}
+
+// DetectSize probes the spacing of sync bytes at the head of the input and
+// returns the packet size and the offset of the TS packet within it.
+// 192-byte packets (BDAV/M2TS) are prefixed with a 4-byte arrival timestamp
+// and 204-byte packets are followed by 16 bytes of Reed-Solomon parity.
+// It falls back to plain 188-byte packets when nothing matches.
+func DetectSize(reader *bufio.Reader) (size int, offset int) {
+	head, _ := reader.Peek(sizeProbeCount*204 + 4)
+	candidates := []struct{ size, offset int }{
+		{Size, 0},
+		{192, 4},
+		{204, 0},
+	}
+	for _, c := range candidates {
+		n := 0
+		for i := c.offset; i < len(head) && n < sizeProbeCount; i += c.size {
+			if head[i] != SyncByte {
+				n = -1
+				break
+			}
+			n++
+		}
+		// Short inputs are accepted as long as every packet they hold
+		// starts with a sync byte.
+		if n > 0 && (n == sizeProbeCount || len(head) < c.offset+sizeProbeCount*c.size) {
+			return c.size, c.offset
+		}
+	}
+	return Size, 0
+}
@@ -0,0 +1,43 @@
+package tspacket
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+// packets returns n packets of size bytes, each a TS packet of PID 0x100
+// at offset with zeros around it.
+func packets(n, size, offset int) []byte {
+	var b []byte
+	for i := 0; i < n; i++ {
+		p := make([]byte, size)
+		copy(p[offset:], []byte{SyncByte, 0x01, 0x00, 0x10 | byte(i&0x0f)})
+		b = append(b, p...)
+	}
+	return b
+}
+
+func TestDetectSize(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		input        []byte
+		size, offset int
+	}{
+		{"188", packets(sizeProbeCount+2, Size, 0), Size, 0},
+		{"192", packets(sizeProbeCount+2, 192, 4), 192, 4},
+		{"204", packets(sizeProbeCount+2, 204, 0), 204, 0},
+		{"192 shorter than the probe", packets(3, 192, 4), 192, 4},
+		{"204 shorter than the probe", packets(3, 204, 0), 204, 0},
+		{"empty", nil, Size, 0},
+		// Nothing matches, so Reader reads 188-byte packets from the head
+		// and Demuxer fails with ErrSync there rather than at a guess.
+		{"garbage before the first sync", append([]byte{0x00, 0x01, 0x02, 0x03, 0x04}, packets(sizeProbeCount+2, Size, 0)...), Size, 0},
+		{"192 turning into 188", append(packets(3, 192, 4), packets(sizeProbeCount, Size, 0)...), Size, 0},
+	} {
+		size, offset := DetectSize(bufio.NewReader(bytes.NewReader(test.input)))
+		if size != test.size || offset != test.offset {
+			t.Errorf("%s: DetectSize = %d, %d, want %d, %d", test.name, size, offset, test.size, test.offset)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package tspacket
+
+// Longest private section allowed in a TS
+// [ISO] 2.4.4.11
+const maxSectionSize = 4096
+
+// SectionAssembler reassembles the PSI/SI sections of one PID from the
+// payloads of its TS packets, so that tables larger than a packet (e.g. a PMT
+// with many descriptors or an EIT) are parsed only once they are complete.
+// The zero value is ready to use.
+type SectionAssembler struct {
+	buf []byte
+}
+
+// Push feeds the payload of a packet and calls fn for every section it
+// completes. The section passed to fn starts with table_id and includes
+// CRC_32; it is only valid during the call.
+func (a *SectionAssembler) Push(payload []byte, payload_unit_start_indicator bool, fn func(section []byte)) {
+	if !payload_unit_start_indicator {
+		if len(a.buf) == 0 {
+			// The beginning of this section was missed.
+			return
+		}
+		a.buf = append(a.buf, payload...)
+		if section, ok := a.complete(); ok {
+			fn(section)
+			a.buf = a.buf[:0]
+		}
+		return
+	}
+
+	// [ISO] 2.4.4.2 pointer_field
+	if len(payload) == 0 || 1+int(payload[0]) > len(payload) {
+		a.buf = a.buf[:0]
+		return
+	}
+	pointer_field := int(payload[0])
+	if len(a.buf) != 0 {
+		// The bytes before pointer_field conclude the previous section.
+		a.buf = append(a.buf, payload[1:1+pointer_field]...)
+		if section, ok := a.complete(); ok {
+			fn(section)
+		}
+		a.buf = a.buf[:0]
+	}
+
+	p := payload[1+pointer_field:]
+	for len(p) != 0 && p[0] != 0xff {
+		if len(p) < 3 {
+			a.buf = append(a.buf[:0], p...)
+			return
+		}
+		size := 3 + (int(p[1]&0x0F)<<8 | int(p[2]))
+		if size > len(p) {
+			a.buf = append(a.buf[:0], p...)
+			return
+		}
+		fn(p[:size])
+		p = p[size:]
+	}
+}
+
+// Reset discards the section being reassembled, e.g. after packet loss.
+func (a *SectionAssembler) Reset() {
+	a.buf = a.buf[:0]
+}
+
+// complete returns the section in buf once all of it has arrived.
+func (a *SectionAssembler) complete() ([]byte, bool) {
+	if len(a.buf) < 3 {
+		return nil, false
+	}
+	size := 3 + (int(a.buf[1]&0x0F)<<8 | int(a.buf[2]))
+	if size > maxSectionSize {
+		a.buf = a.buf[:0]
+		return nil, false
+	}
+	if len(a.buf) < size {
+		return nil, false
+	}
+	return a.buf[:size], true
+}
@@ -0,0 +1,114 @@
+package tspacket
+
+import (
+	"bytes"
+	"testing"
+)
+
+// testSection returns a long form section of table_id 0x02 with size bytes
+// in all, CRC_32 included.
+func testSection(size int, fill byte) []byte {
+	section := []byte{0x02, 0xb0 | byte((size-3)>>8), byte(size - 3), 0x04, 0x00, 0xc1, 0x00, 0x00}
+	for len(section) < size-4 {
+		section = append(section, fill)
+	}
+	crc := CRC32(section)
+	return append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
+
+// testPacket returns a packet of PID 0x1f0 carrying payload, padded with
+// 0xff.
+func testPacket(start bool, continuity_counter int, payload []byte) Packet {
+	packet := make(Packet, Size)
+	packet[0] = SyncByte
+	packet[1] = 0x01
+	if start {
+		packet[1] |= 0x40
+	}
+	packet[2] = 0xf0
+	packet[3] = 0x10 | byte(continuity_counter)
+	n := copy(packet[4:], payload)
+	for i := 4 + n; i < Size; i++ {
+		packet[i] = 0xff
+	}
+	return packet
+}
+
+func TestDemuxSections(t *testing.T) {
+	long := testSection(300, 0x11)
+	short := testSection(40, 0x22)
+	broken := testSection(40, 0x33)
+	broken[20] ^= 0x01
+	// The section that starts in the middle of the packet after the tail of
+	// long, located by pointer_field
+	tail := long[Size-5:]
+
+	for _, test := range []struct {
+		name    string
+		packets []Packet
+		want    [][]byte
+		crcOK   []bool
+	}{
+		{
+			name: "spanning packets",
+			packets: []Packet{
+				testPacket(true, 0, append([]byte{0x00}, long[:Size-5]...)),
+				testPacket(false, 1, tail),
+			},
+			want:  [][]byte{long},
+			crcOK: []bool{true},
+		},
+		{
+			name: "pointer_field",
+			packets: []Packet{
+				testPacket(true, 0, append([]byte{0x00}, long[:Size-5]...)),
+				testPacket(true, 1, append(append([]byte{byte(len(tail))}, tail...), short...)),
+			},
+			want:  [][]byte{long, short},
+			crcOK: []bool{true, true},
+		},
+		{
+			name: "CRC_32 error",
+			packets: []Packet{
+				testPacket(true, 0, append([]byte{0x00}, broken...)),
+				testPacket(true, 1, append([]byte{0x00}, short...)),
+			},
+			want:  [][]byte{broken, short},
+			crcOK: []bool{false, true},
+		},
+		{
+			name: "continuity_counter gap",
+			packets: []Packet{
+				testPacket(true, 0, append([]byte{0x00}, long[:Size-5]...)),
+				// The packet of continuity_counter 1 is lost, and the
+				// tail of long with it.
+				testPacket(false, 2, tail),
+				testPacket(true, 3, append([]byte{0x00}, short...)),
+			},
+			want:  [][]byte{short},
+			crcOK: []bool{true},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			d := NewDemuxer(nil)
+			var got [][]byte
+			d.HandleSections(0x1f0, func(section []byte) {
+				got = append(got, append([]byte(nil), section...))
+			})
+			for _, packet := range test.packets {
+				d.Push(packet)
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("got %d sections, want %d", len(got), len(test.want))
+			}
+			for i, section := range got {
+				if !bytes.Equal(section, test.want[i]) {
+					t.Errorf("section %d = % x, want % x", i, section, test.want[i])
+				}
+				if ok := CRC32(section) == 0; ok != test.crcOK[i] {
+					t.Errorf("CRC_32 of section %d is correct: %v", i, ok)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package tspacket
+
+import "time"
+
+var jst = time.FixedZone("JST", 9*60*60)
+
+// ParseTOT returns JST_time of a TOT section as Unix time, or 0 when the
+// section isn't a TOT or is too short.
+// [B10] 5.2.9 Time Offset Table
+func ParseTOT(section []byte) int64 {
+	if len(section) < 8 || section[0] != 0x73 {
+		return 0
+	}
+	return DecodeJSTTime(section[3:8])
+}
+
+// DecodeJSTTime decodes 40-bit JST_time (16-bit MJD and 24-bit BCD time)
+// into Unix time.
+func DecodeJSTTime(b []byte) int64 {
+	// [B10] Appendix C
+	MJD := (int(b[0]) << 8) | int(b[1])
+	y := int((float64(MJD) - 15078.2) / 365.25)
+	m := int((float64(MJD) - 14956.1 - float64(int(float64(y)*365.25))) / 30.6001)
+	k := 0
+	if m == 14 || m == 15 {
+		k = 1
+	}
+	year := y + k + 1900
+	month := m - 1 - k*12
+	day := MJD - 14956 - int(float64(y)*365.25) - int(float64(m)*30.6001)
+	hour := DecodeBCD(b[2])
+	minute := DecodeBCD(b[3])
+	second := DecodeBCD(b[4])
+
+	// Broken values are normalized rather than rejected, like month 13
+	// to January of the next year.
+	return time.Date(year, time.Month(month), day, hour, minute, second, 0, jst).Unix()
+}
+
+// DecodeBCD decodes a 2-digit BCD byte.
+func DecodeBCD(n byte) int {
+	return (int(n)>>4)*10 + int(n&0x0f)
+}
+
+// EncodeJSTTime encodes t in JST into 40-bit JST_time, the inverse of
+// DecodeJSTTime.
+func EncodeJSTTime(t time.Time) []byte {
+	t = t.In(jst)
+	MJD := int(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Sub(time.Date(1858, time.November, 17, 0, 0, 0, 0, time.UTC)).Hours() / 24)
+	return []byte{byte(MJD >> 8), byte(MJD), encodeBCD(t.Hour()), encodeBCD(t.Minute()), encodeBCD(t.Second())}
+}
+
+func encodeBCD(n int) byte {
+	return byte(n/10<<4 | n%10)
+}
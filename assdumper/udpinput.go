@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sync/atomic"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+// udpReader turns TS-over-UDP datagrams into a byte stream of whole TS
+// packets. Datagrams may carry an RTP header (RFC 3550), as IPTV headends
+// usually send MP2T over RTP (RFC 2250).
+//
+// The datagrams are received on a goroutine of their own into a bounded
+// queue, so that a slow output stalling the analyzer doesn't stop the
+// receiving. When the queue is full, datagrams are dropped and counted
+// rather than waited for, since the sender doesn't wait either; the gap
+// shows up as a continuity_counter gap to the demuxer.
+type udpReader struct {
+	conn  *net.UDPConn
+	queue chan []byte
+	// err is the error that ended receiving, set before queue is closed.
+	err     error
+	pending []byte
+	closed  atomic.Bool
+	// dropped counts the datagrams dropped with the queue full, and
+	// maxQueued is the longest the queue has been.
+	dropped   atomic.Int64
+	maxQueued atomic.Int64
+}
+
+// udpQueueLength is the number of datagrams queued for the analyzer, about
+// 3 seconds of a full-segment stream sent as 7 TS packets per datagram.
+const udpQueueLength = 4096
+
+// openUDPInput listens on a udp://ADDR:PORT address, joining the group when
+// ADDR is a multicast address. The interface used for the group can be
+// given as ?iface=NAME. Reading ends with io.EOF when ctx is done so that
+// the subtitles received so far are still written out.
+func openUDPInput(ctx context.Context, address string) (io.ReadCloser, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "udp" {
+		return nil, fmt.Errorf("unsupported listen address %s", address)
+	}
+	addr, err := net.ResolveUDPAddr("udp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn *net.UDPConn
+	if addr.IP != nil && addr.IP.IsMulticast() {
+		var iface *net.Interface
+		if name := u.Query().Get("iface"); name != "" {
+			iface, err = net.InterfaceByName(name)
+			if err != nil {
+				return nil, err
+			}
+		}
+		conn, err = net.ListenMulticastUDP("udp", iface, addr)
+	} else {
+		conn, err = net.ListenUDP("udp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// A full-segment ISDB-T stream is ~17Mbps; give the kernel room to
+	// absorb scheduling hiccups.
+	conn.SetReadBuffer(4 * 1024 * 1024)
+
+	r := &udpReader{conn: conn, queue: make(chan []byte, udpQueueLength)}
+	go r.receive()
+	context.AfterFunc(ctx, func() {
+		r.Close()
+	})
+	return r, nil
+}
+
+func (r *udpReader) receive() {
+	defer close(r.queue)
+	buf := make([]byte, 65536)
+	for {
+		n, err := r.conn.Read(buf)
+		if err != nil {
+			if !r.closed.Load() {
+				r.err = err
+			}
+			return
+		}
+		packets := tsPayloadOfDatagram(buf[:n])
+		if len(packets) == 0 {
+			continue
+		}
+		select {
+		case r.queue <- append([]byte(nil), packets...):
+			if queued := int64(len(r.queue)); queued > r.maxQueued.Load() {
+				r.maxQueued.Store(queued)
+			}
+		default:
+			if r.dropped.Add(1) == 1 {
+				fmt.Fprintln(os.Stderr, "Dropping datagrams: the output can't keep up with the input")
+			}
+		}
+	}
+}
+
+func (r *udpReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		packets, ok := <-r.queue
+		if !ok {
+			if r.err != nil {
+				return 0, r.err
+			}
+			return 0, io.EOF
+		}
+		r.pending = packets
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *udpReader) Close() error {
+	if r.closed.Swap(true) {
+		return nil
+	}
+	if dropped := r.dropped.Load(); dropped != 0 {
+		fmt.Fprintf(os.Stderr, "Dropped %d datagrams with %d queued\n", dropped, udpQueueLength)
+	} else if debugMode() {
+		fmt.Fprintf(os.Stderr, "Queued at most %d of %d datagrams\n", r.maxQueued.Load(), udpQueueLength)
+	}
+	return r.conn.Close()
+}
+
+// tsPayloadOfDatagram strips an RTP header if present and returns the whole
+// TS packets of the datagram. Anything that doesn't look like TS is dropped so
+// that packet alignment survives a bogus datagram.
+func tsPayloadOfDatagram(b []byte) []byte {
+	if len(b) > 0 && b[0] != 0x47 {
+		b = stripRTPHeader(b)
+	}
+	if len(b) == 0 || b[0] != 0x47 {
+		if debugMode() {
+			fmt.Fprintln(os.Stderr, "Dropping a datagram without TS packets")
+		}
+		return nil
+	}
+	return b[:len(b)-len(b)%tspacket.Size]
+}
+
+func stripRTPHeader(b []byte) []byte {
+	// RFC 3550 5.1
+	if len(b) < 12 || b[0]>>6 != 2 {
+		return nil
+	}
+	padding := (b[0] & 0x20) != 0
+	extension := (b[0] & 0x10) != 0
+	csrcCount := int(b[0] & 0x0f)
+	header := 12 + 4*csrcCount
+	if extension {
+		if len(b) < header+4 {
+			return nil
+		}
+		header += 4 + 4*(int(b[header+2])<<8|int(b[header+3]))
+	}
+	if len(b) < header {
+		return nil
+	}
+	if padding {
+		paddingLength := int(b[len(b)-1])
+		if len(b)-paddingLength < header {
+			return nil
+		}
+		b = b[:len(b)-paddingLength]
+	}
+	return b[header:]
+}
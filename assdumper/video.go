@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// videoInfo is what the sequence header of MPEG-2 or the SPS of H.264 tells
+// about a video ES, for matching PlayRes of subtitles to the video.
+type videoInfo struct {
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	FrameRate   string `json:"frame_rate,omitempty"`
+	Progressive bool   `json:"progressive"`
+	// AspectRatio is the display aspect ratio, like "16:9".
+	AspectRatio string `json:"aspect_ratio,omitempty"`
+}
+
+func (v *videoInfo) String() string {
+	scan := "i"
+	if v.Progressive {
+		scan = "p"
+	}
+	return fmt.Sprintf("%dx%d%s, %s fps, %s", v.Width, v.Height, scan, orDash(v.FrameRate), orDash(v.AspectRatio))
+}
+
+// videoPeekLimit is how many bytes of PES from the start of one are searched
+// for the sequence header or SPS before giving up on it until the next.
+const videoPeekLimit = 256 * 1024
+
+// videoPeeker gathers the payloads of a video ES from the start of a PES
+// until its sequence header or SPS is found.
+type videoPeeker struct {
+	streamType byte
+	buf        []byte
+	started    bool
+	info       *videoInfo
+}
+
+func (v *videoPeeker) push(payload []byte, start bool) {
+	if v.info != nil {
+		return
+	}
+	if start {
+		v.buf = v.buf[:0]
+		v.started = true
+	}
+	if !v.started || len(v.buf) >= videoPeekLimit {
+		return
+	}
+	v.buf = append(v.buf, payload...)
+	// [ISO] 2.4.3.7 PES packet, whose header of video is followed by
+	// the ES
+	if len(v.buf) < 9 || v.buf[0] != 0 || v.buf[1] != 0 || v.buf[2] != 1 {
+		v.started = false
+		return
+	}
+	es := v.buf[9:]
+	if header := int(v.buf[8]); header <= len(es) {
+		es = es[header:]
+	} else {
+		return
+	}
+	switch v.streamType {
+	case 0x01, 0x02:
+		v.info = parseMPEG2Video(es)
+	case 0x1b:
+		v.info = parseH264Video(es)
+	}
+}
+
+// nextStartCode returns the index after the next start code 0x000001 from
+// index in es, or -1.
+func nextStartCode(es []byte, index int) int {
+	if index > len(es) {
+		return -1
+	}
+	i := bytes.Index(es[index:], []byte{0x00, 0x00, 0x01})
+	if i < 0 {
+		return -1
+	}
+	return index + i + 3
+}
+
+// mpeg2FrameRates are frame_rate_code.
+// ISO/IEC 13818-2 Table 6-4
+var mpeg2FrameRates = map[int]string{
+	1: "23.976", 2: "24", 3: "25", 4: "29.97", 5: "30", 6: "50", 7: "59.94", 8: "60",
+}
+
+// mpeg2AspectRatios are aspect_ratio_information, as the display aspect
+// ratio but for 1 of square samples.
+var mpeg2AspectRatios = map[int]string{
+	2: "4:3", 3: "16:9", 4: "2.21:1",
+}
+
+// parseMPEG2Video returns what the sequence header and sequence extension
+// in es tell, once both have arrived.
+func parseMPEG2Video(es []byte) *videoInfo {
+	// ISO/IEC 13818-2 6.2.2.1 Sequence header
+	var v *videoInfo
+	for i := nextStartCode(es, 0); i >= 0 && i < len(es); i = nextStartCode(es, i) {
+		b := es[i:]
+		switch {
+		case b[0] == 0xB3 && len(b) >= 5:
+			v = &videoInfo{
+				Width:     int(b[1])<<4 | int(b[2])>>4,
+				Height:    int(b[2]&0x0F)<<8 | int(b[3]),
+				FrameRate: mpeg2FrameRates[int(b[4]&0x0F)],
+			}
+			aspect_ratio_information := int(b[4] >> 4)
+			if aspect_ratio_information == 1 {
+				v.AspectRatio = aspectRatio(v.Width, v.Height)
+			} else {
+				v.AspectRatio = mpeg2AspectRatios[aspect_ratio_information]
+			}
+		case b[0] == 0xB5 && len(b) >= 4 && b[1]>>4 == 1 && v != nil:
+			// ISO/IEC 13818-2 6.2.2.3 Sequence extension, absent
+			// from MPEG-1
+			v.Progressive = b[2]&0x08 != 0
+			v.Width |= (int(b[2]&0x01)<<1 | int(b[3]>>7)) << 12
+			v.Height |= int(b[3]>>5&0x03) << 12
+			return v
+		case b[0] == 0x00 && v != nil:
+			// A picture without the extension is of MPEG-1.
+			v.Progressive = true
+			return v
+		}
+	}
+	return nil
+}
+
+// h264AspectRatios are the sample aspect ratios of aspect_ratio_idc.
+// ITU-T H.264 Table E-1
+var h264AspectRatios = [][2]int{
+	{0, 0}, {1, 1}, {12, 11}, {10, 11}, {16, 11}, {40, 33}, {24, 11}, {20, 11}, {32, 11},
+	{80, 33}, {18, 11}, {15, 11}, {64, 33}, {160, 99}, {4, 3}, {3, 2}, {2, 1},
+}
+
+// parseH264Video returns what the first SPS in es tells.
+func parseH264Video(es []byte) *videoInfo {
+	for i := nextStartCode(es, 0); i >= 0 && i < len(es); i = nextStartCode(es, i) {
+		// nal_unit_type 7, seq_parameter_set_rbsp
+		if es[i]&0x1F != 7 {
+			continue
+		}
+		end := nextStartCode(es, i)
+		if end < 0 {
+			// The SPS may go on in the next packet.
+			return nil
+		}
+		if v, ok := parseH264SPS(unescapeRBSP(es[i+1 : end-3])); ok {
+			return v
+		}
+	}
+	return nil
+}
+
+// unescapeRBSP drops emulation_prevention_three_byte of a NAL unit.
+func unescapeRBSP(nal []byte) []byte {
+	rbsp := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return rbsp
+}
+
+// bitReader reads the bits of an RBSP, failing by ok rather than at every
+// read.
+type bitReader struct {
+	data []byte
+	pos  int
+	ok   bool
+}
+
+func (r *bitReader) u(n int) int {
+	v := 0
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.data)*8 {
+			r.ok = false
+			return 0
+		}
+		v = v<<1 | int(r.data[r.pos/8]>>(7-r.pos%8)&1)
+		r.pos++
+	}
+	return v
+}
+
+// ue reads ue(v), an Exp-Golomb code.
+func (r *bitReader) ue() int {
+	zeros := 0
+	for r.u(1) == 0 {
+		if !r.ok || zeros >= 31 {
+			r.ok = false
+			return 0
+		}
+		zeros++
+	}
+	return 1<<zeros - 1 + r.u(zeros)
+}
+
+func (r *bitReader) se() int {
+	k := r.ue()
+	if k%2 == 1 {
+		return (k + 1) / 2
+	}
+	return -k / 2
+}
+
+// parseH264SPS decodes the size, the scan, and the sample aspect ratio and
+// frame rate of VUI of an SPS.
+func parseH264SPS(rbsp []byte) (*videoInfo, bool) {
+	// ITU-T H.264 7.3.2.1.1 Sequence parameter set data syntax
+	r := &bitReader{data: rbsp, ok: true}
+	profile_idc := r.u(8)
+	r.u(16)
+	r.ue()
+	chroma_format_idc := 1
+	switch profile_idc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chroma_format_idc = r.ue()
+		if chroma_format_idc == 3 {
+			r.u(1)
+		}
+		r.ue()
+		r.ue()
+		r.u(1)
+		if r.u(1) == 1 {
+			lists := 8
+			if chroma_format_idc == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.u(1) == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				lastScale, nextScale := 8, 8
+				for j := 0; j < size && r.ok; j++ {
+					if nextScale != 0 {
+						nextScale = (lastScale + r.se() + 256) % 256
+					}
+					if nextScale != 0 {
+						lastScale = nextScale
+					}
+				}
+			}
+		}
+	}
+	r.ue()
+	switch r.ue() {
+	case 0:
+		r.ue()
+	case 1:
+		r.u(1)
+		r.se()
+		r.se()
+		n := r.ue()
+		for i := 0; i < n && r.ok; i++ {
+			r.se()
+		}
+	}
+	r.ue()
+	r.u(1)
+	pic_width_in_mbs_minus1 := r.ue()
+	pic_height_in_map_units_minus1 := r.ue()
+	frame_mbs_only_flag := r.u(1)
+	if frame_mbs_only_flag == 0 {
+		r.u(1)
+	}
+	r.u(1)
+	v := &videoInfo{
+		Width:       (pic_width_in_mbs_minus1 + 1) * 16,
+		Height:      (2 - frame_mbs_only_flag) * (pic_height_in_map_units_minus1 + 1) * 16,
+		Progressive: frame_mbs_only_flag == 1,
+	}
+	if r.u(1) == 1 {
+		// frame_cropping_flag, in units of the chroma samples
+		cropX, cropY := 1, 2-frame_mbs_only_flag
+		if chroma_format_idc == 1 || chroma_format_idc == 2 {
+			cropX = 2
+		}
+		if chroma_format_idc == 1 {
+			cropY *= 2
+		}
+		v.Width -= (r.ue() + r.ue()) * cropX
+		v.Height -= (r.ue() + r.ue()) * cropY
+	}
+	if !r.ok || v.Width <= 0 || v.Height <= 0 {
+		return nil, false
+	}
+	sarWidth, sarHeight := 1, 1
+	if r.u(1) == 1 {
+		// ITU-T H.264 E.1.1 VUI parameters syntax
+		if r.u(1) == 1 {
+			aspect_ratio_idc := r.u(8)
+			if aspect_ratio_idc == 255 {
+				sarWidth, sarHeight = r.u(16), r.u(16)
+			} else if aspect_ratio_idc > 0 && aspect_ratio_idc < len(h264AspectRatios) {
+				sarWidth, sarHeight = h264AspectRatios[aspect_ratio_idc][0], h264AspectRatios[aspect_ratio_idc][1]
+			}
+		}
+		if r.u(1) == 1 {
+			r.u(1)
+		}
+		if r.u(1) == 1 {
+			r.u(4)
+			if r.u(1) == 1 {
+				r.u(24)
+			}
+		}
+		if r.u(1) == 1 {
+			r.ue()
+			r.ue()
+		}
+		if r.u(1) == 1 {
+			num_units_in_tick := r.u(32)
+			time_scale := r.u(32)
+			if r.ok && num_units_in_tick != 0 {
+				// A frame is two ticks.
+				v.FrameRate = formatFrameRate(float64(time_scale) / float64(2*num_units_in_tick))
+			}
+		}
+	}
+	if sarWidth != 0 && sarHeight != 0 {
+		v.AspectRatio = aspectRatio(v.Width*sarWidth, v.Height*sarHeight)
+	}
+	return v, true
+}
+
+func formatFrameRate(fps float64) string {
+	s := fmt.Sprintf("%.3f", fps)
+	s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	return s
+}
+
+// aspectRatio reduces width:height.
+func aspectRatio(width, height int) string {
+	a, b := width, height
+	for b != 0 {
+		a, b = b, a%b
+	}
+	if a == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d", width/a, height/a)
+}
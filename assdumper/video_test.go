@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestVideo decodes the SPS of 1440x1080i with the sample aspect ratio of 4:3,
+// as BS and terrestrial broadcasting send, and the sequence header of SD
+// MPEG-2, from PES split into two payloads.
+func TestVideo(t *testing.T) {
+	var bits []bool
+	u := func(n, v int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, v>>i&1 == 1)
+		}
+	}
+	ue := func(v int) {
+		n := 0
+		for (v+1)>>n > 1 {
+			n++
+		}
+		u(n, 0)
+		u(n+1, v+1)
+	}
+	// profile_idc of High, the constraint flags, level_idc and
+	// seq_parameter_set_id
+	u(8, 100)
+	u(8, 0)
+	u(8, 40)
+	ue(0)
+	// 4:2:0 of 8 bits without scaling matrices
+	ue(1)
+	ue(0)
+	ue(0)
+	u(1, 0)
+	u(1, 0)
+	// log2_max_frame_num_minus4, pic_order_cnt_type 0,
+	// log2_max_pic_order_cnt_lsb_minus4, max_num_ref_frames and
+	// gaps_in_frame_num_value_allowed_flag
+	ue(0)
+	ue(0)
+	ue(0)
+	ue(4)
+	u(1, 0)
+	// 90 macroblocks wide and 34 map units of field pairs high, cropped by
+	// 8 lines at the bottom
+	ue(89)
+	ue(33)
+	u(1, 0)
+	u(1, 1)
+	u(1, 1)
+	u(1, 1)
+	ue(0)
+	ue(0)
+	ue(0)
+	ue(2)
+	// VUI of aspect_ratio_idc 14, and timing_info of 30000/1001 frames
+	u(1, 1)
+	u(1, 1)
+	u(8, 14)
+	u(1, 0)
+	u(1, 0)
+	u(1, 0)
+	u(1, 1)
+	u(32, 1001)
+	u(32, 60000)
+	u(1, 1)
+	// rbsp_trailing_bits
+	u(1, 1)
+	for len(bits)%8 != 0 {
+		bits = append(bits, false)
+	}
+	var sps []byte
+	for i := 0; i < len(bits); i += 8 {
+		b := 0
+		for _, bit := range bits[i : i+8] {
+			b <<= 1
+			if bit {
+				b |= 1
+			}
+		}
+		sps = append(sps, byte(b))
+	}
+
+	pes := []byte{0x00, 0x00, 0x01, 0xe0, 0x00, 0x00, 0x80, 0x00, 0x00}
+	// Access unit delimiter, the SPS and PPS
+	pes = append(pes, 0x00, 0x00, 0x00, 0x01, 0x09, 0xf0, 0x00, 0x00, 0x00, 0x01, 0x67)
+	pes = append(pes, sps...)
+	pes = append(pes, 0x00, 0x00, 0x00, 0x01, 0x68, 0xce)
+	v := &videoPeeker{streamType: 0x1b}
+	v.push(pes[:20], true)
+	if v.info != nil {
+		t.Fatalf("decoded a partial SPS: %v", v.info)
+	}
+	v.push(pes[20:], false)
+	if v.info == nil || v.info.String() != "1440x1080i, 29.97 fps, 16:9" {
+		t.Errorf("H.264 = %v", v.info)
+	}
+
+	// 720x480 of 4:3 at 29.97 fps, and the sequence extension of an
+	// interlaced sequence
+	m := &videoPeeker{streamType: 0x02}
+	m.push([]byte{
+		0x00, 0x00, 0x01, 0xe0, 0x00, 0x00, 0x80, 0x00, 0x00,
+		0x00, 0x00, 0x01, 0xb3, 0x2d, 0x01, 0xe0, 0x24, 0xff, 0xff, 0xe0, 0x00,
+		0x00, 0x00, 0x01, 0xb5, 0x14, 0x82, 0x00, 0x01, 0x00, 0x00,
+	}, true)
+	if m.info == nil || m.info.String() != "720x480i, 29.97 fps, 4:3" {
+		t.Errorf("MPEG-2 = %v", m.info)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// The XMLTV format of the guide, which tvheadend, Jellyfin, Plex and the
+// like read.
+// https://github.com/XMLTV/xmltv/blob/master/xmltv.dtd
+type xmltvGuide struct {
+	XMLName       xml.Name         `xml:"tv"`
+	GeneratorName string           `xml:"generator-info-name,attr"`
+	Channels      []xmltvChannel   `xml:"channel"`
+	Programmes    []xmltvProgramme `xml:"programme"`
+}
+
+type xmltvChannel struct {
+	ID           string      `xml:"id,attr"`
+	DisplayNames []xmltvText `xml:"display-name"`
+}
+
+type xmltvProgramme struct {
+	Start      string      `xml:"start,attr"`
+	Stop       string      `xml:"stop,attr,omitempty"`
+	Channel    string      `xml:"channel,attr"`
+	Title      xmltvText   `xml:"title"`
+	Desc       *xmltvText  `xml:"desc"`
+	Categories []xmltvText `xml:"category"`
+}
+
+type xmltvText struct {
+	Lang string `xml:"lang,attr,omitempty"`
+	Text string `xml:",chardata"`
+}
+
+// xmltvChannelID names a service by original_network_id, transport_stream_id
+// and service_id, which are unique across networks unlike service_id alone.
+func xmltvChannelID(s *epgService) string {
+	return fmt.Sprintf("%d.%d.%d", s.OriginalNetworkID, s.TransportStreamID, s.ServiceID)
+}
+
+// xmltvTime formats t in the time zone of the broadcast, like
+// 20211201210000 +0900.
+func xmltvTime(t int64) string {
+	return time.Unix(t, 0).In(jst).Format("20060102150405 -0700")
+}
+
+// writeXMLTV writes the guide as XMLTV. The items of the extended event
+// descriptors follow the description of a programme. Events whose start
+// time is undefined are left out, as XMLTV needs one.
+func (c *epgCollector) writeXMLTV(out io.Writer) error {
+	guide := xmltvGuide{GeneratorName: "assdumper"}
+	for _, s := range c.guide() {
+		id := xmltvChannelID(s)
+		channel := xmltvChannel{ID: id}
+		if s.Name != "" {
+			channel.DisplayNames = append(channel.DisplayNames, xmltvText{Lang: "ja", Text: s.Name})
+		} else {
+			channel.DisplayNames = append(channel.DisplayNames, xmltvText{Text: fmt.Sprint(s.ServiceID)})
+		}
+		guide.Channels = append(guide.Channels, channel)
+
+		for _, e := range s.Events {
+			if e.startTime == 0 {
+				continue
+			}
+			p := xmltvProgramme{
+				Start:   xmltvTime(e.startTime),
+				Channel: id,
+				Title:   xmltvText{Lang: "ja", Text: e.Title},
+			}
+			if e.Duration != 0 {
+				p.Stop = xmltvTime(e.startTime + int64(e.Duration))
+			}
+			var desc []string
+			if e.Description != "" {
+				desc = append(desc, e.Description)
+			}
+			for _, item := range e.Extended {
+				desc = append(desc, item.Description+"\n"+item.Text)
+			}
+			if len(desc) != 0 {
+				p.Desc = &xmltvText{Lang: "ja", Text: strings.Join(desc, "\n\n")}
+			}
+			for _, g := range e.Genres {
+				if g.Name != "" && !containsCategory(p.Categories, g.Name) {
+					p.Categories = append(p.Categories, xmltvText{Lang: "ja", Text: g.Name})
+				}
+			}
+			guide.Programmes = append(guide.Programmes, p)
+		}
+	}
+
+	if _, err := io.WriteString(out, xml.Header+"<!DOCTYPE tv SYSTEM \"xmltv.dtd\">\n"); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(out)
+	enc.Indent("", "  ")
+	if err := enc.Encode(guide); err != nil {
+		return err
+	}
+	_, err := io.WriteString(out, "\n")
+	return err
+}
+
+func containsCategory(categories []xmltvText, name string) bool {
+	for _, c := range categories {
+		if c.Text == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"testing"
+	"time"
+
+	"github.com/eagletmt/eagletmt-recutils/assdumper/aribcaption"
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tsgen"
+	"github.com/eagletmt/eagletmt-recutils/assdumper/tspacket"
+)
+
+// insertPackets inserts packets into a generated stream after its first PMT.
+func insertPackets(ts []byte, packets ...tspacket.Packet) []byte {
+	var out bytes.Buffer
+	for i := 0; i+tspacket.Size <= len(ts); i += tspacket.Size {
+		packet := tspacket.Packet(ts[i : i+tspacket.Size])
+		out.Write(packet)
+		if packet.PID() == tsgen.PMTPID && packets != nil {
+			for _, p := range packets {
+				out.Write(p)
+			}
+			packets = nil
+		}
+	}
+	return out.Bytes()
+}
+
+// siString encodes text as an ARIB string of SI.
+func siString(t *testing.T, text string) []byte {
+	t.Helper()
+	b, err := aribcaption.Encode(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// sdtSection returns SDT of the generated stream, whose transport_stream_id
+// and original_network_id are 0x7fe0, with the service descriptor of its
+// program, without CRC_32.
+func sdtSection(t *testing.T, service_type byte, provider, name string) []byte {
+	p, n := siString(t, provider), siString(t, name)
+	descriptor := append([]byte{0x48, byte(3 + len(p) + len(n)), service_type, byte(len(p))}, p...)
+	descriptor = append(append(descriptor, byte(len(n))), n...)
+	section := []byte{
+		0x42, 0xf0, 0x00, 0x7f, 0xe0, 0xc1, 0x00, 0x00, 0x7f, 0xe0, 0xff,
+		byte(tsgen.ProgramNumber >> 8), byte(tsgen.ProgramNumber & 0xff), 0xfc, 0x80, byte(len(descriptor)),
+	}
+	return append(section, descriptor...)
+}
+
+// eitSection returns EIT p/f of the program of the generated stream, with an
+// event starting at start for duration, titled title, without CRC_32.
+func eitSection(t *testing.T, section_number, event_id byte, start time.Time, duration time.Duration, title string) []byte {
+	name := siString(t, title)
+	descriptor := append([]byte{0x4d, byte(5 + len(name)), 'j', 'p', 'n', byte(len(name))}, name...)
+	descriptor = append(descriptor, 0x00)
+	d := int(duration / time.Second)
+	section := []byte{
+		0x4e, 0xf0, 0x00, byte(tsgen.ProgramNumber >> 8), byte(tsgen.ProgramNumber & 0xff), 0xc1, section_number, 0x01,
+		0x7f, 0xe0, 0x7f, 0xe0, 0x01, 0x4e,
+		0x00, event_id,
+	}
+	section = append(section, tspacket.EncodeJSTTime(start)...)
+	section = append(section, bcd(d/3600), bcd(d/60%60), bcd(d%60), 0x80, byte(len(descriptor)))
+	return append(section, descriptor...)
+}
+
+func bcd(n int) byte {
+	return byte(n/10<<4 | n%10)
+}
+
+// TestXMLTV collects the guide of a generated stream carrying SDT and EIT
+// p/f, and reads back the XMLTV written for it.
+func TestXMLTV(t *testing.T) {
+	jst := time.FixedZone("JST", 9*60*60)
+	start := time.Date(2024, time.April, 1, 21, 0, 0, 0, jst)
+	ts := insertPackets(generateTS(t, `@start 2024-04-01T21:00:00+09:00
+1s	字幕
+2s
+`),
+		sectionPacket(0x0011, 0, sdtSection(t, 0x01, "放送局", "テスト")),
+		sectionPacket(0x0012, 0, eitSection(t, 0, 1, start, 30*time.Minute, "ニュース")),
+		sectionPacket(0x0012, 1, eitSection(t, 1, 2, start.Add(30*time.Minute), time.Hour, "天気予報")),
+	)
+
+	c := newEPGCollector(-1)
+	if err := demuxInput(context.Background(), c.demux, bytes.NewReader(ts)); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := c.writeXMLTV(&out); err != nil {
+		t.Fatal(err)
+	}
+	var guide xmltvGuide
+	if err := xml.Unmarshal(out.Bytes(), &guide); err != nil {
+		t.Fatalf("%v:\n%s", err, out.Bytes())
+	}
+	id := "32736.32736.1024"
+	if len(guide.Channels) != 1 || guide.Channels[0].ID != id || len(guide.Channels[0].DisplayNames) != 1 || guide.Channels[0].DisplayNames[0].Text != "テスト" {
+		t.Errorf("channels = %+v", guide.Channels)
+	}
+	want := []xmltvProgramme{
+		{Start: "20240401210000 +0900", Stop: "20240401213000 +0900", Channel: id, Title: xmltvText{Lang: "ja", Text: "ニュース"}},
+		{Start: "20240401213000 +0900", Stop: "20240401223000 +0900", Channel: id, Title: xmltvText{Lang: "ja", Text: "天気予報"}},
+	}
+	if len(guide.Programmes) != len(want) {
+		t.Fatalf("programmes = %+v", guide.Programmes)
+	}
+	for i, p := range guide.Programmes {
+		if p.Start != want[i].Start || p.Stop != want[i].Stop || p.Channel != want[i].Channel || p.Title != want[i].Title {
+			t.Errorf("programme %d = %+v, want %+v", i, p, want[i])
+		}
+	}
+}